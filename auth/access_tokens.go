@@ -0,0 +1,285 @@
+package auth
+
+import (
+ "context"
+ "crypto/rand"
+ "crypto/sha256"
+ "database/sql"
+ "errors"
+ "fmt"
+ "hash/crc32"
+ "log/slog"
+ "net/http"
+ "strings"
+ "time"
+)
+
+// Personal access tokens look like "apt_" + 36 random base62 chars + 6 base62
+// checksum chars. The checksum lets us reject typos and foreign strings before
+// touching the database; only the SHA-256 of the full token is stored.
+const (
+ accessTokenPrefix       = "apt_"
+ accessTokenRandomLen    = 36
+ accessTokenChecksumLen  = 6
+ accessTokenHintLen      = len(accessTokenPrefix) + 4
+)
+
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func (a *API) createAccessTokenInternal(ctx context.Context, userID int64, name string, scopes []string, expiry time.Duration) (string, AccessToken, error) {
+ name = strings.TrimSpace(name)
+ if name == "" {
+  return "", AccessToken{}, fmt.Errorf("token name required")
+ }
+ if expiry < 0 {
+  return "", AccessToken{}, fmt.Errorf("token expiry must not be negative")
+ }
+ for _, s := range scopes {
+  if s == "" || strings.ContainsAny(s, " \t\r\n") {
+   return "", AccessToken{}, fmt.Errorf("invalid scope %q", s)
+  }
+ }
+
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return "", AccessToken{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ token, at, err := a.insertAccessTokenTx(ctx, tx, userID, name, scopes, expiry)
+ if err != nil {
+  return "", AccessToken{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return "", AccessToken{}, fmt.Errorf("commit: %w", err)
+ }
+ return token, at, nil
+}
+
+// insertAccessTokenTx stores a new token within tx; the arguments are validated by
+// the caller.
+func (a *API) insertAccessTokenTx(ctx context.Context, tx txHandle, userID int64, name string, scopes []string, expiry time.Duration) (string, AccessToken, error) {
+ now := a.now()
+ var expiresAt int64
+ if expiry > 0 {
+  expiresAt = now.Add(expiry).Unix()
+ }
+
+ for attempts := 0; attempts < 3; attempts++ {
+  token, err := newAccessToken()
+  if err != nil {
+   return "", AccessToken{}, err
+  }
+  sum := sha256.Sum256([]byte(token))
+  hint := token[:accessTokenHintLen]
+  res, err := tx.ExecContext(ctx, `
+   INSERT INTO access_tokens (user_id, name, token_hash, hint, scopes, created_at, expires_at)
+   VALUES (?, ?, ?, ?, ?, ?, ?)
+  `, userID, name, sum[:], hint, strings.Join(scopes, " "), now.Unix(), expiresAt)
+  if err != nil {
+   msg := strings.ToLower(err.Error())
+   if strings.Contains(msg, "unique") && strings.Contains(msg, "token_hash") {
+    continue // retry on unlikely collision
+   }
+   if strings.Contains(msg, "foreign key") {
+    return "", AccessToken{}, fmt.Errorf("unknown user")
+   }
+   return "", AccessToken{}, fmt.Errorf("insert access token: %w", err)
+  }
+  id, err := res.LastInsertId()
+  if err != nil {
+   return "", AccessToken{}, fmt.Errorf("last insert id: %w", err)
+  }
+  at := AccessToken{
+   ID:        id,
+   UserID:    userID,
+   Name:      name,
+   Scopes:    append([]string(nil), scopes...),
+   Hint:      hint,
+   CreatedAt: time.Unix(now.Unix(), 0),
+  }
+  if expiresAt > 0 {
+   at.ExpiresAt = time.Unix(expiresAt, 0)
+  }
+  return token, at, nil
+ }
+ return "", AccessToken{}, fmt.Errorf("could not create unique access token after retries")
+}
+
+func (a *API) listAccessTokensInternal(ctx context.Context, userID int64) ([]AccessToken, error) {
+ rows, err := a.db.QueryContext(ctx, `
+  SELECT id, name, hint, scopes, created_at, expires_at, last_used_at
+  FROM access_tokens
+  WHERE user_id = ?
+  ORDER BY created_at, id
+ `, userID)
+ if err != nil {
+  return nil, fmt.Errorf("query access tokens: %w", err)
+ }
+ defer rows.Close()
+
+ var out []AccessToken
+ for rows.Next() {
+  var (
+   at                             AccessToken
+   scopes                         string
+   createdAt, expiresAt, lastUsed int64
+  )
+  if err := rows.Scan(&at.ID, &at.Name, &at.Hint, &scopes, &createdAt, &expiresAt, &lastUsed); err != nil {
+   return nil, fmt.Errorf("scan access token: %w", err)
+  }
+  at.UserID = userID
+  at.Scopes = strings.Fields(scopes)
+  at.CreatedAt = time.Unix(createdAt, 0)
+  if expiresAt > 0 {
+   at.ExpiresAt = time.Unix(expiresAt, 0)
+  }
+  if lastUsed > 0 {
+   at.LastUsedAt = time.Unix(lastUsed, 0)
+  }
+  out = append(out, at)
+ }
+ return out, rows.Err()
+}
+
+func (a *API) revokeAccessTokenInternal(ctx context.Context, userID, tokenID int64) error {
+ res, err := a.db.ExecContext(ctx, `DELETE FROM access_tokens WHERE id = ? AND user_id = ?`, tokenID, userID)
+ if err != nil {
+  return fmt.Errorf("delete access token: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return ErrAccessTokenNotFound
+ }
+ return nil
+}
+
+// authenticateAccessToken resolves a personal access token to its user and scopes.
+// ok is false for malformed, unknown or expired tokens.
+func (a *API) authenticateAccessToken(ctx context.Context, token string) (User, []string, bool, error) {
+ if !validAccessTokenFormat(token) {
+  return User{}, nil, false, nil
+ }
+ sum := sha256.Sum256([]byte(token))
+ var (
+  id, lastUsed, expiresAt int64
+  scopes                  string
+  u                       User
+  uc                      int64
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT t.id, t.scopes, t.expires_at, t.last_used_at, u.id, u.email, u.created_at
+  FROM access_tokens t
+  JOIN users u ON u.id = t.user_id
+  WHERE t.token_hash = ?
+ `, sum[:]).Scan(&id, &scopes, &expiresAt, &lastUsed, &u.ID, &u.Email, &uc)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return User{}, nil, false, nil
+  }
+  return User{}, nil, false, fmt.Errorf("query access token: %w", err)
+ }
+ now := a.now().Unix()
+ if expiresAt > 0 && now >= expiresAt {
+  return User{}, nil, false, nil
+ }
+ if now-lastUsed >= lastUsedGranularity {
+  if _, err := a.db.ExecContext(ctx, `UPDATE access_tokens SET last_used_at = ? WHERE id = ?`, now, id); err != nil {
+   a.logError(ctx, "access token last-used update failed", err, slog.Int64("token_id", id))
+  }
+ }
+ u.CreatedAt = time.Unix(uc, 0)
+ return u, strings.Fields(scopes), true, nil
+}
+
+// accessTokenFromRequest returns a bearer token carrying the access token prefix,
+// if TransportAccessToken is enabled.
+func (a *API) accessTokenFromRequest(r *http.Request) (string, bool) {
+ if a.cfg.SessionTransports&TransportAccessToken == 0 {
+  return "", false
+ }
+ token, ok := bearerToken(r)
+ if !ok || !strings.HasPrefix(token, accessTokenPrefix) {
+  return "", false
+ }
+ return token, true
+}
+
+func (a *API) requireScopeInternal(scopes []string) func(http.Handler) http.Handler {
+ return func(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+   if _, ok := fromContext(r.Context()); !ok {
+    a.unauthorized(w, r)
+    return
+   }
+   // Only access-token requests are scope-limited; sessions act as the full user.
+   if granted, ok := scopesFromContext(r.Context()); ok {
+    for _, s := range scopes {
+     if !containsString(granted, s) {
+      w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+      http.Error(w, "forbidden", http.StatusForbidden)
+      return
+     }
+    }
+   }
+   next.ServeHTTP(w, r)
+  })
+ }
+}
+
+func newAccessToken() (string, error) {
+ random, err := randomBase62(accessTokenRandomLen)
+ if err != nil {
+  return "", err
+ }
+ return accessTokenPrefix + random + accessTokenChecksum(random), nil
+}
+
+func accessTokenChecksum(random string) string {
+ n := uint64(crc32.ChecksumIEEE([]byte(random)))
+ var b [accessTokenChecksumLen]byte
+ for i := len(b) - 1; i >= 0; i-- {
+  b[i] = base62Alphabet[n%62]
+  n /= 62
+ }
+ return string(b[:])
+}
+
+func validAccessTokenFormat(token string) bool {
+ if len(token) != len(accessTokenPrefix)+accessTokenRandomLen+accessTokenChecksumLen ||
+  !strings.HasPrefix(token, accessTokenPrefix) {
+  return false
+ }
+ body := token[len(accessTokenPrefix):]
+ random, sum := body[:accessTokenRandomLen], body[accessTokenRandomLen:]
+ return accessTokenChecksum(random) == sum
+}
+
+// randomBase62 returns n uniformly random base62 characters.
+func randomBase62(n int) (string, error) {
+ out := make([]byte, 0, n)
+ var buf [64]byte
+ for len(out) < n {
+  if _, err := rand.Read(buf[:]); err != nil {
+   return "", err
+  }
+  for _, b := range buf {
+   // Reject 248..255 to avoid modulo bias (248 = 4*62).
+   if b >= 248 {
+    continue
+   }
+   out = append(out, base62Alphabet[b%62])
+   if len(out) == n {
+    break
+   }
+  }
+ }
+ return string(out), nil
+}
+
+func containsString(list []string, s string) bool {
+ for _, v := range list {
+  if v == s {
+   return true
+  }
+ }
+ return false
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "strings"
+ "testing"
+ "time"
+)
+
+func TestAccessTokenLifecycle(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportAccessToken
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "ci@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ token, at, err := api.CreateAccessToken(ctx, u.ID, "deploy", []string{"repo:read", "repo:write"}, 0)
+ if err != nil {
+  t.Fatalf("CreateAccessToken: %v", err)
+ }
+ if !strings.HasPrefix(token, accessTokenPrefix) || !validAccessTokenFormat(token) {
+  t.Fatalf("malformed token %q", token)
+ }
+ if !strings.HasPrefix(token, at.Hint) || len(at.Hint) >= len(token) {
+  t.Fatalf("hint %q should be a short prefix of the token", at.Hint)
+ }
+
+ var gotScopes []string
+ h := api.Middleware(api.RequireScope("repo:read")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  user, _ := FromContext(r.Context())
+  gotScopes, _ = ScopesFromContext(r.Context())
+  _, _ = w.Write([]byte(user.Email))
+ })))
+
+ w := httptest.NewRecorder()
+ h.ServeHTTP(w, newReqWithBearer(http.MethodGet, "/repo", token))
+ if w.Code != http.StatusOK || w.Body.String() != "ci@example.com" {
+  t.Fatalf("token request: status=%d body=%q", w.Code, w.Body.String())
+ }
+ if len(gotScopes) != 2 || gotScopes[0] != "repo:read" {
+  t.Fatalf("scopes in context: %v", gotScopes)
+ }
+
+ // A flipped character fails the checksum.
+ bad := token[:len(token)-1] + "x"
+ if token[len(token)-1] == 'x' {
+  bad = token[:len(token)-1] + "y"
+ }
+ w2 := httptest.NewRecorder()
+ h.ServeHTTP(w2, newReqWithBearer(http.MethodGet, "/repo", bad))
+ if w2.Code != http.StatusUnauthorized {
+  t.Fatalf("expected 401 for corrupted token, got %d", w2.Code)
+ }
+
+ api.cfg.Now = func() time.Time { return base.Add(time.Hour) }
+ h.ServeHTTP(httptest.NewRecorder(), newReqWithBearer(http.MethodGet, "/repo", token))
+ list, err := api.ListAccessTokens(ctx, u.ID)
+ if err != nil || len(list) != 1 {
+  t.Fatalf("ListAccessTokens: %v %v", list, err)
+ }
+ if !list[0].LastUsedAt.Equal(base.Add(time.Hour)) {
+  t.Fatalf("last used not tracked: %v", list[0].LastUsedAt)
+ }
+
+ if err := api.RevokeAccessToken(ctx, u.ID+1, at.ID); !errors.Is(err, ErrAccessTokenNotFound) {
+  t.Fatalf("revoking another user's token: %v", err)
+ }
+ if err := api.RevokeAccessToken(ctx, u.ID, at.ID); err != nil {
+  t.Fatalf("RevokeAccessToken: %v", err)
+ }
+ w3 := httptest.NewRecorder()
+ h.ServeHTTP(w3, newReqWithBearer(http.MethodGet, "/repo", token))
+ if w3.Code != http.StatusUnauthorized {
+  t.Fatalf("expected 401 after revoke, got %d", w3.Code)
+ }
+}
+
+func TestAccessTokenScopesAndExpiry(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportAccessToken
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "scope@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ token, _, err := api.CreateAccessToken(ctx, u.ID, "read-only", []string{"repo:read"}, time.Hour)
+ if err != nil {
+  t.Fatalf("CreateAccessToken: %v", err)
+ }
+
+ h := api.Middleware(api.RequireScope("repo:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+ w := httptest.NewRecorder()
+ h.ServeHTTP(w, newReqWithBearer(http.MethodPost, "/repo", token))
+ if w.Code != http.StatusForbidden {
+  t.Fatalf("expected 403 for missing scope, got %d", w.Code)
+ }
+
+ api.cfg.Now = func() time.Time { return base.Add(2 * time.Hour) }
+ w2 := httptest.NewRecorder()
+ h.ServeHTTP(w2, newReqWithBearer(http.MethodPost, "/repo", token))
+ if w2.Code != http.StatusUnauthorized {
+  t.Fatalf("expected 401 for expired token, got %d", w2.Code)
+ }
+}
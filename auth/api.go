@@ -44,75 +44,18 @@
 //
 //         mux := http.NewServeMux()
 //
-//         // POST /register
-//         mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-//           if r.Method != http.MethodPost {
-//             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-//             return
-//           }
-//           // Basic CSRF hardening: enforce same-origin for state-changing POST
-//           if !auth.SameOrigin(r) {
-//             http.Error(w, "forbidden", http.StatusForbidden)
-//             return
-//           }
-//           email := r.FormValue("email")
-//           password := r.FormValue("password")
-//           _, err := api.Register(r.Context(), email, password)
-//           if err != nil {
-//             // Do not leak internal errors; log if needed
-//             http.Error(w, "invalid input", http.StatusBadRequest)
-//             return
-//           }
-//           w.WriteHeader(http.StatusCreated)
-//           _, _ = w.Write([]byte("registered"))
-//         })
+//         // POST /auth/register, /auth/login, /auth/logout, /auth/password and
+//         // GET /auth/me, accepting JSON or HTML forms (see Routes).
+//         api.Routes(mux, "/auth")
 //
-//         // POST /login
-//         mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-//           if r.Method != http.MethodPost {
-//             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-//             return
-//           }
-//           if !auth.SameOrigin(r) {
-//             http.Error(w, "forbidden", http.StatusForbidden)
-//             return
-//           }
-//           email := r.FormValue("email")
-//           password := r.FormValue("password")
-//           _, err := api.Login(w, r, email, password)
-//           if err != nil {
-//             http.Error(w, "invalid credentials", http.StatusUnauthorized)
-//             return
-//           }
-//           _, _ = w.Write([]byte("logged in"))
-//         })
+//         // Or HTML pages for people: /account/login, /account/register, ... (see PageRoutes).
+//         // api.PageRoutes(mux, "/account")
 //
-//         // GET /me (requires session middleware)
-//         mux.Handle("/me", api.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-//           user, ok := auth.FromContext(r.Context())
-//           if !ok {
-//             http.Error(w, "unauthenticated", http.StatusUnauthorized)
-//             return
-//           }
+//         // Your own pages: Middleware resolves the user, RequireAuth enforces it.
+//         mux.Handle("/dashboard", api.Middleware(api.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//           user, _ := auth.FromContext(r.Context())
 //           _, _ = w.Write([]byte("hello " + user.Email))
-//         })))
-//
-//         // POST /logout (method-locked and same-origin check)
-//         mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-//           if r.Method != http.MethodPost {
-//             http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-//             return
-//           }
-//           if !auth.SameOrigin(r) {
-//             http.Error(w, "forbidden", http.StatusForbidden)
-//             return
-//           }
-//           if err := api.Logout(w, r); err != nil {
-//             http.Error(w, "internal error", http.StatusInternalServerError)
-//             return
-//           }
-//           _, _ = w.Write([]byte("logged out"))
-//         })
+//         }))))
 //
 //         log.Println("listening on :8080")
 //         log.Fatal(http.ListenAndServe(":8080", mux))
@@ -121,9 +64,14 @@
 // Security notes:
 //   - Set CookieSecure=true in production (HTTPS).
 //   - Choose an appropriate BcryptCost (10–14 typical). Higher cost => more CPU.
-//   - Session tokens are random 32-byte values, stored server-side.
+//   - Session tokens are random 32-byte values, stored server-side (or, with
+//     StatelessSessions, AES-GCM encrypted payloads that need no lookup).
 //   - Sessions expire after SessionTTL and are refreshed in Middleware.
-//   - Basic CSRF hardening in example: POST-only and same-origin checks.
+//   - API clients may use "Authorization: Bearer <token>" (see SessionTransports).
+//   - The built-in handlers change state only on POST and check the origin
+//     (SameOrigin, or HandlerOptions.OriginPolicy); JSON or Authorization-header
+//     requests without Origin and Referer (non-browser clients) pass. For your own
+//     cookie-authenticated forms, use CSRFMiddleware or an OriginPolicy.
 //
 // Driver note:
 //   - Uses github.com/mattn/go-sqlite3 (cgo). To use a pure-Go driver, replace
@@ -137,19 +85,88 @@
 //   - func (*API) Close() error
 //   - func (*API) Register(ctx, email, password) (User, error)
 //   - func (*API) Login(w, r, email, password) (User, error)
+//   - func (*API) LoginToken(ctx, email, password) (string, User, error)
 //   - func (*API) Logout(w, r) error
 //   - func (*API) CurrentUser(w, r) (User, bool, error)
+//   - func (*API) Routes(mux, prefix)
+//   - func (*API) Handler() http.Handler
+//   - func (*API) PageRoutes(mux, prefix)
 //   - func (*API) Middleware(next http.Handler) http.Handler
+//   - func (*API) CSRFMiddleware(next http.Handler) http.Handler
+//   - func CSRFToken(r) string
+//   - func (*API) CSRFField(r) template.HTML
 //   - func (*API) RequireAuth(next http.Handler) http.Handler
+//   - func NextPath(r, fallback) string
+//   - func (*API) RequireRecentAuth(maxAge) func(http.Handler) http.Handler
+//   - func (*API) ReauthenticatePassword(w, r, password) error
 //   - func FromContext(ctx) (User, bool)
+//   - func ScopesFromContext(ctx) ([]string, bool)
+//   - func (*API) RequireScope(scopes...) func(http.Handler) http.Handler
+//   - func (*API) DefineRole(ctx, name, permissions...) error
+//   - func (*API) DeleteRole(ctx, name) error
+//   - func (*API) RolePermissions(ctx, role) ([]string, error)
+//   - func (*API) GrantRole(ctx, userID, role) error
+//   - func (*API) RevokeRole(ctx, userID, role) error
+//   - func (*API) UserAuthorization(ctx, userID) (Authorization, error)
+//   - func AuthorizationFromContext(ctx) (Authorization, bool)
+//   - func (*API) RequireRole(roles...) func(http.Handler) http.Handler
+//   - func (*API) RequirePermission(permissions...) func(http.Handler) http.Handler
+//   - func (*API) CreateInvite(ctx, inviterID, email, InviteOptions) (string, Invite, error)
+//   - func (*API) AcceptInvite(w, r, token, password) (User, error)
+//   - func (*API) RevokeInvite(ctx, inviteID) error
+//   - func (*API) CreateOrganization(ctx, ownerID, name) (Organization, error)
+//   - func (*API) AddMember / RemoveMember / SetMemberRole / TransferOwnership
+//   - func (*API) ListMembers(ctx, orgID) / ListOrganizations(ctx, userID) ([]Membership, error)
+//   - func (*API) SetActiveOrganization(w, r, orgID) error
+//   - func (*API) OrganizationMiddleware(next http.Handler) http.Handler
+//   - func OrganizationFromContext(ctx) (Membership, bool)
+//   - func (*API) CreateAccessToken(ctx, userID, name, scopes, expiry) (string, AccessToken, error)
+//   - func (*API) ListAccessTokens(ctx, userID) ([]AccessToken, error)
+//   - func (*API) RevokeAccessToken(ctx, userID, tokenID) error
 //   - func (*API) PruneExpiredSessions(ctx) error
 //   - func (*API) RevokeAllSessions(ctx, userID) error
 //   - func (*API) ChangePassword(ctx, userID, newPassword) error
+//   - func (*API) CreatePasswordReset(ctx, email) (string, User, error)
+//   - func (*API) ResetPassword(ctx, token, newPassword) (User, error)
+//   - func (*API) ListEvents(ctx, EventFilter) ([]Event, error)
+//   - func WithLogAttrs(ctx, attrs...) context.Context
+//   - func NewPrometheusMetrics() *PrometheusMetrics
+//   - func VerifyWebhookSignature(secret, signature, body, maxAge) error
+//   - func NewJWTKey(id, alg) (JWTKey, error)
+//   - func (*API) IssueTokenPair(ctx, userID) (TokenPair, error)
+//   - func (*API) LoginTokenPair(ctx, email, password) (TokenPair, User, error)
+//   - func (*API) RefreshTokenPair(ctx, refreshToken) (TokenPair, error)
+//   - func (*API) RevokeRefreshToken(ctx, refreshToken) error
+//   - func (*API) VerifyAccessToken(ctx, token) (User, error)
+//   - func (*API) JWTMiddleware(next http.Handler) http.Handler
+//   - func (*API) JWKSHandler() http.Handler
+//   - func NewJWTVerifier(JWTVerifierConfig) (*JWTVerifier, error)
+//   - func NewOriginPolicy(OriginPolicyConfig) (*OriginPolicy, error)
+//   - func (*OriginPolicy) Allowed(r) bool
+//   - func (*OriginPolicy) Middleware(next http.Handler) http.Handler
+//   - func (*API) OIDCLogin(w, r, provider) error
+//   - func (*API) OIDCCallback(w, r, provider) (User, error)
+//   - func (*API) LinkIdentity(w, r, provider) error
+//   - func (*API) ListIdentities(ctx, userID) ([]Identity, error)
+//   - func (*API) UnlinkIdentity(ctx, userID, identityID) error
+//   - func (*API) OIDCServerHandler() http.Handler
+//   - func (*API) RegisterOAuthClient(ctx, OAuthClient) (OAuthClient, string, error)
+//   - func (*API) DeleteOAuthClient(ctx, clientID) error
+//   - func (*API) RotateSigningKey(ctx) (string, error)
+//   - func (*API) DeviceAuthorizationHandler() http.Handler
+//   - func (*API) DeviceTokenHandler() http.Handler
+//   - func (*API) DeviceApprovalHandler() http.Handler
+//   - func (*API) ApproveDeviceCode(ctx, userID, userCode) error
 package auth
 
 import (
   "context"
+  "crypto"
+  "errors"
+  "html/template"
+  "log/slog"
   "net/http"
+  "net/netip"
   "time"
   "sync"
 )
@@ -166,6 +183,12 @@ type Config struct {
  // SessionTTL controls session lifetime. Default: 24h.
  SessionTTL time.Duration
 
+ // SessionTransports selects how clients may present credentials:
+ // TransportCookie (the SessionName cookie), TransportBearer
+ // ("Authorization: Bearer <token>", see LoginToken), TransportAccessToken
+ // (personal access tokens), OR'ed together. Default: TransportCookie.
+ SessionTransports Transport
+
  // CookieDomain sets the cookie domain (empty => host-only).
  CookieDomain string
 
@@ -179,6 +202,45 @@ type Config struct {
  // CookieSameSite controls the SameSite attribute. Default: http.SameSiteLaxMode.
  CookieSameSite http.SameSite
 
+ // LoginURL is where RequireAuth and the other Require* middleware send signed-out
+ // page loads (GET or HEAD accepting text/html), with the original URI in the
+ // "next" query parameter; redirect back with NextPath after Login. Other requests
+ // get 401, with a JSON body unless they accept HTML. Empty: always 401. Also the
+ // default for OIDCServerConfig.LoginURL.
+ LoginURL string
+
+ // UnauthorizedHandler, when set, answers every request rejected for lacking a
+ // signed-in user instead of the responses described at LoginURL.
+ UnauthorizedHandler http.Handler
+
+ // ReauthURL is where RequireRecentAuth sends page loads whose sign-in is too old,
+ // with the original URI in "next". The page should call ReauthenticatePassword and
+ // redirect back with NextPath; PageRoutes serves one at {prefix}/reauthenticate.
+ // Empty answers 401 instead.
+ ReauthURL string
+
+ // Handlers customizes the endpoints served by Handler and Routes.
+ Handlers HandlerOptions
+
+ // Pages customizes the HTML pages served by PageRoutes.
+ Pages PageOptions
+
+ // CSRFKey signs the double-submit cookies CSRFMiddleware gives anonymous visitors
+ // and stateless sessions (at least 32 bytes). Default: a random key per process,
+ // so set it when several instances serve the same users.
+ CSRFKey []byte
+
+ // CSRFHeader and CSRFFormField name where unsafe requests carry the CSRF token.
+ // Defaults: "X-CSRF-Token" and "csrf_token".
+ CSRFHeader    string
+ CSRFFormField string
+
+ // CSRFCookieName names the double-submit cookie. Default: SessionName + "_csrf".
+ CSRFCookieName string
+
+ // CSRFFailureHandler answers requests rejected by CSRFMiddleware. Default: 403.
+ CSRFFailureHandler http.Handler
+
  // BcryptCost controls password hashing difficulty (4..31). Typical: 10–14.
  // Default: bcrypt.DefaultCost. Setup-only: must be provided in Config.
  BcryptCost int
@@ -198,17 +260,745 @@ type Config struct {
  MaxOpenConns int
  MaxIdleConns int
 
- // Logf is an optional logger hook (printf-style). If nil, logging is disabled.
+ // SessionMode selects server-side sessions (default) or StatelessSessions, where the
+ // token is an AES-GCM encrypted payload and requests need no session lookup.
+ // StatelessSessions delay revocation; see its documentation.
+ SessionMode SessionMode
+
+ // SessionKeys are the 32-byte AEAD keys for StatelessSessions. The first key seals
+ // new tokens; every key opens tokens carrying its ID, so rotate by prepending a key
+ // and drop the old one after SessionTTL.
+ SessionKeys []SessionKey
+
+ // MaxSessionsPerUser caps how many live sessions a user may hold (0 => unlimited).
+ // Not supported with StatelessSessions.
+ // SessionLimitPolicy decides what a login does once the cap is reached.
+ // Default policy: EvictOldestSession.
+ MaxSessionsPerUser int
+ SessionLimitPolicy SessionLimitPolicy
+
+ // Registration policy (optional), applied to every new account.
+ // AllowedEmailDomains restricts sign-ups to the listed domains and their
+ // subdomains (ErrEmailDomainNotAllowed). BlockDisposableEmails rejects a built-in
+ // list of throwaway-mail domains, extended by DisposableEmailDomains
+ // (ErrDisposableEmail). ValidateRegistration runs last, before the user is
+ // inserted; its error is returned wrapped in ErrRegistrationRejected.
+ AllowedEmailDomains    []string
+ BlockDisposableEmails  bool
+ DisposableEmailDomains []string
+ ValidateRegistration   func(ctx context.Context, email string) error
+
+ // InviteOnly makes Register fail with ErrInviteRequired; accounts are then only
+ // created through AcceptInvite. Default: false.
+ InviteOnly bool
+
+ // InviteTTL is how long invite tokens stay valid. Default: 7 days.
+ InviteTTL time.Duration
+
+ // PasswordResetTTL is how long password reset tokens stay valid. Default: 1h.
+ PasswordResetTTL time.Duration
+
+ // AdminRole is the RBAC role allowed to create invites that are not tied to an
+ // organization. Default: "admin".
+ AdminRole string
+
+ // OIDCProviders enables "Sign in with ..." through external OpenID Connect
+ // providers (see OIDCLogin, OIDCCallback).
+ OIDCProviders []OIDCProvider
+
+ // OIDCAutoLinkVerifiedEmail links a first-time external sign-in to the existing
+ // account with the same email when the provider reports the email as verified.
+ // Only enable it for providers you trust to verify emails. Default: false.
+ OIDCAutoLinkVerifiedEmail bool
+
+ // RecentAuthWindow is how recently a session must have signed in (or called
+ // ReauthenticatePassword) for sensitive operations such as LinkIdentity. It is
+ // also RequireRecentAuth's default. Default: 15m.
+ RecentAuthWindow time.Duration
+
+ // OIDCServer makes this API an OpenID Connect provider for other applications
+ // (see OIDCServerHandler, RegisterOAuthClient). Nil disables it.
+ OIDCServer *OIDCServerConfig
+
+ // DeviceAuth enables the OAuth 2.0 device authorization grant for CLIs and other
+ // devices without a browser (see DeviceAuthorizationHandler). Nil disables it.
+ DeviceAuth *DeviceAuthConfig
+
+ // JWT enables signed JWT access tokens with rotating refresh tokens
+ // (see IssueTokenPair, JWKSHandler). Nil disables them.
+ JWT *JWTConfig
+
+ // Webhooks delivers registrations and password changes to an HTTP endpoint
+ // through a transactional outbox (see WebhookConfig). Nil disables them.
+ Webhooks *WebhookConfig
+
+ // Hooks are callbacks for the auth lifecycle, e.g. to create a profile on
+ // registration or notify a user of a new sign-in.
+ Hooks Hooks
+
+ // AuditRetention is how long the janitor keeps auth_events (see ListEvents)
+ // and delivered or abandoned webhook events. Default: 90 days.
+ AuditRetention time.Duration
+
+ // ClientIP returns the client address recorded in audit events. Default: the
+ // host of RemoteAddr; behind a reverse proxy, read the header it sets instead.
+ ClientIP func(r *http.Request) string
+
+ // Tracer, if set, traces Register, Login, CurrentUser, each database call and
+ // each bcrypt operation (see Tracer). If nil, tracing costs no allocations.
+ Tracer Tracer
+
+ // Metrics receives counters, histograms and gauges of auth operations (see
+ // Metrics and NewPrometheusMetrics). If nil, nothing is measured.
+ Metrics Metrics
+
+ // Logger receives structured log records: unexpected errors, and at info level
+ // the events of the audit log. Records use the keys user_id, session_id (the
+ // session's row ID), event and error, plus ip and any attributes added with
+ // WithLogAttrs; they never include tokens or passwords. The context of the
+ // operation is passed to the handler. If nil, Logf is used.
+ Logger *slog.Logger
+
+ // Logf is an optional printf-style logger that receives the records as text
+ // lines (key=value). Ignored when Logger is set; if both are nil, logging is
+ // disabled.
  Logf func(format string, args ...any)
 }
 
+// Transport is a bit set of the ways a session token may be presented.
+type Transport uint8
+
+const (
+ // TransportCookie reads the token from the SessionName cookie.
+ TransportCookie Transport = 1 << iota
+ // TransportBearer reads the token from an "Authorization: Bearer" header.
+ TransportBearer
+ // TransportAccessToken accepts personal access tokens (see CreateAccessToken)
+ // as "Authorization: Bearer apt_..." in Middleware.
+ TransportAccessToken
+)
+
+// SessionMode selects where session state lives.
+type SessionMode int
+
+const (
+ // ServerSessions stores sessions in the sessions table; the cookie is an opaque token.
+ ServerSessions SessionMode = iota
+ // StatelessSessions keeps session state in an encrypted cookie. Revocation
+ // (RevokeAllSessions, ChangePassword) bumps a per-user version that is only
+ // checked when the cookie is refreshed, within the last 20% of SessionTTL: until
+ // then a revoked or copied token stays valid. Logout only clears the cookie. Use
+ // ServerSessions when revocation must take effect at once. TransportBearer is
+ // not supported.
+ StatelessSessions
+)
+
+// SessionKey is an encryption key for StatelessSessions, identified by ID in tokens.
+type SessionKey struct {
+ ID  string // short identifier, must not contain "."
+ Key []byte // 32 bytes (AES-256-GCM)
+}
+
+// JWTConfig configures JWT access token and refresh token issuance.
+type JWTConfig struct {
+ // Issuer and Audience populate the iss/aud claims and are required on verification
+ // when non-empty.
+ Issuer   string
+ Audience string
+
+ // SigningKeys: the first key signs new tokens; all are published by JWKSHandler and
+ // accepted when verifying, so keys can be rotated by prepending a new one.
+ // The algorithm follows the key type (see NewJWTKey).
+ SigningKeys []JWTKey
+
+ // AccessTTL is the access token lifetime. Default: 15m.
+ AccessTTL time.Duration
+
+ // RefreshTTL is the lifetime of each refresh token; rotation issues a fresh one.
+ // Default: 30 days.
+ RefreshTTL time.Duration
+}
+
+// JWTAlgorithm names a JWS signature algorithm.
+type JWTAlgorithm string
+
+const (
+ EdDSA JWTAlgorithm = "EdDSA" // Ed25519
+ ES256 JWTAlgorithm = "ES256" // ECDSA P-256 with SHA-256
+ RS256 JWTAlgorithm = "RS256" // RSA PKCS#1 v1.5 with SHA-256 (>= 2048 bits)
+)
+
+// JWTKey is a signing key identified by ID (the JWS "kid").
+// Key must be an ed25519.PrivateKey, a P-256 *ecdsa.PrivateKey or an *rsa.PrivateKey.
+type JWTKey struct {
+ ID  string
+ Key crypto.Signer
+}
+
+// TokenPair is the result of IssueTokenPair and RefreshTokenPair, shaped like an
+// OAuth 2.0 token response.
+type TokenPair struct {
+ AccessToken  string `json:"access_token"`
+ TokenType    string `json:"token_type"`
+ ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
+ RefreshToken string `json:"refresh_token"`
+}
+
+// JWTVerifierConfig configures a standalone JWTVerifier.
+type JWTVerifierConfig struct {
+ // Issuer and Audience must match the token's iss/aud claims when non-empty.
+ Issuer   string
+ Audience string
+
+ // JWKSURL is where signing keys are fetched from (see API.JWKSHandler).
+ JWKSURL string
+
+ // HTTPClient is used for JWKS requests. Default: a client with a 10s timeout.
+ HTTPClient *http.Client
+
+ // Leeway tolerates clock skew on exp/nbf/iat. Default: 30s.
+ Leeway time.Duration
+
+ // Now overrides the time source (useful in tests). Default: time.Now.
+ Now func() time.Time
+}
+
+// JWTVerifier validates JWT access tokens without a database, using keys from a
+// JWKS endpoint. Safe for concurrent use.
+type JWTVerifier struct {
+ issuer   string
+ audience string
+ leeway   time.Duration
+ now      func() time.Time
+ keyFor   func(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// HandlerOptions customizes the built-in endpoints (see Routes).
+type HandlerOptions struct {
+ // OriginPolicy vets POST requests. Default: SameOrigin. Requests without Origin
+ // or Referer that send JSON or an Authorization header skip it.
+ OriginPolicy *OriginPolicy
+
+ // SignInAfterRegister starts a session for newly registered users.
+ SignInAfterRegister bool
+
+ // FormRedirect is where successful HTML form posts are redirected (303 See
+ // Other). Empty answers them with the status text instead.
+ FormRedirect string
+
+ // Respond, when set, sees every result first and returns true if it wrote the
+ // response itself; otherwise the default response is written.
+ Respond func(w http.ResponseWriter, r *http.Request, res HandlerResult) bool
+}
+
+// HandlerResult is the outcome of a request to a built-in endpoint.
+type HandlerResult struct {
+ Endpoint string // "register", "login", "logout", "me", "password" or "reauthenticate"
+ Status   int    // status code of the default response
+ User     User   // the user concerned, when known
+ Err      error  // nil on success
+}
+
+// Hooks lets applications react to auth events. Every hook is optional and runs
+// synchronously with the operation's context. None runs inside a database
+// transaction: the On* hooks run after the change has been committed, so they
+// cannot undo it and handle their own errors; BeforeLogin runs before the session
+// is written. Hooks may call back into the API.
+type Hooks struct {
+ // OnRegister runs after an account is created: by Register, by AcceptInvite for
+ // a new email, or by a first sign-in through an OIDC provider.
+ OnRegister func(ctx context.Context, user User)
+
+ // BeforeLogin runs once the credentials of Login, LoginToken, LoginTokenPair,
+ // AcceptInvite or an OIDC sign-in check out, when the built-in pages or handlers
+ // sign a new account in, and when a device polls for an approved code, before a
+ // session or token is issued. An error vetoes the sign-in, which fails with it
+ // wrapped in ErrLoginRejected; a vetoed device code is consumed and its poll
+ // answered with access_denied.
+ BeforeLogin func(ctx context.Context, user User) error
+
+ // OnLogin runs after one of those sign-ins succeeded.
+ OnLogin func(ctx context.Context, user User)
+
+ // OnLoginFailed runs when a password sign-in (Login, LoginToken,
+ // LoginTokenPair) fails, vetoes included; email is as given.
+ OnLoginFailed func(ctx context.Context, email string, err error)
+
+ // OnLogout runs after Logout ended a live session.
+ OnLogout func(ctx context.Context, userID int64)
+
+ // OnPasswordChanged runs after ChangePassword or ResetPassword.
+ OnPasswordChanged func(ctx context.Context, userID int64)
+
+ // OnSessionRevoked runs after all of a user's sessions were revoked, by
+ // RevokeAllSessions, ChangePassword or ResetPassword.
+ OnSessionRevoked func(ctx context.Context, userID int64)
+}
+
+// EventType identifies what an audit Event records. Registrations and sign-ins
+// other than by password carry their method in Detail when they succeed: "invite",
+// "oidc:<provider>" or, for sign-ins only, "device" and "register" (the built-in
+// pages and handlers signing a new account in).
+type EventType string
+
+const (
+ EventRegister        EventType = "register"         // new account, failures included
+ EventLogin           EventType = "login"            // sign-in, failures included
+ EventLogout          EventType = "logout"           // Logout of a live session
+ EventPasswordChanged EventType = "password_changed" // ChangePassword, or ResetPassword (Detail "reset")
+ EventSessionsRevoked EventType = "sessions_revoked" // RevokeAllSessions
+ EventSessionsPruned  EventType = "sessions_pruned"  // the janitor deleted expired sessions
+)
+
+// Event is an entry of the audit log. IP and UserAgent come from the request: the
+// one passed to Login or Logout, or for calls taking a context, a request that
+// went through Middleware or the built-in handlers.
+type Event struct {
+ ID        int64
+ Type      EventType
+ UserID    int64  // 0 when no account is concerned or known
+ Email     string // the email given, for sign-in and registration attempts
+ IP        string
+ UserAgent string
+ Success   bool
+ Detail    string // the failure reason, or extra context
+ CreatedAt time.Time
+}
+
+// EventFilter selects events for ListEvents. Zero fields do not filter.
+type EventFilter struct {
+ UserID int64
+ Type   EventType
+ Email  string
+ Since  time.Time // inclusive
+ Until  time.Time // exclusive
+
+ // Limit caps the page size. Default: 50; at most 1000.
+ Limit int
+
+ // BeforeID returns events older than this ID. Pass the last ID of a page to get
+ // the next one.
+ BeforeID int64
+}
+
+// WebhookConfig configures webhook delivery. Register (and the other ways an
+// account is created) and password changes write a WebhookEvent in the same
+// transaction as the change, so no event is lost if the process dies after
+// commit. A background dispatcher POSTs due events as JSON to URL, retrying
+// failures with exponential backoff, and stops on Close. Delivery is at least
+// once: receivers should deduplicate by WebhookEvent.ID.
+//
+// Each request carries WebhookIDHeader and WebhookSignatureHeader, which
+// VerifyWebhookSignature checks.
+type WebhookConfig struct {
+ // URL receives the events. Required.
+ URL string
+
+ // Secret is the HMAC-SHA256 key of the signature, at least 32 bytes. Required.
+ Secret []byte
+
+ // Client sends the requests. Default: an http.Client with a 10s timeout.
+ Client *http.Client
+
+ // PollInterval is how often the dispatcher looks for due events. Default: 5s.
+ PollInterval time.Duration
+
+ // MaxAttempts is how many deliveries of an event are tried before it is
+ // abandoned. Any response other than 2xx is a failure. Default: 12.
+ MaxAttempts int
+
+ // InitialBackoff is the delay after the first failure; it doubles with each
+ // further failure up to MaxBackoff. Defaults: 30s and 6h.
+ InitialBackoff time.Duration
+ MaxBackoff     time.Duration
+}
+
+// Tracer starts spans. Its shape follows OpenTelemetry's trace.Tracer, so an
+// adapter is a thin wrapper. Spans are named auth.Register, auth.Login,
+// auth.CurrentUser (also for Middleware), auth.bcrypt.hash, auth.bcrypt.compare,
+// db.exec, db.query, db.begin and db.commit; attributes include auth.user_id, bcrypt.cost, db.system and
+// db.statement (never its arguments).
+type Tracer interface {
+ Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer, like OpenTelemetry's trace.Span.
+type Span interface {
+ SetAttributes(attrs ...slog.Attr)
+ RecordError(err error)
+ End()
+}
+
+// Metrics receives the measurements of an API. Implementations must be safe for
+// concurrent use; adapt one to your metrics library, or use NewPrometheusMetrics.
+// Label values are passed in the order listed:
+//
+//   auth_registrations_total            counter    outcome: success, email_taken, rejected, error
+//   auth_logins_total                   counter    outcome: success, invalid_credentials, rejected, session_limit, error
+//   auth_logouts_total                  counter
+//   auth_session_refreshes_total        counter    kind: session (sliding renewal), refresh_token
+//   auth_janitor_pruned_sessions_total  counter
+//   auth_janitor_duration_seconds       histogram
+//   auth_password_hash_duration_seconds histogram  op: hash, compare
+//   auth_active_sessions                gauge      (server-side sessions, set by the janitor)
+type Metrics interface {
+ AddCounter(name string, delta float64, labelValues ...string)
+ ObserveHistogram(name string, value float64, labelValues ...string)
+ SetGauge(name string, value float64, labelValues ...string)
+}
+
+// PrometheusMetrics is a Metrics that keeps the values in memory and serves them
+// in the Prometheus text exposition format. Mount it at your scrape path:
+//
+//   metrics := auth.NewPrometheusMetrics()
+//   api, _ := auth.New(auth.Config{Metrics: metrics})
+//   mux.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+ mu      sync.Mutex
+ metrics map[string]*promMetric
+}
+
+// WebhookEvent is the JSON body of a webhook request. Type is EventRegister or
+// EventPasswordChanged; Email is the account's email when the event was written.
+type WebhookEvent struct {
+ ID        int64     `json:"id"`
+ Type      EventType `json:"type"`
+ UserID    int64     `json:"user_id"`
+ Email     string    `json:"email"`
+ CreatedAt time.Time `json:"created_at"`
+}
+
+// PageOptions customizes the HTML pages (see PageRoutes).
+type PageOptions struct {
+ // Templates replaces built-in pages by template name: "login", "register",
+ // "forgot_password", "reset_password", "account" and "reauthenticate", each
+ // executed with a Page.
+ // Pages the set does not define keep the built-in template. Forms must include
+ // Page.CSRFField.
+ Templates *template.Template
+
+ // AfterLogin is where sign-in and registration redirect when the request has no
+ // safe "next" path. Default: "/".
+ AfterLogin string
+
+ // SendPasswordReset delivers a password reset link, e.g. by email. It runs on a
+ // background worker after the forgot-password page has answered, one request at
+ // a time, with the request's context values but not its cancellation. Nil disables the forgot-password and
+ // reset-password pages.
+ SendPasswordReset func(ctx context.Context, user User, resetURL string) error
+
+ // ResetURL is the absolute URL of the reset-password page; links append the
+ // token as the "token" query parameter. Required with SendPasswordReset, so links
+ // never depend on the request's Host header.
+ ResetURL string
+}
+
+// Page is the data passed to the page templates (see PageOptions.Templates).
+type Page struct {
+ Name         string        // template name, e.g. "login"
+ Prefix       string        // path PageRoutes is mounted at, for links and form actions
+ User         User          // the signed-in user; zero when signed out
+ CSRFField    template.HTML // hidden input every form must include
+ Error        string        // why the submitted form failed, if it did
+ Notice       string        // one-time message carried over a redirect
+ Email        string        // email to prefill after a failed submission
+ Next         string        // validated same-site path to continue to after sign-in
+ Token        string        // password reset token on "reset_password"; empty if invalid
+ ResetEnabled bool          // whether the forgot-password page is served
+}
+
+// OriginPolicyConfig configures an OriginPolicy.
+type OriginPolicyConfig struct {
+ // AllowedOrigins are trusted in addition to the request's own origin, as
+ // "scheme://host[:port]", or "https://*.example.com" for any subdomain of
+ // example.com (not example.com itself). Schemes must match exactly.
+ AllowedOrigins []string
+
+ // TrustedProxies are IPs or CIDR ranges whose X-Forwarded-Host and
+ // X-Forwarded-Proto headers describe the request's own origin. Behind a proxy
+ // that is not listed, add the app's public origin to AllowedOrigins instead.
+ TrustedProxies []string
+
+ // FailureHandler answers requests rejected by Middleware. Default: 403.
+ FailureHandler http.Handler
+}
+
+// OriginPolicy decides whether a request was initiated by a trusted origin, using
+// Fetch Metadata (Sec-Fetch-Site), Origin and Referer. Safe for concurrent use.
+type OriginPolicy struct {
+ allowed []originPattern
+ proxies []netip.Prefix
+ failure http.Handler
+}
+
+// OIDCProvider configures an external OpenID Connect provider. Endpoints and signing
+// keys are discovered from Issuer/.well-known/openid-configuration.
+type OIDCProvider struct {
+ // Name identifies the provider in OIDCLogin/OIDCCallback and linked identities,
+ // e.g. "google". Must be unique.
+ Name string
+
+ // Issuer is the provider's issuer URL; it must match the discovery document and
+ // the iss claim of ID tokens exactly.
+ Issuer string
+
+ // ClientID and ClientSecret are the credentials registered with the provider.
+ // An empty ClientSecret makes this a public client (PKCE only).
+ ClientID     string
+ ClientSecret string
+
+ // RedirectURL is the absolute URL of the handler that calls OIDCCallback.
+ RedirectURL string
+
+ // Scopes to request. "openid" is always included.
+ // Default: openid, email, profile.
+ Scopes []string
+
+ // HTTPClient is used for discovery, JWKS and token requests.
+ // Default: a client with a 10s timeout.
+ HTTPClient *http.Client
+}
+
+// Identity is an external account linked to a user.
+type Identity struct {
+ ID          int64
+ Provider    string // OIDCProvider.Name
+ Subject     string // the provider's stable user ID ("sub")
+ Email       string // as last reported by the provider
+ CreatedAt   time.Time
+ LastLoginAt time.Time // zero if never used to sign in
+}
+
+// OIDCServerConfig configures the built-in OpenID Connect provider.
+type OIDCServerConfig struct {
+ // Issuer is the absolute URL OIDCServerHandler is served at, e.g.
+ // "https://login.example.com/oauth". Endpoints are published below it.
+ Issuer string
+
+ // LoginURL is where /authorize sends users without a session, with the original
+ // request in the "next" query parameter. Default: Config.LoginURL; if both are
+ // empty /authorize answers 401 instead.
+ LoginURL string
+
+ // SigningAlgorithm for keys generated by RotateSigningKey. Default: RS256, which
+ // every OpenID Connect client supports.
+ SigningAlgorithm JWTAlgorithm
+
+ // CodeTTL is the authorization code lifetime. Default: 1m.
+ CodeTTL time.Duration
+
+ // AccessTTL is the lifetime of access and ID tokens. Default: 1h.
+ AccessTTL time.Duration
+
+ // RefreshTTL is the lifetime of each refresh token; rotation issues a fresh one.
+ // Refresh tokens are only issued when the client was granted offline_access.
+ // Default: 30 days.
+ RefreshTTL time.Duration
+
+ // ConsentTemplate renders the consent page with a ConsentPage. It must POST
+ // consent_id and decision ("allow" or "deny") to Action. Default: a minimal page.
+ ConsentTemplate *template.Template
+
+ // EmailVerified asserts "email_verified": true with every email claim. Set it
+ // when account emails are known to belong to their users (for example, accounts
+ // are only created from invites or after an email confirmation). Relying parties
+ // built on this package only register accounts for verified emails.
+ EmailVerified bool
+}
+
+// OAuthClient is an application registered with the OpenID Connect provider or
+// for the device authorization grant.
+type OAuthClient struct {
+ ID           string // assigned by RegisterOAuthClient
+ Name         string // shown on the consent and device approval pages
+ RedirectURIs []string // exact-match allow list; may be empty for device flow clients
+ Public       bool     // no client secret (native apps, SPAs); PKCE only
+ SkipConsent  bool     // first-party apps: never ask the user for consent
+ Scopes       []string // device flow: the scopes the client may request; others are dropped
+ CreatedAt    time.Time
+}
+
+// DeviceAuthConfig configures the device authorization grant (RFC 8628).
+type DeviceAuthConfig struct {
+ // VerificationURL is the absolute URL DeviceApprovalHandler is served at; clients
+ // show it to the user. Required.
+ VerificationURL string
+
+ // CodeTTL is how long a device code can be approved and polled. Default: 10m.
+ CodeTTL time.Duration
+
+ // Interval is the minimum time between polls. Default: 5s.
+ Interval time.Duration
+
+ // IssueAccessTokens makes the token endpoint return a personal access token
+ // limited to the granted scope instead of a bearer session token. New requires
+ // TransportAccessToken in SessionTransports for access tokens and TransportBearer
+ // for session tokens.
+ IssueAccessTokens bool
+
+ // AccessTokenExpiry is the lifetime of issued access tokens. Default: 90 days.
+ AccessTokenExpiry time.Duration
+
+ // Template renders the approval page with a DevicePage. Default: a minimal page.
+ Template *template.Template
+}
+
+// DevicePage is the data passed to DeviceAuthConfig.Template. Stage is "enter"
+// (ask for the user code, showing Error if set), "confirm" (a form POSTing
+// user_code, confirm and decision "allow" or "deny" to Action), "approved" or
+// "denied".
+type DevicePage struct {
+ Stage      string
+ UserCode   string
+ ClientID   string
+ ClientName string // the registered OAuthClient.Name
+ Scopes     []string
+ User       User
+ Confirm    string
+ Action     string
+ Error      string
+}
+
+// ConsentPage is the data passed to OIDCServerConfig.ConsentTemplate.
+type ConsentPage struct {
+ ClientName string
+ Scopes     []string
+ User       User
+ ConsentID  string
+ Action     string
+}
+
+// SessionLimitPolicy selects how Login behaves when MaxSessionsPerUser is reached.
+type SessionLimitPolicy int
+
+const (
+ // EvictOldestSession deletes the user's earliest-created sessions to make room.
+ EvictOldestSession SessionLimitPolicy = iota
+ // EvictLeastRecentlyUsedSession deletes the sessions that were used least recently.
+ EvictLeastRecentlyUsedSession
+ // RejectNewSession fails the new login with ErrSessionLimitReached.
+ RejectNewSession
+)
+
+// ErrAccessTokenNotFound is returned by RevokeAccessToken when the token does not
+// exist or belongs to another user.
+var ErrAccessTokenNotFound = errors.New("access token not found")
+
+// Registration errors. Errors from Config.ValidateRegistration are wrapped in
+// ErrRegistrationRejected, so both errors.Is checks succeed.
+var (
+ ErrInvalidEmail          = errors.New("invalid email")
+ ErrEmailTaken            = errors.New("email already registered")
+ ErrEmailDomainNotAllowed = errors.New("email domain not allowed")
+ ErrDisposableEmail       = errors.New("disposable email addresses are not allowed")
+ ErrRegistrationRejected  = errors.New("registration rejected")
+)
+
+// ErrInvalidCredentials is returned when the email or password does not match.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrWeakPassword is returned, wrapped with the failed requirement, for passwords
+// that violate MinPasswordLength or RequireStrongPasswords.
+var ErrWeakPassword = errors.New("weak password")
+
+// ErrForbidden is returned when the acting user lacks the rights for an operation.
+var ErrForbidden = errors.New("forbidden")
+
+// ErrLoginRejected wraps the error of a Hooks.BeforeLogin veto.
+var ErrLoginRejected = errors.New("login rejected")
+
+// ErrInviteRequired is returned by Register when InviteOnly is set.
+var ErrInviteRequired = errors.New("registration requires an invite")
+
+// ErrInvalidInvite is returned for unknown, expired, revoked or already accepted invites.
+var ErrInvalidInvite = errors.New("invalid or expired invite")
+
+// ErrNoSession is returned by helpers that act on the current session when the
+// request has none.
+var ErrNoSession = errors.New("no session")
+
+// Organization errors.
+var (
+ ErrOrganizationNotFound = errors.New("organization not found")
+ ErrNotMember            = errors.New("not a member of the organization")
+ ErrAlreadyMember        = errors.New("already a member of the organization")
+ // ErrOwnerRole: ownership only changes through TransferOwnership.
+ ErrOwnerRole = errors.New("the owner role can only change via TransferOwnership")
+)
+
+// ErrRoleNotFound is returned when a role name has not been defined with DefineRole.
+var ErrRoleNotFound = errors.New("role not found")
+
+// ErrInvalidRefreshToken is returned by RefreshTokenPair for unknown, expired or
+// revoked refresh tokens.
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ErrRefreshTokenReused is returned by RefreshTokenPair when an already-rotated
+// refresh token is presented; its whole token family has been revoked.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// ErrSessionLimitReached is returned (wrapped) by Login when the user already holds
+// MaxSessionsPerUser sessions and SessionLimitPolicy is RejectNewSession.
+var ErrSessionLimitReached = errors.New("session limit reached")
+
+// OIDC errors.
+var (
+ // ErrUnknownProvider: the provider name is not in Config.OIDCProviders.
+ ErrUnknownProvider = errors.New("unknown identity provider")
+ // ErrInvalidOIDCState: the callback does not match a pending login from this
+ // browser, or the login took longer than 10 minutes.
+ ErrInvalidOIDCState = errors.New("invalid or expired login state")
+ // ErrEmailNotVerified: the provider did not verify the email of a first
+ // sign-in, so no account is registered for it.
+ ErrEmailNotVerified = errors.New("identity provider did not verify the email")
+ // ErrIdentityLinked: the external identity already belongs to an account.
+ ErrIdentityLinked = errors.New("identity already linked to an account")
+ // ErrIdentityNotFound: no such identity is linked to the user.
+ ErrIdentityNotFound = errors.New("identity not found")
+ // ErrLastSignInMethod: unlinking would leave the account without a password or
+ // any other identity to sign in with.
+ ErrLastSignInMethod = errors.New("cannot remove the last sign-in method")
+)
+
+// ErrClientNotFound is returned for unknown OAuth client IDs.
+var ErrClientNotFound = errors.New("oauth client not found")
+
+// ErrUserNotFound is returned by CreatePasswordReset when no account has the
+// email. Do not reveal it to the requester.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrTooManyPasswordResets is returned by CreatePasswordReset when the account
+// already has several unexpired reset tokens. Do not reveal it to the requester.
+var ErrTooManyPasswordResets = errors.New("too many pending password resets")
+
+// ErrInvalidResetToken is returned for unknown, expired or already used password
+// reset tokens.
+var ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// ErrInvalidWebhookSignature is returned by VerifyWebhookSignature.
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// ErrInvalidUserCode is returned for unknown, expired or already used device user codes.
+var ErrInvalidUserCode = errors.New("invalid or expired user code")
+
+// ErrReauthRequired is returned when an operation needs a more recent sign-in than
+// the session has (see RecentAuthWindow).
+var ErrReauthRequired = errors.New("recent authentication required")
+
 // API is the main entry point for authentication operations.
 // It is safe to share a single instance across handlers.
 type API struct {
   db     dbHandle
   cfg    Config
+  sealer *sessionSealer // non-nil in StatelessSessions mode
+  csrfKey []byte
+  jwt    *jwtKeys       // non-nil when Config.JWT is set
+  oidc   map[string]*oidcClient
+  oidcServer *oidcServer // non-nil when Config.OIDCServer is set
+  resetQueue chan resetRequest // non-nil when Pages.SendPasswordReset is set
   stopCh chan struct{}
   wg     sync.WaitGroup
+  logger *slog.Logger // nil disables logging
 }
 
 // User is a minimal representation returned by the API (no password fields).
@@ -218,6 +1008,81 @@ type User struct {
  CreatedAt time.Time
 }
 
+// Authorization lists a user's roles and the union of their roles' permissions,
+// both sorted. RequireRole and RequirePermission store it in the request context.
+type Authorization struct {
+ Roles       []string
+ Permissions []string
+}
+
+// HasRole reports whether the user holds role.
+func (az Authorization) HasRole(role string) bool {
+ return sortedContains(az.Roles, role)
+}
+
+// HasPermission reports whether any of the user's roles carries permission.
+func (az Authorization) HasPermission(permission string) bool {
+ return sortedContains(az.Permissions, permission)
+}
+
+// Organization is a tenant that users belong to through a Membership.
+type Organization struct {
+ ID        int64
+ Name      string
+ CreatedAt time.Time
+}
+
+// Built-in organization roles. Other role names may be used freely; exactly one
+// member holds OrgRoleOwner.
+const (
+ OrgRoleOwner  = "owner"
+ OrgRoleAdmin  = "admin"
+ OrgRoleMember = "member"
+)
+
+// Membership links a user to an Organization with a per-organization role.
+type Membership struct {
+ Organization Organization
+ UserID       int64
+ Role         string
+ CreatedAt    time.Time
+}
+
+// InviteOptions customize CreateInvite.
+type InviteOptions struct {
+ // OrgID invites into an organization (the inviter must be its owner or an admin).
+ // Zero creates a plain account invite, which requires Config.AdminRole.
+ OrgID int64
+
+ // Role is the organization role (default OrgRoleMember) when OrgID is set, or else
+ // an optional RBAC role granted on acceptance.
+ Role string
+}
+
+// Invite describes a pending invitation. The token is only returned by CreateInvite.
+type Invite struct {
+ ID        int64
+ Email     string
+ OrgID     int64
+ Role      string
+ InvitedBy int64
+ CreatedAt time.Time
+ ExpiresAt time.Time
+}
+
+// AccessToken describes a personal access token. The secret itself is only
+// returned once, by CreateAccessToken.
+type AccessToken struct {
+ ID         int64
+ UserID     int64
+ Name       string
+ Scopes     []string
+ Hint       string    // leading characters of the token, for display
+ CreatedAt  time.Time
+ ExpiresAt  time.Time // zero => never expires
+ LastUsedAt time.Time // zero => never used
+}
+
 // New initializes the SQLite database, runs migrations, and returns an API.
 func New(cfg Config) (*API, error) {
  return newAPI(cfg)
@@ -231,6 +1096,9 @@ func (a *API) Close() error {
 // Register creates a new user with a bcrypt-hashed password.
 // - Email is normalized to lower-case and trimmed.
 // - Password must meet configured policy (min length, optional strength).
+// - Email must pass the registration policy (AllowedEmailDomains,
+//   BlockDisposableEmails, ValidateRegistration); see the registration errors.
+// - With InviteOnly set, it fails with ErrInviteRequired (see AcceptInvite).
 // Returns the created User (without password).
 func (a *API) Register(ctx context.Context, email, password string) (User, error) {
  return a.registerInternal(ctx, email, password)
@@ -239,16 +1107,26 @@ func (a *API) Register(ctx context.Context, email, password string) (User, error
 // Login verifies credentials, creates a server-side session, and sets a secure cookie.
 // Returns the authenticated User on success. The cookie contains an opaque token;
 // session state (user, expiry) is stored in SQLite.
+// If MaxSessionsPerUser is set, the cap is enforced per SessionLimitPolicy.
 func (a *API) Login(w http.ResponseWriter, r *http.Request, email, password string) (User, error) {
  return a.loginInternal(w, r, email, password)
 }
 
+// LoginToken verifies credentials and creates a server-side session like Login, but
+// returns the opaque session token instead of setting a cookie. Clients present it as
+// "Authorization: Bearer <token>"; without TransportBearer in SessionTransports it
+// returns an error. Token sessions slide their expiry on use like cookie sessions.
+func (a *API) LoginToken(ctx context.Context, email, password string) (string, User, error) {
+ return a.loginTokenInternal(ctx, email, password)
+}
+
 // Logout removes the current session (if any) and clears the cookie.
+// For bearer requests, the token's session is deleted and no cookie is written.
 func (a *API) Logout(w http.ResponseWriter, r *http.Request) error {
  return a.logoutInternal(w, r)
 }
 
-// CurrentUser resolves the session from the request cookie and returns:
+// CurrentUser resolves the session from the request (cookie or bearer token) and returns:
 //   - User: the associated user
 //   - ok: whether a valid session was found
 //   - err: unexpected errors (db, etc.)
@@ -256,6 +1134,46 @@ func (a *API) CurrentUser(w http.ResponseWriter, r *http.Request) (User, bool, e
  return a.currentUserInternal(w, r)
 }
 
+// Routes mounts the built-in endpoints on mux under prefix (e.g. "/auth"):
+//   POST prefix/register  email, password            201 {"user": ...}
+//   POST prefix/login     email, password            200 {"user": ...}
+//   POST prefix/logout                               204
+//   GET  prefix/me                                   200 {"user": ...}
+//   POST prefix/password  current_password, new_password  200 {"user": ...}
+//   POST prefix/reauthenticate  password             200 {"user": ...}
+// Bodies may be JSON or HTML forms. Responses are JSON ({"error": msg} on failure)
+// except for form posts that do not accept JSON, which get a redirect to
+// FormRedirect or plain text. Other methods get 405; POSTs failing the origin check
+// 403; bad credentials or no session 401; a wrong current password 403 (also on
+// /reauthenticate, see ReauthenticatePassword); invalid input 400; a taken email
+// 409. Changing the password signs out every session and signs a cookie client
+// back in. Customize via Config.Handlers.
+func (a *API) Routes(mux *http.ServeMux, prefix string) {
+ a.routesInternal(mux, prefix)
+}
+
+// Handler returns the endpoints of Routes at the root, for use with
+// http.StripPrefix.
+func (a *API) Handler() http.Handler {
+ return a.handlerInternal()
+}
+
+// PageRoutes mounts server-rendered HTML pages on mux under prefix:
+//
+//   {prefix}/login            sign in; redirects to a safe "next" path or AfterLogin
+//   {prefix}/register         create an account and sign in
+//   {prefix}/logout           POST only; signs out and returns to the login page
+//   {prefix}/account          change the password; signed-out visitors go to login
+//   {prefix}/forgot-password  email a reset link (with PageOptions.SendPasswordReset)
+//   {prefix}/reset-password   set a new password from a reset link
+//   {prefix}/reauthenticate   confirm the password again (see ReauthURL)
+//
+// The pages resolve the session themselves and require CSRF tokens on every POST.
+// See PageOptions to supply your own templates.
+func (a *API) PageRoutes(mux *http.ServeMux, prefix string) {
+ a.pageRoutesInternal(mux, prefix)
+}
+
 // Middleware resolves the current user (if any) and injects it into the request context.
 // It also refreshes sessions close to expiry.
 func (a *API) Middleware(next http.Handler) http.Handler {
@@ -263,22 +1181,244 @@ func (a *API) Middleware(next http.Handler) http.Handler {
 }
 
 // RequireAuth ensures a valid user is present in context (e.g., after Middleware).
-// If not authenticated, it returns 401 and stops the chain.
+// If not authenticated it stops the chain: browsers are redirected to LoginURL when
+// set, other clients get 401 (see Config.LoginURL and UnauthorizedHandler).
 func (a *API) RequireAuth(next http.Handler) http.Handler {
  return a.requireAuthInternal(next)
 }
 
+// RequireRecentAuth only lets requests through whose session signed in, or called
+// ReauthenticatePassword, within maxAge (RecentAuthWindow if maxAge <= 0); use it
+// in front of sensitive actions. Signed-out requests are answered like RequireAuth;
+// stale sessions are redirected to ReauthURL or get 401 (see Config.ReauthURL).
+func (a *API) RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+ return a.requireRecentAuthInternal(maxAge)
+}
+
+// ReauthenticatePassword confirms the signed-in user's password and marks the
+// session as freshly authenticated, satisfying RequireRecentAuth and
+// RecentAuthWindow again. A wrong password returns ErrInvalidCredentials and no
+// session ErrNoSession.
+func (a *API) ReauthenticatePassword(w http.ResponseWriter, r *http.Request, password string) error {
+ _, err := a.reauthenticatePasswordInternal(w, r, password)
+ return err
+}
+
+// NextPath returns the request's "next" parameter (query or form), as added by the
+// redirect to LoginURL, if it is a path on this site, and fallback otherwise. Use it
+// after Login to return the user without creating an open redirect:
+//
+//   http.Redirect(w, r, auth.NextPath(r, "/"), http.StatusSeeOther)
+func NextPath(r *http.Request, fallback string) string {
+ if next := safeNextPath(r.FormValue("next")); next != "" {
+  return next
+ }
+ return fallback
+}
+
+// CSRFMiddleware rejects POST, PUT, PATCH and DELETE requests that do not carry the
+// CSRF token in the CSRFHeader header or the CSRFFormField form field, and makes
+// the token available to handlers through CSRFToken. Place it after Middleware:
+// signed-in users get a token stored with their session, anonymous visitors a
+// signed double-submit cookie. Bearer and access-token requests are not checked.
+func (a *API) CSRFMiddleware(next http.Handler) http.Handler {
+ return a.csrfMiddlewareInternal(next)
+}
+
+// CSRFToken returns the CSRF token for the request, set by CSRFMiddleware, for
+// embedding in forms or handing to scripts. Empty outside CSRFMiddleware.
+func CSRFToken(r *http.Request) string {
+ return csrfTokenFromContext(r.Context())
+}
+
+// CSRFField returns a hidden form input carrying the request's CSRF token, for use
+// in html/template forms.
+func (a *API) CSRFField(r *http.Request) template.HTML {
+ return a.csrfTemplateField(r)
+}
+
 // FromContext retrieves the current user injected by Middleware.
 func FromContext(ctx context.Context) (User, bool) {
  return fromContext(ctx)
 }
 
-// PruneExpiredSessions deletes expired sessions immediately.
+// ScopesFromContext returns the scopes granted to the personal access token that
+// authenticated the request. ok is false for session-authenticated requests.
+func ScopesFromContext(ctx context.Context) ([]string, bool) {
+ return scopesFromContext(ctx)
+}
+
+// RequireScope returns middleware that, for access-token requests, requires every
+// listed scope (403 otherwise). Session-authenticated requests act as the full user
+// and pass. Unauthenticated requests get 401. Use after Middleware.
+func (a *API) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+ return a.requireScopeInternal(scopes)
+}
+
+// DefineRole creates the role if needed and sets its permissions to exactly the
+// given list (an empty list clears them).
+func (a *API) DefineRole(ctx context.Context, name string, permissions ...string) error {
+ return a.defineRoleInternal(ctx, name, permissions)
+}
+
+// DeleteRole removes a role and all grants of it.
+func (a *API) DeleteRole(ctx context.Context, name string) error {
+ return a.deleteRoleInternal(ctx, name)
+}
+
+// RolePermissions returns the permissions carried by a role, sorted.
+func (a *API) RolePermissions(ctx context.Context, role string) ([]string, error) {
+ return a.rolePermissionsInternal(ctx, role)
+}
+
+// GrantRole gives a user a defined role. Granting a role twice is a no-op.
+func (a *API) GrantRole(ctx context.Context, userID int64, role string) error {
+ return a.grantRoleInternal(ctx, userID, role)
+}
+
+// RevokeRole takes a role away from a user.
+func (a *API) RevokeRole(ctx context.Context, userID int64, role string) error {
+ return a.revokeRoleInternal(ctx, userID, role)
+}
+
+// UserAuthorization loads a user's roles and resolved permissions.
+func (a *API) UserAuthorization(ctx context.Context, userID int64) (Authorization, error) {
+ return a.loadAuthorization(ctx, userID)
+}
+
+// AuthorizationFromContext returns the Authorization resolved by RequireRole or
+// RequirePermission earlier in the chain.
+func AuthorizationFromContext(ctx context.Context) (Authorization, bool) {
+ return authorizationFromContext(ctx)
+}
+
+// RequireRole returns middleware that admits users holding any of the given roles.
+// Unauthenticated requests get 401; authenticated users without the role get 403.
+// Use after Middleware.
+func (a *API) RequireRole(roles ...string) func(http.Handler) http.Handler {
+ return a.requireAccessInternal(func(az Authorization) bool {
+  for _, r := range roles {
+   if az.HasRole(r) {
+    return true
+   }
+  }
+  return false
+ })
+}
+
+// RequirePermission returns middleware that admits users whose roles carry all of
+// the given permissions. Unauthenticated requests get 401; others lacking a
+// permission get 403. Use after Middleware.
+func (a *API) RequirePermission(permissions ...string) func(http.Handler) http.Handler {
+ return a.requireAccessInternal(func(az Authorization) bool {
+  for _, p := range permissions {
+   if !az.HasPermission(p) {
+    return false
+   }
+  }
+  return true
+ })
+}
+
+// CreateInvite creates an expiring invite for email and returns its token, to be
+// delivered by the caller (e.g., in a link). Only the token's hash is stored.
+func (a *API) CreateInvite(ctx context.Context, inviterID int64, email string, opts InviteOptions) (string, Invite, error) {
+ return a.createInviteInternal(ctx, inviterID, email, opts)
+}
+
+// AcceptInvite redeems an invite token and logs the user in. If no account exists
+// for the invited email one is registered with password (this bypasses InviteOnly);
+// otherwise password must be the existing account's password.
+func (a *API) AcceptInvite(w http.ResponseWriter, r *http.Request, token, password string) (User, error) {
+ return a.acceptInviteInternal(w, r, token, password)
+}
+
+// RevokeInvite deletes a pending invite.
+func (a *API) RevokeInvite(ctx context.Context, inviteID int64) error {
+ return a.revokeInviteInternal(ctx, inviteID)
+}
+
+// CreateOrganization creates an organization owned by ownerID.
+func (a *API) CreateOrganization(ctx context.Context, ownerID int64, name string) (Organization, error) {
+ return a.createOrganizationInternal(ctx, ownerID, name)
+}
+
+// AddMember adds a user to an organization with the given (non-owner) role.
+func (a *API) AddMember(ctx context.Context, orgID, userID int64, role string) error {
+ return a.addMemberInternal(ctx, orgID, userID, role)
+}
+
+// RemoveMember removes a non-owner member and clears it as their active organization.
+func (a *API) RemoveMember(ctx context.Context, orgID, userID int64) error {
+ return a.removeMemberInternal(ctx, orgID, userID)
+}
+
+// SetMemberRole changes a non-owner member's role.
+func (a *API) SetMemberRole(ctx context.Context, orgID, userID int64, role string) error {
+ return a.setMemberRoleInternal(ctx, orgID, userID, role)
+}
+
+// TransferOwnership makes an existing member the owner; the previous owner becomes
+// an admin.
+func (a *API) TransferOwnership(ctx context.Context, orgID, newOwnerID int64) error {
+ return a.transferOwnershipInternal(ctx, orgID, newOwnerID)
+}
+
+// ListMembers returns an organization's memberships, oldest first.
+func (a *API) ListMembers(ctx context.Context, orgID int64) ([]Membership, error) {
+ return a.listMembersInternal(ctx, orgID)
+}
+
+// ListOrganizations returns the user's memberships, by organization name.
+func (a *API) ListOrganizations(ctx context.Context, userID int64) ([]Membership, error) {
+ return a.listOrganizationsInternal(ctx, userID)
+}
+
+// SetActiveOrganization selects the organization for the current session (the user
+// must be a member); 0 clears it. OrganizationMiddleware resolves it per request.
+func (a *API) SetActiveOrganization(w http.ResponseWriter, r *http.Request, orgID int64) error {
+ return a.setActiveOrganizationInternal(w, r, orgID)
+}
+
+// OrganizationMiddleware puts the session's active organization membership into the
+// request context (see OrganizationFromContext). Use after Middleware.
+func (a *API) OrganizationMiddleware(next http.Handler) http.Handler {
+ return a.organizationMiddlewareInternal(next)
+}
+
+// OrganizationFromContext returns the active organization membership resolved by
+// OrganizationMiddleware.
+func OrganizationFromContext(ctx context.Context) (Membership, bool) {
+ return membershipFromContext(ctx)
+}
+
+// CreateAccessToken creates a long-lived personal access token for scripts and CI.
+// The returned string is shown once; only its SHA-256 is stored. expiry <= 0 means
+// the token never expires. Requires TransportAccessToken to be accepted by Middleware.
+func (a *API) CreateAccessToken(ctx context.Context, userID int64, name string, scopes []string, expiry time.Duration) (string, AccessToken, error) {
+ return a.createAccessTokenInternal(ctx, userID, name, scopes, expiry)
+}
+
+// ListAccessTokens returns the user's personal access tokens, oldest first.
+func (a *API) ListAccessTokens(ctx context.Context, userID int64) ([]AccessToken, error) {
+ return a.listAccessTokensInternal(ctx, userID)
+}
+
+// RevokeAccessToken deletes one of the user's personal access tokens.
+func (a *API) RevokeAccessToken(ctx context.Context, userID, tokenID int64) error {
+ return a.revokeAccessTokenInternal(ctx, userID, tokenID)
+}
+
+// PruneExpiredSessions deletes expired sessions immediately, along with other
+// expired state and audit events older than AuditRetention. The janitor calls it
+// every PruneInterval.
 func (a *API) PruneExpiredSessions(ctx context.Context) error {
  return a.pruneExpiredSessionsInternal(ctx)
 }
 
 // RevokeAllSessions deletes all sessions for the given user (e.g., after password change).
+// Stateless sessions are invalidated at their next refresh, which may be up to 80%
+// of SessionTTL away (see StatelessSessions).
 func (a *API) RevokeAllSessions(ctx context.Context, userID int64) error {
  return a.revokeAllSessionsInternal(ctx, userID)
 }
@@ -286,4 +1426,248 @@ func (a *API) RevokeAllSessions(ctx context.Context, userID int64) error {
 // ChangePassword updates the user's password hash and revokes all their sessions.
 func (a *API) ChangePassword(ctx context.Context, userID int64, newPassword string) error {
  return a.changePasswordInternal(ctx, userID, newPassword)
-}
\ No newline at end of file
+}
+
+// CreatePasswordReset creates a single-use password reset token for the account
+// with email, valid for PasswordResetTTL, and returns it with its user for
+// delivery. It returns ErrUserNotFound if no account has the email and
+// ErrTooManyPasswordResets if the account has 3 unexpired tokens.
+func (a *API) CreatePasswordReset(ctx context.Context, email string) (string, User, error) {
+ return a.createPasswordResetInternal(ctx, email)
+}
+
+// ResetPassword redeems a token from CreatePasswordReset: it sets newPassword,
+// revokes all the user's sessions and invalidates their other reset tokens.
+// Invalid, expired or used tokens return ErrInvalidResetToken.
+func (a *API) ResetPassword(ctx context.Context, token, newPassword string) (User, error) {
+ return a.resetPasswordInternal(ctx, token, newPassword)
+}
+
+// ListEvents returns audit events matching f, newest first. Events are kept for
+// AuditRetention.
+func (a *API) ListEvents(ctx context.Context, f EventFilter) ([]Event, error) {
+ return a.listEventsInternal(ctx, f)
+}
+
+// WithLogAttrs returns a context whose log records carry attrs, such as a request
+// ID. Attach it in middleware in front of the API's handlers.
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+ return withLogAttrsInternal(ctx, attrs)
+}
+
+// VerifyWebhookSignature checks the WebhookSignatureHeader value of a webhook
+// request against its raw body and the WebhookConfig.Secret. If maxAge > 0, a
+// signature made longer ago than that is rejected too, which limits replays.
+func VerifyWebhookSignature(secret []byte, signature string, body []byte, maxAge time.Duration) error {
+ return verifyWebhookSignatureInternal(secret, signature, body, maxAge, time.Now())
+}
+// NewJWTKey generates a signing key for the given algorithm, for use in
+// JWTConfig.SigningKeys. Persist the key yourself; tokens signed by a key that is
+// no longer configured stop verifying.
+func NewJWTKey(id string, alg JWTAlgorithm) (JWTKey, error) {
+ return generateJWTKey(id, alg)
+}
+
+// IssueTokenPair mints a JWT access token and starts a new refresh token family
+// for the user. Requires Config.JWT.
+func (a *API) IssueTokenPair(ctx context.Context, userID int64) (TokenPair, error) {
+ return a.issueTokenPairInternal(ctx, userID)
+}
+
+// LoginTokenPair verifies credentials like Login and returns a token pair instead
+// of creating a session.
+func (a *API) LoginTokenPair(ctx context.Context, email, password string) (TokenPair, User, error) {
+ return a.loginTokenPairInternal(ctx, email, password)
+}
+
+// RefreshTokenPair exchanges a refresh token for a new pair; the old refresh token
+// becomes unusable. Reusing a rotated token revokes its family and returns
+// ErrRefreshTokenReused.
+func (a *API) RefreshTokenPair(ctx context.Context, refreshToken string) (TokenPair, error) {
+ return a.refreshTokenPairInternal(ctx, refreshToken)
+}
+
+// RevokeRefreshToken revokes the refresh token's whole family (e.g., on logout).
+// Access tokens already issued stay valid until they expire.
+func (a *API) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+ return a.revokeRefreshTokenInternal(ctx, refreshToken)
+}
+
+// VerifyAccessToken validates a JWT access token issued by this API and returns its User.
+func (a *API) VerifyAccessToken(ctx context.Context, token string) (User, error) {
+ return a.verifyAccessTokenInternal(ctx, token)
+}
+
+// JWTMiddleware injects the User from a valid JWT bearer token, like Middleware does
+// for sessions. Services without this API's database should use NewJWTVerifier.
+func (a *API) JWTMiddleware(next http.Handler) http.Handler {
+ return a.jwtMiddlewareInternal(next)
+}
+
+// JWKSHandler serves the public signing keys as a JSON Web Key Set
+// (mount at e.g. /.well-known/jwks.json).
+func (a *API) JWKSHandler() http.Handler {
+ return a.jwksHandlerInternal()
+}
+
+// OIDCLogin starts a sign-in with the named external provider: it stores the login
+// state server-side, binds it to the browser with a short-lived cookie and
+// redirects to the provider's authorization endpoint (authorization code + PKCE).
+func (a *API) OIDCLogin(w http.ResponseWriter, r *http.Request, provider string) error {
+ return a.oidcLoginInternal(w, r, provider)
+}
+
+// OIDCCallback completes a sign-in started by OIDCLogin; mount it at the provider's
+// RedirectURL. It verifies state, exchanges the code, validates the ID token
+// against the provider's JWKS and logs the linked user in like Login does. On first
+// sign-in a password-less account is registered for the token's email, subject to
+// the registration policy and InviteOnly; if that email is already registered the
+// call fails with ErrEmailTaken, and if the provider did not verify it (the
+// email_verified claim) with ErrEmailNotVerified.
+func (a *API) OIDCCallback(w http.ResponseWriter, r *http.Request, provider string) (User, error) {
+ return a.oidcCallbackInternal(w, r, provider)
+}
+
+// LinkIdentity starts linking an external provider to the signed-in user; it
+// redirects like OIDCLogin, and OIDCCallback then attaches the identity without
+// changing the session. The session must have signed in within RecentAuthWindow,
+// else ErrReauthRequired. A password-less user can add a password with
+// ChangePassword.
+func (a *API) LinkIdentity(w http.ResponseWriter, r *http.Request, provider string) error {
+ return a.linkIdentityInternal(w, r, provider)
+}
+
+// ListIdentities returns the external identities linked to userID.
+func (a *API) ListIdentities(ctx context.Context, userID int64) ([]Identity, error) {
+ return a.listIdentitiesInternal(ctx, userID)
+}
+
+// UnlinkIdentity removes a linked identity. It fails with ErrLastSignInMethod if the
+// user has no password and no other identity.
+func (a *API) UnlinkIdentity(ctx context.Context, userID, identityID int64) error {
+ return a.unlinkIdentityInternal(ctx, userID, identityID)
+}
+
+// OIDCServerHandler serves the OpenID Connect provider endpoints: discovery
+// (/.well-known/openid-configuration), /jwks, /authorize, /token and /userinfo.
+// Mount it at the Issuer's path, e.g.
+//   mux.Handle("/oauth/", http.StripPrefix("/oauth", api.OIDCServerHandler()))
+// /authorize reuses the browser's session cookie (so Middleware in front of it is
+// optional); only the authorization code flow with PKCE (S256) is supported.
+func (a *API) OIDCServerHandler() http.Handler {
+ return a.oidcServerHandlerInternal()
+}
+
+// RegisterOAuthClient registers an application with the OpenID Connect provider or
+// for the device flow and returns it with its generated ID and, for confidential
+// clients, the secret. The secret is shown only once; a hash is stored.
+func (a *API) RegisterOAuthClient(ctx context.Context, c OAuthClient) (OAuthClient, string, error) {
+ return a.registerOAuthClientInternal(ctx, c)
+}
+
+// DeleteOAuthClient removes a client and revokes its refresh tokens.
+func (a *API) DeleteOAuthClient(ctx context.Context, clientID string) error {
+ return a.deleteOAuthClientInternal(ctx, clientID)
+}
+
+// RotateSigningKey generates a new provider signing key, stored in the database,
+// and returns its key ID. The previous key stops signing but stays published in
+// the JWKS for AccessTTL plus a day. A first key is generated automatically.
+func (a *API) RotateSigningKey(ctx context.Context) (string, error) {
+ return a.rotateSigningKeyInternal(ctx)
+}
+
+// DeviceAuthorizationHandler serves the device authorization endpoint: a POST with
+// the client_id of a registered OAuthClient (and its client_secret, if it has one)
+// and an optional scope returns a device_code, a user_code and the verification URL
+// (RFC 8628 §3.2). Unknown clients get invalid_client; requested scopes the client
+// is not registered for are dropped.
+func (a *API) DeviceAuthorizationHandler() http.Handler {
+ return a.deviceAuthorizationHandlerInternal()
+}
+
+// DeviceTokenHandler serves the endpoint clients poll with the device_code. It
+// answers authorization_pending until the user decides, slow_down when polled
+// faster than the interval, expired_token, access_denied, and finally a bearer
+// session token or, with IssueAccessTokens, a personal access token. Clients
+// authenticate as at DeviceAuthorizationHandler. An approved code is exchanged
+// only once.
+func (a *API) DeviceTokenHandler() http.Handler {
+ return a.deviceTokenHandlerInternal()
+}
+
+// DeviceApprovalHandler serves the verification page where a signed-in user enters
+// the code shown by the device and approves or denies it. Mount it at
+// VerificationURL behind Middleware; requests without a session get 401.
+func (a *API) DeviceApprovalHandler() http.Handler {
+ return a.deviceApprovalHandlerInternal()
+}
+
+// ApproveDeviceCode approves a pending user code on behalf of userID, for apps that
+// build their own approval page. Such a page must confirm the code with the user
+// and protect the approval against cross-site requests.
+func (a *API) ApproveDeviceCode(ctx context.Context, userID int64, userCode string) error {
+ return a.approveDeviceCodeInternal(ctx, userID, userCode)
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+ return newPrometheusMetrics()
+}
+
+// AddCounter adds delta to a counter.
+func (m *PrometheusMetrics) AddCounter(name string, delta float64, labelValues ...string) {
+ m.addCounterInternal(name, delta, labelValues)
+}
+
+// ObserveHistogram records value in a histogram.
+func (m *PrometheusMetrics) ObserveHistogram(name string, value float64, labelValues ...string) {
+ m.observeHistogramInternal(name, value, labelValues)
+}
+
+// SetGauge sets a gauge to value.
+func (m *PrometheusMetrics) SetGauge(name string, value float64, labelValues ...string) {
+ m.setGaugeInternal(name, value, labelValues)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+ m.serveHTTPInternal(w, r)
+}
+
+// NewOriginPolicy validates cfg and returns the policy.
+func NewOriginPolicy(cfg OriginPolicyConfig) (*OriginPolicy, error) {
+ return newOriginPolicy(cfg)
+}
+
+// Allowed reports whether r comes from the request's own origin (scheme and host)
+// or an allowed one. Sec-Fetch-Site "same-origin" or "none" is accepted outright;
+// otherwise Origin, or Referer for unsafe methods, must match. Unsafe requests
+// with none of these headers are rejected; safe ones are accepted.
+func (p *OriginPolicy) Allowed(r *http.Request) bool {
+ return p.allowedInternal(r)
+}
+
+// Middleware rejects POST, PUT, PATCH and DELETE requests that Allowed refuses.
+func (p *OriginPolicy) Middleware(next http.Handler) http.Handler {
+ return p.middlewareInternal(next)
+}
+
+// NewJWTVerifier returns a verifier for access tokens that fetches keys from a JWKS
+// endpoint, for services that do not share the auth database.
+func NewJWTVerifier(cfg JWTVerifierConfig) (*JWTVerifier, error) {
+ return newJWTVerifier(cfg)
+}
+
+// Verify checks the token's signature, expiry, issuer and audience and returns the
+// User it was issued for.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (User, error) {
+ return v.verifyInternal(ctx, token)
+}
+
+// Middleware injects the User from a valid "Authorization: Bearer <jwt>" header into
+// the request context (see FromContext). Invalid or missing tokens pass through
+// unauthenticated; combine with RequireAuth-style checks downstream.
+func (v *JWTVerifier) Middleware(next http.Handler) http.Handler {
+ return v.middlewareInternal(next)
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+ "context"
+ "fmt"
+ "log/slog"
+ "net"
+ "net/http"
+ "strings"
+ "time"
+)
+
+// Audit events are written with a.db after the operation they describe, never
+// inside its transaction. A failed write is logged and does not fail the operation.
+
+// maxAuditUserAgent bounds the stored User-Agent header.
+const maxAuditUserAgent = 256
+
+// Event list page sizes.
+const (
+ defaultEventLimit = 50
+ maxEventLimit     = 1000
+)
+
+var ctxClientKey ctxKey = "auth.client"
+
+// clientInfo describes the client of the request an operation runs for.
+type clientInfo struct {
+ ip        string
+ userAgent string
+}
+
+func clientFromContext(ctx context.Context) (clientInfo, bool) {
+ c, ok := ctx.Value(ctxClientKey).(clientInfo)
+ return c, ok
+}
+
+// withClientInfo records the request's client in its context, once, so that
+// operations taking only a context (Register, ChangePassword, ...) can audit it.
+func (a *API) withClientInfo(r *http.Request) *http.Request {
+ if _, ok := clientFromContext(r.Context()); ok {
+  return r
+ }
+ c := clientInfo{userAgent: r.UserAgent()}
+ if len(c.userAgent) > maxAuditUserAgent {
+  c.userAgent = c.userAgent[:maxAuditUserAgent]
+ }
+ if a.cfg.ClientIP != nil {
+  c.ip = a.cfg.ClientIP(r)
+ } else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+  c.ip = host
+ } else {
+  c.ip = r.RemoteAddr
+ }
+ return r.WithContext(context.WithValue(r.Context(), ctxClientKey, c))
+}
+
+// recordEvent appends ev to auth_events, filling in the client from ctx.
+func (a *API) recordEvent(ctx context.Context, ev Event) {
+ c, _ := clientFromContext(ctx)
+ if _, err := a.db.ExecContext(ctx, `
+  INSERT INTO auth_events (type, user_id, email, ip, user_agent, success, detail, created_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ `, string(ev.Type), ev.UserID, ev.Email, c.ip, c.userAgent, ev.Success, ev.Detail, a.now().Unix()); err != nil {
+  a.logError(ctx, "audit write failed", err, slog.String(logKeyEvent, string(ev.Type)))
+ }
+ attrs := []slog.Attr{slog.String(logKeyEvent, string(ev.Type)), slog.Bool("success", ev.Success)}
+ if ev.UserID != 0 {
+  attrs = append(attrs, userAttr(ev.UserID))
+ }
+ if !ev.Success && ev.Detail != "" {
+  attrs = append(attrs, slog.String(logKeyError, ev.Detail))
+ }
+ a.log(ctx, slog.LevelInfo, "auth event", attrs...)
+}
+
+// recordOutcome records ev as a success, or as a failure described by err.
+func (a *API) recordOutcome(ctx context.Context, ev Event, err error) {
+ ev.Success = err == nil
+ if err != nil {
+  ev.Detail = err.Error()
+ }
+ a.recordEvent(ctx, ev)
+}
+
+func (a *API) listEventsInternal(ctx context.Context, f EventFilter) ([]Event, error) {
+ var (
+  where []string
+  args  []any
+ )
+ if f.UserID != 0 {
+  where, args = append(where, "user_id = ?"), append(args, f.UserID)
+ }
+ if f.Type != "" {
+  where, args = append(where, "type = ?"), append(args, string(f.Type))
+ }
+ if f.Email != "" {
+  where, args = append(where, "email = ?"), append(args, normalizeEmail(f.Email))
+ }
+ if !f.Since.IsZero() {
+  where, args = append(where, "created_at >= ?"), append(args, f.Since.Unix())
+ }
+ if !f.Until.IsZero() {
+  where, args = append(where, "created_at < ?"), append(args, f.Until.Unix())
+ }
+ if f.BeforeID != 0 {
+  where, args = append(where, "id < ?"), append(args, f.BeforeID)
+ }
+ limit := f.Limit
+ if limit <= 0 {
+  limit = defaultEventLimit
+ } else if limit > maxEventLimit {
+  limit = maxEventLimit
+ }
+ query := `SELECT id, type, user_id, email, ip, user_agent, success, detail, created_at FROM auth_events`
+ if len(where) > 0 {
+  query += ` WHERE ` + strings.Join(where, " AND ")
+ }
+ query += ` ORDER BY id DESC LIMIT ?`
+ rows, err := a.db.QueryContext(ctx, query, append(args, limit)...)
+ if err != nil {
+  return nil, fmt.Errorf("query events: %w", err)
+ }
+ defer rows.Close()
+ var events []Event
+ for rows.Next() {
+  var (
+   ev        Event
+   typ       string
+   createdAt int64
+  )
+  if err := rows.Scan(&ev.ID, &typ, &ev.UserID, &ev.Email, &ev.IP, &ev.UserAgent, &ev.Success, &ev.Detail, &createdAt); err != nil {
+   return nil, fmt.Errorf("scan event: %w", err)
+  }
+  ev.Type, ev.CreatedAt = EventType(typ), time.Unix(createdAt, 0)
+  events = append(events, ev)
+ }
+ return events, rows.Err()
+}
+
+// pruneEventsInternal deletes events older than AuditRetention.
+func (a *API) pruneEventsInternal(ctx context.Context) error {
+ _, err := a.db.ExecContext(ctx, `
+  DELETE FROM auth_events WHERE created_at < ?
+ `, a.now().Add(-a.cfg.AuditRetention).Unix())
+ return err
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+ "context"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+ "time"
+)
+
+func TestAuditEvents(t *testing.T) {
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Now = func() time.Time { return now }
+  c.AuditRetention = 24 * time.Hour
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ // Register called from a handler behind Middleware knows its client.
+ var user User
+ register := api.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  user, _ = api.Register(r.Context(), "alice@example.com", "password123")
+ }))
+ req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+ req.Header.Set("User-Agent", "test-agent/1.0")
+ serve(register, req)
+ _, _ = api.Register(ctx, "alice@example.com", "password123")
+
+ if _, err := api.Login(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login", nil), "Alice@example.com", "wrong-password"); err == nil {
+  t.Fatal("login with a wrong password succeeded")
+ }
+ session := mustLogin(t, api, "alice@example.com", "password123")
+ if err := api.Logout(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/logout", session)); err != nil {
+  t.Fatalf("Logout: %v", err)
+ }
+ _ = api.ChangePassword(ctx, user.ID, "password456")
+ _ = api.RevokeAllSessions(ctx, user.ID)
+
+ events, err := api.ListEvents(ctx, EventFilter{})
+ if err != nil {
+  t.Fatalf("ListEvents: %v", err)
+ }
+ want := []struct {
+  typ     EventType
+  userID  int64
+  success bool
+ }{
+  {EventSessionsRevoked, user.ID, true},
+  {EventPasswordChanged, user.ID, true},
+  {EventLogout, user.ID, true},
+  {EventLogin, user.ID, true},
+  {EventLogin, user.ID, false},
+  {EventRegister, 0, false},
+  {EventRegister, user.ID, true},
+ }
+ if len(events) != len(want) {
+  t.Fatalf("got %d events: %+v", len(events), events)
+ }
+ for i, w := range want {
+  if ev := events[i]; ev.Type != w.typ || ev.UserID != w.userID || ev.Success != w.success {
+   t.Fatalf("event %d: %+v, want %+v", i, ev, w)
+  }
+ }
+ if ev := events[6]; ev.IP != "192.0.2.1" || ev.UserAgent != "test-agent/1.0" || ev.Email != "alice@example.com" {
+  t.Fatalf("register event client: %+v", ev)
+ }
+ if ev := events[4]; ev.Email != "alice@example.com" || ev.Detail != ErrInvalidCredentials.Error() || ev.IP != "192.0.2.1" {
+  t.Fatalf("failed login event: %+v", ev)
+ }
+ if ev := events[5]; ev.Detail != ErrEmailTaken.Error() || ev.IP != "" {
+  t.Fatalf("duplicate register event: %+v", ev)
+ }
+
+ // Filters and pagination.
+ logins, _ := api.ListEvents(ctx, EventFilter{Type: EventLogin, UserID: user.ID})
+ if len(logins) != 2 {
+  t.Fatalf("login events: %+v", logins)
+ }
+ page, _ := api.ListEvents(ctx, EventFilter{Limit: 3})
+ next, _ := api.ListEvents(ctx, EventFilter{Limit: 3, BeforeID: page[2].ID})
+ if len(page) != 3 || len(next) != 3 || next[0].ID != events[3].ID {
+  t.Fatalf("pages: %+v / %+v", page, next)
+ }
+
+ // The janitor records pruning and drops events past AuditRetention.
+ mustLogin(t, api, "alice@example.com", "password456")
+ now = now.Add(25 * time.Hour)
+ if err := api.PruneExpiredSessions(ctx); err != nil {
+  t.Fatalf("prune: %v", err)
+ }
+ events, _ = api.ListEvents(ctx, EventFilter{})
+ if len(events) != 1 || events[0].Type != EventSessionsPruned || events[0].Detail != "expired sessions: 1" {
+  t.Fatalf("after prune: %+v", events)
+ }
+}
+
+func TestAuditEventsForInvitesAndOIDC(t *testing.T) {
+ idp := newMockIdP(t, time.Unix(1_700_000_000, 0))
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+ })
+ defer cleanup()
+ ctx := context.Background()
+ owner, _ := api.Register(ctx, "owner@example.com", "password123")
+ org, _ := api.CreateOrganization(ctx, owner.ID, "Acme")
+ token, _, err := api.CreateInvite(ctx, owner.ID, "new@example.com", InviteOptions{OrgID: org.ID})
+ if err != nil {
+  t.Fatalf("CreateInvite: %v", err)
+ }
+ invited, err := api.AcceptInvite(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/invite", nil), token, "password123")
+ if err != nil {
+  t.Fatalf("AcceptInvite: %v", err)
+ }
+ _, oidcUser, err := oidcSignIn(t, api, idp, "carol-sub", "carol@example.com")
+ if err != nil {
+  t.Fatalf("OIDC sign-in: %v", err)
+ }
+
+ // Every account the webhook outbox reports is in the audit log, with its sign-in.
+ for _, want := range []struct {
+  typ    EventType
+  userID int64
+  detail string
+ }{
+  {EventRegister, invited.ID, "invite"},
+  {EventLogin, invited.ID, "invite"},
+  {EventRegister, oidcUser.ID, "oidc:mock"},
+  {EventLogin, oidcUser.ID, "oidc:mock"},
+ } {
+  events, _ := api.ListEvents(ctx, EventFilter{Type: want.typ, UserID: want.userID})
+  if len(events) != 1 || !events[0].Success || events[0].Detail != want.detail {
+   t.Fatalf("%s events of user %d: %+v", want.typ, want.userID, events)
+  }
+ }
+}
@@ -5,6 +5,7 @@ import (
   "database/sql"
   "errors"
   "fmt"
+  "log/slog"
   "net/http"
   "strings"
   "time"
@@ -13,29 +14,82 @@ import (
 
 const failedLoginDelay = 250 * time.Millisecond
 
+// lastUsedGranularity is the minimum interval (seconds) between last_used_at writes.
+const lastUsedGranularity = 60
+
 func (a *API) registerInternal(ctx context.Context, email, password string) (User, error) {
- email = normalizeEmail(email)
- if !validEmailBasic(email) {
-  return User{}, fmt.Errorf("invalid email")
+ ctx, span := a.startSpan(ctx, "auth.Register")
+ user, err := a.registerUser(ctx, email, password)
+ a.endSpan(span, user.ID, err)
+ a.recordRegistration(ctx, email, "", user, err)
+ if err != nil {
+  return User{}, err
  }
+ return user, nil
+}
 
- if err := validatePasswordPolicy(password, a.cfg.MinPasswordLength, a.cfg.RequireStrongPasswords); err != nil {
-  return User{}, err
+// recordRegistration audits an account creation (method is the event Detail, e.g.
+// "invite") and runs OnRegister on success.
+func (a *API) recordRegistration(ctx context.Context, email, method string, user User, err error) {
+ a.recordOutcome(ctx, Event{Type: EventRegister, UserID: user.ID, Email: normalizeEmail(email), Detail: method}, err)
+ a.addCounter(metricRegistrations, 1, registrationOutcome(err))
+ if err == nil {
+  a.hookRegister(ctx, user)
  }
+}
 
- cost := a.cfg.BcryptCost
- hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+func (a *API) registerUser(ctx context.Context, email, password string) (User, error) {
+ if a.cfg.InviteOnly {
+  return User{}, ErrInviteRequired
+ }
+ email, hash, err := a.prepareNewUser(ctx, email, password)
  if err != nil {
-  return User{}, fmt.Errorf("hash password: %w", err)
+  return User{}, err
  }
 
- now := a.now().Unix()
  tx, err := a.db.BeginTx(ctx, nil)
  if err != nil {
   return User{}, fmt.Errorf("begin: %w", err)
  }
  defer rollbackIfNeeded(tx)
 
+ user, err := a.insertUserTx(ctx, tx, email, hash)
+ if err != nil {
+  return User{}, err
+ }
+ if err := a.enqueueWebhookTx(ctx, tx, EventRegister, user.ID); err != nil {
+  return User{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return User{}, fmt.Errorf("commit: %w", err)
+ }
+ return user, nil
+}
+
+// prepareNewUser normalizes and validates registration input, applies the
+// registration policy and hashes the password.
+func (a *API) prepareNewUser(ctx context.Context, email, password string) (string, []byte, error) {
+ email = normalizeEmail(email)
+ if !validEmailBasic(email) {
+  return "", nil, ErrInvalidEmail
+ }
+ if err := a.checkRegistrationPolicy(ctx, email); err != nil {
+  return "", nil, err
+ }
+
+ if err := validatePasswordPolicy(password, a.cfg.MinPasswordLength, a.cfg.RequireStrongPasswords); err != nil {
+  return "", nil, err
+ }
+
+ hash, err := a.hashPassword(ctx, password)
+ if err != nil {
+  return "", nil, fmt.Errorf("hash password: %w", err)
+ }
+ return email, hash, nil
+}
+
+func (a *API) insertUserTx(ctx context.Context, tx txHandle, email string, hash []byte) (User, error) {
+ now := a.now().Unix()
  res, err := tx.ExecContext(ctx, `
   INSERT INTO users (email, password_hash, created_at)
   VALUES (?, ?, ?)
@@ -44,7 +98,7 @@ func (a *API) registerInternal(ctx context.Context, email, password string) (Use
   // Be driver-agnostic: detect unique violations by message.
   msg := strings.ToLower(err.Error())
   if strings.Contains(msg, "unique") && strings.Contains(msg, "users") && strings.Contains(msg, "email") {
-   return User{}, fmt.Errorf("email already registered")
+   return User{}, ErrEmailTaken
   }
   return User{}, fmt.Errorf("insert user: %w", err)
  }
@@ -53,14 +107,95 @@ func (a *API) registerInternal(ctx context.Context, email, password string) (Use
  if err != nil {
   return User{}, fmt.Errorf("last insert id: %w", err)
  }
- if err := tx.Commit(); err != nil {
-  return User{}, fmt.Errorf("commit: %w", err)
- }
  return User{ID: id, Email: email, CreatedAt: time.Unix(now, 0)}, nil
 }
 
 func (a *API) loginInternal(w http.ResponseWriter, r *http.Request, email, password string) (User, error) {
-  ctx := r.Context()
+  ctx, span := a.startSpan(a.withClientInfo(r).Context(), "auth.Login")
+  user, err := a.loginSession(w, ctx, email, password)
+  a.endSpan(span, user.ID, err)
+  return user, err
+}
+
+func (a *API) loginSession(w http.ResponseWriter, ctx context.Context, email, password string) (User, error) {
+  user, err := a.authenticatePassword(ctx, email, password)
+  if err == nil {
+    err = a.beforeLogin(ctx, user)
+  }
+  if err != nil {
+    a.recordLogin(ctx, email, user, err)
+    return User{}, err
+  }
+  if err := a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
+    a.recordLogin(ctx, email, user, err)
+    return User{}, fmt.Errorf("create session: %w", err)
+  }
+  a.recordLogin(ctx, email, user, nil)
+  return user, nil
+}
+
+func (a *API) loginTokenInternal(ctx context.Context, email, password string) (string, User, error) {
+  // Middleware would reject the token, so do not create a session for it.
+  if a.cfg.SessionTransports&TransportBearer == 0 {
+    return "", User{}, errBearerDisabled
+  }
+  user, err := a.authenticatePassword(ctx, email, password)
+  if err == nil {
+    err = a.beforeLogin(ctx, user)
+  }
+  if err != nil {
+    a.recordLogin(ctx, email, user, err)
+    return "", User{}, err
+  }
+  token, _, err := a.createSession(ctx, user.ID)
+  if err != nil {
+    a.recordLogin(ctx, email, user, err)
+    return "", User{}, fmt.Errorf("create session: %w", err)
+  }
+  a.recordLogin(ctx, email, user, nil)
+  return token, user, nil
+}
+
+// recordLogin audits a password sign-in and runs the login hooks; user is the
+// account when known, which includes a wrong password for an existing account.
+func (a *API) recordLogin(ctx context.Context, email string, user User, err error) {
+  a.recordOutcome(ctx, Event{Type: EventLogin, UserID: user.ID, Email: normalizeEmail(email)}, err)
+  a.addCounter(metricLogins, 1, loginOutcome(err))
+  if err != nil {
+    a.hookLoginFailed(ctx, email, err)
+    return
+  }
+  a.hookLogin(ctx, user)
+}
+
+// signInRegistered starts a session for a user the built-in pages or handlers just
+// registered, subject to BeforeLogin like any other sign-in.
+func (a *API) signInRegistered(w http.ResponseWriter, ctx context.Context, user User) error {
+  err := a.beforeLogin(ctx, user)
+  if err == nil {
+    if err = a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
+      err = fmt.Errorf("create session: %w", err)
+    }
+  }
+  a.recordSignIn(ctx, "register", user, err)
+  return err
+}
+
+// recordSignIn audits a sign-in without a password (method is the event Detail,
+// e.g. "invite") and runs OnLogin on success; OnLoginFailed is for passwords only.
+func (a *API) recordSignIn(ctx context.Context, method string, user User, err error) {
+  a.recordOutcome(ctx, Event{Type: EventLogin, UserID: user.ID, Email: user.Email, Detail: method}, err)
+  a.addCounter(metricLogins, 1, loginOutcome(err))
+  if err == nil {
+    a.hookLogin(ctx, user)
+  }
+}
+
+// authenticatePassword verifies credentials (with a constant failure delay) and
+// opportunistically upgrades the bcrypt cost. It does not create a session. On a
+// wrong password for an existing account the user is returned alongside
+// ErrInvalidCredentials, for auditing only.
+func (a *API) authenticatePassword(ctx context.Context, email, password string) (User, error) {
   email = normalizeEmail(email)
   var (
     id        int64
@@ -76,109 +211,225 @@ func (a *API) loginInternal(w http.ResponseWriter, r *http.Request, email, passw
   if err != nil {
     if errors.Is(err, sql.ErrNoRows) {
       time.Sleep(failedLoginDelay)
-      return User{}, fmt.Errorf("invalid credentials")
+      return User{}, ErrInvalidCredentials
     }
     return User{}, fmt.Errorf("query user: %w", err)
   }
-  if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+  if err := a.comparePassword(ctx, hash, password); err != nil {
     time.Sleep(failedLoginDelay)
-    return User{}, fmt.Errorf("invalid credentials")
+    return User{ID: id, Email: dbEmail, CreatedAt: time.Unix(createdAt, 0)}, ErrInvalidCredentials
   }
 
   // Opportunistic bcrypt upgrade
   if currentCost, err := bcrypt.Cost(hash); err == nil && currentCost < a.cfg.BcryptCost {
     if err := validateBcryptCost(a.cfg.BcryptCost); err == nil {
-      if newHash, err := bcrypt.GenerateFromPassword([]byte(password), a.cfg.BcryptCost); err == nil {
+      if newHash, err := a.hashPassword(ctx, password); err == nil {
         if _, err := a.db.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, newHash, id); err != nil {
-          a.logf("bcrypt upgrade failed for user %d: %v", id, err)
+          a.logError(ctx, "bcrypt upgrade failed", err, userAttr(id))
         }
       } else {
-        a.logf("bcrypt rehash error: %v", err)
+        a.logError(ctx, "bcrypt rehash failed", err, userAttr(id))
       }
     }
   }
 
-  user := User{ID: id, Email: dbEmail, CreatedAt: time.Unix(createdAt, 0)}
-  if err := a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
-    return User{}, fmt.Errorf("create session: %w", err)
-  }
-  return user, nil
+  return User{ID: id, Email: dbEmail, CreatedAt: time.Unix(createdAt, 0)}, nil
 }
 
 func (a *API) logoutInternal(w http.ResponseWriter, r *http.Request) error {
- token, err := a.readSessionCookie(r)
+ ctx := a.withClientInfo(r).Context()
+ token, transport, err := a.readSessionToken(r)
+ if transport == TransportCookie {
+  defer a.clearCookie(w)
+ }
  if err != nil || token == "" {
-  a.clearCookie(w)
   return nil
  }
- if _, err := a.db.ExecContext(r.Context(), `DELETE FROM sessions WHERE token = ?`, token); err != nil {
-  a.clearCookie(w)
+ // Stateless tokens have no row to delete; clearing the cookie is all we can do.
+ if a.sealer != nil {
+  if p, err := a.sealer.open(token); err == nil && a.now().Unix() < p.ExpiresAt {
+   a.recordEvent(ctx, Event{Type: EventLogout, UserID: p.UserID, Success: true})
+   a.hookLogout(ctx, p.UserID)
+   a.addCounter(metricLogouts, 1)
+  }
+  return nil
+ }
+ var userID int64
+ err = a.db.QueryRowContext(ctx, `SELECT user_id FROM sessions WHERE token = ?`, token).Scan(&userID)
+ if errors.Is(err, sql.ErrNoRows) {
+  return nil
+ }
+ if err != nil {
+  return fmt.Errorf("query session: %w", err)
+ }
+ if _, err := a.db.ExecContext(ctx, `DELETE FROM sessions WHERE token = ?`, token); err != nil {
   return fmt.Errorf("delete session: %w", err)
  }
- a.clearCookie(w)
+ a.recordEvent(ctx, Event{Type: EventLogout, UserID: userID, Success: true})
+ a.hookLogout(ctx, userID)
+ a.addCounter(metricLogouts, 1)
  return nil
 }
 
 func (a *API) currentUserInternal(w http.ResponseWriter, r *http.Request) (User, bool, error) {
+ user, _, ok, err := a.tracedResolveSession(w, r)
+ return user, ok, err
+}
+
+// tracedResolveSession runs resolveSession in an auth.CurrentUser span, for
+// CurrentUser and Middleware.
+func (a *API) tracedResolveSession(w http.ResponseWriter, r *http.Request) (User, sessionInfo, bool, error) {
+ if a.cfg.Tracer == nil {
+  return a.resolveSession(w, r)
+ }
+ // Only here: WithContext copies the request.
+ ctx, span := a.cfg.Tracer.Start(r.Context(), "auth.CurrentUser")
+ user, info, ok, err := a.resolveSession(w, r.WithContext(ctx))
+ a.endSpan(span, user.ID, err)
+ return user, info, ok, err
+}
+
+// resolveSession validates the request's session token (refreshing it if due) and
+// returns the user together with per-session state.
+func (a *API) resolveSession(w http.ResponseWriter, r *http.Request) (User, sessionInfo, bool, error) {
  ctx := r.Context()
- token, err := a.readSessionCookie(r)
+ token, transport, err := a.readSessionToken(r)
  if err != nil || token == "" {
-  return User{}, false, nil
+  return User{}, sessionInfo{}, false, nil
+ }
+ // Bearer clients manage their own token; never touch the cookie for them.
+ usesCookie := transport == TransportCookie
+ if a.sealer != nil {
+  return a.resolveStatelessSession(w, r, token, transport)
  }
  var (
-  userID    int64
-  email     string
-  uc        int64
-  expiresAt int64
+  userID     int64
+  email      string
+  uc         int64
+  expiresAt  int64
+  lastUsedAt int64
+  info       = sessionInfo{token: token, transport: transport}
  )
  err = a.db.QueryRowContext(ctx, `
-  SELECT u.id, u.email, u.created_at, s.expires_at
+  SELECT s.id, u.id, u.email, u.created_at, s.expires_at, s.last_used_at, s.active_org_id, s.csrf_token
   FROM sessions s
   JOIN users u ON u.id = s.user_id
   WHERE s.token = ?
- `, token).Scan(&userID, &email, &uc, &expiresAt)
+ `, token).Scan(&info.id, &userID, &email, &uc, &expiresAt, &lastUsedAt, &info.activeOrgID, &info.csrfToken)
  if err != nil {
   if errors.Is(err, sql.ErrNoRows) {
-   a.clearCookie(w)
-   return User{}, false, nil
+   if usesCookie {
+    a.clearCookie(w)
+   }
+   return User{}, sessionInfo{}, false, nil
   }
-  return User{}, false, fmt.Errorf("query session: %w", err)
+  return User{}, sessionInfo{}, false, fmt.Errorf("query session: %w", err)
  }
  now := a.now().Unix()
  if now >= expiresAt {
   _, _ = a.db.ExecContext(ctx, `DELETE FROM sessions WHERE token = ?`, token)
-  a.clearCookie(w)
-  return User{}, false, nil
+  if usesCookie {
+   a.clearCookie(w)
+  }
+  return User{}, sessionInfo{}, false, nil
  }
- // Refresh if within last 20% of TTL.
+ // Refresh if within last 20% of TTL. Bearer sessions slide the same way,
+ // only without the Set-Cookie write.
  ttl := int64(a.cfg.SessionTTL.Seconds())
  if ttl > 0 {
   remaining := expiresAt - now
   if remaining*5 <= ttl {
    newExp := now + ttl
-   if _, err := a.db.ExecContext(ctx, `UPDATE sessions SET expires_at = ? WHERE token = ?`, newExp, token); err == nil {
-    a.setCookie(w, token, time.Unix(newExp, 0))
+   if _, err := a.db.ExecContext(ctx, `UPDATE sessions SET expires_at = ?, last_used_at = ? WHERE token = ?`, newExp, now, token); err == nil {
+    if usesCookie {
+     a.setCookie(w, token, time.Unix(newExp, 0))
+    }
+    lastUsedAt = now
+    a.addCounter(metricRefreshes, 1, "session")
    }
   }
  }
- return User{ID: userID, Email: email, CreatedAt: time.Unix(uc, 0)}, true, nil
+ // Track last use at a coarse granularity to avoid a write per request.
+ if now-lastUsedAt >= lastUsedGranularity {
+  _, _ = a.db.ExecContext(ctx, `UPDATE sessions SET last_used_at = ? WHERE token = ?`, now, token)
+ }
+ return User{ID: userID, Email: email, CreatedAt: time.Unix(uc, 0)}, info, true, nil
 }
 
 func (a *API) pruneExpiredSessionsInternal(ctx context.Context) error {
- _, err := a.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at <= ?`, a.now().Unix())
+ defer a.observeDuration(metricPruneDuration, time.Now())
+ now := a.now().Unix()
+ res, err := a.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at <= ?`, now)
+ if err != nil {
+  return err
+ }
+ if n, err := res.RowsAffected(); err == nil && n > 0 {
+  a.recordEvent(ctx, Event{Type: EventSessionsPruned, Success: true, Detail: fmt.Sprintf("expired sessions: %d", n)})
+  a.addCounter(metricPrunedSessions, float64(n))
+ }
+ if err := a.updateActiveSessions(ctx); err != nil {
+  return err
+ }
+ if err := a.pruneEventsInternal(ctx); err != nil {
+  return err
+ }
+ if _, err := a.db.ExecContext(ctx, `DELETE FROM oidc_states WHERE expires_at <= ?`, now); err != nil {
+  return err
+ }
+ if _, err := a.db.ExecContext(ctx, `DELETE FROM password_resets WHERE expires_at <= ?`, now); err != nil {
+  return err
+ }
+ if err := a.pruneWebhooksInternal(ctx); err != nil {
+  return err
+ }
+ if err := a.pruneOIDCServerInternal(ctx); err != nil {
+  return err
+ }
+ if err := a.pruneDeviceCodesInternal(ctx); err != nil {
+  return err
+ }
+ // Rotated refresh tokens are kept until expiry for reuse detection.
+ _, err = a.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at <= ?`, now)
  return err
 }
 
 func (a *API) revokeAllSessionsInternal(ctx context.Context, userID int64) error {
- _, err := a.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
- return err
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ if err := revokeSessionsTx(ctx, tx, userID, a.now().Unix()); err != nil {
+  return err
+ }
+ if err := tx.Commit(); err != nil {
+  return fmt.Errorf("commit: %w", err)
+ }
+ a.recordEvent(ctx, Event{Type: EventSessionsRevoked, UserID: userID, Success: true})
+ a.hookSessionRevoked(ctx, userID)
+ return nil
+}
+
+// revokeSessionsTx deletes server-side sessions, revokes refresh tokens and bumps
+// session_version, which invalidates stateless tokens at their next refresh.
+func revokeSessionsTx(ctx context.Context, tx txHandle, userID, now int64) error {
+ if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+  return fmt.Errorf("revoke sessions: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `UPDATE users SET session_version = session_version + 1 WHERE id = ?`, userID); err != nil {
+  return fmt.Errorf("bump session version: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at = 0`, now, userID); err != nil {
+  return fmt.Errorf("revoke refresh tokens: %w", err)
+ }
+ return nil
 }
 
 func (a *API) changePasswordInternal(ctx context.Context, userID int64, newPassword string) error {
  if err := validatePasswordPolicy(newPassword, a.cfg.MinPasswordLength, a.cfg.RequireStrongPasswords); err != nil {
   return err
  }
- hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), a.cfg.BcryptCost)
+ hash, err := a.hashPassword(ctx, newPassword)
  if err != nil {
   return fmt.Errorf("hash password: %w", err)
  }
@@ -190,11 +441,49 @@ func (a *API) changePasswordInternal(ctx context.Context, userID int64, newPassw
  if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, hash, userID); err != nil {
   return fmt.Errorf("update user: %w", err)
  }
- if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
-  return fmt.Errorf("revoke sessions: %w", err)
+ if err := revokeSessionsTx(ctx, tx, userID, a.now().Unix()); err != nil {
+  return err
+ }
+ if err := a.enqueueWebhookTx(ctx, tx, EventPasswordChanged, userID); err != nil {
+  return err
  }
  if err := tx.Commit(); err != nil {
   return fmt.Errorf("commit: %w", err)
  }
+ a.recordEvent(ctx, Event{Type: EventPasswordChanged, UserID: userID, Success: true})
+ a.hookPasswordChanged(ctx, userID)
+ a.hookSessionRevoked(ctx, userID)
  return nil
-}
\ No newline at end of file
+}
+
+// hashPassword hashes with BcryptCost; it and comparePassword are the only bcrypt
+// calls, so every one is measured and traced.
+func (a *API) hashPassword(ctx context.Context, password string) ([]byte, error) {
+ defer a.observeDuration(metricHashDuration, time.Now(), "hash")
+ _, span := a.startSpan(ctx, "auth.bcrypt.hash")
+ if a.cfg.Tracer != nil {
+  span.SetAttributes(slog.Int("bcrypt.cost", a.cfg.BcryptCost))
+ }
+ hash, err := bcrypt.GenerateFromPassword([]byte(password), a.cfg.BcryptCost)
+ finishSpan(span, err)
+ return hash, err
+}
+
+func (a *API) comparePassword(ctx context.Context, hash []byte, password string) error {
+ defer a.observeDuration(metricHashDuration, time.Now(), "compare")
+ _, span := a.startSpan(ctx, "auth.bcrypt.compare")
+ if a.cfg.Tracer != nil {
+  if cost, err := bcrypt.Cost(hash); err == nil {
+   span.SetAttributes(slog.Int("bcrypt.cost", cost))
+  }
+ }
+ err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+ if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+  finishSpan(span, nil) // a wrong password is not a failed operation
+ } else {
+  finishSpan(span, err)
+ }
+ return err
+}
+
+var errBearerDisabled = errors.New("bearer transport is not enabled")
@@ -0,0 +1,126 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+ "time"
+)
+
+func newReqWithBearer(method, target, token string) *http.Request {
+ r := httptest.NewRequest(method, target, nil)
+ r.Header.Set("Authorization", "Bearer "+token)
+ return r
+}
+
+func TestLoginTokenAndBearerMiddleware(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "cli@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ if _, _, err := api.LoginToken(ctx, "cli@example.com", "wrong-password"); err == nil {
+  t.Fatalf("expected invalid credentials")
+ }
+ token, u, err := api.LoginToken(ctx, "cli@example.com", "password123")
+ if err != nil || token == "" || u.Email != "cli@example.com" {
+  t.Fatalf("LoginToken: token=%q user=%v err=%v", token, u, err)
+ }
+
+ h := api.Middleware(api.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  u, _ := FromContext(r.Context())
+  _, _ = w.Write([]byte(u.Email))
+ })))
+
+ w := httptest.NewRecorder()
+ h.ServeHTTP(w, newReqWithBearer(http.MethodGet, "/me", token))
+ if w.Code != http.StatusOK || w.Body.String() != "cli@example.com" {
+  t.Fatalf("bearer request: status=%d body=%q", w.Code, w.Body.String())
+ }
+ if len(w.Result().Cookies()) != 0 {
+  t.Fatalf("bearer request must not set cookies")
+ }
+
+ w2 := httptest.NewRecorder()
+ h.ServeHTTP(w2, newReqWithBearer(http.MethodGet, "/me", "bogus"))
+ if w2.Code != http.StatusUnauthorized {
+  t.Fatalf("expected 401 for bogus token, got %d", w2.Code)
+ }
+ if w2.Header().Get("WWW-Authenticate") == "" {
+  t.Fatalf("expected WWW-Authenticate challenge")
+ }
+
+ // Logout with the bearer token deletes the session without touching cookies.
+ w3 := httptest.NewRecorder()
+ if err := api.Logout(w3, newReqWithBearer(http.MethodPost, "/logout", token)); err != nil {
+  t.Fatalf("logout: %v", err)
+ }
+ if len(w3.Result().Cookies()) != 0 {
+  t.Fatalf("bearer logout must not set cookies")
+ }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithBearer(http.MethodGet, "/me", token)); ok {
+  t.Fatalf("token should be invalid after logout")
+ }
+}
+
+func TestBearerRejectedWhenTransportDisabled(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "nob@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ if token, _, err := api.LoginToken(ctx, "nob@example.com", "password123"); !errors.Is(err, errBearerDisabled) || token != "" {
+  t.Fatalf("LoginToken without TransportBearer: %q %v", token, err)
+ }
+ var n int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&n); err != nil || n != 0 {
+  t.Fatalf("sessions created: %d (%v)", n, err)
+ }
+ // A cookie session token presented as a bearer token is not accepted either.
+ session := mustLogin(t, api, "nob@example.com", "password123")
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithBearer(http.MethodGet, "/me", session.Value)); ok {
+  t.Fatalf("bearer token accepted although only cookies are enabled")
+ }
+}
+
+func TestBearerSlidingExpiry(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportBearer
+  c.SessionTTL = 100 * time.Second
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "slide@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ token, _, err := api.LoginToken(ctx, "slide@example.com", "password123")
+ if err != nil {
+  t.Fatalf("LoginToken: %v", err)
+ }
+
+ // Within the refresh window: expiry slides forward, but no cookie is written.
+ api.cfg.Now = func() time.Time { return base.Add(90 * time.Second) }
+ w := httptest.NewRecorder()
+ if _, ok, _ := api.CurrentUser(w, newReqWithBearer(http.MethodGet, "/me", token)); !ok {
+  t.Fatalf("token should be valid")
+ }
+ if len(w.Result().Cookies()) != 0 {
+  t.Fatalf("refresh must not set cookies for bearer sessions")
+ }
+
+ // Past the original expiry, still within the slid one.
+ api.cfg.Now = func() time.Time { return base.Add(150 * time.Second) }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithBearer(http.MethodGet, "/me", token)); !ok {
+  t.Fatalf("token should have slid past its original expiry")
+ }
+}
@@ -15,6 +15,9 @@ func applyDefaults(cfg *Config) {
  if cfg.SessionName == "" {
   cfg.SessionName = "session"
  }
+ if cfg.SessionTransports == 0 {
+  cfg.SessionTransports = TransportCookie
+ }
  if cfg.SessionTTL <= 0 {
   cfg.SessionTTL = 24 * time.Hour
  }
@@ -42,6 +45,92 @@ func applyDefaults(cfg *Config) {
  if cfg.MaxIdleConns <= 0 {
   cfg.MaxIdleConns = 1
  }
+ if cfg.CSRFHeader == "" {
+  cfg.CSRFHeader = "X-CSRF-Token"
+ }
+ if cfg.CSRFFormField == "" {
+  cfg.CSRFFormField = "csrf_token"
+ }
+ if cfg.InviteTTL <= 0 {
+  cfg.InviteTTL = 7 * 24 * time.Hour
+ }
+ if cfg.PasswordResetTTL <= 0 {
+  cfg.PasswordResetTTL = time.Hour
+ }
+ if cfg.Pages.AfterLogin == "" {
+  cfg.Pages.AfterLogin = "/"
+ }
+ if cfg.AuditRetention <= 0 {
+  cfg.AuditRetention = 90 * 24 * time.Hour
+ }
+ if cfg.AdminRole == "" {
+  cfg.AdminRole = "admin"
+ }
+ if cfg.RecentAuthWindow <= 0 {
+  cfg.RecentAuthWindow = 15 * time.Minute
+ }
+ if cfg.OIDCServer != nil {
+  o := *cfg.OIDCServer
+  if o.SigningAlgorithm == "" {
+   o.SigningAlgorithm = RS256
+  }
+  if o.LoginURL == "" {
+   o.LoginURL = cfg.LoginURL
+  }
+  if o.CodeTTL <= 0 {
+   o.CodeTTL = time.Minute
+  }
+  if o.AccessTTL <= 0 {
+   o.AccessTTL = time.Hour
+  }
+  if o.RefreshTTL <= 0 {
+   o.RefreshTTL = 30 * 24 * time.Hour
+  }
+  cfg.OIDCServer = &o
+ }
+ if cfg.DeviceAuth != nil {
+  d := *cfg.DeviceAuth
+  if d.CodeTTL <= 0 {
+   d.CodeTTL = 10 * time.Minute
+  }
+  if d.Interval <= 0 {
+   d.Interval = 5 * time.Second
+  }
+  if d.AccessTokenExpiry <= 0 {
+   d.AccessTokenExpiry = 90 * 24 * time.Hour
+  }
+  cfg.DeviceAuth = &d
+ }
+ if cfg.Webhooks != nil {
+  wh := *cfg.Webhooks
+  if wh.Client == nil {
+   wh.Client = &http.Client{Timeout: 10 * time.Second}
+  }
+  if wh.PollInterval <= 0 {
+   wh.PollInterval = 5 * time.Second
+  }
+  if wh.MaxAttempts <= 0 {
+   wh.MaxAttempts = 12
+  }
+  if wh.InitialBackoff <= 0 {
+   wh.InitialBackoff = 30 * time.Second
+  }
+  if wh.MaxBackoff <= 0 {
+   wh.MaxBackoff = 6 * time.Hour
+  }
+  cfg.Webhooks = &wh
+ }
+ if cfg.JWT != nil {
+  // Copy so defaults never write through the caller's pointer.
+  j := *cfg.JWT
+  if j.AccessTTL <= 0 {
+   j.AccessTTL = 15 * time.Minute
+  }
+  if j.RefreshTTL <= 0 {
+   j.RefreshTTL = 30 * 24 * time.Hour
+  }
+  cfg.JWT = &j
+ }
 }
 
 func validateBcryptCost(cost int) error {
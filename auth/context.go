@@ -7,6 +7,11 @@ import (
 type ctxKey string
 
 var ctxUserKey ctxKey = "auth.user"
+var ctxScopesKey ctxKey = "auth.scopes"
+var ctxAuthorizationKey ctxKey = "auth.authorization"
+var ctxSessionKey ctxKey = "auth.session"
+var ctxMembershipKey ctxKey = "auth.membership"
+var ctxJWTKey ctxKey = "auth.jwt"
 
 func fromContext(ctx context.Context) (User, bool) {
  u, ok := ctx.Value(ctxUserKey).(User)
@@ -15,4 +20,56 @@ func fromContext(ctx context.Context) (User, bool) {
 
 func withUser(ctx context.Context, u User) context.Context {
  return context.WithValue(ctx, ctxUserKey, u)
-}
\ No newline at end of file
+}
+
+// scopesFromContext reports the scopes granted to an access-token request.
+// ok is false when the request was not authenticated by an access token.
+func scopesFromContext(ctx context.Context) ([]string, bool) {
+ s, ok := ctx.Value(ctxScopesKey).([]string)
+ return s, ok
+}
+
+func withScopes(ctx context.Context, scopes []string) context.Context {
+ if scopes == nil {
+  scopes = []string{}
+ }
+ return context.WithValue(ctx, ctxScopesKey, scopes)
+}
+
+// jwtAuthFromContext reports whether the request was authenticated by a JWT bearer
+// token rather than a session.
+func jwtAuthFromContext(ctx context.Context) bool {
+ ok, _ := ctx.Value(ctxJWTKey).(bool)
+ return ok
+}
+
+func withJWTAuth(ctx context.Context, u User) context.Context {
+ return context.WithValue(withUser(ctx, u), ctxJWTKey, true)
+}
+
+func authorizationFromContext(ctx context.Context) (Authorization, bool) {
+ az, ok := ctx.Value(ctxAuthorizationKey).(Authorization)
+ return az, ok
+}
+
+func withAuthorization(ctx context.Context, az Authorization) context.Context {
+ return context.WithValue(ctx, ctxAuthorizationKey, az)
+}
+
+func sessionFromContext(ctx context.Context) (sessionInfo, bool) {
+ s, ok := ctx.Value(ctxSessionKey).(sessionInfo)
+ return s, ok
+}
+
+func withSession(ctx context.Context, s sessionInfo) context.Context {
+ return context.WithValue(ctx, ctxSessionKey, s)
+}
+
+func membershipFromContext(ctx context.Context) (Membership, bool) {
+ m, ok := ctx.Value(ctxMembershipKey).(Membership)
+ return m, ok
+}
+
+func withMembership(ctx context.Context, m Membership) context.Context {
+ return context.WithValue(ctx, ctxMembershipKey, m)
+}
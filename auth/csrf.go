@@ -0,0 +1,160 @@
+package auth
+
+import (
+ "context"
+ "crypto/hmac"
+ "crypto/sha256"
+ "crypto/subtle"
+ "encoding/base64"
+ "fmt"
+ "html/template"
+ "net/http"
+ "strconv"
+ "strings"
+)
+
+// CSRF tokens come from one of two places:
+//   - server-side sessions keep a random token in sessions.csrf_token, created on
+//     first use and dropped with the session;
+//   - anonymous visitors and stateless sessions get a signed double-submit cookie
+//     "<nonce>.<HMAC(CSRFKey, nonce|binding)>", where binding ties the cookie to the
+//     stateless session's sign-in, so a cookie planted by a sibling subdomain does
+//     not validate for a signed-in user.
+// Requests authenticated by a bearer, access or JWT token carry no ambient
+// credentials and are not checked.
+
+var ctxCSRFKey ctxKey = "auth.csrf"
+
+func csrfTokenFromContext(ctx context.Context) string {
+ s, _ := ctx.Value(ctxCSRFKey).(string)
+ return s
+}
+
+func (a *API) csrfCookieName() string {
+ if a.cfg.CSRFCookieName != "" {
+  return a.cfg.CSRFCookieName
+ }
+ return a.cfg.SessionName + "_csrf"
+}
+
+func (a *API) csrfMiddlewareInternal(next http.Handler) http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  ctx := r.Context()
+  info, hasSession := sessionFromContext(ctx)
+  _, tokenAuth := scopesFromContext(ctx)
+  if tokenAuth || jwtAuthFromContext(ctx) || (hasSession && info.transport != TransportCookie) {
+   next.ServeHTTP(w, r)
+   return
+  }
+  var (
+   token string
+   err   error
+  )
+  if hasSession && info.stateless == nil {
+   token, err = a.sessionCSRFToken(ctx, info)
+  } else {
+   token, err = a.cookieCSRFToken(w, r, csrfBinding(info, hasSession))
+  }
+  if err != nil {
+   a.logError(ctx, "csrf token failed", err)
+   http.Error(w, "internal error", http.StatusInternalServerError)
+   return
+  }
+  r = r.WithContext(context.WithValue(ctx, ctxCSRFKey, token))
+  if isUnsafeMethod(r.Method) && !validCSRFToken(token, a.submittedCSRFToken(r)) {
+   a.csrfFailure(w, r)
+   return
+  }
+  next.ServeHTTP(w, r)
+ })
+}
+
+// submittedCSRFToken reads the token from the header, falling back to the form
+// field for HTML form posts.
+func (a *API) submittedCSRFToken(r *http.Request) string {
+ if t := r.Header.Get(a.cfg.CSRFHeader); t != "" {
+  return t
+ }
+ return r.PostFormValue(a.cfg.CSRFFormField)
+}
+
+func validCSRFToken(expected, got string) bool {
+ return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1
+}
+
+func (a *API) csrfFailure(w http.ResponseWriter, r *http.Request) {
+ if a.cfg.CSRFFailureHandler != nil {
+  a.cfg.CSRFFailureHandler.ServeHTTP(w, r)
+  return
+ }
+ http.Error(w, "invalid CSRF token", http.StatusForbidden)
+}
+
+// sessionCSRFToken returns the server-side session's token, creating it on first use.
+func (a *API) sessionCSRFToken(ctx context.Context, info sessionInfo) (string, error) {
+ if info.csrfToken != "" {
+  return info.csrfToken, nil
+ }
+ token, err := newSessionToken()
+ if err != nil {
+  return "", err
+ }
+ if _, err := a.db.ExecContext(ctx, `
+  UPDATE sessions SET csrf_token = ? WHERE token = ? AND csrf_token = ''
+ `, token, info.token); err != nil {
+  return "", fmt.Errorf("store csrf token: %w", err)
+ }
+ // A concurrent request may have won the race; use whichever token was stored.
+ var stored string
+ if err := a.db.QueryRowContext(ctx, `SELECT csrf_token FROM sessions WHERE token = ?`, info.token).Scan(&stored); err != nil {
+  return "", fmt.Errorf("query csrf token: %w", err)
+ }
+ return stored, nil
+}
+
+// csrfBinding ties cookie tokens of stateless sessions to the sign-in; anonymous
+// visitors have an empty binding.
+func csrfBinding(info sessionInfo, hasSession bool) string {
+ if !hasSession || info.stateless == nil {
+  return ""
+ }
+ return strconv.FormatInt(info.stateless.UserID, 10) + ":" + strconv.FormatInt(info.stateless.AuthAt, 10)
+}
+
+// cookieCSRFToken returns the double-submit cookie's token when its signature
+// matches binding, else issues a new cookie.
+func (a *API) cookieCSRFToken(w http.ResponseWriter, r *http.Request, binding string) (string, error) {
+ if c, err := r.Cookie(a.csrfCookieName()); err == nil {
+  if nonce, _, ok := strings.Cut(c.Value, "."); ok && hmac.Equal([]byte(c.Value), []byte(a.signCSRFNonce(nonce, binding))) {
+   return c.Value, nil
+  }
+ }
+ nonce, err := newSessionToken()
+ if err != nil {
+  return "", err
+ }
+ token := a.signCSRFNonce(nonce, binding)
+ // Pages get the token from CSRFToken, never from the cookie, so it stays HttpOnly.
+ http.SetCookie(w, &http.Cookie{
+  Name:     a.csrfCookieName(),
+  Value:    token,
+  Path:     "/",
+  Domain:   a.cfg.CookieDomain,
+  HttpOnly: true,
+  Secure:   a.cfg.CookieSecure,
+  SameSite: http.SameSiteLaxMode,
+ })
+ return token, nil
+}
+
+func (a *API) signCSRFNonce(nonce, binding string) string {
+ mac := hmac.New(sha256.New, a.csrfKey)
+ mac.Write([]byte(nonce + "|" + binding))
+ return nonce + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfTemplateField renders the hidden form input carrying the request's token.
+func (a *API) csrfTemplateField(r *http.Request) template.HTML {
+ return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(a.cfg.CSRFFormField) +
+  `" value="` + template.HTMLEscapeString(csrfTokenFromContext(r.Context())) + `">`)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+ "context"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "strings"
+ "testing"
+)
+
+// csrfEcho serves the request's CSRF token behind Middleware and CSRFMiddleware.
+func csrfEcho(api *API) http.Handler {
+ return api.Middleware(api.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  _, _ = w.Write([]byte(CSRFToken(r)))
+ })))
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+ rr := httptest.NewRecorder()
+ h.ServeHTTP(rr, r)
+ return rr
+}
+
+func TestCSRFSessionToken(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+ })
+ defer cleanup()
+ _, _ = api.Register(context.Background(), "alice@example.com", "password123")
+ session := mustLogin(t, api, "alice@example.com", "password123")
+ h := csrfEcho(api)
+
+ token := serve(h, newReqWithCookie(http.MethodGet, "/", session)).Body.String()
+ if token == "" {
+  t.Fatal("no token for session")
+ }
+ if again := serve(h, newReqWithCookie(http.MethodGet, "/", session)).Body.String(); again != token {
+  t.Fatalf("token changed within the session: %q != %q", again, token)
+ }
+
+ if rr := serve(h, newReqWithCookie(http.MethodPost, "/", session)); rr.Code != http.StatusForbidden {
+  t.Fatalf("POST without token: %d", rr.Code)
+ }
+ req := newReqWithCookie(http.MethodPost, "/", session)
+ req.Header.Set("X-CSRF-Token", token)
+ if rr := serve(h, req); rr.Code != http.StatusOK {
+  t.Fatalf("POST with header token: %d", rr.Code)
+ }
+ if rr := postForm(h, "/", url.Values{"csrf_token": {token}}, session); rr.Code != http.StatusOK {
+  t.Fatalf("POST with form token: %d", rr.Code)
+ }
+
+ // A new session gets a new token.
+ other := mustLogin(t, api, "alice@example.com", "password123")
+ req = newReqWithCookie(http.MethodPost, "/", other)
+ req.Header.Set("X-CSRF-Token", token)
+ if rr := serve(h, req); rr.Code != http.StatusForbidden {
+  t.Fatalf("token accepted for another session: %d", rr.Code)
+ }
+
+ // Bearer requests carry no ambient credentials.
+ bearer, _, err := api.LoginToken(context.Background(), "alice@example.com", "password123")
+ if err != nil {
+  t.Fatalf("LoginToken: %v", err)
+ }
+ if rr := serve(h, newReqWithBearer(http.MethodPost, "/", bearer)); rr.Code != http.StatusOK {
+  t.Fatalf("bearer POST: %d", rr.Code)
+ }
+}
+
+func TestCSRFAnonymousDoubleSubmit(t *testing.T) {
+ failed := 0
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.CSRFFailureHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+   failed++
+   http.Error(w, "nope", http.StatusTeapot)
+  })
+ })
+ defer cleanup()
+ h := csrfEcho(api)
+
+ rr := serve(h, httptest.NewRequest(http.MethodGet, "/", nil))
+ var cookie *http.Cookie
+ for _, c := range rr.Result().Cookies() {
+  if c.Name == "session_csrf" {
+   cookie = c
+  }
+ }
+ if cookie == nil || !cookie.HttpOnly || rr.Body.String() != cookie.Value {
+  t.Fatalf("csrf cookie: %+v body %q", cookie, rr.Body.String())
+ }
+
+ req := newReqWithCookie(http.MethodPost, "/", cookie)
+ req.Header.Set("X-CSRF-Token", cookie.Value)
+ if rr := serve(h, req); rr.Code != http.StatusOK {
+  t.Fatalf("double-submit POST: %d", rr.Code)
+ }
+ req = newReqWithCookie(http.MethodPost, "/", cookie)
+ req.Header.Set("X-CSRF-Token", cookie.Value+"x")
+ if rr := serve(h, req); rr.Code != http.StatusTeapot {
+  t.Fatalf("mismatched token: %d", rr.Code)
+ }
+
+ // A cookie the attacker made up is not signed with CSRFKey.
+ forged := &http.Cookie{Name: "session_csrf", Value: "attacker.c2lnbmF0dXJl"}
+ req = newReqWithCookie(http.MethodPost, "/", forged)
+ req.Header.Set("X-CSRF-Token", forged.Value)
+ if rr := serve(h, req); rr.Code != http.StatusTeapot || failed != 2 {
+  t.Fatalf("forged cookie: %d (failures %d)", rr.Code, failed)
+ }
+}
+
+func TestCSRFStatelessSessionBinding(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionMode = StatelessSessions
+  c.SessionKeys = []SessionKey{testSessionKey("k1", 1)}
+ })
+ defer cleanup()
+ _, _ = api.Register(context.Background(), "bob@example.com", "password123")
+ h := csrfEcho(api)
+
+ anon := serve(h, httptest.NewRequest(http.MethodGet, "/", nil)).Result().Cookies()[0]
+ session := mustLogin(t, api, "bob@example.com", "password123")
+
+ // The anonymous cookie is not valid for the signed-in user.
+ req := newReqWithCookie(http.MethodPost, "/", session)
+ req.AddCookie(anon)
+ req.Header.Set("X-CSRF-Token", anon.Value)
+ rr := serve(h, req)
+ if rr.Code != http.StatusForbidden {
+  t.Fatalf("anonymous token after sign-in: %d", rr.Code)
+ }
+ fresh := rr.Result().Cookies()[0]
+
+ req = newReqWithCookie(http.MethodPost, "/", session)
+ req.AddCookie(fresh)
+ req.Header.Set("X-CSRF-Token", fresh.Value)
+ if rr := serve(h, req); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), ".") {
+  t.Fatalf("session-bound token: %d", rr.Code)
+ }
+}
+
+func TestCSRFSkipsJWTRequests(t *testing.T) {
+ api, cleanup := newJWTTestAPI(t, EdDSA)
+ defer cleanup()
+ u, err := api.Register(context.Background(), "jwt-csrf@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ pair, err := api.IssueTokenPair(context.Background(), u.ID)
+ if err != nil {
+  t.Fatalf("IssueTokenPair: %v", err)
+ }
+ h := api.JWTMiddleware(api.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  user, _ := FromContext(r.Context())
+  _, _ = w.Write([]byte(user.Email))
+ })))
+
+ // A JWT carries no ambient credentials, so a POST needs no CSRF token.
+ if rr := serve(h, newReqWithBearer(http.MethodPost, "/", pair.AccessToken)); rr.Code != http.StatusOK || rr.Body.String() != u.Email {
+  t.Fatalf("JWT POST: %d %q", rr.Code, rr.Body.String())
+ }
+ // An invalid token leaves the request anonymous, which is still checked.
+ if rr := serve(h, newReqWithBearer(http.MethodPost, "/", pair.AccessToken+"x")); rr.Code != http.StatusForbidden {
+  t.Fatalf("invalid JWT POST: %d", rr.Code)
+ }
+}
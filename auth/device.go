@@ -0,0 +1,529 @@
+package auth
+
+import (
+ "context"
+ "crypto/rand"
+ "crypto/sha256"
+ "crypto/subtle"
+ "database/sql"
+ "errors"
+ "fmt"
+ "html/template"
+ "math/big"
+ "net/http"
+ "net/url"
+ "strings"
+ "time"
+)
+
+// deviceCodeGrantType is the grant_type polled at DeviceTokenHandler.
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// User codes are typed by people: 8 characters from an alphabet without vowels
+// (no accidental words) or look-alikes, shown as XXXX-XXXX. 20^8 codes plus the
+// short lifetime and the need for a signed-in browser make guessing impractical.
+const (
+ userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+ userCodeLen      = 8
+)
+
+// Device code states.
+const (
+ devicePending = iota
+ deviceApproved
+ deviceDenied
+)
+
+var defaultDeviceTemplate = template.Must(template.New("device").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>Device sign-in</title></head>
+<body>
+{{if eq .Stage "approved"}}<p>Device approved. You can return to your device.</p>
+{{else if eq .Stage "denied"}}<p>Request denied.</p>
+{{else if eq .Stage "confirm"}}<form method="post" action="{{.Action}}">
+<p>Sign in <strong>{{.ClientName}}</strong> as {{.User.Email}}?</p>
+<p>Only continue if your device shows the code <strong>{{.UserCode}}</strong>.</p>
+{{if .Scopes}}<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<input type="hidden" name="confirm" value="{{.Confirm}}">
+<button type="submit" name="decision" value="allow">Approve</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+{{else}}<form method="get" action="{{.Action}}">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<label>Enter the code shown on your device <input name="user_code" autocomplete="off" autofocus></label>
+<button type="submit">Continue</button>
+</form>
+{{end}}
+</body></html>
+`))
+
+func checkDeviceAuthConfig(cfg *DeviceAuthConfig, transports Transport) error {
+ if cfg == nil {
+  return nil
+ }
+ u, err := url.Parse(cfg.VerificationURL)
+ if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+  return fmt.Errorf("DeviceAuth.VerificationURL must be an absolute URL")
+ }
+ // Refuse to issue tokens Middleware would not accept.
+ if cfg.IssueAccessTokens && transports&TransportAccessToken == 0 {
+  return fmt.Errorf("DeviceAuth.IssueAccessTokens requires TransportAccessToken")
+ }
+ if !cfg.IssueAccessTokens && transports&TransportBearer == 0 {
+  return fmt.Errorf("DeviceAuth requires TransportBearer unless IssueAccessTokens is set")
+ }
+ return nil
+}
+
+// Device authorization endpoint.
+
+func (a *API) deviceAuthorizationHandlerInternal() http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  cfg := a.cfg.DeviceAuth
+  if cfg == nil {
+   http.NotFound(w, r)
+   return
+  }
+  if r.Method != http.MethodPost {
+   w.Header().Set("Allow", "POST")
+   http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+   return
+  }
+  client, err := a.authenticateOAuthClient(r)
+  if err != nil {
+   if _, ok := err.(*oauthError); !ok {
+    a.logError(r.Context(), "device authorization failed", err)
+   }
+   writeOAuthError(w, err)
+   return
+  }
+  scope := grantedScopes(r.PostFormValue("scope"), client.Scopes)
+  deviceCode, userCode, err := a.createDeviceCode(r.Context(), client.ID, scope)
+  if err != nil {
+   a.logError(r.Context(), "device authorization failed", err)
+   writeOAuthError(w, err)
+   return
+  }
+  display := userCode[:userCodeLen/2] + "-" + userCode[userCodeLen/2:]
+  complete, _ := url.Parse(cfg.VerificationURL)
+  q := complete.Query()
+  q.Set("user_code", display)
+  complete.RawQuery = q.Encode()
+  w.Header().Set("Cache-Control", "no-store")
+  writeJSON(w, http.StatusOK, map[string]any{
+   "device_code":               deviceCode,
+   "user_code":                 display,
+   "verification_uri":          cfg.VerificationURL,
+   "verification_uri_complete": complete.String(),
+   "expires_in":                int64(cfg.CodeTTL.Seconds()),
+   "interval":                  int64(cfg.Interval.Seconds()),
+  })
+ })
+}
+
+func (a *API) createDeviceCode(ctx context.Context, clientID, scope string) (string, string, error) {
+ cfg := a.cfg.DeviceAuth
+ now := a.now()
+ for attempts := 0; attempts < 3; attempts++ {
+  deviceCode, err := newSessionToken()
+  if err != nil {
+   return "", "", err
+  }
+  userCode, err := newUserCode()
+  if err != nil {
+   return "", "", err
+  }
+  sum := sha256.Sum256([]byte(deviceCode))
+  _, err = a.db.ExecContext(ctx, `
+   INSERT INTO device_codes (device_code_hash, user_code, client_id, scope, poll_interval, created_at, expires_at)
+   VALUES (?, ?, ?, ?, ?, ?, ?)
+  `, sum[:], userCode, clientID, scope, int64(cfg.Interval.Seconds()), now.Unix(), now.Add(cfg.CodeTTL).Unix())
+  if err != nil {
+   if strings.Contains(strings.ToLower(err.Error()), "unique") {
+    continue // retry on unlikely collision
+   }
+   return "", "", fmt.Errorf("insert device code: %w", err)
+  }
+  return deviceCode, userCode, nil
+ }
+ return "", "", fmt.Errorf("could not create unique device code after retries")
+}
+
+// grantedScopes keeps the requested scopes that are in allowed, without duplicates.
+func grantedScopes(requested string, allowed []string) string {
+ var scopes []string
+ for _, s := range strings.Fields(requested) {
+  if containsString(allowed, s) && !containsString(scopes, s) {
+   scopes = append(scopes, s)
+  }
+ }
+ return strings.Join(scopes, " ")
+}
+
+func newUserCode() (string, error) {
+ max := big.NewInt(int64(len(userCodeAlphabet)))
+ b := make([]byte, userCodeLen)
+ for i := range b {
+  n, err := rand.Int(rand.Reader, max)
+  if err != nil {
+   return "", err
+  }
+  b[i] = userCodeAlphabet[n.Int64()]
+ }
+ return string(b), nil
+}
+
+// normalizeUserCode accepts codes as typed: any case, with or without separators.
+func normalizeUserCode(s string) string {
+ var b strings.Builder
+ for _, c := range strings.ToUpper(s) {
+  if strings.ContainsRune(userCodeAlphabet, c) {
+   b.WriteRune(c)
+  }
+ }
+ return b.String()
+}
+
+// Token endpoint.
+
+func (a *API) deviceTokenHandlerInternal() http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if a.cfg.DeviceAuth == nil {
+   http.NotFound(w, r)
+   return
+  }
+  if r.Method != http.MethodPost {
+   w.Header().Set("Allow", "POST")
+   http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+   return
+  }
+  if r.PostFormValue("grant_type") != deviceCodeGrantType {
+   writeOAuthError(w, &oauthError{http.StatusBadRequest, "unsupported_grant_type", ""})
+   return
+  }
+  client, err := a.authenticateOAuthClient(r)
+  var resp map[string]any
+  if err == nil {
+   resp, err = a.pollDeviceCode(r.Context(), r.PostFormValue("device_code"), client.ID)
+  }
+  if err != nil {
+   if _, ok := err.(*oauthError); !ok {
+    a.logError(r.Context(), "device token endpoint failed", err)
+   }
+   writeOAuthError(w, err)
+   return
+  }
+  w.Header().Set("Cache-Control", "no-store")
+  writeJSON(w, http.StatusOK, resp)
+ })
+}
+
+// pollDeviceCode answers one poll of the token endpoint. Polling faster than the
+// interval earns slow_down and a 5 second longer interval (RFC 8628 §3.5). An
+// approved code is consumed and exchanged for a token exactly once.
+func (a *API) pollDeviceCode(ctx context.Context, deviceCode, clientID string) (map[string]any, error) {
+ invalid := &oauthError{http.StatusBadRequest, "invalid_grant", ""}
+ sum := sha256.Sum256([]byte(deviceCode))
+ now := a.now().Unix()
+
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return nil, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var (
+  rowClient, scope          string
+  userID, userCreated       sql.NullInt64
+  userEmail                 sql.NullString
+  status                    int
+  interval, lastPolled, exp int64
+ )
+ err = tx.QueryRowContext(ctx, `
+  SELECT d.client_id, d.scope, d.user_id, u.email, u.created_at, d.status, d.poll_interval, d.last_polled_at, d.expires_at
+  FROM device_codes d LEFT JOIN users u ON u.id = d.user_id
+  WHERE d.device_code_hash = ?
+ `, sum[:]).Scan(&rowClient, &scope, &userID, &userEmail, &userCreated, &status, &interval, &lastPolled, &exp)
+ if errors.Is(err, sql.ErrNoRows) {
+  return nil, invalid
+ }
+ if err != nil {
+  return nil, fmt.Errorf("query device code: %w", err)
+ }
+ if rowClient != clientID {
+  return nil, invalid
+ }
+ if now >= exp {
+  return nil, &oauthError{http.StatusBadRequest, "expired_token", ""}
+ }
+
+ switch status {
+ case deviceDenied:
+  if _, err := tx.ExecContext(ctx, `DELETE FROM device_codes WHERE device_code_hash = ?`, sum[:]); err != nil {
+   return nil, fmt.Errorf("delete device code: %w", err)
+  }
+  if err := tx.Commit(); err != nil {
+   return nil, fmt.Errorf("commit: %w", err)
+  }
+  return nil, &oauthError{http.StatusBadRequest, "access_denied", ""}
+ case deviceApproved:
+  // BeforeLogin must not run inside the transaction.
+  _ = tx.Rollback()
+  user := User{ID: userID.Int64, Email: userEmail.String, CreatedAt: time.Unix(userCreated.Int64, 0)}
+  return a.redeemDeviceCode(ctx, sum[:], user, rowClient, scope)
+ }
+
+ pending := &oauthError{http.StatusBadRequest, "authorization_pending", ""}
+ if lastPolled != 0 && now-lastPolled < interval {
+  interval += 5
+  pending = &oauthError{http.StatusBadRequest, "slow_down", ""}
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE device_codes SET last_polled_at = ?, poll_interval = ? WHERE device_code_hash = ?
+ `, now, interval, sum[:]); err != nil {
+  return nil, fmt.Errorf("update device code: %w", err)
+ }
+ if err := tx.Commit(); err != nil {
+  return nil, fmt.Errorf("commit: %w", err)
+ }
+ return nil, pending
+}
+
+// redeemDeviceCode consults BeforeLogin for an approved code, then consumes the
+// code in the transaction that issues the token: if issuing fails, the approval
+// stays for the next poll. A veto consumes the code and denies access.
+func (a *API) redeemDeviceCode(ctx context.Context, hash []byte, user User, clientID, scope string) (map[string]any, error) {
+ if err := a.beforeLogin(ctx, user); err != nil {
+  a.recordSignIn(ctx, "device", user, err)
+  if _, err := a.db.ExecContext(ctx, `DELETE FROM device_codes WHERE device_code_hash = ?`, hash); err != nil {
+   return nil, fmt.Errorf("delete device code: %w", err)
+  }
+  return nil, &oauthError{http.StatusBadRequest, "access_denied", ""}
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return nil, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ // Another poll may have redeemed the code while the hook ran.
+ res, err := tx.ExecContext(ctx, `
+  DELETE FROM device_codes WHERE device_code_hash = ? AND status = ?
+ `, hash, deviceApproved)
+ if err != nil {
+  return nil, fmt.Errorf("delete device code: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return nil, &oauthError{http.StatusBadRequest, "invalid_grant", ""}
+ }
+ resp, err := a.issueDeviceToken(ctx, tx, user.ID, clientID, scope)
+ if err != nil {
+  return nil, err
+ }
+ if err := tx.Commit(); err != nil {
+  return nil, fmt.Errorf("commit: %w", err)
+ }
+ a.recordSignIn(ctx, "device", user, nil)
+ return resp, nil
+}
+
+// issueDeviceToken issues the token for an approved code within tx. Session tokens
+// act as the full user; only access tokens are limited to scope.
+func (a *API) issueDeviceToken(ctx context.Context, tx txHandle, userID int64, clientID, scope string) (map[string]any, error) {
+ cfg := a.cfg.DeviceAuth
+ if cfg.IssueAccessTokens {
+  token, _, err := a.insertAccessTokenTx(ctx, tx, userID, "Device sign-in: "+clientID, strings.Fields(scope), cfg.AccessTokenExpiry)
+  if err != nil {
+   return nil, err
+  }
+  return map[string]any{
+   "access_token": token,
+   "token_type":   "Bearer",
+   "scope":        scope,
+   "expires_in":   int64(cfg.AccessTokenExpiry.Seconds()),
+  }, nil
+ }
+ token, expiresAt, err := a.createSessionTx(ctx, tx, userID)
+ if err != nil {
+  return nil, err
+ }
+ return map[string]any{
+  "access_token": token,
+  "token_type":   "Bearer",
+  "expires_in":   expiresAt - a.now().Unix(),
+ }, nil
+}
+
+// Approval page.
+
+// deviceRequest is a pending device code as shown on the approval page.
+type deviceRequest struct {
+ userCode   string
+ clientID   string
+ clientName string
+ scope      string
+}
+
+// pendingDeviceCode looks up an unexpired, undecided code by its user code.
+func (a *API) pendingDeviceCode(ctx context.Context, userCode string) (deviceRequest, bool, error) {
+ req := deviceRequest{userCode: normalizeUserCode(userCode)}
+ if len(req.userCode) != userCodeLen {
+  return deviceRequest{}, false, nil
+ }
+ err := a.db.QueryRowContext(ctx, `
+  SELECT d.client_id, c.name, d.scope FROM device_codes d JOIN oauth_clients c ON c.id = d.client_id
+  WHERE d.user_code = ? AND d.status = ? AND d.expires_at > ?
+ `, req.userCode, devicePending, a.now().Unix()).Scan(&req.clientID, &req.clientName, &req.scope)
+ if errors.Is(err, sql.ErrNoRows) {
+  return deviceRequest{}, false, nil
+ }
+ if err != nil {
+  return deviceRequest{}, false, fmt.Errorf("query device code: %w", err)
+ }
+ return req, true, nil
+}
+
+// decideDeviceCode records userID's decision on a pending code. With a non-nil
+// confirm, the decision must come with the nonce shown to that same user on the
+// confirmation page.
+func (a *API) decideDeviceCode(ctx context.Context, userID int64, userCode string, confirm []byte, approve bool) error {
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ code := normalizeUserCode(userCode)
+ var (
+  confirmHash []byte
+  confirmUser sql.NullInt64
+ )
+ err = tx.QueryRowContext(ctx, `
+  SELECT confirm_hash, confirm_user_id FROM device_codes
+  WHERE user_code = ? AND status = ? AND expires_at > ?
+ `, code, devicePending, a.now().Unix()).Scan(&confirmHash, &confirmUser)
+ if errors.Is(err, sql.ErrNoRows) {
+  return ErrInvalidUserCode
+ }
+ if err != nil {
+  return fmt.Errorf("query device code: %w", err)
+ }
+ if confirm != nil {
+  sum := sha256.Sum256(confirm)
+  if confirmUser.Int64 != userID || subtle.ConstantTimeCompare(sum[:], confirmHash) != 1 {
+   return ErrInvalidUserCode
+  }
+ }
+ status := deviceDenied
+ if approve {
+  status = deviceApproved
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE device_codes SET status = ?, user_id = ? WHERE user_code = ?
+ `, status, userID, code); err != nil {
+  return fmt.Errorf("update device code: %w", err)
+ }
+ return tx.Commit()
+}
+
+// approveDeviceCodeInternal approves a code for a custom approval UI, which is
+// responsible for its own confirmation and CSRF protection.
+func (a *API) approveDeviceCodeInternal(ctx context.Context, userID int64, userCode string) error {
+ if a.cfg.DeviceAuth == nil {
+  return errDeviceAuthDisabled
+ }
+ return a.decideDeviceCode(ctx, userID, userCode, nil, true)
+}
+
+// deviceApprovalHandlerInternal serves the verification page: GET asks for a user
+// code and then for confirmation; POST records the decision. The confirmation
+// form carries a nonce bound to the user, so other sites cannot submit it.
+func (a *API) deviceApprovalHandlerInternal() http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  cfg := a.cfg.DeviceAuth
+  if cfg == nil {
+   http.NotFound(w, r)
+   return
+  }
+  ctx := r.Context()
+  user, ok := fromContext(ctx)
+  if _, browser := sessionFromContext(ctx); !ok || !browser {
+   a.unauthorized(w, r)
+   return
+  }
+  page := DevicePage{User: user, Action: cfg.VerificationURL, Stage: "enter"}
+  switch r.Method {
+  case http.MethodGet:
+   code := r.URL.Query().Get("user_code")
+   if code == "" {
+    break
+   }
+   req, found, err := a.pendingDeviceCode(ctx, code)
+   if err != nil {
+    a.logError(ctx, "device approval failed", err)
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   }
+   if !found {
+    page.Error = "That code is invalid or has expired."
+    break
+   }
+   confirm, err := newSessionToken()
+   if err != nil {
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   }
+   sum := sha256.Sum256([]byte(confirm))
+   if _, err := a.db.ExecContext(ctx, `
+    UPDATE device_codes SET confirm_hash = ?, confirm_user_id = ? WHERE user_code = ?
+   `, sum[:], user.ID, req.userCode); err != nil {
+    a.logError(ctx, "device approval failed", err)
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   }
+   page.Stage, page.Confirm = "confirm", confirm
+   page.UserCode = req.userCode[:userCodeLen/2] + "-" + req.userCode[userCodeLen/2:]
+   page.ClientID, page.ClientName, page.Scopes = req.clientID, req.clientName, strings.Fields(req.scope)
+  case http.MethodPost:
+   approve := r.PostFormValue("decision") == "allow"
+   err := a.decideDeviceCode(ctx, user.ID, r.PostFormValue("user_code"), []byte(r.PostFormValue("confirm")), approve)
+   switch {
+   case errors.Is(err, ErrInvalidUserCode):
+    page.Error = "That code is invalid or has expired."
+   case err != nil:
+    a.logError(ctx, "device approval failed", err)
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   case approve:
+    page.Stage = "approved"
+   default:
+    page.Stage = "denied"
+   }
+  default:
+   w.Header().Set("Allow", "GET, POST")
+   http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+   return
+  }
+  tmpl := cfg.Template
+  if tmpl == nil {
+   tmpl = defaultDeviceTemplate
+  }
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.Header().Set("Cache-Control", "no-store")
+  w.Header().Set("X-Frame-Options", "DENY")
+  if err := tmpl.Execute(w, page); err != nil {
+   a.logError(ctx, "device template failed", err)
+  }
+ })
+}
+
+// pruneDeviceCodesInternal deletes device codes that expired a CodeTTL ago; until
+// then polls keep receiving expired_token rather than invalid_grant.
+func (a *API) pruneDeviceCodesInternal(ctx context.Context) error {
+ if a.cfg.DeviceAuth == nil {
+  return nil
+ }
+ _, err := a.db.ExecContext(ctx, `
+  DELETE FROM device_codes WHERE expires_at <= ?
+ `, a.now().Add(-a.cfg.DeviceAuth.CodeTTL).Unix())
+ return err
+}
+
+var errDeviceAuthDisabled = errors.New("device authorization is not configured")
@@ -0,0 +1,308 @@
+package auth
+
+import (
+ "context"
+ "encoding/json"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "regexp"
+ "strings"
+ "testing"
+ "time"
+)
+
+func postForm(h http.Handler, target string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+ req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+ req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+ if cookie != nil {
+  req.AddCookie(cookie)
+ }
+ rr := httptest.NewRecorder()
+ h.ServeHTTP(rr, req)
+ return rr
+}
+
+func decodeJSON(t *testing.T, rr *httptest.ResponseRecorder) map[string]any {
+ t.Helper()
+ var body map[string]any
+ if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+  t.Fatalf("decode %q: %v", rr.Body.String(), err)
+ }
+ return body
+}
+
+// registerDeviceClient registers a public device flow client allowed scopes.
+func registerDeviceClient(t *testing.T, api *API, scopes ...string) string {
+ t.Helper()
+ c, _, err := api.RegisterOAuthClient(context.Background(), OAuthClient{Name: "Acme CLI", Public: true, Scopes: scopes})
+ if err != nil {
+  t.Fatalf("RegisterOAuthClient: %v", err)
+ }
+ return c.ID
+}
+
+// startDeviceFlow requests a device code and returns the device and user codes.
+func startDeviceFlow(t *testing.T, api *API, clientID, scope string) (string, string) {
+ t.Helper()
+ rr := postForm(api.DeviceAuthorizationHandler(), "/device/code", url.Values{"client_id": {clientID}, "scope": {scope}}, nil)
+ body := decodeJSON(t, rr)
+ if rr.Code != http.StatusOK || body["device_code"] == nil || body["interval"] != float64(5) {
+  t.Fatalf("device authorization: %d %v", rr.Code, body)
+ }
+ if !strings.HasPrefix(body["verification_uri_complete"].(string), "https://app.example/device?user_code=") {
+  t.Fatalf("verification_uri_complete: %v", body["verification_uri_complete"])
+ }
+ return body["device_code"].(string), body["user_code"].(string)
+}
+
+func pollDevice(t *testing.T, api *API, clientID, deviceCode string) (int, map[string]any) {
+ t.Helper()
+ rr := postForm(api.DeviceTokenHandler(), "/device/token", url.Values{
+  "grant_type": {deviceCodeGrantType}, "device_code": {deviceCode}, "client_id": {clientID},
+ }, nil)
+ return rr.Code, decodeJSON(t, rr)
+}
+
+var deviceConfirmPattern = regexp.MustCompile(`name="confirm" value="([^"]+)"`)
+
+// approveDevice walks the approval page as the signed-in owner of session.
+func approveDevice(t *testing.T, api *API, session *http.Cookie, userCode string) {
+ t.Helper()
+ page := api.Middleware(api.DeviceApprovalHandler())
+ rr := httptest.NewRecorder()
+ page.ServeHTTP(rr, newReqWithCookie(http.MethodGet, "/device?user_code="+url.QueryEscape(userCode), session))
+ m := deviceConfirmPattern.FindStringSubmatch(rr.Body.String())
+ if rr.Code != http.StatusOK || m == nil {
+  t.Fatalf("confirmation page: %d %s", rr.Code, rr.Body.String())
+ }
+ rr = postForm(page, "/device", url.Values{"user_code": {userCode}, "confirm": {m[1]}, "decision": {"allow"}}, session)
+ if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "Device approved") {
+  t.Fatalf("approval: %d %s", rr.Code, rr.Body.String())
+ }
+}
+
+func TestDeviceFlowIssuesBearerSession(t *testing.T) {
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device"}
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+ client := registerDeviceClient(t, api)
+ user, _ := api.Register(context.Background(), "alice@example.com", "password123")
+ session := mustLogin(t, api, "alice@example.com", "password123")
+
+ deviceCode, userCode := startDeviceFlow(t, api, client, "")
+ if status, body := pollDevice(t, api, client, deviceCode); status != http.StatusBadRequest || body["error"] != "authorization_pending" {
+  t.Fatalf("first poll: %d %v", status, body)
+ }
+ if _, body := pollDevice(t, api, client, deviceCode); body["error"] != "slow_down" {
+  t.Fatalf("fast poll: %v", body)
+ }
+
+ // Codes are accepted as typed.
+ approveDevice(t, api, session, strings.ToLower(strings.ReplaceAll(userCode, "-", "")))
+
+ now = now.Add(10 * time.Second)
+ status, body := pollDevice(t, api, client, deviceCode)
+ if status != http.StatusOK || body["token_type"] != "Bearer" {
+  t.Fatalf("approved poll: %d %v", status, body)
+ }
+ got, ok, err := api.CurrentUser(httptest.NewRecorder(), newReqWithBearer(http.MethodGet, "/", body["access_token"].(string)))
+ if err != nil || !ok || got.ID != user.ID {
+  t.Fatalf("bearer session: %+v %v %v", got, ok, err)
+ }
+
+ now = now.Add(time.Minute)
+ if _, body := pollDevice(t, api, client, deviceCode); body["error"] != "invalid_grant" {
+  t.Fatalf("code exchanged twice: %v", body)
+ }
+}
+
+func TestDeviceFlowIssuesAccessToken(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportAccessToken
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device", IssueAccessTokens: true}
+ })
+ defer cleanup()
+ ctx := context.Background()
+ user, _ := api.Register(ctx, "bob@example.com", "password123")
+ client := registerDeviceClient(t, api, "repo:read", "repo:write")
+
+ // Scopes the client is not registered for are dropped.
+ deviceCode, userCode := startDeviceFlow(t, api, client, "repo:read admin repo:read")
+ if err := api.ApproveDeviceCode(ctx, user.ID, userCode); err != nil {
+  t.Fatalf("ApproveDeviceCode: %v", err)
+ }
+ if err := api.ApproveDeviceCode(ctx, user.ID, userCode); err != ErrInvalidUserCode {
+  t.Fatalf("approving twice: %v", err)
+ }
+ status, body := pollDevice(t, api, client, deviceCode)
+ if status != http.StatusOK || !strings.HasPrefix(body["access_token"].(string), accessTokenPrefix) {
+  t.Fatalf("approved poll: %d %v", status, body)
+ }
+ tokens, _ := api.ListAccessTokens(ctx, user.ID)
+ if len(tokens) != 1 || len(tokens[0].Scopes) != 1 || tokens[0].Scopes[0] != "repo:read" {
+  t.Fatalf("access tokens: %+v", tokens)
+ }
+ if body["scope"] != "repo:read" || body["expires_in"] != float64(90*24*60*60) || tokens[0].ExpiresAt.IsZero() {
+  t.Fatalf("token response %v, token %+v", body, tokens[0])
+ }
+}
+
+func TestDeviceFlowExpiryAndDenial(t *testing.T) {
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device"}
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+ client := registerDeviceClient(t, api)
+ _, _ = api.Register(context.Background(), "carol@example.com", "password123")
+ session := mustLogin(t, api, "carol@example.com", "password123")
+ page := api.Middleware(api.DeviceApprovalHandler())
+
+ deviceCode, userCode := startDeviceFlow(t, api, client, "")
+ rr := httptest.NewRecorder()
+ page.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/device?user_code="+userCode, nil))
+ if rr.Code != http.StatusUnauthorized {
+  t.Fatalf("signed-out approval page: %d", rr.Code)
+ }
+ // A forged form without the confirmation nonce changes nothing.
+ rr = postForm(page, "/device", url.Values{"user_code": {userCode}, "decision": {"allow"}}, session)
+ if !strings.Contains(rr.Body.String(), "invalid or has expired") {
+  t.Fatalf("forged approval: %d %s", rr.Code, rr.Body.String())
+ }
+
+ rr = httptest.NewRecorder()
+ page.ServeHTTP(rr, newReqWithCookie(http.MethodGet, "/device?user_code="+userCode, session))
+ m := deviceConfirmPattern.FindStringSubmatch(rr.Body.String())
+ if m == nil {
+  t.Fatalf("confirmation page: %s", rr.Body.String())
+ }
+ postForm(page, "/device", url.Values{"user_code": {userCode}, "confirm": {m[1]}, "decision": {"deny"}}, session)
+ if _, body := pollDevice(t, api, client, deviceCode); body["error"] != "access_denied" {
+  t.Fatalf("denied poll: %v", body)
+ }
+
+ deviceCode, _ = startDeviceFlow(t, api, client, "")
+ now = now.Add(11 * time.Minute)
+ if _, body := pollDevice(t, api, client, deviceCode); body["error"] != "expired_token" {
+  t.Fatalf("expired poll: %v", body)
+ }
+}
+
+func TestDeviceFlowClients(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device"}
+ })
+ defer cleanup()
+ ctx := context.Background()
+ confidential, secret, err := api.RegisterOAuthClient(ctx, OAuthClient{Name: "Build agent"})
+ if err != nil || secret == "" {
+  t.Fatalf("RegisterOAuthClient: %v", err)
+ }
+
+ for name, form := range map[string]url.Values{
+  "unknown client": {"client_id": {"made-up-app"}},
+  "missing secret": {"client_id": {confidential.ID}},
+  "wrong secret":   {"client_id": {confidential.ID}, "client_secret": {"nope"}},
+ } {
+  rr := postForm(api.DeviceAuthorizationHandler(), "/device/code", form, nil)
+  if body := decodeJSON(t, rr); rr.Code != http.StatusUnauthorized || body["error"] != "invalid_client" {
+   t.Fatalf("%s: %d %v", name, rr.Code, body)
+  }
+ }
+ rr := postForm(api.DeviceAuthorizationHandler(), "/device/code", url.Values{"client_id": {confidential.ID}, "client_secret": {secret}}, nil)
+ if rr.Code != http.StatusOK {
+  t.Fatalf("confidential client: %d %s", rr.Code, rr.Body.String())
+ }
+ deviceCode := decodeJSON(t, rr)["device_code"].(string)
+ // Polls authenticate the client too.
+ if status, body := pollDevice(t, api, confidential.ID, deviceCode); status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+  t.Fatalf("poll without secret: %d %v", status, body)
+ }
+
+ // Tokens Middleware would reject are refused when the API is created.
+ for _, c := range []Config{
+  {DBPath: ":memory:", DeviceAuth: &DeviceAuthConfig{VerificationURL: "https://app.example/device"}},
+  {DBPath: ":memory:", SessionTransports: TransportBearer, DeviceAuth: &DeviceAuthConfig{VerificationURL: "https://app.example/device", IssueAccessTokens: true}},
+ } {
+  if _, err := New(c); err == nil {
+   t.Fatalf("New accepted transports %b with %+v", c.SessionTransports, c.DeviceAuth)
+  }
+ }
+}
+
+func TestDeviceFlowKeepsApprovalWhenIssuingFails(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.MaxSessionsPerUser = 1
+  c.SessionLimitPolicy = RejectNewSession
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device"}
+ })
+ defer cleanup()
+ client := registerDeviceClient(t, api)
+ _, _ = api.Register(context.Background(), "dave@example.com", "password123")
+ session := mustLogin(t, api, "dave@example.com", "password123")
+
+ deviceCode, userCode := startDeviceFlow(t, api, client, "")
+ approveDevice(t, api, session, userCode)
+ if status, _ := pollDevice(t, api, client, deviceCode); status != http.StatusInternalServerError {
+  t.Fatalf("poll at the session limit: %d", status)
+ }
+ if err := api.Logout(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/logout", session)); err != nil {
+  t.Fatalf("Logout: %v", err)
+ }
+ if status, body := pollDevice(t, api, client, deviceCode); status != http.StatusOK || body["access_token"] == nil {
+  t.Fatalf("poll after the failure: %d %v", status, body)
+ }
+}
+
+func TestDeviceFlowRunsBeforeLogin(t *testing.T) {
+ var (
+  veto   bool
+  logins []string
+ )
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.DeviceAuth = &DeviceAuthConfig{VerificationURL: "https://app.example/device"}
+  c.Hooks.BeforeLogin = func(ctx context.Context, user User) error {
+   if veto {
+    return errors.New("suspended")
+   }
+   return nil
+  }
+  c.Hooks.OnLogin = func(ctx context.Context, user User) { logins = append(logins, user.Email) }
+ })
+ defer cleanup()
+ client := registerDeviceClient(t, api)
+ _, _ = api.Register(context.Background(), "erin@example.com", "password123")
+ session := mustLogin(t, api, "erin@example.com", "password123")
+ logins = nil
+
+ veto = true
+ deviceCode, userCode := startDeviceFlow(t, api, client, "")
+ approveDevice(t, api, session, userCode)
+ if status, body := pollDevice(t, api, client, deviceCode); status != http.StatusBadRequest || body["error"] != "access_denied" {
+  t.Fatalf("vetoed poll: %d %v", status, body)
+ }
+ if _, body := pollDevice(t, api, client, deviceCode); body["error"] != "invalid_grant" {
+  t.Fatalf("vetoed code kept: %v", body)
+ }
+
+ veto = false
+ deviceCode, userCode = startDeviceFlow(t, api, client, "")
+ approveDevice(t, api, session, userCode)
+ if status, _ := pollDevice(t, api, client, deviceCode); status != http.StatusOK {
+  t.Fatalf("approved poll: %d", status)
+ }
+ if len(logins) != 1 || logins[0] != "erin@example.com" {
+  t.Fatalf("OnLogin calls: %v", logins)
+ }
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+ "encoding/json"
+ "errors"
+ "io"
+ "log/slog"
+ "mime"
+ "net/http"
+ "strings"
+ "time"
+)
+
+// maxHandlerBody bounds JSON and form bodies accepted by the built-in handlers.
+const maxHandlerBody = 1 << 20
+
+// handlerInput is the request body of the built-in handlers, from JSON or a form.
+type handlerInput struct {
+ Email           string `json:"email"`
+ Password        string `json:"password"`
+ CurrentPassword string `json:"current_password"`
+ NewPassword     string `json:"new_password"`
+}
+
+// userJSON is the wire form of User in handler responses.
+type userJSON struct {
+ ID        int64     `json:"id"`
+ Email     string    `json:"email"`
+ CreatedAt time.Time `json:"created_at"`
+}
+
+func (a *API) handlerInternal() http.Handler {
+ mux := http.NewServeMux()
+ a.routesInternal(mux, "")
+ return mux
+}
+
+func (a *API) routesInternal(mux *http.ServeMux, prefix string) {
+ prefix = strings.TrimSuffix(prefix, "/")
+ mux.Handle(prefix+"/register", a.endpoint("register", http.MethodPost, a.handleRegister))
+ mux.Handle(prefix+"/login", a.endpoint("login", http.MethodPost, a.handleLogin))
+ mux.Handle(prefix+"/logout", a.endpoint("logout", http.MethodPost, a.handleLogout))
+ mux.Handle(prefix+"/me", a.endpoint("me", http.MethodGet, a.handleMe))
+ mux.Handle(prefix+"/password", a.endpoint("password", http.MethodPost, a.handleChangePassword))
+ mux.Handle(prefix+"/reauthenticate", a.endpoint("reauthenticate", http.MethodPost, a.handleReauthenticate))
+}
+
+// endpoint wraps a handler with method locking and, for POST, the origin check.
+// The handler returns the result to respond with.
+func (a *API) endpoint(name, method string, h func(w http.ResponseWriter, r *http.Request, in handlerInput) HandlerResult) http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  r = a.withClientInfo(r)
+  res := HandlerResult{Endpoint: name}
+  switch {
+  case r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead):
+   w.Header().Set("Allow", method)
+   res.Status, res.Err = http.StatusMethodNotAllowed, errMethodNotAllowed
+  case method == http.MethodPost && !a.handlerOriginAllowed(r):
+   res.Status, res.Err = http.StatusForbidden, ErrForbidden
+  default:
+   in, err := readHandlerInput(w, r)
+   if err != nil {
+    res.Status, res.Err = http.StatusBadRequest, err
+    break
+   }
+   res = h(w, r, in)
+   res.Endpoint = name
+   if res.Status >= http.StatusInternalServerError && res.Err != nil {
+    a.logError(r.Context(), "auth handler failed", res.Err, slog.String("endpoint", name))
+   }
+  }
+  a.respond(w, r, res)
+ })
+}
+
+// handlerOriginAllowed vets a POST. Requests without Origin or Referer come from
+// non-browser clients or old browsers; they pass when they send a JSON body or an
+// Authorization header, neither of which a cross-site page can send without a CORS
+// preflight.
+func (a *API) handlerOriginAllowed(r *http.Request) bool {
+ if r.Header.Get("Origin") == "" && r.Header.Get("Referer") == "" && (isJSONRequest(r) || r.Header.Get("Authorization") != "") {
+  return true
+ }
+ if p := a.cfg.Handlers.OriginPolicy; p != nil {
+  return p.Allowed(r)
+ }
+ return SameOrigin(r)
+}
+
+func readHandlerInput(w http.ResponseWriter, r *http.Request) (handlerInput, error) {
+ var in handlerInput
+ if r.Method != http.MethodPost {
+  return in, nil
+ }
+ r.Body = http.MaxBytesReader(w, r.Body, maxHandlerBody)
+ if isJSONRequest(r) {
+  if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+   return in, errBadRequestBody
+  }
+  return in, nil
+ }
+ var err error
+ if mediaType(r) == "multipart/form-data" {
+  err = r.ParseMultipartForm(maxHandlerBody)
+ } else {
+  err = r.ParseForm()
+ }
+ if err != nil {
+  return in, errBadRequestBody
+ }
+ in.Email = r.PostFormValue("email")
+ in.Password = r.PostFormValue("password")
+ in.CurrentPassword = r.PostFormValue("current_password")
+ in.NewPassword = r.PostFormValue("new_password")
+ return in, nil
+}
+
+func (a *API) handleRegister(w http.ResponseWriter, r *http.Request, in handlerInput) HandlerResult {
+ user, err := a.registerInternal(r.Context(), in.Email, in.Password)
+ if err != nil {
+  return a.handlerError(err)
+ }
+ if a.cfg.Handlers.SignInAfterRegister {
+  if err := a.signInRegistered(w, r.Context(), user); err != nil {
+   return a.handlerError(err)
+  }
+ }
+ return HandlerResult{Status: http.StatusCreated, User: user}
+}
+
+func (a *API) handleLogin(w http.ResponseWriter, r *http.Request, in handlerInput) HandlerResult {
+ user, err := a.loginInternal(w, r, in.Email, in.Password)
+ if err != nil {
+  return a.handlerError(err)
+ }
+ return HandlerResult{Status: http.StatusOK, User: user}
+}
+
+func (a *API) handleLogout(w http.ResponseWriter, r *http.Request, _ handlerInput) HandlerResult {
+ user, _, _ := a.currentUserInternal(w, r)
+ if err := a.logoutInternal(w, r); err != nil {
+  return a.handlerError(err)
+ }
+ return HandlerResult{Status: http.StatusNoContent, User: user}
+}
+
+func (a *API) handleMe(w http.ResponseWriter, r *http.Request, _ handlerInput) HandlerResult {
+ user, ok, err := a.currentUserInternal(w, r)
+ if err != nil {
+  return a.handlerError(err)
+ }
+ if !ok {
+  return a.handlerError(ErrNoSession)
+ }
+ return HandlerResult{Status: http.StatusOK, User: user}
+}
+
+// handleChangePassword verifies the current password, changes it (which signs out
+// every session) and signs the cookie client back in with a fresh session.
+func (a *API) handleChangePassword(w http.ResponseWriter, r *http.Request, in handlerInput) HandlerResult {
+ ctx := r.Context()
+ user, info, err := a.currentSession(w, r)
+ if err != nil {
+  return a.handlerError(err)
+ }
+ if _, err := a.authenticatePassword(ctx, user.Email, in.CurrentPassword); err != nil {
+  if errors.Is(err, ErrInvalidCredentials) {
+   return HandlerResult{Status: http.StatusForbidden, Err: err}
+  }
+  return a.handlerError(err)
+ }
+ if err := a.changePasswordInternal(ctx, user.ID, in.NewPassword); err != nil {
+  return a.handlerError(err)
+ }
+ if info.transport == TransportCookie {
+  if err := a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
+   return a.handlerError(err)
+  }
+ }
+ return HandlerResult{Status: http.StatusOK, User: user}
+}
+
+func (a *API) handleReauthenticate(w http.ResponseWriter, r *http.Request, in handlerInput) HandlerResult {
+ user, err := a.reauthenticatePasswordInternal(w, r, in.Password)
+ if errors.Is(err, ErrInvalidCredentials) {
+  return HandlerResult{Status: http.StatusForbidden, Err: err}
+ }
+ if err != nil {
+  return a.handlerError(err)
+ }
+ return HandlerResult{Status: http.StatusOK, User: user}
+}
+
+// handlerError maps err to a status code; endpoint logs the unexpected ones.
+func (a *API) handlerError(err error) HandlerResult {
+ status := http.StatusInternalServerError
+ switch {
+ case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrNoSession):
+  status = http.StatusUnauthorized
+ case errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrWeakPassword),
+  errors.Is(err, ErrEmailDomainNotAllowed), errors.Is(err, ErrDisposableEmail),
+  errors.Is(err, ErrRegistrationRejected):
+  status = http.StatusBadRequest
+ case errors.Is(err, ErrInviteRequired), errors.Is(err, ErrForbidden), errors.Is(err, ErrLoginRejected):
+  status = http.StatusForbidden
+ case errors.Is(err, ErrEmailTaken), errors.Is(err, ErrSessionLimitReached):
+  status = http.StatusConflict
+ }
+ return HandlerResult{Status: status, Err: err}
+}
+
+// respond lets the Respond hook write the response, else writes JSON or, for HTML
+// form posts, a redirect or short text.
+func (a *API) respond(w http.ResponseWriter, r *http.Request, res HandlerResult) {
+ if hook := a.cfg.Handlers.Respond; hook != nil && hook(w, r, res) {
+  return
+ }
+ msg := ""
+ if res.Err != nil {
+  msg = res.Err.Error()
+  if res.Status >= http.StatusInternalServerError {
+   msg = "internal error"
+  }
+ }
+ if isFormRequest(r) && !acceptsJSON(r) {
+  if res.Err != nil {
+   http.Error(w, msg, res.Status)
+   return
+  }
+  if a.cfg.Handlers.FormRedirect != "" {
+   http.Redirect(w, r, a.cfg.Handlers.FormRedirect, http.StatusSeeOther)
+   return
+  }
+  if res.Status == http.StatusNoContent {
+   w.WriteHeader(res.Status)
+   return
+  }
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.WriteHeader(res.Status)
+  _, _ = w.Write([]byte(http.StatusText(res.Status)))
+  return
+ }
+ w.Header().Set("Cache-Control", "no-store")
+ switch {
+ case res.Err != nil:
+  writeJSON(w, res.Status, map[string]string{"error": msg})
+ case res.Status == http.StatusNoContent:
+  w.WriteHeader(res.Status)
+ default:
+  u := res.User
+  writeJSON(w, res.Status, map[string]any{"user": userJSON{ID: u.ID, Email: u.Email, CreatedAt: u.CreatedAt.UTC()}})
+ }
+}
+
+func mediaType(r *http.Request) string {
+ mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+ return mt
+}
+
+func isJSONRequest(r *http.Request) bool {
+ return mediaType(r) == "application/json"
+}
+
+func isFormRequest(r *http.Request) bool {
+ mt := mediaType(r)
+ return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data"
+}
+
+func acceptsJSON(r *http.Request) bool {
+ return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+var (
+ errMethodNotAllowed = errors.New("method not allowed")
+ errBadRequestBody   = errors.New("malformed request body")
+)
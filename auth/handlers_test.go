@@ -0,0 +1,161 @@
+package auth
+
+import (
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "strings"
+ "testing"
+)
+
+// postJSON posts body as JSON from the request's own origin.
+func postJSON(h http.Handler, target, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+ req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+ req.Header.Set("Content-Type", "application/json")
+ req.Header.Set("Origin", "http://example.com")
+ if cookie != nil {
+  req.AddCookie(cookie)
+ }
+ return serve(h, req)
+}
+
+func sessionCookie(api *API, rr *httptest.ResponseRecorder) *http.Cookie {
+ for _, c := range rr.Result().Cookies() {
+  if c.Name == api.cfg.SessionName && c.Value != "" {
+   return c
+  }
+ }
+ return nil
+}
+
+func TestHandlersJSON(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+ mux := http.NewServeMux()
+ api.Routes(mux, "/auth/")
+
+ rr := postJSON(mux, "/auth/register", `{"email":"alice@example.com","password":"password123"}`, nil)
+ if body := decodeJSON(t, rr); rr.Code != http.StatusCreated || body["user"].(map[string]any)["email"] != "alice@example.com" {
+  t.Fatalf("register: %d %v", rr.Code, body)
+ }
+ if sessionCookie(api, rr) != nil {
+  t.Fatal("register signed in without SignInAfterRegister")
+ }
+ if rr := postJSON(mux, "/auth/register", `{"email":"alice@example.com","password":"password123"}`, nil); rr.Code != http.StatusConflict {
+  t.Fatalf("duplicate register: %d", rr.Code)
+ }
+ if rr := postJSON(mux, "/auth/register", `{"email":"bob@example.com","password":"short"}`, nil); rr.Code != http.StatusBadRequest {
+  t.Fatalf("weak password: %d", rr.Code)
+ }
+ if rr := postJSON(mux, "/auth/register", `{"email":`, nil); rr.Code != http.StatusBadRequest {
+  t.Fatalf("malformed body: %d", rr.Code)
+ }
+
+ if rr := postJSON(mux, "/auth/login", `{"email":"alice@example.com","password":"wrong-password"}`, nil); rr.Code != http.StatusUnauthorized ||
+  decodeJSON(t, rr)["error"] != ErrInvalidCredentials.Error() {
+  t.Fatalf("wrong password: %d %s", rr.Code, rr.Body.String())
+ }
+ rr = postJSON(mux, "/auth/login", `{"email":"alice@example.com","password":"password123"}`, nil)
+ session := sessionCookie(api, rr)
+ if rr.Code != http.StatusOK || session == nil {
+  t.Fatalf("login: %d %v", rr.Code, rr.Result().Cookies())
+ }
+
+ if rr := serve(mux, newReqWithCookie(http.MethodGet, "/auth/me", session)); rr.Code != http.StatusOK ||
+  decodeJSON(t, rr)["user"].(map[string]any)["email"] != "alice@example.com" {
+  t.Fatalf("me: %d %s", rr.Code, rr.Body.String())
+ }
+ if rr := serve(mux, httptest.NewRequest(http.MethodGet, "/auth/me", nil)); rr.Code != http.StatusUnauthorized {
+  t.Fatalf("me signed out: %d", rr.Code)
+ }
+ if rr := postJSON(mux, "/auth/me", `{}`, session); rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != http.MethodGet {
+  t.Fatalf("POST /me: %d %v", rr.Code, rr.Header())
+ }
+
+ if rr := postJSON(mux, "/auth/password", `{"current_password":"nope","new_password":"password456"}`, session); rr.Code != http.StatusForbidden {
+  t.Fatalf("wrong current password: %d", rr.Code)
+ }
+ rr = postJSON(mux, "/auth/password", `{"current_password":"password123","new_password":"password456"}`, session)
+ fresh := sessionCookie(api, rr)
+ if rr.Code != http.StatusOK || fresh == nil || fresh.Value == session.Value {
+  t.Fatalf("change password: %d %v", rr.Code, rr.Result().Cookies())
+ }
+ if rr := serve(mux, newReqWithCookie(http.MethodGet, "/auth/me", session)); rr.Code != http.StatusUnauthorized {
+  t.Fatalf("old session after password change: %d", rr.Code)
+ }
+
+ if rr := postJSON(mux, "/auth/reauthenticate", `{"password":"password123"}`, fresh); rr.Code != http.StatusForbidden {
+  t.Fatalf("reauthenticate with the old password: %d", rr.Code)
+ }
+ if rr := postJSON(mux, "/auth/reauthenticate", `{"password":"password456"}`, fresh); rr.Code != http.StatusOK {
+  t.Fatalf("reauthenticate: %d %s", rr.Code, rr.Body.String())
+ }
+
+ if rr := postJSON(mux, "/auth/logout", ``, fresh); rr.Code != http.StatusNoContent {
+  t.Fatalf("logout: %d", rr.Code)
+ }
+ if rr := serve(mux, newReqWithCookie(http.MethodGet, "/auth/me", fresh)); rr.Code != http.StatusUnauthorized {
+  t.Fatalf("me after logout: %d", rr.Code)
+ }
+}
+
+func TestHandlersRejectCrossOrigin(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+ h := api.Handler()
+
+ req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"email":"eve@example.com","password":"password123"}`))
+ req.Header.Set("Content-Type", "application/json")
+ req.Header.Set("Origin", "https://evil.example")
+ if rr := serve(h, req); rr.Code != http.StatusForbidden {
+  t.Fatalf("cross-origin register: %d", rr.Code)
+ }
+ // Without Origin or Referer the request cannot be attributed to this site.
+ if rr := postForm(h, "/login", url.Values{"email": {"eve@example.com"}}, nil); rr.Code != http.StatusForbidden {
+  t.Fatalf("unattributed login: %d", rr.Code)
+ }
+ // Non-browser JSON clients send neither; a cross-site page cannot send JSON
+ // without a preflight.
+ req = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"email":"cli@example.com","password":"password123"}`))
+ req.Header.Set("Content-Type", "application/json")
+ if rr := serve(h, req); rr.Code != http.StatusCreated {
+  t.Fatalf("unattributed JSON register: %d", rr.Code)
+ }
+}
+
+func TestHandlersFormPost(t *testing.T) {
+ var results []HandlerResult
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Handlers.SignInAfterRegister = true
+  c.Handlers.FormRedirect = "/dashboard"
+  c.Handlers.Respond = func(w http.ResponseWriter, r *http.Request, res HandlerResult) bool {
+   results = append(results, res)
+   if res.Err != nil && res.Endpoint == "login" {
+    http.Redirect(w, r, "/login?error=1", http.StatusSeeOther)
+    return true
+   }
+   return false
+  }
+ })
+ defer cleanup()
+ h := api.Handler()
+ form := func(target string, v url.Values) *httptest.ResponseRecorder {
+  req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(v.Encode()))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.Header.Set("Referer", "http://example.com/signup")
+  return serve(h, req)
+ }
+
+ rr := form("/register", url.Values{"email": {"carol@example.com"}, "password": {"password123"}})
+ if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/dashboard" || sessionCookie(api, rr) == nil {
+  t.Fatalf("form register: %d %v", rr.Code, rr.Header())
+ }
+ rr = form("/login", url.Values{"email": {"carol@example.com"}, "password": {"wrong-password"}})
+ if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login?error=1" {
+  t.Fatalf("failed form login: %d %v", rr.Code, rr.Header())
+ }
+ if len(results) != 2 || results[0].Endpoint != "register" || results[0].Status != http.StatusCreated ||
+  results[1].Status != http.StatusUnauthorized || results[1].Err != ErrInvalidCredentials {
+  t.Fatalf("hook results: %+v", results)
+ }
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+ "context"
+ "fmt"
+)
+
+// Config.Hooks are invoked through these helpers, on the caller's goroutine and
+// never while a transaction is open: the notifications after the change has
+// committed, beforeLogin before the session is written.
+
+func (a *API) hookRegister(ctx context.Context, user User) {
+ if h := a.cfg.Hooks.OnRegister; h != nil {
+  h(ctx, user)
+ }
+}
+
+// beforeLogin lets Hooks.BeforeLogin veto a sign-in whose credentials checked out.
+func (a *API) beforeLogin(ctx context.Context, user User) error {
+ if h := a.cfg.Hooks.BeforeLogin; h != nil {
+  if err := h(ctx, user); err != nil {
+   return fmt.Errorf("%w: %w", ErrLoginRejected, err)
+  }
+ }
+ return nil
+}
+
+func (a *API) hookLogin(ctx context.Context, user User) {
+ if h := a.cfg.Hooks.OnLogin; h != nil {
+  h(ctx, user)
+ }
+}
+
+func (a *API) hookLoginFailed(ctx context.Context, email string, err error) {
+ if h := a.cfg.Hooks.OnLoginFailed; h != nil {
+  h(ctx, email, err)
+ }
+}
+
+func (a *API) hookLogout(ctx context.Context, userID int64) {
+ if h := a.cfg.Hooks.OnLogout; h != nil {
+  h(ctx, userID)
+ }
+}
+
+func (a *API) hookPasswordChanged(ctx context.Context, userID int64) {
+ if h := a.cfg.Hooks.OnPasswordChanged; h != nil {
+  h(ctx, userID)
+ }
+}
+
+func (a *API) hookSessionRevoked(ctx context.Context, userID int64) {
+ if h := a.cfg.Hooks.OnSessionRevoked; h != nil {
+  h(ctx, userID)
+ }
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "fmt"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "reflect"
+ "testing"
+)
+
+func TestHooks(t *testing.T) {
+ var calls []string
+ var blocked string
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.Hooks = Hooks{
+   OnRegister: func(ctx context.Context, u User) { calls = append(calls, "register "+u.Email) },
+   BeforeLogin: func(ctx context.Context, u User) error {
+    if u.Email == blocked {
+     return errors.New("suspended")
+    }
+    return nil
+   },
+   OnLogin:       func(ctx context.Context, u User) { calls = append(calls, "login "+u.Email) },
+   OnLoginFailed: func(ctx context.Context, email string, err error) { calls = append(calls, "failed "+email) },
+   OnLogout:      func(ctx context.Context, id int64) { calls = append(calls, fmt.Sprint("logout ", id)) },
+   OnPasswordChanged: func(ctx context.Context, id int64) {
+    calls = append(calls, fmt.Sprint("password ", id))
+   },
+   OnSessionRevoked: func(ctx context.Context, id int64) { calls = append(calls, fmt.Sprint("revoked ", id)) },
+  }
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ user, err := api.Register(ctx, "alice@example.com", "password123")
+ if err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ if _, err := api.Register(ctx, "alice@example.com", "password123"); !errors.Is(err, ErrEmailTaken) {
+  t.Fatalf("duplicate Register: %v", err)
+ }
+ session := mustLogin(t, api, "alice@example.com", "password123")
+ if _, _, err := api.LoginToken(ctx, "alice@example.com", "wrong-password"); !errors.Is(err, ErrInvalidCredentials) {
+  t.Fatalf("wrong password: %v", err)
+ }
+ rr := httptest.NewRecorder()
+ if err := api.Logout(rr, newReqWithCookie(http.MethodPost, "/", session)); err != nil {
+  t.Fatalf("Logout: %v", err)
+ }
+ if err := api.ChangePassword(ctx, user.ID, "password456"); err != nil {
+  t.Fatalf("ChangePassword: %v", err)
+ }
+
+ want := []string{
+  "register alice@example.com",
+  "login alice@example.com",
+  "failed alice@example.com",
+  fmt.Sprint("logout ", user.ID),
+  fmt.Sprint("password ", user.ID),
+  fmt.Sprint("revoked ", user.ID),
+ }
+ if !reflect.DeepEqual(calls, want) {
+  t.Fatalf("hook calls:\n got %q\nwant %q", calls, want)
+ }
+
+ // A veto fails the sign-in before any session is issued.
+ calls, blocked = nil, "alice@example.com"
+ rr = httptest.NewRecorder()
+ _, err = api.Login(rr, httptest.NewRequest(http.MethodPost, "/", nil), "alice@example.com", "password456")
+ if !errors.Is(err, ErrLoginRejected) || err.Error() != "login rejected: suspended" {
+  t.Fatalf("vetoed Login: %v", err)
+ }
+ if len(rr.Result().Cookies()) != 0 {
+  t.Fatal("vetoed Login set a cookie")
+ }
+ if _, _, err := api.LoginToken(ctx, "alice@example.com", "password456"); !errors.Is(err, ErrLoginRejected) {
+  t.Fatalf("vetoed LoginToken: %v", err)
+ }
+ if want := []string{"failed alice@example.com", "failed alice@example.com"}; !reflect.DeepEqual(calls, want) {
+  t.Fatalf("veto hook calls: %q", calls)
+ }
+ var n int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE user_id = ?`, user.ID).Scan(&n); err != nil || n != 0 {
+  t.Fatalf("sessions after veto: %d (%v)", n, err)
+ }
+
+ // The built-in handlers answer a veto with 403.
+ res := postJSON(api.Handler(), "/login", `{"email":"alice@example.com","password":"password456"}`, nil)
+ if res.Code != http.StatusForbidden {
+  t.Fatalf("handler veto: %d", res.Code)
+ }
+}
+
+// Registering through the built-in pages or handlers does not skip BeforeLogin.
+func TestHooksVetoRegisterSignIn(t *testing.T) {
+ var logins []string
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Handlers.SignInAfterRegister = true
+  c.Hooks.BeforeLogin = func(ctx context.Context, u User) error {
+   if u.Email != "ok@example.com" {
+    return errors.New("suspended")
+   }
+   return nil
+  }
+  c.Hooks.OnLogin = func(ctx context.Context, u User) { logins = append(logins, u.Email) }
+ })
+ defer cleanup()
+
+ res := postJSON(api.Handler(), "/register", `{"email":"eve@example.com","password":"password123"}`, nil)
+ if res.Code != http.StatusForbidden || sessionCookie(api, res) != nil {
+  t.Fatalf("vetoed handler register: %d %v", res.Code, res.Result().Cookies())
+ }
+ mux := http.NewServeMux()
+ api.PageRoutes(mux, "/auth/")
+ c := newPageClient(t, mux)
+ c.get("/auth/register")
+ page := c.post("/auth/register", url.Values{"email": {"mallory@example.com"}, "password": {"password123"}, "password_confirm": {"password123"}})
+ if page.Code != http.StatusForbidden || sessionCookie(api, page) != nil {
+  t.Fatalf("vetoed page register: %d %v", page.Code, page.Result().Cookies())
+ }
+ var n int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&n); err != nil || n != 0 {
+  t.Fatalf("sessions after veto: %d (%v)", n, err)
+ }
+
+ if res := postJSON(api.Handler(), "/register", `{"email":"ok@example.com","password":"password123"}`, nil); res.Code != http.StatusCreated || sessionCookie(api, res) == nil {
+  t.Fatalf("handler register: %d", res.Code)
+ }
+ if !reflect.DeepEqual(logins, []string{"ok@example.com"}) {
+  t.Fatalf("OnLogin calls: %q", logins)
+ }
+}
+
+// Hooks run outside the transaction, so they may call back into the API.
+func TestHooksMayUseAPI(t *testing.T) {
+ var api *API
+ var events []Event
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Hooks.OnRegister = func(ctx context.Context, u User) {
+   if err := api.RevokeAllSessions(ctx, u.ID); err != nil {
+    t.Errorf("RevokeAllSessions in hook: %v", err)
+   }
+  }
+  c.Hooks.OnPasswordChanged = func(ctx context.Context, id int64) {
+   var err error
+   if events, err = api.ListEvents(ctx, EventFilter{UserID: id}); err != nil {
+    t.Errorf("ListEvents in hook: %v", err)
+   }
+  }
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ user, err := api.Register(ctx, "bob@example.com", "password123")
+ if err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ if err := api.ChangePassword(ctx, user.ID, "password456"); err != nil {
+  t.Fatalf("ChangePassword: %v", err)
+ }
+ if len(events) == 0 || events[0].Type != EventPasswordChanged {
+  t.Fatalf("hook saw events %+v", events)
+ }
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+ "context"
+ "database/sql"
+ "errors"
+ "fmt"
+ "net/http"
+ "time"
+)
+
+// linkIdentityInternal starts an OIDC flow that links provider to the signed-in
+// user. The session must have authenticated within RecentAuthWindow.
+func (a *API) linkIdentityInternal(w http.ResponseWriter, r *http.Request, provider string) error {
+ user, err := a.requireRecentAuth(w, r, a.cfg.RecentAuthWindow)
+ if err != nil {
+  return err
+ }
+ return a.startOIDCFlow(w, r, provider, user.ID)
+}
+
+// linkIdentity attaches ext to userID. Linking an identity the user already has is a
+// no-op; one that belongs to another account fails with ErrIdentityLinked.
+func (a *API) linkIdentity(ctx context.Context, userID int64, ext externalIdentity) error {
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var owner int64
+ err = tx.QueryRowContext(ctx, `
+  SELECT user_id FROM identities WHERE provider = ? AND subject = ?
+ `, ext.provider, ext.subject).Scan(&owner)
+ switch {
+ case err == nil && owner == userID:
+  return nil
+ case err == nil:
+  return ErrIdentityLinked
+ case !errors.Is(err, sql.ErrNoRows):
+  return fmt.Errorf("query identity: %w", err)
+ }
+ if err := a.insertIdentityTx(ctx, tx, userID, ext); err != nil {
+  return err
+ }
+ return tx.Commit()
+}
+
+func (a *API) listIdentitiesInternal(ctx context.Context, userID int64) ([]Identity, error) {
+ rows, err := a.db.QueryContext(ctx, `
+  SELECT id, provider, subject, email, created_at, last_login_at
+  FROM identities
+  WHERE user_id = ?
+  ORDER BY created_at, id
+ `, userID)
+ if err != nil {
+  return nil, fmt.Errorf("query identities: %w", err)
+ }
+ defer rows.Close()
+ var out []Identity
+ for rows.Next() {
+  var (
+   id        Identity
+   ca, lastAt int64
+  )
+  if err := rows.Scan(&id.ID, &id.Provider, &id.Subject, &id.Email, &ca, &lastAt); err != nil {
+   return nil, fmt.Errorf("scan identity: %w", err)
+  }
+  id.CreatedAt = time.Unix(ca, 0)
+  if lastAt != 0 {
+   id.LastLoginAt = time.Unix(lastAt, 0)
+  }
+  out = append(out, id)
+ }
+ return out, rows.Err()
+}
+
+// unlinkIdentityInternal removes an identity unless it is the user's last way to
+// sign in (no password and no other identity).
+func (a *API) unlinkIdentityInternal(ctx context.Context, userID, identityID int64) error {
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var (
+  hash   []byte
+  others int
+ )
+ err = tx.QueryRowContext(ctx, `
+  SELECT u.password_hash,
+         (SELECT COUNT(*) FROM identities o WHERE o.user_id = u.id AND o.id != i.id)
+  FROM identities i
+  JOIN users u ON u.id = i.user_id
+  WHERE i.id = ? AND i.user_id = ?
+ `, identityID, userID).Scan(&hash, &others)
+ if errors.Is(err, sql.ErrNoRows) {
+  return ErrIdentityNotFound
+ }
+ if err != nil {
+  return fmt.Errorf("query identity: %w", err)
+ }
+ if len(hash) == 0 && others == 0 {
+  return ErrLastSignInMethod
+ }
+ if _, err := tx.ExecContext(ctx, `DELETE FROM identities WHERE id = ?`, identityID); err != nil {
+  return fmt.Errorf("delete identity: %w", err)
+ }
+ return tx.Commit()
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+ "time"
+)
+
+func TestLinkAndUnlinkIdentity(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ now := base
+ idp := newMockIdP(t, base)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ user, _ := api.Register(ctx, "carol@example.com", "password123")
+ session := mustLogin(t, api, "carol@example.com", "password123")
+
+ rr := httptest.NewRecorder()
+ if err := api.LinkIdentity(rr, newReqWithCookie(http.MethodPost, "/link", session), "mock"); err != nil {
+  t.Fatalf("LinkIdentity: %v", err)
+ }
+ cb := newReqWithCookie(http.MethodGet, idp.authorize(rr.Header().Get("Location"), "carol-sub", "carol@gmail.example"), session)
+ for _, c := range rr.Result().Cookies() {
+  cb.AddCookie(c)
+ }
+ linked, err := api.OIDCCallback(httptest.NewRecorder(), cb, "mock")
+ if err != nil || linked.ID != user.ID {
+  t.Fatalf("link callback: %+v %v", linked, err)
+ }
+
+ ids, err := api.ListIdentities(ctx, user.ID)
+ if err != nil || len(ids) != 1 || ids[0].Provider != "mock" || ids[0].Subject != "carol-sub" {
+  t.Fatalf("ListIdentities: %+v %v", ids, err)
+ }
+ // The linked identity now signs into the password account.
+ if _, got, err := oidcSignIn(t, api, idp, "carol-sub", "carol@gmail.example"); err != nil || got.ID != user.ID {
+  t.Fatalf("sign-in via linked identity: %+v %v", got, err)
+ }
+
+ if err := api.UnlinkIdentity(ctx, user.ID+1, ids[0].ID); !errors.Is(err, ErrIdentityNotFound) {
+  t.Fatalf("unlinking someone else's identity: %v", err)
+ }
+ if err := api.UnlinkIdentity(ctx, user.ID, ids[0].ID); err != nil {
+  t.Fatalf("UnlinkIdentity: %v", err)
+ }
+
+ // Linking needs a recent sign-in.
+ now = base.Add(time.Hour - time.Minute)
+ session = mustLogin(t, api, "carol@example.com", "password123")
+ now = now.Add(20 * time.Minute)
+ if err := api.LinkIdentity(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/link", session), "mock"); !errors.Is(err, ErrReauthRequired) {
+  t.Fatalf("stale session linked an identity: %v", err)
+ }
+}
+
+func TestUnlinkLastSignInMethod(t *testing.T) {
+ idp := newMockIdP(t, time.Unix(1_700_000_000, 0))
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ _, user, err := oidcSignIn(t, api, idp, "dave-sub", "dave@example.com")
+ if err != nil {
+  t.Fatalf("sign-in: %v", err)
+ }
+ ids, _ := api.ListIdentities(ctx, user.ID)
+ if len(ids) != 1 {
+  t.Fatalf("identities: %+v", ids)
+ }
+ if err := api.UnlinkIdentity(ctx, user.ID, ids[0].ID); !errors.Is(err, ErrLastSignInMethod) {
+  t.Fatalf("unlinking the only sign-in method: %v", err)
+ }
+ if err := api.ChangePassword(ctx, user.ID, "password123"); err != nil {
+  t.Fatalf("ChangePassword: %v", err)
+ }
+ if err := api.UnlinkIdentity(ctx, user.ID, ids[0].ID); err != nil {
+  t.Fatalf("unlink after setting a password: %v", err)
+ }
+}
+
+func TestAutoLinkVerifiedEmail(t *testing.T) {
+ idp := newMockIdP(t, time.Unix(1_700_000_000, 0))
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+  c.OIDCAutoLinkVerifiedEmail = true
+ })
+ defer cleanup()
+
+ user, _ := api.Register(context.Background(), "erin@example.com", "password123")
+ _, got, err := oidcSignIn(t, api, idp, "erin-sub", "Erin@example.com")
+ if err != nil || got.ID != user.ID {
+  t.Fatalf("auto-link: %+v %v", got, err)
+ }
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+ "context"
+ "crypto/sha256"
+ "database/sql"
+ "errors"
+ "fmt"
+ "net/http"
+ "time"
+)
+
+func (a *API) createInviteInternal(ctx context.Context, inviterID int64, email string, opts InviteOptions) (string, Invite, error) {
+ email = normalizeEmail(email)
+ if !validEmailBasic(email) {
+  return "", Invite{}, ErrInvalidEmail
+ }
+ role := opts.Role
+ if opts.OrgID != 0 {
+  m, err := a.membershipInternal(ctx, opts.OrgID, inviterID)
+  if err != nil {
+   if errors.Is(err, ErrNotMember) {
+    return "", Invite{}, ErrForbidden
+   }
+   return "", Invite{}, err
+  }
+  if m.Role != OrgRoleOwner && m.Role != OrgRoleAdmin {
+   return "", Invite{}, ErrForbidden
+  }
+  if role == "" {
+   role = OrgRoleMember
+  }
+  if err := validateMemberRole(role); err != nil {
+   return "", Invite{}, err
+  }
+ } else {
+  az, err := a.loadAuthorization(ctx, inviterID)
+  if err != nil {
+   return "", Invite{}, err
+  }
+  if !az.HasRole(a.cfg.AdminRole) {
+   return "", Invite{}, ErrForbidden
+  }
+  if role != "" {
+   if _, err := a.roleID(ctx, role); err != nil {
+    return "", Invite{}, err
+   }
+  }
+ }
+
+ token, err := newSessionToken()
+ if err != nil {
+  return "", Invite{}, err
+ }
+ sum := sha256.Sum256([]byte(token))
+ now := a.now()
+ expiresAt := now.Add(a.cfg.InviteTTL)
+ orgID := sql.NullInt64{Int64: opts.OrgID, Valid: opts.OrgID != 0}
+ res, err := a.db.ExecContext(ctx, `
+  INSERT INTO invites (email, token_hash, org_id, role, invited_by, created_at, expires_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+ `, email, sum[:], orgID, role, inviterID, now.Unix(), expiresAt.Unix())
+ if err != nil {
+  return "", Invite{}, fmt.Errorf("insert invite: %w", err)
+ }
+ id, err := res.LastInsertId()
+ if err != nil {
+  return "", Invite{}, fmt.Errorf("last insert id: %w", err)
+ }
+ return token, Invite{
+  ID:        id,
+  Email:     email,
+  OrgID:     opts.OrgID,
+  Role:      role,
+  InvitedBy: inviterID,
+  CreatedAt: time.Unix(now.Unix(), 0),
+  ExpiresAt: time.Unix(expiresAt.Unix(), 0),
+ }, nil
+}
+
+// acceptInviteInternal redeems an invite: a new account is registered with password,
+// or, if the invited email already has an account, password must match it. The
+// invite's membership or role is applied and the user is logged in.
+func (a *API) acceptInviteInternal(w http.ResponseWriter, r *http.Request, token, password string) (User, error) {
+ ctx := r.Context()
+ inv, err := a.pendingInvite(ctx, token)
+ if err != nil {
+  return User{}, err
+ }
+ user, created, err := a.redeemInvite(ctx, inv, password)
+ if created {
+  a.recordRegistration(ctx, inv.Email, "invite", user, err)
+ }
+ if err == nil {
+  err = a.beforeLogin(ctx, user)
+ }
+ if err == nil {
+  if err = a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
+   err = fmt.Errorf("create session: %w", err)
+  }
+ }
+ // A registration that failed is not also a failed sign-in.
+ if !created || user.ID != 0 {
+  a.recordSignIn(ctx, "invite", user, err)
+ }
+ if err != nil {
+  return User{}, err
+ }
+ return user, nil
+}
+
+// redeemInvite marks inv accepted by the account it names, registering it with
+// password first if needed, and applies the invite's membership or role. created
+// reports whether a new account was attempted; user is set once known.
+func (a *API) redeemInvite(ctx context.Context, inv Invite, password string) (user User, created bool, err error) {
+ var existingID int64
+ err = a.db.QueryRowContext(ctx, `SELECT id FROM users WHERE email = ?`, inv.Email).Scan(&existingID)
+ if err != nil && !errors.Is(err, sql.ErrNoRows) {
+  return User{}, false, fmt.Errorf("query user: %w", err)
+ }
+ created = existingID == 0
+ var hash []byte
+ if !created {
+  if user, err = a.authenticatePassword(ctx, inv.Email, password); err != nil {
+   return user, false, err
+  }
+ } else {
+  if _, hash, err = a.prepareNewUser(ctx, inv.Email, password); err != nil {
+   return User{}, true, err
+  }
+ }
+
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return User{}, created, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+
+ if created {
+  if user, err = a.insertUserTx(ctx, tx, inv.Email, hash); err != nil {
+   return User{}, true, err
+  }
+  if err := a.enqueueWebhookTx(ctx, tx, EventRegister, user.ID); err != nil {
+   return User{}, true, err
+  }
+ }
+ res, err := tx.ExecContext(ctx, `
+  UPDATE invites SET accepted_at = ?, accepted_by = ? WHERE id = ? AND accepted_at = 0
+ `, a.now().Unix(), user.ID, inv.ID)
+ if err != nil {
+  return User{}, created, fmt.Errorf("accept invite: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return User{}, created, ErrInvalidInvite // accepted concurrently
+ }
+ if inv.OrgID != 0 {
+  if _, err := tx.ExecContext(ctx, `
+   INSERT INTO memberships (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+   ON CONFLICT(org_id, user_id) DO NOTHING
+  `, inv.OrgID, user.ID, inv.Role, a.now().Unix()); err != nil {
+   return User{}, created, fmt.Errorf("insert membership: %w", err)
+  }
+ } else if inv.Role != "" {
+  if _, err := tx.ExecContext(ctx, `
+   INSERT INTO user_roles (user_id, role_id, created_at)
+   SELECT ?, id, ? FROM roles WHERE name = ?
+   ON CONFLICT DO NOTHING
+  `, user.ID, a.now().Unix(), inv.Role); err != nil {
+   return User{}, created, fmt.Errorf("grant role: %w", err)
+  }
+ }
+ if err := tx.Commit(); err != nil {
+  return User{}, created, fmt.Errorf("commit: %w", err)
+ }
+ return user, created, nil
+}
+
+// pendingInvite looks up an unaccepted, unexpired invite by its token.
+func (a *API) pendingInvite(ctx context.Context, token string) (Invite, error) {
+ sum := sha256.Sum256([]byte(token))
+ var (
+  inv                              Invite
+  orgID                            sql.NullInt64
+  createdAt, expiresAt, acceptedAt int64
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT id, email, org_id, role, invited_by, created_at, expires_at, accepted_at
+  FROM invites
+  WHERE token_hash = ?
+ `, sum[:]).Scan(&inv.ID, &inv.Email, &orgID, &inv.Role, &inv.InvitedBy, &createdAt, &expiresAt, &acceptedAt)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return Invite{}, ErrInvalidInvite
+  }
+  return Invite{}, fmt.Errorf("query invite: %w", err)
+ }
+ if acceptedAt != 0 || a.now().Unix() >= expiresAt {
+  return Invite{}, ErrInvalidInvite
+ }
+ inv.OrgID = orgID.Int64
+ inv.CreatedAt = time.Unix(createdAt, 0)
+ inv.ExpiresAt = time.Unix(expiresAt, 0)
+ return inv, nil
+}
+
+func (a *API) revokeInviteInternal(ctx context.Context, inviteID int64) error {
+ res, err := a.db.ExecContext(ctx, `DELETE FROM invites WHERE id = ? AND accepted_at = 0`, inviteID)
+ if err != nil {
+  return fmt.Errorf("delete invite: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return ErrInvalidInvite
+ }
+ return nil
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+ "time"
+)
+
+func TestInviteIntoOrganization(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ now := base
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.InviteOnly = true
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "walkin@example.com", "password123"); !errors.Is(err, ErrInviteRequired) {
+  t.Fatalf("invite-only Register: %v", err)
+ }
+
+ // Seed an owner directly since Register is closed.
+ owner := seedUser(t, api, "owner@example.com", "password123")
+ org, err := api.CreateOrganization(ctx, owner.ID, "Acme")
+ if err != nil {
+  t.Fatalf("CreateOrganization: %v", err)
+ }
+ token, inv, err := api.CreateInvite(ctx, owner.ID, "New@Example.com", InviteOptions{OrgID: org.ID, Role: OrgRoleAdmin})
+ if err != nil {
+  t.Fatalf("CreateInvite: %v", err)
+ }
+ if inv.Email != "new@example.com" || inv.Role != OrgRoleAdmin {
+  t.Fatalf("unexpected invite: %+v", inv)
+ }
+
+ rr := httptest.NewRecorder()
+ user, err := api.AcceptInvite(rr, httptest.NewRequest(http.MethodPost, "/invite", nil), token, "password123")
+ if err != nil {
+  t.Fatalf("AcceptInvite: %v", err)
+ }
+ if len(rr.Result().Cookies()) == 0 {
+  t.Fatalf("AcceptInvite did not log the user in")
+ }
+ m, err := api.membershipInternal(ctx, org.ID, user.ID)
+ if err != nil || m.Role != OrgRoleAdmin {
+  t.Fatalf("membership not granted: %+v %v", m, err)
+ }
+
+ if _, err := api.AcceptInvite(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/invite", nil), token, "password123"); !errors.Is(err, ErrInvalidInvite) {
+  t.Fatalf("reused invite: %v", err)
+ }
+
+ // A plain member cannot invite, and invites expire.
+ if _, _, err := api.CreateInvite(ctx, user.ID, "x@example.com", InviteOptions{}); !errors.Is(err, ErrForbidden) {
+  t.Fatalf("non-admin global invite: %v", err)
+ }
+ token, _, err = api.CreateInvite(ctx, owner.ID, "late@example.com", InviteOptions{OrgID: org.ID})
+ if err != nil {
+  t.Fatalf("CreateInvite: %v", err)
+ }
+ now = base.Add(8 * 24 * time.Hour)
+ if _, err := api.AcceptInvite(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/invite", nil), token, "password123"); !errors.Is(err, ErrInvalidInvite) {
+  t.Fatalf("expired invite: %v", err)
+ }
+}
+
+func TestInviteExistingAccount(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ admin, _ := api.Register(ctx, "admin@example.com", "password123")
+ existing, _ := api.Register(ctx, "existing@example.com", "password123")
+ if err := api.DefineRole(ctx, "admin"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ if err := api.DefineRole(ctx, "editor", "posts:write"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ if err := api.GrantRole(ctx, admin.ID, "admin"); err != nil {
+  t.Fatalf("GrantRole: %v", err)
+ }
+
+ token, _, err := api.CreateInvite(ctx, admin.ID, "existing@example.com", InviteOptions{Role: "editor"})
+ if err != nil {
+  t.Fatalf("CreateInvite: %v", err)
+ }
+ req := httptest.NewRequest(http.MethodPost, "/invite", nil)
+ if _, err := api.AcceptInvite(httptest.NewRecorder(), req, token, "wrong-password"); err == nil {
+  t.Fatalf("existing account attached without its password")
+ }
+ user, err := api.AcceptInvite(httptest.NewRecorder(), req, token, "password123")
+ if err != nil || user.ID != existing.ID {
+  t.Fatalf("AcceptInvite: %+v %v", user, err)
+ }
+ az, err := api.UserAuthorization(ctx, existing.ID)
+ if err != nil || !az.HasPermission("posts:write") {
+  t.Fatalf("role not granted: %+v %v", az, err)
+ }
+
+ token, inv, _ := api.CreateInvite(ctx, admin.ID, "someone@example.com", InviteOptions{})
+ if err := api.RevokeInvite(ctx, inv.ID); err != nil {
+  t.Fatalf("RevokeInvite: %v", err)
+ }
+ if _, err := api.AcceptInvite(httptest.NewRecorder(), req, token, "password123"); !errors.Is(err, ErrInvalidInvite) {
+  t.Fatalf("revoked invite: %v", err)
+ }
+}
+
+func seedUser(t *testing.T, api *API, email, password string) User {
+ t.Helper()
+ email, hash, err := api.prepareNewUser(context.Background(), email, password)
+ if err != nil {
+  t.Fatalf("prepareNewUser: %v", err)
+ }
+ tx, err := api.db.BeginTx(context.Background(), nil)
+ if err != nil {
+  t.Fatalf("begin: %v", err)
+ }
+ defer rollbackIfNeeded(tx)
+ user, err := api.insertUserTx(context.Background(), tx, email, hash)
+ if err != nil {
+  t.Fatalf("insertUserTx: %v", err)
+ }
+ if err := tx.Commit(); err != nil {
+  t.Fatalf("commit: %v", err)
+ }
+ return user
+}
@@ -0,0 +1,314 @@
+package auth
+
+import (
+ "crypto"
+ "crypto/ecdsa"
+ "crypto/ed25519"
+ "crypto/elliptic"
+ "crypto/rand"
+ "crypto/rsa"
+ "crypto/sha256"
+ "encoding/asn1"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "math/big"
+ "strings"
+)
+
+// Minimal JWS (compact serialization) support for the three algorithms this package
+// issues and accepts. Claims are handled as map[string]any so the same code serves
+// access tokens, OIDC ID tokens and tokens from external providers.
+
+var errJWTSignature = errors.New("jwt: invalid signature")
+
+func jwtAlgorithmFor(key crypto.PublicKey) (JWTAlgorithm, error) {
+ switch k := key.(type) {
+ case ed25519.PublicKey:
+  return EdDSA, nil
+ case *ecdsa.PublicKey:
+  if k.Curve != elliptic.P256() {
+   return "", fmt.Errorf("jwt: only P-256 ECDSA keys are supported")
+  }
+  return ES256, nil
+ case *rsa.PublicKey:
+  if k.N.BitLen() < 2048 {
+   return "", fmt.Errorf("jwt: RSA keys must be at least 2048 bits")
+  }
+  return RS256, nil
+ default:
+  return "", fmt.Errorf("jwt: unsupported key type %T", key)
+ }
+}
+
+// signJWT serializes claims and signs them with key, which must be an Ed25519,
+// P-256 ECDSA or RSA signer.
+func signJWT(key JWTKey, claims map[string]any) (string, error) {
+ alg, err := jwtAlgorithmFor(key.Key.Public())
+ if err != nil {
+  return "", err
+ }
+ header, err := json.Marshal(map[string]string{"alg": string(alg), "typ": "JWT", "kid": key.ID})
+ if err != nil {
+  return "", err
+ }
+ payload, err := json.Marshal(claims)
+ if err != nil {
+  return "", err
+ }
+ signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+ var sig []byte
+ switch alg {
+ case EdDSA:
+  sig, err = key.Key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+ case ES256:
+  digest := sha256.Sum256([]byte(signingInput))
+  var der []byte
+  der, err = key.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+  if err == nil {
+   sig, err = ecdsaDERToRaw(der, 32)
+  }
+ case RS256:
+  digest := sha256.Sum256([]byte(signingInput))
+  sig, err = key.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+ }
+ if err != nil {
+  return "", fmt.Errorf("jwt: sign: %w", err)
+ }
+ return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseJWT verifies the signature of a compact JWS and returns its claims. keyFor is
+// called with the header's kid and must return the matching public key. Time and
+// audience claims are not checked here; see validateJWTClaims.
+func parseJWT(token string, keyFor func(kid string) (crypto.PublicKey, error)) (map[string]any, error) {
+ parts := strings.Split(token, ".")
+ if len(parts) != 3 {
+  return nil, errors.New("jwt: malformed token")
+ }
+ rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+ if err != nil {
+  return nil, errors.New("jwt: malformed header")
+ }
+ var header struct {
+  Alg  string   `json:"alg"`
+  Kid  string   `json:"kid"`
+  Crit []string `json:"crit"`
+ }
+ if err := json.Unmarshal(rawHeader, &header); err != nil {
+  return nil, errors.New("jwt: malformed header")
+ }
+ if len(header.Crit) > 0 {
+  return nil, errors.New("jwt: unsupported critical header")
+ }
+ sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+ if err != nil {
+  return nil, errors.New("jwt: malformed signature")
+ }
+ key, err := keyFor(header.Kid)
+ if err != nil {
+  return nil, err
+ }
+ // The algorithm is pinned by the key type, never taken from the header alone.
+ alg, err := jwtAlgorithmFor(key)
+ if err != nil {
+  return nil, err
+ }
+ if header.Alg != string(alg) {
+  return nil, fmt.Errorf("jwt: algorithm %q does not match key", header.Alg)
+ }
+ signingInput := parts[0] + "." + parts[1]
+ if !verifyJWS(alg, key, []byte(signingInput), sig) {
+  return nil, errJWTSignature
+ }
+ rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+ if err != nil {
+  return nil, errors.New("jwt: malformed payload")
+ }
+ dec := json.NewDecoder(strings.NewReader(string(rawClaims)))
+ dec.UseNumber()
+ var claims map[string]any
+ if err := dec.Decode(&claims); err != nil {
+  return nil, errors.New("jwt: malformed payload")
+ }
+ return claims, nil
+}
+
+func verifyJWS(alg JWTAlgorithm, key crypto.PublicKey, signingInput, sig []byte) bool {
+ switch alg {
+ case EdDSA:
+  return ed25519.Verify(key.(ed25519.PublicKey), signingInput, sig)
+ case ES256:
+  if len(sig) != 64 {
+   return false
+  }
+  digest := sha256.Sum256(signingInput)
+  r := new(big.Int).SetBytes(sig[:32])
+  s := new(big.Int).SetBytes(sig[32:])
+  return ecdsa.Verify(key.(*ecdsa.PublicKey), digest[:], r, s)
+ case RS256:
+  digest := sha256.Sum256(signingInput)
+  return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+ }
+ return false
+}
+
+// validateJWTClaims checks exp/nbf/iat (with leeway seconds), and iss/aud when set.
+func validateJWTClaims(claims map[string]any, issuer, audience string, now, leeway int64) error {
+ exp, ok := numericClaim(claims, "exp")
+ if !ok {
+  return errors.New("jwt: missing exp")
+ }
+ if now >= exp+leeway {
+  return errors.New("jwt: token expired")
+ }
+ if nbf, ok := numericClaim(claims, "nbf"); ok && now+leeway < nbf {
+  return errors.New("jwt: token not yet valid")
+ }
+ if iat, ok := numericClaim(claims, "iat"); ok && now+leeway < iat {
+  return errors.New("jwt: token issued in the future")
+ }
+ if issuer != "" {
+  if iss, _ := claims["iss"].(string); iss != issuer {
+   return errors.New("jwt: issuer mismatch")
+  }
+ }
+ if audience != "" && !jwtAudienceContains(claims["aud"], audience) {
+  return errors.New("jwt: audience mismatch")
+ }
+ return nil
+}
+
+func jwtAudienceContains(aud any, want string) bool {
+ switch v := aud.(type) {
+ case string:
+  return v == want
+ case []any:
+  for _, a := range v {
+   if s, ok := a.(string); ok && s == want {
+    return true
+   }
+  }
+ }
+ return false
+}
+
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+ switch v := claims[name].(type) {
+ case json.Number:
+  if n, err := v.Int64(); err == nil {
+   return n, true
+  }
+  if f, err := v.Float64(); err == nil {
+   return int64(f), true
+  }
+ case float64:
+  return int64(v), true
+ case int64:
+  return v, true
+ }
+ return 0, false
+}
+
+func ecdsaDERToRaw(der []byte, size int) ([]byte, error) {
+ var sig struct{ R, S *big.Int }
+ if _, err := asn1.Unmarshal(der, &sig); err != nil {
+  return nil, err
+ }
+ out := make([]byte, 2*size)
+ sig.R.FillBytes(out[:size])
+ sig.S.FillBytes(out[size:])
+ return out, nil
+}
+
+// jwk is the JSON Web Key representation of a public key (RFC 7517/8037).
+type jwk struct {
+ Kty string `json:"kty"`
+ Kid string `json:"kid,omitempty"`
+ Use string `json:"use,omitempty"`
+ Alg string `json:"alg,omitempty"`
+ Crv string `json:"crv,omitempty"`
+ X   string `json:"x,omitempty"`
+ Y   string `json:"y,omitempty"`
+ N   string `json:"n,omitempty"`
+ E   string `json:"e,omitempty"`
+}
+
+type jwkSet struct {
+ Keys []jwk `json:"keys"`
+}
+
+func jwkFromPublicKey(kid string, key crypto.PublicKey) (jwk, error) {
+ alg, err := jwtAlgorithmFor(key)
+ if err != nil {
+  return jwk{}, err
+ }
+ b64 := base64.RawURLEncoding.EncodeToString
+ out := jwk{Kid: kid, Use: "sig", Alg: string(alg)}
+ switch k := key.(type) {
+ case ed25519.PublicKey:
+  out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64(k)
+ case *ecdsa.PublicKey:
+  x, y := make([]byte, 32), make([]byte, 32)
+  k.X.FillBytes(x)
+  k.Y.FillBytes(y)
+  out.Kty, out.Crv, out.X, out.Y = "EC", "P-256", b64(x), b64(y)
+ case *rsa.PublicKey:
+  out.Kty, out.N, out.E = "RSA", b64(k.N.Bytes()), b64(big.NewInt(int64(k.E)).Bytes())
+ }
+ return out, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+ dec := base64.RawURLEncoding.DecodeString
+ switch k.Kty {
+ case "OKP":
+  x, err := dec(k.X)
+  if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+   return nil, fmt.Errorf("jwk %q: invalid OKP key", k.Kid)
+  }
+  return ed25519.PublicKey(x), nil
+ case "EC":
+  x, errX := dec(k.X)
+  y, errY := dec(k.Y)
+  if errX != nil || errY != nil || k.Crv != "P-256" {
+   return nil, fmt.Errorf("jwk %q: invalid EC key", k.Kid)
+  }
+  pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+  if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+   return nil, fmt.Errorf("jwk %q: point not on curve", k.Kid)
+  }
+  return pub, nil
+ case "RSA":
+  n, errN := dec(k.N)
+  e, errE := dec(k.E)
+  if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+   return nil, fmt.Errorf("jwk %q: invalid RSA key", k.Kid)
+  }
+  return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+ }
+ return nil, fmt.Errorf("jwk %q: unsupported kty %q", k.Kid, k.Kty)
+}
+
+func generateJWTKey(id string, alg JWTAlgorithm) (JWTKey, error) {
+ var (
+  key crypto.Signer
+  err error
+ )
+ switch alg {
+ case EdDSA:
+  _, key, err = ed25519.GenerateKey(rand.Reader)
+ case ES256:
+  key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+ case RS256:
+  key, err = rsa.GenerateKey(rand.Reader, 2048)
+ default:
+  return JWTKey{}, fmt.Errorf("jwt: unsupported algorithm %q", alg)
+ }
+ if err != nil {
+  return JWTKey{}, fmt.Errorf("jwt: generate %s key: %w", alg, err)
+ }
+ return JWTKey{ID: id, Key: key}, nil
+}
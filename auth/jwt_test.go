@@ -0,0 +1,274 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "sync"
+ "testing"
+ "time"
+)
+
+func newJWTTestAPI(t *testing.T, alg JWTAlgorithm) (*API, func()) {
+ t.Helper()
+ key, err := NewJWTKey("k1", alg)
+ if err != nil {
+  t.Fatalf("NewJWTKey: %v", err)
+ }
+ return newTestAPI(t, func(c *Config) {
+  c.JWT = &JWTConfig{Issuer: "https://auth.test", Audience: "svc", SigningKeys: []JWTKey{key}}
+ })
+}
+
+func TestJWTAccessTokenAlgorithms(t *testing.T) {
+ for _, alg := range []JWTAlgorithm{EdDSA, ES256, RS256} {
+  t.Run(string(alg), func(t *testing.T) {
+   api, cleanup := newJWTTestAPI(t, alg)
+   defer cleanup()
+
+   ctx := context.Background()
+   if _, err := api.Register(ctx, "jwt@example.com", "password123"); err != nil {
+    t.Fatalf("register: %v", err)
+   }
+   pair, u, err := api.LoginTokenPair(ctx, "jwt@example.com", "password123")
+   if err != nil {
+    t.Fatalf("LoginTokenPair: %v", err)
+   }
+   if pair.TokenType != "Bearer" || pair.ExpiresIn != 900 || pair.RefreshToken == "" {
+    t.Fatalf("unexpected pair: %+v", pair)
+   }
+   got, err := api.VerifyAccessToken(ctx, pair.AccessToken)
+   if err != nil || got.ID != u.ID || got.Email != u.Email {
+    t.Fatalf("VerifyAccessToken: %v %v", got, err)
+   }
+   tampered := pair.AccessToken[:len(pair.AccessToken)-4] + "AAAA"
+   if _, err := api.VerifyAccessToken(ctx, tampered); err == nil {
+    t.Fatalf("tampered token verified")
+   }
+  })
+ }
+}
+
+func TestJWTExpiryAndMiddleware(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newJWTTestAPI(t, EdDSA)
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "mw@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ pair, err := api.IssueTokenPair(ctx, u.ID)
+ if err != nil {
+  t.Fatalf("IssueTokenPair: %v", err)
+ }
+
+ h := api.JWTMiddleware(api.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  user, _ := FromContext(r.Context())
+  _, _ = w.Write([]byte(user.Email))
+ })))
+ w := httptest.NewRecorder()
+ h.ServeHTTP(w, newReqWithBearer(http.MethodGet, "/me", pair.AccessToken))
+ if w.Code != http.StatusOK || w.Body.String() != "mw@example.com" {
+  t.Fatalf("jwt middleware: status=%d body=%q", w.Code, w.Body.String())
+ }
+
+ api.cfg.Now = func() time.Time { return base.Add(time.Hour) }
+ w2 := httptest.NewRecorder()
+ h.ServeHTTP(w2, newReqWithBearer(http.MethodGet, "/me", pair.AccessToken))
+ if w2.Code != http.StatusUnauthorized {
+  t.Fatalf("expected 401 for expired token, got %d", w2.Code)
+ }
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+ api, cleanup := newJWTTestAPI(t, EdDSA)
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "rt@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ first, err := api.IssueTokenPair(ctx, u.ID)
+ if err != nil {
+  t.Fatalf("IssueTokenPair: %v", err)
+ }
+ second, err := api.RefreshTokenPair(ctx, first.RefreshToken)
+ if err != nil {
+  t.Fatalf("RefreshTokenPair: %v", err)
+ }
+ if second.RefreshToken == first.RefreshToken {
+  t.Fatalf("refresh token was not rotated")
+ }
+
+ // Replaying the rotated token revokes the family, including the newest token.
+ if _, err := api.RefreshTokenPair(ctx, first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+  t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+ }
+ if _, err := api.RefreshTokenPair(ctx, second.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+  t.Fatalf("expected family revoked, got %v", err)
+ }
+
+ // Other families are unaffected until RevokeAllSessions.
+ other, err := api.IssueTokenPair(ctx, u.ID)
+ if err != nil {
+  t.Fatalf("IssueTokenPair: %v", err)
+ }
+ if err := api.RevokeAllSessions(ctx, u.ID); err != nil {
+  t.Fatalf("RevokeAllSessions: %v", err)
+ }
+ if _, err := api.RefreshTokenPair(ctx, other.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+  t.Fatalf("expected refresh tokens revoked with sessions, got %v", err)
+ }
+}
+
+func TestJWTVerifierWithRemoteJWKS(t *testing.T) {
+ api, cleanup := newJWTTestAPI(t, ES256)
+ defer cleanup()
+
+ srv := httptest.NewServer(api.JWKSHandler())
+ defer srv.Close()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "svc@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ pair, err := api.IssueTokenPair(ctx, u.ID)
+ if err != nil {
+  t.Fatalf("IssueTokenPair: %v", err)
+ }
+
+ base := time.Unix(1_700_000_000, 0)
+ v, err := NewJWTVerifier(JWTVerifierConfig{
+  Issuer:   "https://auth.test",
+  Audience: "svc",
+  JWKSURL:  srv.URL,
+  Now:      func() time.Time { return base },
+ })
+ if err != nil {
+  t.Fatalf("NewJWTVerifier: %v", err)
+ }
+ got, err := v.Verify(ctx, pair.AccessToken)
+ if err != nil || got.ID != u.ID {
+  t.Fatalf("Verify: %v %v", got, err)
+ }
+
+ wrongAud, _ := NewJWTVerifier(JWTVerifierConfig{
+  Audience: "other",
+  JWKSURL:  srv.URL,
+  Now:      func() time.Time { return base },
+ })
+ if _, err := wrongAud.Verify(ctx, pair.AccessToken); err == nil {
+  t.Fatalf("expected audience mismatch")
+ }
+}
+
+func TestRemoteKeySetFetchesOutsideLock(t *testing.T) {
+ api, cleanup := newJWTTestAPI(t, ES256)
+ defer cleanup()
+ jwks := api.JWKSHandler()
+ var (
+  mu      sync.Mutex
+  fetches int
+ )
+ release := make(chan struct{})
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  mu.Lock()
+  fetches++
+  n := fetches
+  mu.Unlock()
+  if n > 1 {
+   <-release // a slow IdP
+  }
+  jwks.ServeHTTP(w, r)
+ }))
+ defer srv.Close()
+
+ now := time.Unix(1_700_000_000, 0)
+ ks := &remoteKeySet{url: srv.URL, client: srv.Client(), now: func() time.Time { return now }}
+ ctx := context.Background()
+ if _, err := ks.key(ctx, "k1"); err != nil {
+  t.Fatalf("first fetch: %v", err)
+ }
+
+ // Unknown kids past the refetch interval share one slow fetch.
+ now = now.Add(2 * jwksRefetchInterval)
+ var wg sync.WaitGroup
+ for i := 0; i < 5; i++ {
+  wg.Add(1)
+  go func() {
+   defer wg.Done()
+   if _, err := ks.key(ctx, "rotated"); err == nil {
+    t.Error("unknown kid resolved")
+   }
+  }()
+ }
+ for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+  mu.Lock()
+  n := fetches
+  mu.Unlock()
+  if n == 2 {
+   break
+  }
+  if time.Now().After(deadline) {
+   t.Fatal("refetch not started")
+  }
+ }
+ // Cached keys resolve while the fetch is in flight.
+ got := make(chan error, 1)
+ go func() {
+  _, err := ks.key(ctx, "k1")
+  got <- err
+ }()
+ select {
+ case err := <-got:
+  if err != nil {
+   t.Fatalf("cached key: %v", err)
+  }
+ case <-time.After(5 * time.Second):
+  t.Fatal("cached key blocked by the JWKS fetch")
+ }
+ close(release)
+ wg.Wait()
+ if fetches != 2 {
+  t.Fatalf("%d JWKS fetches, want 2", fetches)
+ }
+}
+
+func TestRemoteKeySetLimitsFailedFetches(t *testing.T) {
+ var (
+  mu      sync.Mutex
+  fetches int
+ )
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  mu.Lock()
+  fetches++
+  mu.Unlock()
+  http.Error(w, "down", http.StatusServiceUnavailable)
+ }))
+ defer srv.Close()
+
+ now := time.Unix(1_700_000_000, 0)
+ ks := &remoteKeySet{url: srv.URL, client: srv.Client(), now: func() time.Time { return now }}
+ ctx := context.Background()
+ // Random kids while the issuer is down cause one fetch per interval.
+ for _, kid := range []string{"a", "b", "c"} {
+  if _, err := ks.key(ctx, kid); err == nil {
+   t.Fatalf("kid %q resolved", kid)
+  }
+ }
+ if fetches != 1 {
+  t.Fatalf("%d JWKS fetches within the interval, want 1", fetches)
+ }
+ now = now.Add(jwksRefetchInterval)
+ if _, err := ks.key(ctx, "d"); err == nil {
+  t.Fatal("kid resolved")
+ }
+ if fetches != 2 {
+  t.Fatalf("%d JWKS fetches after the interval, want 2", fetches)
+ }
+}
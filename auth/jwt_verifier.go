@@ -0,0 +1,190 @@
+package auth
+
+import (
+ "context"
+ "crypto"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "net/http"
+ "strconv"
+ "sync"
+ "time"
+)
+
+// defaultJWTLeeway tolerates small clock differences between issuer and verifier.
+const defaultJWTLeeway = 30 * time.Second
+
+// jwksRefetchInterval bounds how often an unknown kid may trigger a JWKS fetch.
+const jwksRefetchInterval = time.Minute
+
+func newJWTVerifier(cfg JWTVerifierConfig) (*JWTVerifier, error) {
+ if cfg.JWKSURL == "" {
+  return nil, fmt.Errorf("JWKSURL is required")
+ }
+ if cfg.HTTPClient == nil {
+  cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+ }
+ if cfg.Leeway == 0 {
+  cfg.Leeway = defaultJWTLeeway
+ }
+ if cfg.Now == nil {
+  cfg.Now = time.Now
+ }
+ ks := &remoteKeySet{url: cfg.JWKSURL, client: cfg.HTTPClient, now: cfg.Now}
+ return &JWTVerifier{
+  issuer:   cfg.Issuer,
+  audience: cfg.Audience,
+  leeway:   cfg.Leeway,
+  now:      cfg.Now,
+  keyFor:   ks.key,
+ }, nil
+}
+
+func (v *JWTVerifier) verifyClaims(ctx context.Context, token string) (map[string]any, error) {
+ claims, err := parseJWT(token, func(kid string) (crypto.PublicKey, error) {
+  return v.keyFor(ctx, kid)
+ })
+ if err != nil {
+  return nil, err
+ }
+ if err := validateJWTClaims(claims, v.issuer, v.audience, v.now().Unix(), int64(v.leeway.Seconds())); err != nil {
+  return nil, err
+ }
+ return claims, nil
+}
+
+func (v *JWTVerifier) verifyInternal(ctx context.Context, token string) (User, error) {
+ claims, err := v.verifyClaims(ctx, token)
+ if err != nil {
+  return User{}, err
+ }
+ return userFromJWTClaims(claims)
+}
+
+func (v *JWTVerifier) middlewareInternal(next http.Handler) http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if token, ok := bearerToken(r); ok {
+   if user, err := v.verifyInternal(r.Context(), token); err == nil {
+    next.ServeHTTP(w, r.WithContext(withJWTAuth(r.Context(), user)))
+    return
+   }
+  }
+  next.ServeHTTP(w, r)
+ })
+}
+
+func userFromJWTClaims(claims map[string]any) (User, error) {
+ sub, _ := claims["sub"].(string)
+ id, err := strconv.ParseInt(sub, 10, 64)
+ if err != nil || id <= 0 {
+  return User{}, errors.New("jwt: invalid sub")
+ }
+ email, _ := claims["email"].(string)
+ u := User{ID: id, Email: email}
+ if uc, ok := numericClaim(claims, "created_at"); ok {
+  u.CreatedAt = time.Unix(uc, 0)
+ }
+ return u, nil
+}
+
+// staticKeySet resolves kids against a fixed set of public keys.
+func staticKeySet(keys map[string]crypto.PublicKey) func(context.Context, string) (crypto.PublicKey, error) {
+ return func(_ context.Context, kid string) (crypto.PublicKey, error) {
+  if k, ok := keys[kid]; ok {
+   return k, nil
+  }
+  return nil, fmt.Errorf("jwt: unknown key id %q", kid)
+ }
+}
+
+// remoteKeySet caches a JWKS document and refetches it when an unknown kid shows up
+// (at most once per jwksRefetchInterval, whether or not the last attempt
+// succeeded), which picks up key rotation. The fetch
+// runs without holding mu, so cached keys stay available meanwhile, and only one
+// fetch runs at a time; other callers wait for it.
+type remoteKeySet struct {
+ url    string
+ client *http.Client
+ now    func() time.Time
+
+ mu        sync.Mutex
+ keys      map[string]crypto.PublicKey
+ attemptAt time.Time // last fetch, successful or not
+ fetching  chan struct{} // closed when the running fetch finishes
+}
+
+func (s *remoteKeySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+ for {
+  s.mu.Lock()
+  if k, ok := s.keys[kid]; ok {
+   s.mu.Unlock()
+   return k, nil
+  }
+  if !s.attemptAt.IsZero() && s.now().Sub(s.attemptAt) < jwksRefetchInterval {
+   s.mu.Unlock()
+   return nil, fmt.Errorf("jwt: unknown key id %q", kid)
+  }
+  if done := s.fetching; done != nil {
+   s.mu.Unlock()
+   select {
+   case <-done:
+    continue // look again in the fetched set
+   case <-ctx.Done():
+    return nil, ctx.Err()
+   }
+  }
+  done := make(chan struct{})
+  s.fetching = done
+  s.mu.Unlock()
+
+  keys, err := fetchJWKS(ctx, s.client, s.url)
+  s.mu.Lock()
+  if err == nil {
+   s.keys = keys
+  }
+  s.attemptAt, s.fetching = s.now(), nil
+  s.mu.Unlock()
+  close(done)
+  if err != nil {
+   return nil, err
+  }
+  if k, ok := keys[kid]; ok {
+   return k, nil
+  }
+  return nil, fmt.Errorf("jwt: unknown key id %q", kid)
+ }
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+ req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+ if err != nil {
+  return nil, err
+ }
+ req.Header.Set("Accept", "application/json")
+ res, err := client.Do(req)
+ if err != nil {
+  return nil, fmt.Errorf("fetch jwks: %w", err)
+ }
+ defer res.Body.Close()
+ if res.StatusCode != http.StatusOK {
+  return nil, fmt.Errorf("fetch jwks: status %d", res.StatusCode)
+ }
+ var set jwkSet
+ if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&set); err != nil {
+  return nil, fmt.Errorf("decode jwks: %w", err)
+ }
+ keys := make(map[string]crypto.PublicKey, len(set.Keys))
+ for _, k := range set.Keys {
+  if k.Use != "" && k.Use != "sig" {
+   continue
+  }
+  pub, err := k.publicKey()
+  if err != nil {
+   continue // skip key types we do not support
+  }
+  keys[k.Kid] = pub
+ }
+ return keys, nil
+}
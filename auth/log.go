@@ -0,0 +1,92 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "log/slog"
+)
+
+// Attribute keys of log records. Records never carry session tokens, passwords or
+// other secrets; sessions are identified by their row ID.
+const (
+ logKeyUserID    = "user_id"
+ logKeySessionID = "session_id"
+ logKeyEvent     = "event"
+ logKeyError     = "error"
+ logKeyIP        = "ip"
+)
+
+var ctxLogAttrsKey ctxKey = "auth.log_attrs"
+
+// newLogger returns Config.Logger, a logger writing text lines to Config.Logf, or
+// nil when neither is set.
+func newLogger(cfg Config) *slog.Logger {
+ switch {
+ case cfg.Logger != nil:
+  return cfg.Logger
+ case cfg.Logf != nil:
+  return slog.New(slog.NewTextHandler(logfWriter(cfg.Logf), &slog.HandlerOptions{
+   ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+    if len(groups) == 0 && a.Key == slog.TimeKey {
+     return slog.Attr{} // Logf adds its own
+    }
+    return a
+   },
+  }))
+ }
+ return nil
+}
+
+// logfWriter passes each line of a text handler to a printf-style logger.
+type logfWriter func(format string, args ...any)
+
+func (f logfWriter) Write(p []byte) (int, error) {
+ f("%s", bytes.TrimSuffix(p, []byte("\n")))
+ return len(p), nil
+}
+
+func withLogAttrsInternal(ctx context.Context, attrs []slog.Attr) context.Context {
+ prev, _ := ctx.Value(ctxLogAttrsKey).([]slog.Attr)
+ all := make([]slog.Attr, 0, len(prev)+len(attrs))
+ all = append(append(all, prev...), attrs...)
+ return context.WithValue(ctx, ctxLogAttrsKey, all)
+}
+
+// log writes a record with attrs followed by the request-scoped attributes of
+// ctx: the client IP, the signed-in user unless attrs name one, the session, and
+// those added with WithLogAttrs.
+func (a *API) log(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+ if a == nil || a.logger == nil || !a.logger.Enabled(ctx, level) {
+  return
+ }
+ hasUser := false
+ for _, at := range attrs {
+  hasUser = hasUser || at.Key == logKeyUserID
+ }
+ if c, ok := clientFromContext(ctx); ok && c.ip != "" {
+  attrs = append(attrs, slog.String(logKeyIP, c.ip))
+ }
+ if u, ok := fromContext(ctx); ok && !hasUser {
+  attrs = append(attrs, userAttr(u.ID))
+ }
+ if s, ok := sessionFromContext(ctx); ok && s.id != 0 {
+  attrs = append(attrs, slog.Int64(logKeySessionID, s.id))
+ }
+ if extra, ok := ctx.Value(ctxLogAttrsKey).([]slog.Attr); ok {
+  attrs = append(attrs, extra...)
+ }
+ a.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// logError logs an unexpected error at error level.
+func (a *API) logError(ctx context.Context, msg string, err error, attrs ...slog.Attr) {
+ a.log(ctx, slog.LevelError, msg, append(attrs, errAttr(err))...)
+}
+
+func userAttr(id int64) slog.Attr {
+ return slog.Int64(logKeyUserID, id)
+}
+
+func errAttr(err error) slog.Attr {
+ return slog.String(logKeyError, err.Error())
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "encoding/json"
+ "fmt"
+ "log/slog"
+ "net/http"
+ "net/http/httptest"
+ "strings"
+ "testing"
+)
+
+// logRecords decodes the lines of a slog.JSONHandler.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+ t.Helper()
+ var recs []map[string]any
+ for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+  if line == "" {
+   continue
+  }
+  var rec map[string]any
+  if err := json.Unmarshal([]byte(line), &rec); err != nil {
+   t.Fatalf("log line %q: %v", line, err)
+  }
+  recs = append(recs, rec)
+ }
+ return recs
+}
+
+func findEvent(recs []map[string]any, event string) map[string]any {
+ for _, rec := range recs {
+  if rec["event"] == event {
+   return rec
+  }
+ }
+ return nil
+}
+
+func TestLogger(t *testing.T) {
+ var buf bytes.Buffer
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+ })
+ defer cleanup()
+
+ user, err := api.Register(context.Background(), "alice@example.com", "password123")
+ if err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ session := mustLogin(t, api, "alice@example.com", "password123")
+
+ // A failed sign-in, with a request ID attached by the application.
+ r := httptest.NewRequest(http.MethodPost, "/login", nil)
+ r = r.WithContext(WithLogAttrs(r.Context(), slog.String("request_id", "req-1")))
+ if _, err := api.Login(httptest.NewRecorder(), r, "alice@example.com", "wrong-secret"); err == nil {
+  t.Fatal("Login with wrong password succeeded")
+ }
+ // A logout through Middleware, which knows the session.
+ var sessionID int64
+ if err := api.db.QueryRow(`SELECT id FROM sessions WHERE token = ?`, session.Value).Scan(&sessionID); err != nil {
+  t.Fatalf("session id: %v", err)
+ }
+ logout := api.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if err := api.Logout(w, r); err != nil {
+   t.Errorf("Logout: %v", err)
+  }
+ }))
+ serve(logout, newReqWithCookie(http.MethodPost, "/logout", session))
+
+ recs := logRecords(t, &buf)
+ uid := float64(user.ID)
+ if rec := findEvent(recs, "register"); rec == nil || rec["user_id"] != uid || rec["success"] != true {
+  t.Fatalf("register record: %v", rec)
+ }
+ var failed map[string]any
+ for _, rec := range recs {
+  if rec["event"] == "login" && rec["success"] == false {
+   failed = rec
+  }
+ }
+ if failed == nil || failed["user_id"] != uid || failed["error"] != ErrInvalidCredentials.Error() ||
+  failed["request_id"] != "req-1" || failed["ip"] != "192.0.2.1" {
+  t.Fatalf("failed login record: %v", failed)
+ }
+ if rec := findEvent(recs, "logout"); rec == nil || rec["user_id"] != uid || rec["session_id"] != float64(sessionID) {
+  t.Fatalf("logout record: %v", rec)
+ }
+
+ for _, secret := range []string{"password123", "wrong-secret", session.Value} {
+  if strings.Contains(buf.String(), secret) {
+   t.Fatalf("log contains secret %q:\n%s", secret, buf.String())
+  }
+ }
+}
+
+func TestLogfCompatibility(t *testing.T) {
+ var lines []string
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Logf = func(format string, args ...any) { lines = append(lines, fmt.Sprintf(format, args...)) }
+ })
+ defer cleanup()
+ if _, err := api.Register(context.Background(), "bob@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ if len(lines) != 1 || !strings.Contains(lines[0], `msg="auth event" event=register`) ||
+  strings.Contains(lines[0], "time=") || strings.HasSuffix(lines[0], "\n") {
+  t.Fatalf("Logf lines: %q", lines)
+ }
+}
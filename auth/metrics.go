@@ -0,0 +1,249 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "errors"
+ "fmt"
+ "math"
+ "net/http"
+ "sort"
+ "strconv"
+ "strings"
+ "time"
+)
+
+// Metric names, with their label names in metricDefs.
+const (
+ metricRegistrations  = "auth_registrations_total"
+ metricLogins         = "auth_logins_total"
+ metricLogouts        = "auth_logouts_total"
+ metricRefreshes      = "auth_session_refreshes_total"
+ metricPrunedSessions = "auth_janitor_pruned_sessions_total"
+ metricPruneDuration  = "auth_janitor_duration_seconds"
+ metricHashDuration   = "auth_password_hash_duration_seconds"
+ metricActiveSessions = "auth_active_sessions"
+)
+
+type metricType string
+
+const (
+ counterMetric   metricType = "counter"
+ gaugeMetric     metricType = "gauge"
+ histogramMetric metricType = "histogram"
+)
+
+type metricDef struct {
+ name   string
+ typ    metricType
+ help   string
+ labels []string
+}
+
+// metricDefs lists every metric the API reports, in exposition order.
+var metricDefs = []metricDef{
+ {metricRegistrations, counterMetric, "Account registrations by outcome.", []string{"outcome"}},
+ {metricLogins, counterMetric, "Sign-ins by outcome.", []string{"outcome"}},
+ {metricLogouts, counterMetric, "Sessions ended by logout.", nil},
+ {metricRefreshes, counterMetric, "Session renewals and refresh token exchanges.", []string{"kind"}},
+ {metricPrunedSessions, counterMetric, "Expired sessions deleted by the janitor.", nil},
+ {metricPruneDuration, histogramMetric, "Duration of janitor runs.", nil},
+ {metricHashDuration, histogramMetric, "Duration of bcrypt operations.", []string{"op"}},
+ {metricActiveSessions, gaugeMetric, "Unexpired server-side sessions, counted by the janitor.", nil},
+}
+
+// metricBuckets are the histogram bucket upper bounds, in seconds.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (a *API) addCounter(name string, delta float64, labelValues ...string) {
+ if m := a.cfg.Metrics; m != nil {
+  m.AddCounter(name, delta, labelValues...)
+ }
+}
+
+func (a *API) observeDuration(name string, since time.Time, labelValues ...string) {
+ if m := a.cfg.Metrics; m != nil {
+  m.ObserveHistogram(name, time.Since(since).Seconds(), labelValues...)
+ }
+}
+
+// updateActiveSessions reports the number of unexpired server-side sessions.
+func (a *API) updateActiveSessions(ctx context.Context) error {
+ if a.cfg.Metrics == nil || a.sealer != nil {
+  return nil
+ }
+ var n int64
+ if err := a.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions WHERE expires_at > ?`, a.now().Unix()).Scan(&n); err != nil {
+  return fmt.Errorf("count sessions: %w", err)
+ }
+ a.cfg.Metrics.SetGauge(metricActiveSessions, float64(n))
+ return nil
+}
+
+func loginOutcome(err error) string {
+ switch {
+ case err == nil:
+  return "success"
+ case errors.Is(err, ErrInvalidCredentials):
+  return "invalid_credentials"
+ case errors.Is(err, ErrLoginRejected):
+  return "rejected"
+ case errors.Is(err, ErrSessionLimitReached):
+  return "session_limit"
+ }
+ return "error"
+}
+
+func registrationOutcome(err error) string {
+ switch {
+ case err == nil:
+  return "success"
+ case errors.Is(err, ErrEmailTaken):
+  return "email_taken"
+ case errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrWeakPassword),
+  errors.Is(err, ErrEmailDomainNotAllowed), errors.Is(err, ErrDisposableEmail),
+  errors.Is(err, ErrRegistrationRejected), errors.Is(err, ErrInviteRequired):
+  return "rejected"
+ }
+ return "error"
+}
+
+// PrometheusMetrics internals.
+
+type promMetric struct {
+ def    metricDef
+ series map[string]*promSeries // by joined label values
+}
+
+type promSeries struct {
+ labels []string
+ value  float64  // counters and gauges
+ counts []uint64 // histograms: observations per bucket, not cumulative
+ sum    float64
+ count  uint64
+}
+
+func newPrometheusMetrics() *PrometheusMetrics {
+ m := &PrometheusMetrics{metrics: make(map[string]*promMetric, len(metricDefs))}
+ for _, def := range metricDefs {
+  m.metrics[def.name] = &promMetric{def: def, series: map[string]*promSeries{}}
+ }
+ return m
+}
+
+// update applies fn to the series of name with labelValues. Unknown metrics and
+// label counts that do not match the definition are ignored.
+func (m *PrometheusMetrics) update(name string, labelValues []string, fn func(*promSeries)) {
+ m.mu.Lock()
+ defer m.mu.Unlock()
+ pm := m.metrics[name]
+ if pm == nil || len(labelValues) != len(pm.def.labels) {
+  return
+ }
+ key := strings.Join(labelValues, "\xff")
+ s := pm.series[key]
+ if s == nil {
+  s = &promSeries{labels: append([]string(nil), labelValues...)}
+  if pm.def.typ == histogramMetric {
+   s.counts = make([]uint64, len(metricBuckets)+1) // the last is +Inf
+  }
+  pm.series[key] = s
+ }
+ fn(s)
+}
+
+func (m *PrometheusMetrics) addCounterInternal(name string, delta float64, labelValues []string) {
+ m.update(name, labelValues, func(s *promSeries) { s.value += delta })
+}
+
+func (m *PrometheusMetrics) setGaugeInternal(name string, value float64, labelValues []string) {
+ m.update(name, labelValues, func(s *promSeries) { s.value = value })
+}
+
+func (m *PrometheusMetrics) observeHistogramInternal(name string, value float64, labelValues []string) {
+ m.update(name, labelValues, func(s *promSeries) {
+  if s.counts == nil {
+   return // not a histogram
+  }
+  s.counts[sort.SearchFloat64s(metricBuckets, value)]++
+  s.sum += value
+  s.count++
+ })
+}
+
+// writeText renders the metrics in the Prometheus text exposition format.
+// Unlabeled counters are reported from zero; other series once they have a value.
+func (m *PrometheusMetrics) writeText(buf *bytes.Buffer) {
+ m.mu.Lock()
+ defer m.mu.Unlock()
+ for _, def := range metricDefs {
+  pm := m.metrics[def.name]
+  fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", def.name, def.help, def.name, def.typ)
+  if len(pm.series) == 0 && def.typ == counterMetric && len(def.labels) == 0 {
+   fmt.Fprintf(buf, "%s 0\n", def.name)
+   continue
+  }
+  keys := make([]string, 0, len(pm.series))
+  for k := range pm.series {
+   keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for _, k := range keys {
+   s := pm.series[k]
+   if def.typ != histogramMetric {
+    fmt.Fprintf(buf, "%s%s %s\n", def.name, promLabels(def.labels, s.labels, ""), promFloat(s.value))
+    continue
+   }
+   var cumulative uint64
+   for i, n := range s.counts {
+    cumulative += n
+    le := math.Inf(1)
+    if i < len(metricBuckets) {
+     le = metricBuckets[i]
+    }
+    fmt.Fprintf(buf, "%s_bucket%s %d\n", def.name, promLabels(def.labels, s.labels, promFloat(le)), cumulative)
+   }
+   fmt.Fprintf(buf, "%s_sum%s %s\n", def.name, promLabels(def.labels, s.labels, ""), promFloat(s.sum))
+   fmt.Fprintf(buf, "%s_count%s %d\n", def.name, promLabels(def.labels, s.labels, ""), s.count)
+  }
+ }
+}
+
+// promLabels formats {name="value",...}, adding le for histogram buckets.
+func promLabels(names, values []string, le string) string {
+ if len(names) == 0 && le == "" {
+  return ""
+ }
+ var b strings.Builder
+ b.WriteByte('{')
+ for i, name := range names {
+  if i > 0 {
+   b.WriteByte(',')
+  }
+  fmt.Fprintf(&b, "%s=\"%s\"", name, promEscaper.Replace(values[i]))
+ }
+ if le != "" {
+  if len(names) > 0 {
+   b.WriteByte(',')
+  }
+  fmt.Fprintf(&b, "le=\"%s\"", le)
+ }
+ b.WriteByte('}')
+ return b.String()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promFloat(v float64) string {
+ if math.IsInf(v, 1) {
+  return "+Inf"
+ }
+ return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (m *PrometheusMetrics) serveHTTPInternal(w http.ResponseWriter, r *http.Request) {
+ var buf bytes.Buffer
+ m.writeText(&buf)
+ w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+ _, _ = w.Write(buf.Bytes())
+}
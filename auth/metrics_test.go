@@ -0,0 +1,113 @@
+package auth
+
+import (
+ "context"
+ "net/http"
+ "net/http/httptest"
+ "strings"
+ "testing"
+ "time"
+)
+
+func scrape(t *testing.T, m *PrometheusMetrics) string {
+ t.Helper()
+ rr := serve(m, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+ if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+  t.Fatalf("content type %q", ct)
+ }
+ return rr.Body.String()
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+ metrics := NewPrometheusMetrics()
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionTransports = TransportCookie | TransportBearer
+  c.Metrics = metrics
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ if out := scrape(t, metrics); !strings.Contains(out, "# TYPE auth_logins_total counter\n") ||
+  !strings.Contains(out, "\nauth_logouts_total 0\n") {
+  t.Fatalf("initial exposition:\n%s", out)
+ }
+
+ if _, err := api.Register(ctx, "alice@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ _, _ = api.Register(ctx, "alice@example.com", "password123")
+ _, _ = api.Register(ctx, "not-an-email", "password123")
+ session := mustLogin(t, api, "alice@example.com", "password123")
+ _, _, _ = api.LoginToken(ctx, "alice@example.com", "wrong-password")
+ _, _, _ = api.LoginToken(ctx, "nobody@example.com", "password123")
+ mustLogin(t, api, "alice@example.com", "password123")
+
+ // Near expiry the session is renewed, then signed out.
+ now = now.Add(50 * time.Minute)
+ if _, ok, err := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", session)); !ok || err != nil {
+  t.Fatalf("CurrentUser: %v %v", ok, err)
+ }
+ if err := api.Logout(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/", session)); err != nil {
+  t.Fatalf("Logout: %v", err)
+ }
+ // The other session expires and is pruned.
+ now = now.Add(2 * time.Hour)
+ if err := api.PruneExpiredSessions(ctx); err != nil {
+  t.Fatalf("prune: %v", err)
+ }
+
+ out := scrape(t, metrics)
+ for _, want := range []string{
+  `auth_registrations_total{outcome="success"} 1`,
+  `auth_registrations_total{outcome="email_taken"} 1`,
+  `auth_registrations_total{outcome="rejected"} 1`,
+  `auth_logins_total{outcome="success"} 2`,
+  `auth_logins_total{outcome="invalid_credentials"} 2`,
+  `auth_logouts_total 1`,
+  `auth_session_refreshes_total{kind="session"} 1`,
+  `auth_janitor_pruned_sessions_total 1`,
+  `auth_janitor_duration_seconds_count 1`,
+  `auth_password_hash_duration_seconds_count{op="hash"} 2`, // the duplicate is hashed before the insert fails
+  `auth_password_hash_duration_seconds_count{op="compare"} 3`,
+  `auth_password_hash_duration_seconds_bucket{op="compare",le="+Inf"} 3`,
+  `auth_active_sessions 0`,
+ } {
+  if !strings.Contains(out, "\n"+want+"\n") {
+   t.Errorf("missing %q", want)
+  }
+ }
+ if t.Failed() {
+  t.Logf("exposition:\n%s", out)
+ }
+}
+
+func TestPrometheusMetricsFormat(t *testing.T) {
+ m := NewPrometheusMetrics()
+ m.ObserveHistogram(metricHashDuration, 0.05, "hash")
+ m.ObserveHistogram(metricHashDuration, 3, "hash")
+ m.AddCounter(metricLogins, 2, `odd"label`+"\n")
+ m.SetGauge(metricActiveSessions, 7)
+ m.AddCounter("unknown_total", 1)
+ m.AddCounter(metricLogins, 1) // wrong label count
+
+ out := scrape(t, m)
+ for _, want := range []string{
+  `auth_password_hash_duration_seconds_bucket{op="hash",le="0.025"} 0`,
+  `auth_password_hash_duration_seconds_bucket{op="hash",le="0.05"} 1`,
+  `auth_password_hash_duration_seconds_bucket{op="hash",le="2.5"} 1`,
+  `auth_password_hash_duration_seconds_bucket{op="hash",le="5"} 2`,
+  `auth_password_hash_duration_seconds_bucket{op="hash",le="+Inf"} 2`,
+  `auth_password_hash_duration_seconds_sum{op="hash"} 3.05`,
+  `auth_logins_total{outcome="odd\"label\n"} 2`,
+  `auth_active_sessions 7`,
+ } {
+  if !strings.Contains(out, "\n"+want+"\n") {
+   t.Errorf("missing %q in:\n%s", want, out)
+  }
+ }
+ if strings.Contains(out, "unknown_total") || strings.Count(out, "auth_logins_total{") != 1 {
+  t.Errorf("unexpected series in:\n%s", out)
+ }
+}
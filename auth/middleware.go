@@ -1,19 +1,41 @@
 package auth
 
 import (
+  "errors"
+  "fmt"
   "net/http"
+  "net/url"
+  "strings"
+  "time"
 )
 
 func (a *API) middlewareInternal(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-    user, ok, err := a.currentUserInternal(w, r)
+    r = a.withClientInfo(r)
+    if token, ok := a.accessTokenFromRequest(r); ok {
+      user, scopes, ok, err := a.authenticateAccessToken(r.Context(), token)
+      if err != nil {
+        a.logError(r.Context(), "access token lookup failed", err)
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+      }
+      if ok {
+        ctx := withScopes(withUser(r.Context(), user), scopes)
+        next.ServeHTTP(w, r.WithContext(ctx))
+        return
+      }
+      next.ServeHTTP(w, r)
+      return
+    }
+    user, info, ok, err := a.tracedResolveSession(w, r)
     if err != nil {
-      a.logf("currentUser error: %v", err)
+      a.logError(r.Context(), "session lookup failed", err)
       http.Error(w, "internal error", http.StatusInternalServerError)
       return
     }
     if ok {
-      next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+      ctx := withSession(withUser(r.Context(), user), info)
+      next.ServeHTTP(w, r.WithContext(ctx))
       return
     }
     next.ServeHTTP(w, r)
@@ -23,9 +45,110 @@ func (a *API) middlewareInternal(next http.Handler) http.Handler {
 func (a *API) requireAuthInternal(next http.Handler) http.Handler {
  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
   if _, ok := fromContext(r.Context()); !ok {
-   http.Error(w, "unauthorized", http.StatusUnauthorized)
+   a.unauthorized(w, r)
    return
   }
   next.ServeHTTP(w, r)
  })
+}
+
+// unauthorized answers a request that lacks an authenticated user: through
+// UnauthorizedHandler if set, else page loads are sent to LoginURL and everything
+// else gets 401, as JSON unless the client asked for HTML.
+func (a *API) unauthorized(w http.ResponseWriter, r *http.Request) {
+ if h := a.cfg.UnauthorizedHandler; h != nil {
+  h.ServeHTTP(w, r)
+  return
+ }
+ w.Header().Add("Vary", "Accept")
+ html := acceptsHTML(r)
+ if html && a.cfg.LoginURL != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+  loginRedirect(w, r, a.cfg.LoginURL)
+  return
+ }
+ if a.cfg.SessionTransports&(TransportBearer|TransportAccessToken) != 0 {
+  w.Header().Set("WWW-Authenticate", `Bearer`)
+ }
+ if html {
+  http.Error(w, "unauthorized", http.StatusUnauthorized)
+  return
+ }
+ writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+}
+
+// requireRecentAuthInternal passes requests whose session authenticated within
+// maxAge (RecentAuthWindow if <= 0).
+func (a *API) requireRecentAuthInternal(maxAge time.Duration) func(http.Handler) http.Handler {
+ if maxAge <= 0 {
+  maxAge = a.cfg.RecentAuthWindow
+ }
+ return func(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+   _, err := a.requireRecentAuth(w, r, maxAge)
+   switch {
+   case err == nil:
+    next.ServeHTTP(w, r)
+   case errors.Is(err, ErrNoSession):
+    a.unauthorized(w, r)
+   case errors.Is(err, ErrReauthRequired):
+    a.reauthRequired(w, r, maxAge)
+   default:
+    a.logError(r.Context(), "recent auth check failed", err)
+    http.Error(w, "internal error", http.StatusInternalServerError)
+   }
+  })
+ }
+}
+
+// reauthRequired answers a request whose sign-in is too old: page loads are sent
+// to ReauthURL, everything else gets 401 with an RFC 9470 step-up challenge.
+func (a *API) reauthRequired(w http.ResponseWriter, r *http.Request, maxAge time.Duration) {
+ w.Header().Add("Vary", "Accept")
+ html := acceptsHTML(r)
+ if html && a.cfg.ReauthURL != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+  loginRedirect(w, r, a.cfg.ReauthURL)
+  return
+ }
+ if a.cfg.SessionTransports&TransportBearer != 0 {
+  w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int64(maxAge.Seconds())))
+ }
+ if html {
+  http.Error(w, ErrReauthRequired.Error(), http.StatusUnauthorized)
+  return
+ }
+ writeJSON(w, http.StatusUnauthorized, map[string]string{"error": ErrReauthRequired.Error()})
+}
+
+// acceptsHTML reports whether the client asked for an HTML page, as browsers do
+// when navigating.
+func acceptsHTML(r *http.Request) bool {
+ return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// loginRedirect sends the client to login with the original request URI as the
+// "next" query parameter.
+func loginRedirect(w http.ResponseWriter, r *http.Request, login string) {
+ back := r.RequestURI // the original URI, unaffected by http.StripPrefix
+ if !strings.HasPrefix(back, "/") {
+  back = r.URL.RequestURI()
+ }
+ sep := "?"
+ if strings.Contains(login, "?") {
+  sep = "&"
+ }
+ w.Header().Set("Cache-Control", "no-store")
+ http.Redirect(w, r, login+sep+"next="+url.QueryEscape(back), http.StatusFound)
+}
+
+// safeNextPath returns next if it is a path on this site, else "". Scheme-relative
+// ("//host") and backslash forms, which browsers treat as other hosts, are refused.
+func safeNextPath(next string) string {
+ if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n\t") {
+  return ""
+ }
+ u, err := url.Parse(next)
+ if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+  return ""
+ }
+ return next
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ import (
  "context"
  "net/http"
  "net/http/httptest"
+ "net/url"
  "strings"
  "testing"
 )
@@ -65,4 +66,69 @@ func TestRequireAuth(t *testing.T) {
  if w2.Code != http.StatusOK {
   t.Fatalf("expected 200, got %d", w2.Code)
  }
-}
\ No newline at end of file
+}
+func TestRequireAuthResponses(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.LoginURL = "/login"
+ })
+ defer cleanup()
+ protected := api.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+ // Browsers navigating to a page are sent to the login page.
+ r := httptest.NewRequest(http.MethodGet, "/reports?year=2024", nil)
+ r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+ rr := serve(protected, r)
+ if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/login?next="+url.QueryEscape("/reports?year=2024") {
+  t.Fatalf("browser: %d %q", rr.Code, rr.Header().Get("Location"))
+ }
+
+ // API clients get a JSON 401.
+ r = httptest.NewRequest(http.MethodGet, "/reports", nil)
+ r.Header.Set("Accept", "application/json")
+ rr = serve(protected, r)
+ if rr.Code != http.StatusUnauthorized || decodeJSON(t, rr)["error"] != "unauthorized" {
+  t.Fatalf("API client: %d %s", rr.Code, rr.Body.String())
+ }
+
+ // Form posts are not redirected: the submission would be lost.
+ r = httptest.NewRequest(http.MethodPost, "/reports", nil)
+ r.Header.Set("Accept", "text/html")
+ if rr := serve(protected, r); rr.Code != http.StatusUnauthorized {
+  t.Fatalf("browser POST: %d", rr.Code)
+ }
+}
+
+func TestRequireAuthUnauthorizedHandler(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.LoginURL = "/login"
+  c.UnauthorizedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+   http.Error(w, "sign in first", http.StatusTeapot)
+  })
+ })
+ defer cleanup()
+ protected := api.RequireRole("staff")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+ r := httptest.NewRequest(http.MethodGet, "/reports", nil)
+ r.Header.Set("Accept", "text/html")
+ if rr := serve(protected, r); rr.Code != http.StatusTeapot {
+  t.Fatalf("hook not used: %d", rr.Code)
+ }
+}
+
+func TestNextPath(t *testing.T) {
+ for next, want := range map[string]string{
+  "/reports?x=1":         "/reports?x=1",
+  "/":                    "/",
+  "":                     "/home",
+  "reports":              "/home",
+  "//evil.example":       "/home",
+  "/\\evil.example":      "/home",
+  "https://evil.example": "/home",
+  "/a\nb":                "/home",
+ } {
+  r := httptest.NewRequest(http.MethodGet, "/login?next="+url.QueryEscape(next), nil)
+  if got := NextPath(r, "/home"); got != want {
+   t.Errorf("NextPath(%q) = %q, want %q", next, got, want)
+  }
+ }
+}
@@ -1,6 +1,9 @@
 package auth
 
-import "fmt"
+import (
+  "database/sql"
+  "fmt"
+)
 
 func (a *API) migrate() error {
   tx, err := a.db.Begin()
@@ -14,7 +17,8 @@ func (a *API) migrate() error {
       id INTEGER PRIMARY KEY AUTOINCREMENT,
       email TEXT NOT NULL UNIQUE,
       password_hash BLOB NOT NULL,
-      created_at INTEGER NOT NULL
+      created_at INTEGER NOT NULL,
+      session_version INTEGER NOT NULL DEFAULT 0
     );`,
     `CREATE TABLE IF NOT EXISTS sessions (
       id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -22,9 +26,209 @@ func (a *API) migrate() error {
       user_id INTEGER NOT NULL,
       expires_at INTEGER NOT NULL,
       created_at INTEGER NOT NULL,
+      last_used_at INTEGER NOT NULL DEFAULT 0,
+      active_org_id INTEGER NOT NULL DEFAULT 0,
       FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
     );`,
     `CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);`,
+    `CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`,
+    `CREATE TABLE IF NOT EXISTS access_tokens (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      user_id INTEGER NOT NULL,
+      name TEXT NOT NULL,
+      token_hash BLOB NOT NULL UNIQUE,
+      hint TEXT NOT NULL,
+      scopes TEXT NOT NULL DEFAULT '',
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL DEFAULT 0,
+      last_used_at INTEGER NOT NULL DEFAULT 0,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens(user_id);`,
+    `CREATE TABLE IF NOT EXISTS refresh_tokens (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      token_hash BLOB NOT NULL UNIQUE,
+      family TEXT NOT NULL,
+      user_id INTEGER NOT NULL,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      used_at INTEGER NOT NULL DEFAULT 0,
+      revoked_at INTEGER NOT NULL DEFAULT 0,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family);`,
+    `CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);`,
+    `CREATE TABLE IF NOT EXISTS roles (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      name TEXT NOT NULL UNIQUE,
+      created_at INTEGER NOT NULL
+    );`,
+    `CREATE TABLE IF NOT EXISTS role_permissions (
+      role_id INTEGER NOT NULL,
+      permission TEXT NOT NULL,
+      PRIMARY KEY(role_id, permission),
+      FOREIGN KEY(role_id) REFERENCES roles(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS user_roles (
+      user_id INTEGER NOT NULL,
+      role_id INTEGER NOT NULL,
+      created_at INTEGER NOT NULL,
+      PRIMARY KEY(user_id, role_id),
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      FOREIGN KEY(role_id) REFERENCES roles(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS organizations (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      name TEXT NOT NULL,
+      created_at INTEGER NOT NULL
+    );`,
+    `CREATE TABLE IF NOT EXISTS memberships (
+      org_id INTEGER NOT NULL,
+      user_id INTEGER NOT NULL,
+      role TEXT NOT NULL,
+      created_at INTEGER NOT NULL,
+      PRIMARY KEY(org_id, user_id),
+      FOREIGN KEY(org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_memberships_user_id ON memberships(user_id);`,
+    `CREATE TABLE IF NOT EXISTS identities (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      provider TEXT NOT NULL,
+      subject TEXT NOT NULL,
+      user_id INTEGER NOT NULL,
+      email TEXT NOT NULL DEFAULT '',
+      created_at INTEGER NOT NULL,
+      last_login_at INTEGER NOT NULL DEFAULT 0,
+      UNIQUE(provider, subject),
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities(user_id);`,
+    `CREATE TABLE IF NOT EXISTS oidc_states (
+      state_hash BLOB PRIMARY KEY,
+      provider TEXT NOT NULL,
+      nonce TEXT NOT NULL,
+      code_verifier TEXT NOT NULL,
+      link_user_id INTEGER NOT NULL DEFAULT 0,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL
+    );`,
+    `CREATE TABLE IF NOT EXISTS oauth_clients (
+      id TEXT PRIMARY KEY,
+      name TEXT NOT NULL,
+      secret_hash BLOB,
+      redirect_uris TEXT NOT NULL,
+      skip_consent INTEGER NOT NULL DEFAULT 0,
+      scopes TEXT NOT NULL DEFAULT '',
+      created_at INTEGER NOT NULL
+    );`,
+    `CREATE TABLE IF NOT EXISTS oauth_consents (
+      user_id INTEGER NOT NULL,
+      client_id TEXT NOT NULL,
+      scope TEXT NOT NULL,
+      created_at INTEGER NOT NULL,
+      PRIMARY KEY(user_id, client_id),
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      FOREIGN KEY(client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS oauth_consent_requests (
+      handle_hash BLOB PRIMARY KEY,
+      client_id TEXT NOT NULL,
+      user_id INTEGER NOT NULL,
+      redirect_uri TEXT NOT NULL,
+      scope TEXT NOT NULL,
+      state TEXT NOT NULL,
+      nonce TEXT NOT NULL,
+      code_challenge TEXT NOT NULL,
+      auth_time INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      FOREIGN KEY(client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS oauth_codes (
+      handle_hash BLOB PRIMARY KEY,
+      client_id TEXT NOT NULL,
+      user_id INTEGER NOT NULL,
+      redirect_uri TEXT NOT NULL,
+      scope TEXT NOT NULL,
+      state TEXT NOT NULL,
+      nonce TEXT NOT NULL,
+      code_challenge TEXT NOT NULL,
+      auth_time INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+      FOREIGN KEY(client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS oidc_signing_keys (
+      kid TEXT PRIMARY KEY,
+      private_key BLOB NOT NULL,
+      created_at INTEGER NOT NULL,
+      retired_at INTEGER NOT NULL DEFAULT 0
+    );`,
+    `CREATE TABLE IF NOT EXISTS device_codes (
+      device_code_hash BLOB PRIMARY KEY,
+      user_code TEXT NOT NULL UNIQUE,
+      client_id TEXT NOT NULL,
+      scope TEXT NOT NULL,
+      status INTEGER NOT NULL DEFAULT 0,
+      user_id INTEGER,
+      confirm_hash BLOB,
+      confirm_user_id INTEGER,
+      poll_interval INTEGER NOT NULL,
+      last_polled_at INTEGER NOT NULL DEFAULT 0,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS invites (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      email TEXT NOT NULL,
+      token_hash BLOB NOT NULL UNIQUE,
+      org_id INTEGER,
+      role TEXT NOT NULL DEFAULT '',
+      invited_by INTEGER NOT NULL,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      accepted_at INTEGER NOT NULL DEFAULT 0,
+      accepted_by INTEGER NOT NULL DEFAULT 0,
+      FOREIGN KEY(org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+      FOREIGN KEY(invited_by) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    `CREATE TABLE IF NOT EXISTS auth_events (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      type TEXT NOT NULL,
+      user_id INTEGER NOT NULL DEFAULT 0,
+      email TEXT NOT NULL DEFAULT '',
+      ip TEXT NOT NULL DEFAULT '',
+      user_agent TEXT NOT NULL DEFAULT '',
+      success INTEGER NOT NULL,
+      detail TEXT NOT NULL DEFAULT '',
+      created_at INTEGER NOT NULL
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_auth_events_user_id ON auth_events(user_id);`,
+    `CREATE INDEX IF NOT EXISTS idx_auth_events_created_at ON auth_events(created_at);`,
+    `CREATE TABLE IF NOT EXISTS password_resets (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      user_id INTEGER NOT NULL,
+      token_hash BLOB NOT NULL UNIQUE,
+      created_at INTEGER NOT NULL,
+      expires_at INTEGER NOT NULL,
+      FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );`,
+    // No foreign key: an event outlives a deleted user until it is delivered.
+    `CREATE TABLE IF NOT EXISTS webhook_outbox (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      type TEXT NOT NULL,
+      user_id INTEGER NOT NULL,
+      email TEXT NOT NULL DEFAULT '',
+      created_at INTEGER NOT NULL,
+      attempts INTEGER NOT NULL DEFAULT 0,
+      next_attempt_at INTEGER NOT NULL,
+      last_error TEXT NOT NULL DEFAULT '',
+      delivered_at INTEGER,
+      failed_at INTEGER
+    );`,
+    `CREATE INDEX IF NOT EXISTS idx_webhook_outbox_next_attempt_at ON webhook_outbox(next_attempt_at);`,
   }
 
   for _, s := range stmts {
@@ -32,8 +236,57 @@ func (a *API) migrate() error {
       return fmt.Errorf("migrate step: %w", err)
     }
   }
+
+  // Columns added after the initial schema; CREATE TABLE IF NOT EXISTS does not
+  // touch tables created by older versions.
+  columns := []struct{ table, column, decl string }{
+    {"sessions", "last_used_at", "INTEGER NOT NULL DEFAULT 0"},
+    {"users", "session_version", "INTEGER NOT NULL DEFAULT 0"},
+    {"sessions", "active_org_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"oidc_states", "link_user_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"refresh_tokens", "client_id", "TEXT NOT NULL DEFAULT ''"},
+    {"refresh_tokens", "scope", "TEXT NOT NULL DEFAULT ''"},
+    {"sessions", "csrf_token", "TEXT NOT NULL DEFAULT ''"},
+    {"sessions", "authenticated_at", "INTEGER NOT NULL DEFAULT 0"},
+    {"oauth_clients", "scopes", "TEXT NOT NULL DEFAULT ''"},
+  }
+  for _, c := range columns {
+    if err := addColumnIfMissing(tx, c.table, c.column, c.decl); err != nil {
+      return fmt.Errorf("migrate column %s.%s: %w", c.table, c.column, err)
+    }
+  }
   if err := tx.Commit(); err != nil {
     return fmt.Errorf("migrate commit: %w", err)
   }
   return nil
 }
+
+
+func addColumnIfMissing(tx txHandle, table, column, decl string) error {
+  rows, err := tx.Query(`PRAGMA table_info(` + table + `)`)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var (
+      cid     int
+      name    string
+      typ     string
+      notNull int
+      dflt    sql.NullString
+      pk      int
+    )
+    if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+      return err
+    }
+    if name == column {
+      return nil
+    }
+  }
+  if err := rows.Err(); err != nil {
+    return err
+  }
+  _, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+  return err
+}
@@ -0,0 +1,490 @@
+package auth
+
+import (
+ "context"
+ "crypto"
+ "crypto/sha256"
+ "crypto/subtle"
+ "database/sql"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "io"
+ "net/http"
+ "net/url"
+ "strings"
+ "sync"
+ "time"
+)
+
+// oidcStateTTL bounds how long a user may take at the provider before returning.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcClient is the runtime state of a configured OIDCProvider.
+type oidcClient struct {
+ cfg    OIDCProvider
+ client *http.Client
+ now    func() time.Time
+
+ mu   sync.Mutex
+ meta *oidcMetadata
+ keys *remoteKeySet
+}
+
+// oidcMetadata is the subset of the provider's discovery document we use.
+type oidcMetadata struct {
+ Issuer                string `json:"issuer"`
+ AuthorizationEndpoint string `json:"authorization_endpoint"`
+ TokenEndpoint         string `json:"token_endpoint"`
+ JWKSURI               string `json:"jwks_uri"`
+}
+
+// externalIdentity is a verified (provider, subject) pair from an ID token.
+type externalIdentity struct {
+ provider      string
+ subject       string
+ email         string
+ emailVerified bool
+}
+
+func newOIDCClients(providers []OIDCProvider, now func() time.Time) (map[string]*oidcClient, error) {
+ if len(providers) == 0 {
+  return nil, nil
+ }
+ out := make(map[string]*oidcClient, len(providers))
+ for _, p := range providers {
+  if p.Name == "" || p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+   return nil, fmt.Errorf("oidc provider %q: Name, Issuer, ClientID and RedirectURL are required", p.Name)
+  }
+  if _, dup := out[p.Name]; dup {
+   return nil, fmt.Errorf("oidc provider %q configured twice", p.Name)
+  }
+  if len(p.Scopes) == 0 {
+   p.Scopes = []string{"openid", "email", "profile"}
+  } else if !containsString(p.Scopes, "openid") {
+   p.Scopes = append([]string{"openid"}, p.Scopes...)
+  }
+  c := &oidcClient{cfg: p, client: p.HTTPClient, now: now}
+  if c.client == nil {
+   c.client = &http.Client{Timeout: 10 * time.Second}
+  }
+  out[p.Name] = c
+ }
+ return out, nil
+}
+
+// metadata fetches and caches the discovery document. Failures are not cached. The
+// fetch runs without holding mu; if several race, the first stored result wins.
+func (c *oidcClient) metadata(ctx context.Context) (*oidcMetadata, *remoteKeySet, error) {
+ c.mu.Lock()
+ meta, keys := c.meta, c.keys
+ c.mu.Unlock()
+ if meta != nil {
+  return meta, keys, nil
+ }
+ m, err := c.fetchMetadata(ctx)
+ if err != nil {
+  return nil, nil, err
+ }
+ c.mu.Lock()
+ defer c.mu.Unlock()
+ if c.meta == nil {
+  c.meta = m
+  c.keys = &remoteKeySet{url: m.JWKSURI, client: c.client, now: c.now}
+ }
+ return c.meta, c.keys, nil
+}
+
+func (c *oidcClient) fetchMetadata(ctx context.Context) (*oidcMetadata, error) {
+ u := strings.TrimSuffix(c.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+ req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+ if err != nil {
+  return nil, err
+ }
+ req.Header.Set("Accept", "application/json")
+ res, err := c.client.Do(req)
+ if err != nil {
+  return nil, fmt.Errorf("oidc discovery: %w", err)
+ }
+ defer res.Body.Close()
+ if res.StatusCode != http.StatusOK {
+  return nil, fmt.Errorf("oidc discovery: status %d", res.StatusCode)
+ }
+ var m oidcMetadata
+ if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&m); err != nil {
+  return nil, fmt.Errorf("decode oidc discovery: %w", err)
+ }
+ if m.Issuer != c.cfg.Issuer {
+  return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", m.Issuer, c.cfg.Issuer)
+ }
+ if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+  return nil, fmt.Errorf("oidc discovery: incomplete provider metadata")
+ }
+ return &m, nil
+}
+
+// exchangeCode redeems an authorization code (with its PKCE verifier) for an ID token.
+func (c *oidcClient) exchangeCode(ctx context.Context, tokenURL, code, verifier string) (string, error) {
+ form := url.Values{
+  "grant_type":    {"authorization_code"},
+  "code":          {code},
+  "redirect_uri":  {c.cfg.RedirectURL},
+  "code_verifier": {verifier},
+  "client_id":     {c.cfg.ClientID},
+ }
+ req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+ if err != nil {
+  return "", err
+ }
+ req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+ req.Header.Set("Accept", "application/json")
+ if c.cfg.ClientSecret != "" {
+  // client_secret_basic; credentials are form-encoded first (RFC 6749 §2.3.1).
+  req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+ }
+ res, err := c.client.Do(req)
+ if err != nil {
+  return "", fmt.Errorf("oidc token request: %w", err)
+ }
+ defer res.Body.Close()
+ var body struct {
+  IDToken          string `json:"id_token"`
+  Error            string `json:"error"`
+  ErrorDescription string `json:"error_description"`
+ }
+ if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil {
+  return "", fmt.Errorf("decode oidc token response: %w", err)
+ }
+ if res.StatusCode != http.StatusOK || body.Error != "" {
+  return "", fmt.Errorf("oidc token request: status %d: %s %s", res.StatusCode, body.Error, body.ErrorDescription)
+ }
+ if body.IDToken == "" {
+  return "", errors.New("oidc token response has no id_token")
+ }
+ return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature against the provider JWKS, its
+// iss/aud/exp and the nonce bound to the login attempt.
+func (c *oidcClient) verifyIDToken(ctx context.Context, keys *remoteKeySet, token, nonce string) (externalIdentity, error) {
+ claims, err := parseJWT(token, func(kid string) (crypto.PublicKey, error) {
+  return keys.key(ctx, kid)
+ })
+ if err != nil {
+  return externalIdentity{}, err
+ }
+ if err := validateJWTClaims(claims, c.cfg.Issuer, c.cfg.ClientID, c.now().Unix(), int64(defaultJWTLeeway.Seconds())); err != nil {
+  return externalIdentity{}, err
+ }
+ if azp, ok := claims["azp"].(string); ok && azp != c.cfg.ClientID {
+  return externalIdentity{}, errors.New("oidc: azp mismatch")
+ }
+ if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+  return externalIdentity{}, errors.New("oidc: nonce mismatch")
+ }
+ sub, _ := claims["sub"].(string)
+ if sub == "" {
+  return externalIdentity{}, errors.New("oidc: missing sub")
+ }
+ id := externalIdentity{provider: c.cfg.Name, subject: sub}
+ id.email, _ = claims["email"].(string)
+ // Some providers send email_verified as a string.
+ switch v := claims["email_verified"].(type) {
+ case bool:
+  id.emailVerified = v
+ case string:
+  id.emailVerified = v == "true"
+ }
+ return id, nil
+}
+
+func (a *API) oidcCookieName() string {
+ return a.cfg.SessionName + "_oidc"
+}
+
+// oidcLoginInternal starts a sign-in flow with provider.
+func (a *API) oidcLoginInternal(w http.ResponseWriter, r *http.Request, provider string) error {
+ return a.startOIDCFlow(w, r, provider, 0)
+}
+
+// startOIDCFlow starts an authorization-code flow: state, nonce and the PKCE verifier
+// are stored server-side, the state is also bound to the browser with a cookie, and
+// the user is redirected to the provider. A non-zero linkUserID marks the flow as
+// linking an identity to that user rather than signing in.
+func (a *API) startOIDCFlow(w http.ResponseWriter, r *http.Request, provider string, linkUserID int64) error {
+ c, ok := a.oidc[provider]
+ if !ok {
+  return ErrUnknownProvider
+ }
+ ctx := r.Context()
+ meta, _, err := c.metadata(ctx)
+ if err != nil {
+  return err
+ }
+ var vals [3]string // state, nonce, PKCE verifier
+ for i := range vals {
+  if vals[i], err = newSessionToken(); err != nil {
+   return err
+  }
+ }
+ state, nonce, verifier := vals[0], vals[1], vals[2]
+ sum := sha256.Sum256([]byte(state))
+ now := a.now()
+ if _, err := a.db.ExecContext(ctx, `
+  INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, link_user_id, created_at, expires_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+ `, sum[:], provider, nonce, verifier, linkUserID, now.Unix(), now.Add(oidcStateTTL).Unix()); err != nil {
+  return fmt.Errorf("insert oidc state: %w", err)
+ }
+
+ challenge := sha256.Sum256([]byte(verifier))
+ u, err := url.Parse(meta.AuthorizationEndpoint)
+ if err != nil {
+  return fmt.Errorf("oidc authorization endpoint: %w", err)
+ }
+ q := u.Query()
+ q.Set("response_type", "code")
+ q.Set("client_id", c.cfg.ClientID)
+ q.Set("redirect_uri", c.cfg.RedirectURL)
+ q.Set("scope", strings.Join(c.cfg.Scopes, " "))
+ q.Set("state", state)
+ q.Set("nonce", nonce)
+ q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+ q.Set("code_challenge_method", "S256")
+ u.RawQuery = q.Encode()
+
+ a.setAuxCookie(w, a.oidcCookieName(), state, oidcStateTTL)
+ http.Redirect(w, r, u.String(), http.StatusFound)
+ return nil
+}
+
+// oidcCallbackInternal completes a flow started by startOIDCFlow. Sign-in flows log
+// the user in, creating the account on first sign-in; link flows attach the identity
+// to the still signed-in user and leave the session alone.
+func (a *API) oidcCallbackInternal(w http.ResponseWriter, r *http.Request, provider string) (User, error) {
+ ctx := r.Context()
+ ext, linkUserID, err := a.oidcExchange(w, r, provider)
+ if err != nil {
+  return User{}, err
+ }
+ if linkUserID != 0 {
+  user, _, err := a.currentSession(w, r)
+  if err != nil {
+   return User{}, err
+  }
+  if user.ID != linkUserID {
+   return User{}, ErrInvalidOIDCState
+  }
+  if err := a.linkIdentity(ctx, user.ID, ext); err != nil {
+   return User{}, err
+  }
+  return user, nil
+ }
+ user, err := a.userForIdentity(ctx, ext)
+ if err != nil {
+  return User{}, err
+ }
+ if err = a.beforeLogin(ctx, user); err == nil {
+  if err = a.createSessionAndSetCookie(w, ctx, user.ID); err != nil {
+   err = fmt.Errorf("create session: %w", err)
+  }
+ }
+ a.recordSignIn(ctx, "oidc:"+provider, user, err)
+ if err != nil {
+  return User{}, err
+ }
+ return user, nil
+}
+
+// oidcExchange validates the callback request against the stored state and returns
+// the verified identity from the provider's ID token, plus the state's link target.
+func (a *API) oidcExchange(w http.ResponseWriter, r *http.Request, provider string) (externalIdentity, int64, error) {
+ c, ok := a.oidc[provider]
+ if !ok {
+  return externalIdentity{}, 0, ErrUnknownProvider
+ }
+ ctx := r.Context()
+ q := r.URL.Query()
+ if e := q.Get("error"); e != "" {
+  return externalIdentity{}, 0, fmt.Errorf("oidc provider error: %s %s", e, q.Get("error_description"))
+ }
+ state, code := q.Get("state"), q.Get("code")
+ cookie, err := r.Cookie(a.oidcCookieName())
+ if err != nil || state == "" || code == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+  return externalIdentity{}, 0, ErrInvalidOIDCState
+ }
+ a.setAuxCookie(w, a.oidcCookieName(), "", 0)
+
+ st, err := a.consumeOIDCState(ctx, provider, state)
+ if err != nil {
+  return externalIdentity{}, 0, err
+ }
+ meta, keys, err := c.metadata(ctx)
+ if err != nil {
+  return externalIdentity{}, 0, err
+ }
+ idToken, err := c.exchangeCode(ctx, meta.TokenEndpoint, code, st.verifier)
+ if err != nil {
+  return externalIdentity{}, 0, err
+ }
+ ext, err := c.verifyIDToken(ctx, keys, idToken, st.nonce)
+ return ext, st.linkUserID, err
+}
+
+// oidcState is a pending authorization request.
+type oidcState struct {
+ nonce      string
+ verifier   string
+ linkUserID int64
+}
+
+// consumeOIDCState deletes a pending login state (single use) and returns it.
+func (a *API) consumeOIDCState(ctx context.Context, provider, state string) (oidcState, error) {
+ sum := sha256.Sum256([]byte(state))
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return oidcState{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var (
+  st        oidcState
+  p         string
+  expiresAt int64
+ )
+ err = tx.QueryRowContext(ctx, `
+  SELECT provider, nonce, code_verifier, link_user_id, expires_at FROM oidc_states WHERE state_hash = ?
+ `, sum[:]).Scan(&p, &st.nonce, &st.verifier, &st.linkUserID, &expiresAt)
+ if errors.Is(err, sql.ErrNoRows) {
+  return oidcState{}, ErrInvalidOIDCState
+ }
+ if err != nil {
+  return oidcState{}, fmt.Errorf("query oidc state: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `DELETE FROM oidc_states WHERE state_hash = ?`, sum[:]); err != nil {
+  return oidcState{}, fmt.Errorf("delete oidc state: %w", err)
+ }
+ if err := tx.Commit(); err != nil {
+  return oidcState{}, fmt.Errorf("commit: %w", err)
+ }
+ if p != provider || a.now().Unix() >= expiresAt {
+  return oidcState{}, ErrInvalidOIDCState
+ }
+ return st, nil
+}
+
+// userForIdentity returns the user linked to ext, registering a new password-less
+// account on first sign-in. New accounts need an email the provider verified and
+// go through the registration policy and InviteOnly; an email that already belongs
+// to an account is not taken over unless OIDCAutoLinkVerifiedEmail is set and the
+// provider verified the email.
+func (a *API) userForIdentity(ctx context.Context, ext externalIdentity) (User, error) {
+ user, ok, err := a.linkedUser(ctx, ext)
+ if err != nil || ok {
+  return user, err
+ }
+ if a.cfg.OIDCAutoLinkVerifiedEmail && ext.emailVerified {
+  var (
+   id, uc int64
+   email  string
+  )
+  err := a.db.QueryRowContext(ctx, `
+   SELECT id, email, created_at FROM users WHERE email = ?
+  `, normalizeEmail(ext.email)).Scan(&id, &email, &uc)
+  if err == nil {
+   if err := a.linkIdentity(ctx, id, ext); err != nil {
+    return User{}, err
+   }
+   return User{ID: id, Email: email, CreatedAt: time.Unix(uc, 0)}, nil
+  }
+  if !errors.Is(err, sql.ErrNoRows) {
+   return User{}, fmt.Errorf("query user: %w", err)
+  }
+ }
+ user, err = a.registerIdentity(ctx, ext)
+ a.recordRegistration(ctx, ext.email, "oidc:"+ext.provider, user, err)
+ if err != nil {
+  return User{}, err
+ }
+ return user, nil
+}
+
+// registerIdentity creates the account for ext's first sign-in.
+func (a *API) registerIdentity(ctx context.Context, ext externalIdentity) (User, error) {
+ if a.cfg.InviteOnly {
+  return User{}, ErrInviteRequired
+ }
+ // Anyone could claim an unverified address at the provider and so keep its
+ // owner from registering.
+ if !ext.emailVerified {
+  return User{}, ErrEmailNotVerified
+ }
+ email := normalizeEmail(ext.email)
+ if !validEmailBasic(email) {
+  return User{}, ErrInvalidEmail
+ }
+ if err := a.checkRegistrationPolicy(ctx, email); err != nil {
+  return User{}, err
+ }
+
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return User{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ // An empty password hash never matches, so the account has no password sign-in.
+ user, err := a.insertUserTx(ctx, tx, email, []byte{})
+ if err != nil {
+  return User{}, err
+ }
+ if err := a.insertIdentityTx(ctx, tx, user.ID, ext); err != nil {
+  return User{}, err
+ }
+ if err := a.enqueueWebhookTx(ctx, tx, EventRegister, user.ID); err != nil {
+  return User{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return User{}, fmt.Errorf("commit: %w", err)
+ }
+ return user, nil
+}
+
+// linkedUser looks up the user linked to ext and records the sign-in.
+func (a *API) linkedUser(ctx context.Context, ext externalIdentity) (User, bool, error) {
+ var (
+  id, uc int64
+  email  string
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT u.id, u.email, u.created_at
+  FROM identities i
+  JOIN users u ON u.id = i.user_id
+  WHERE i.provider = ? AND i.subject = ?
+ `, ext.provider, ext.subject).Scan(&id, &email, &uc)
+ if errors.Is(err, sql.ErrNoRows) {
+  return User{}, false, nil
+ }
+ if err != nil {
+  return User{}, false, fmt.Errorf("query identity: %w", err)
+ }
+ if _, err := a.db.ExecContext(ctx, `
+  UPDATE identities SET email = ?, last_login_at = ? WHERE provider = ? AND subject = ?
+ `, ext.email, a.now().Unix(), ext.provider, ext.subject); err != nil {
+  a.logError(ctx, "identity last login update failed", err, userAttr(id))
+ }
+ return User{ID: id, Email: email, CreatedAt: time.Unix(uc, 0)}, true, nil
+}
+
+func (a *API) insertIdentityTx(ctx context.Context, tx txHandle, userID int64, ext externalIdentity) error {
+ now := a.now().Unix()
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO identities (provider, subject, user_id, email, created_at, last_login_at)
+  VALUES (?, ?, ?, ?, ?, ?)
+ `, ext.provider, ext.subject, userID, ext.email, now, now); err != nil {
+  if strings.Contains(strings.ToLower(err.Error()), "unique") {
+   return ErrIdentityLinked
+  }
+  return fmt.Errorf("insert identity: %w", err)
+ }
+ return nil
+}
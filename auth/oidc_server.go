@@ -0,0 +1,603 @@
+package auth
+
+import (
+ "context"
+ "crypto"
+ "crypto/sha256"
+ "crypto/subtle"
+ "database/sql"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "html/template"
+ "net/http"
+ "net/url"
+ "strconv"
+ "strings"
+)
+
+// oidcServerScopes are the scopes the provider understands; others are dropped.
+var oidcServerScopes = []string{"openid", "email", "profile", "offline_access"}
+
+var defaultConsentTemplate = template.Must(template.New("consent").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>Authorize {{.ClientName}}</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<p><strong>{{.ClientName}}</strong> wants to access your account {{.User.Email}}:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+<input type="hidden" name="consent_id" value="{{.ConsentID}}">
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body></html>
+`))
+
+func newOIDCServer(cfg *OIDCServerConfig) (*oidcServer, error) {
+ if cfg == nil {
+  return nil, nil
+ }
+ u, err := url.Parse(cfg.Issuer)
+ if err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+  return nil, fmt.Errorf("OIDCServer.Issuer must be an absolute URL without query or fragment")
+ }
+ return &oidcServer{cfg: *cfg, signers: map[string]crypto.Signer{}}, nil
+}
+
+func (s *oidcServer) endpoint(path string) string {
+ return strings.TrimSuffix(s.cfg.Issuer, "/") + path
+}
+
+func (a *API) oidcServerHandlerInternal() http.Handler {
+ mux := http.NewServeMux()
+ mux.HandleFunc("/.well-known/openid-configuration", a.oidcDiscovery)
+ mux.HandleFunc("/jwks", a.oidcJWKS)
+ mux.HandleFunc("/authorize", a.oidcAuthorize)
+ mux.HandleFunc("/token", a.oidcToken)
+ mux.HandleFunc("/userinfo", a.oidcUserinfo)
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if a.oidcServer == nil {
+   http.NotFound(w, r)
+   return
+  }
+  mux.ServeHTTP(w, r)
+ })
+}
+
+func (a *API) oidcDiscovery(w http.ResponseWriter, r *http.Request) {
+ s := a.oidcServer
+ writeJSON(w, http.StatusOK, map[string]any{
+  "issuer":                                s.cfg.Issuer,
+  "authorization_endpoint":                s.endpoint("/authorize"),
+  "token_endpoint":                        s.endpoint("/token"),
+  "userinfo_endpoint":                     s.endpoint("/userinfo"),
+  "jwks_uri":                              s.endpoint("/jwks"),
+  "response_types_supported":              []string{"code"},
+  "grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+  "subject_types_supported":               []string{"public"},
+  "id_token_signing_alg_values_supported": []string{string(s.cfg.SigningAlgorithm)},
+  "scopes_supported":                      oidcServerScopes,
+  "token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+  "code_challenge_methods_supported":      []string{"S256"},
+  "claims_supported":                      s.claimsSupported(),
+ })
+}
+
+func (s *oidcServer) claimsSupported() []string {
+ claims := []string{"sub", "email", "iss", "aud", "exp", "iat", "auth_time", "nonce"}
+ if s.cfg.EmailVerified {
+  claims = append(claims, "email_verified")
+ }
+ return claims
+}
+
+func (a *API) oidcJWKS(w http.ResponseWriter, r *http.Request) {
+ keys, err := a.signingKeys(r.Context())
+ if err != nil {
+  a.logError(r.Context(), "oidc signing keys failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ var set jwkSet
+ for _, k := range keys {
+  j, err := jwkFromPublicKey(k.ID, k.Key.Public())
+  if err != nil {
+   continue
+  }
+  set.Keys = append(set.Keys, j)
+ }
+ w.Header().Set("Cache-Control", "public, max-age=300")
+ writeJSON(w, http.StatusOK, set)
+}
+
+// oidcAuthorize handles GET authorization requests and the POSTed consent decision.
+func (a *API) oidcAuthorize(w http.ResponseWriter, r *http.Request) {
+ switch r.Method {
+ case http.MethodGet:
+  a.oidcAuthorizeRequest(w, r)
+ case http.MethodPost:
+  a.oidcConsentDecision(w, r)
+ default:
+  w.Header().Set("Allow", "GET, POST")
+  http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+ }
+}
+
+func (a *API) oidcAuthorizeRequest(w http.ResponseWriter, r *http.Request) {
+ ctx := r.Context()
+ q := r.URL.Query()
+ client, _, err := a.oauthClient(ctx, q.Get("client_id"))
+ if err != nil {
+  // Never redirect to an unverified redirect_uri.
+  http.Error(w, "invalid client_id", http.StatusBadRequest)
+  return
+ }
+ redirectURI := q.Get("redirect_uri")
+ if redirectURI == "" && len(client.RedirectURIs) == 1 {
+  redirectURI = client.RedirectURIs[0]
+ }
+ if !containsString(client.RedirectURIs, redirectURI) {
+  http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+  return
+ }
+ state := q.Get("state")
+ fail := func(code, desc string) { a.redirectAuthzError(w, r, redirectURI, state, code, desc) }
+
+ if q.Get("response_type") != "code" {
+  fail("unsupported_response_type", "only the code flow is supported")
+  return
+ }
+ var scopes []string
+ for _, s := range strings.Fields(q.Get("scope")) {
+  if containsString(oidcServerScopes, s) && !containsString(scopes, s) {
+   scopes = append(scopes, s)
+  }
+ }
+ if !containsString(scopes, "openid") {
+  fail("invalid_scope", "the openid scope is required")
+  return
+ }
+ challenge := q.Get("code_challenge")
+ if challenge == "" || q.Get("code_challenge_method") != "S256" {
+  fail("invalid_request", "PKCE with S256 is required")
+  return
+ }
+ prompt := strings.Fields(q.Get("prompt"))
+
+ user, info, err := a.currentSession(w, r)
+ if err != nil {
+  if !errors.Is(err, ErrNoSession) {
+   a.logError(ctx, "oidc authorize session failed", err)
+   http.Error(w, "internal error", http.StatusInternalServerError)
+   return
+  }
+  if containsString(prompt, "none") {
+   fail("login_required", "")
+   return
+  }
+  a.redirectToLogin(w, r)
+  return
+ }
+ authTime, err := a.sessionAuthenticatedAt(ctx, info)
+ if err != nil {
+  a.logError(ctx, "oidc authorize session failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ req := authzRequest{
+  clientID:    client.ID,
+  userID:      user.ID,
+  redirectURI: redirectURI,
+  scope:       strings.Join(scopes, " "),
+  state:       state,
+  nonce:       q.Get("nonce"),
+  challenge:   challenge,
+  authTime:    authTime,
+ }
+
+ consented := client.SkipConsent
+ if !consented && !containsString(prompt, "consent") {
+  if consented, err = a.hasConsent(ctx, user.ID, client.ID, scopes); err != nil {
+   a.logError(ctx, "oidc consent lookup failed", err)
+   http.Error(w, "internal error", http.StatusInternalServerError)
+   return
+  }
+ }
+ if consented {
+  a.issueAuthorizationCode(w, r, req)
+  return
+ }
+ if containsString(prompt, "none") {
+  fail("consent_required", "")
+  return
+ }
+ consentID, err := a.storeAuthzRequest(ctx, "oauth_consent_requests", req, oidcStateTTL)
+ if err != nil {
+  a.logError(ctx, "oidc consent request failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ tmpl := a.oidcServer.cfg.ConsentTemplate
+ if tmpl == nil {
+  tmpl = defaultConsentTemplate
+ }
+ w.Header().Set("Content-Type", "text/html; charset=utf-8")
+ w.Header().Set("Cache-Control", "no-store")
+ w.Header().Set("X-Frame-Options", "DENY")
+ if err := tmpl.Execute(w, ConsentPage{
+  ClientName: client.Name,
+  Scopes:     scopes,
+  User:       user,
+  ConsentID:  consentID,
+  Action:     a.oidcServer.endpoint("/authorize"),
+ }); err != nil {
+  a.logError(ctx, "oidc consent template failed", err)
+ }
+}
+
+// oidcConsentDecision completes a pending request after the consent form was
+// submitted. The consent ID is an unguessable secret bound to the user, which also
+// protects the form against cross-site submission.
+func (a *API) oidcConsentDecision(w http.ResponseWriter, r *http.Request) {
+ ctx := r.Context()
+ user, _, err := a.currentSession(w, r)
+ if err != nil {
+  http.Error(w, "unauthorized", http.StatusUnauthorized)
+  return
+ }
+ req, ok, err := a.takeAuthzRequest(ctx, "oauth_consent_requests", r.PostFormValue("consent_id"))
+ if err != nil {
+  a.logError(ctx, "oidc consent decision failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ if !ok || req.userID != user.ID {
+  http.Error(w, "invalid or expired consent request", http.StatusBadRequest)
+  return
+ }
+ if r.PostFormValue("decision") != "allow" {
+  a.redirectAuthzError(w, r, req.redirectURI, req.state, "access_denied", "")
+  return
+ }
+ if err := a.saveConsent(ctx, user.ID, req.clientID, strings.Fields(req.scope)); err != nil {
+  a.logError(ctx, "oidc consent save failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ a.issueAuthorizationCode(w, r, req)
+}
+
+func (a *API) issueAuthorizationCode(w http.ResponseWriter, r *http.Request, req authzRequest) {
+ code, err := a.storeAuthzRequest(r.Context(), "oauth_codes", req, a.oidcServer.cfg.CodeTTL)
+ if err != nil {
+  a.logError(r.Context(), "oidc authorization code failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ a.redirectAuthz(w, r, req.redirectURI, url.Values{"code": {code}, "state": {req.state}})
+}
+
+func (a *API) redirectAuthzError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, desc string) {
+ v := url.Values{"error": {code}, "state": {state}}
+ if desc != "" {
+  v.Set("error_description", desc)
+ }
+ a.redirectAuthz(w, r, redirectURI, v)
+}
+
+// redirectAuthz sends the authorization response to the client, including iss
+// (RFC 9207) so clients can detect mix-up attacks.
+func (a *API) redirectAuthz(w http.ResponseWriter, r *http.Request, redirectURI string, v url.Values) {
+ if v.Get("state") == "" {
+  v.Del("state")
+ }
+ v.Set("iss", a.oidcServer.cfg.Issuer)
+ u, _ := url.Parse(redirectURI) // validated at registration
+ q := u.Query()
+ for k, vals := range v {
+  q[k] = vals
+ }
+ u.RawQuery = q.Encode()
+ w.Header().Set("Cache-Control", "no-store")
+ http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// redirectToLogin sends a signed-out user to LoginURL with the original authorize
+// request as the next parameter.
+func (a *API) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+ login := a.oidcServer.cfg.LoginURL
+ if login == "" {
+  http.Error(w, "login required", http.StatusUnauthorized)
+  return
+ }
+ loginRedirect(w, r, login)
+}
+
+// oauthError is an RFC 6749 §5.2 error response.
+type oauthError struct {
+ status int
+ code   string
+ desc   string
+}
+
+func (e *oauthError) Error() string { return e.code + ": " + e.desc }
+
+func writeOAuthError(w http.ResponseWriter, err error) {
+ var oe *oauthError
+ if !errors.As(err, &oe) {
+  oe = &oauthError{status: http.StatusInternalServerError, code: "server_error"}
+ }
+ body := map[string]string{"error": oe.code}
+ if oe.desc != "" {
+  body["error_description"] = oe.desc
+ }
+ if oe.status == http.StatusUnauthorized {
+  w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+ }
+ w.Header().Set("Cache-Control", "no-store")
+ writeJSON(w, oe.status, body)
+}
+
+func (a *API) oidcToken(w http.ResponseWriter, r *http.Request) {
+ if r.Method != http.MethodPost {
+  w.Header().Set("Allow", "POST")
+  http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  return
+ }
+ client, err := a.authenticateOAuthClient(r)
+ if err != nil {
+  writeOAuthError(w, err)
+  return
+ }
+ var resp map[string]any
+ switch r.PostFormValue("grant_type") {
+ case "authorization_code":
+  resp, err = a.oidcExchangeCode(r, client)
+ case "refresh_token":
+  resp, err = a.oidcRefresh(r, client)
+ default:
+  err = &oauthError{http.StatusBadRequest, "unsupported_grant_type", ""}
+ }
+ if err != nil {
+  if _, ok := err.(*oauthError); !ok {
+   a.logError(r.Context(), "oidc token endpoint failed", err)
+  }
+  writeOAuthError(w, err)
+  return
+ }
+ w.Header().Set("Cache-Control", "no-store")
+ writeJSON(w, http.StatusOK, resp)
+}
+
+// authenticateOAuthClient accepts client_secret_basic, client_secret_post and, for
+// public clients, a bare client_id.
+func (a *API) authenticateOAuthClient(r *http.Request) (OAuthClient, error) {
+ invalid := &oauthError{http.StatusUnauthorized, "invalid_client", ""}
+ id, secret, basic := r.BasicAuth()
+ if basic {
+  var err1, err2 error
+  id, err1 = url.QueryUnescape(id)
+  secret, err2 = url.QueryUnescape(secret)
+  if err1 != nil || err2 != nil {
+   return OAuthClient{}, invalid
+  }
+ } else {
+  id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+ }
+ client, secretHash, err := a.oauthClient(r.Context(), id)
+ if errors.Is(err, ErrClientNotFound) {
+  return OAuthClient{}, invalid
+ }
+ if err != nil {
+  return OAuthClient{}, err
+ }
+ if !checkClientSecret(secretHash, secret) {
+  return OAuthClient{}, invalid
+ }
+ return client, nil
+}
+
+func (a *API) oidcExchangeCode(r *http.Request, client OAuthClient) (map[string]any, error) {
+ ctx := r.Context()
+ invalid := &oauthError{http.StatusBadRequest, "invalid_grant", ""}
+ req, ok, err := a.takeAuthzRequest(ctx, "oauth_codes", r.PostFormValue("code"))
+ if err != nil {
+  return nil, err
+ }
+ if !ok || req.clientID != client.ID || req.redirectURI != r.PostFormValue("redirect_uri") {
+  return nil, invalid
+ }
+ sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+ if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(req.challenge)) != 1 {
+  return nil, invalid
+ }
+ family, err := newSessionToken()
+ if err != nil {
+  return nil, err
+ }
+ keys, err := a.signingKeys(ctx)
+ if err != nil {
+  return nil, err
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return nil, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ g := refreshGrant{userID: req.userID, family: family, clientID: client.ID, scope: req.scope}
+ resp, err := a.oidcTokenResponse(ctx, tx, keys[0], g, &req)
+ if err != nil {
+  return nil, err
+ }
+ if err := tx.Commit(); err != nil {
+  return nil, fmt.Errorf("commit: %w", err)
+ }
+ return resp, nil
+}
+
+func (a *API) oidcRefresh(r *http.Request, client OAuthClient) (map[string]any, error) {
+ ctx := r.Context()
+ keys, err := a.signingKeys(ctx)
+ if err != nil {
+  return nil, err
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return nil, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ g, err := a.consumeRefreshToken(ctx, tx, r.PostFormValue("refresh_token"), client.ID)
+ if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+  return nil, &oauthError{http.StatusBadRequest, "invalid_grant", ""}
+ }
+ if err != nil {
+  return nil, err
+ }
+ resp, err := a.oidcTokenResponse(ctx, tx, keys[0], g, nil)
+ if err != nil {
+  return nil, err
+ }
+ if err := tx.Commit(); err != nil {
+  return nil, fmt.Errorf("commit: %w", err)
+ }
+ a.addCounter(metricRefreshes, 1, "refresh_token")
+ return resp, nil
+}
+
+// oidcTokenResponse issues an access token signed with key, an ID token when
+// completing an authorization request and, if offline_access was granted, the
+// next refresh token for g within tx.
+// Callers load key before opening tx, since first use may have to store one.
+func (a *API) oidcTokenResponse(ctx context.Context, tx txHandle, key JWTKey, g refreshGrant, authz *authzRequest) (map[string]any, error) {
+ cfg := a.oidcServer.cfg
+ var email string
+ if err := tx.QueryRowContext(ctx, `SELECT email FROM users WHERE id = ?`, g.userID).Scan(&email); err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return nil, &oauthError{http.StatusBadRequest, "invalid_grant", "user no longer exists"}
+  }
+  return nil, fmt.Errorf("query user: %w", err)
+ }
+ scopes := strings.Fields(g.scope)
+ now := a.now()
+ sub := strconv.FormatInt(g.userID, 10)
+ jti, err := newSessionToken()
+ if err != nil {
+  return nil, err
+ }
+ // Access tokens carry scope and client_id, which ID tokens never do; /userinfo
+ // relies on that to refuse ID tokens.
+ access, err := signJWT(key, map[string]any{
+  "iss":       cfg.Issuer,
+  "sub":       sub,
+  "aud":       g.clientID,
+  "client_id": g.clientID,
+  "scope":     g.scope,
+  "iat":       now.Unix(),
+  "exp":       now.Add(cfg.AccessTTL).Unix(),
+  "jti":       jti,
+ })
+ if err != nil {
+  return nil, err
+ }
+ resp := map[string]any{
+  "access_token": access,
+  "token_type":   "Bearer",
+  "expires_in":   int64(cfg.AccessTTL.Seconds()),
+  "scope":        g.scope,
+ }
+ if authz != nil {
+  claims := map[string]any{
+   "iss":       cfg.Issuer,
+   "sub":       sub,
+   "aud":       g.clientID,
+   "iat":       now.Unix(),
+   "exp":       now.Add(cfg.AccessTTL).Unix(),
+   "auth_time": authz.authTime,
+  }
+  if authz.nonce != "" {
+   claims["nonce"] = authz.nonce
+  }
+  if containsString(scopes, "email") {
+   claims["email"] = email
+   if cfg.EmailVerified {
+    claims["email_verified"] = true
+   }
+  }
+  idToken, err := signJWT(key, claims)
+  if err != nil {
+   return nil, err
+  }
+  resp["id_token"] = idToken
+ }
+
+ if containsString(scopes, "offline_access") {
+  refresh, err := a.insertRefreshToken(ctx, tx, g, cfg.RefreshTTL)
+  if err != nil {
+   return nil, err
+  }
+  resp["refresh_token"] = refresh
+ }
+ return resp, nil
+}
+
+func (a *API) oidcUserinfo(w http.ResponseWriter, r *http.Request) {
+ ctx := r.Context()
+ fail := func() {
+  w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+  http.Error(w, "unauthorized", http.StatusUnauthorized)
+ }
+ token, ok := bearerToken(r)
+ if !ok {
+  fail()
+  return
+ }
+ keys, err := a.signingKeys(ctx)
+ if err != nil {
+  a.logError(ctx, "oidc signing keys failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ public := make(map[string]crypto.PublicKey, len(keys))
+ for _, k := range keys {
+  public[k.ID] = k.Key.Public()
+ }
+ keyFor := staticKeySet(public)
+ claims, err := parseJWT(token, func(kid string) (crypto.PublicKey, error) { return keyFor(ctx, kid) })
+ if err != nil {
+  fail()
+  return
+ }
+ if err := validateJWTClaims(claims, a.oidcServer.cfg.Issuer, "", a.now().Unix(), int64(defaultJWTLeeway.Seconds())); err != nil {
+  fail()
+  return
+ }
+ scope, isAccess := claims["scope"].(string)
+ if _, ok := claims["client_id"].(string); !ok || !isAccess {
+  fail()
+  return
+ }
+ sub, _ := claims["sub"].(string)
+ id, _ := strconv.ParseInt(sub, 10, 64)
+ var email string
+ if err := a.db.QueryRowContext(ctx, `SELECT email FROM users WHERE id = ?`, id).Scan(&email); err != nil {
+  fail()
+  return
+ }
+ out := map[string]any{"sub": sub}
+ if containsString(strings.Fields(scope), "email") {
+  out["email"] = email
+  if a.oidcServer.cfg.EmailVerified {
+   out["email_verified"] = true
+  }
+ }
+ w.Header().Set("Cache-Control", "no-store")
+ writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+ w.Header().Set("Content-Type", "application/json")
+ w.WriteHeader(status)
+ _ = json.NewEncoder(w).Encode(v)
+}
+
+var errOIDCServerDisabled = errors.New("OIDC provider is not configured")
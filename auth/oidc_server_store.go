@@ -0,0 +1,367 @@
+package auth
+
+import (
+ "context"
+ "crypto"
+ "crypto/sha256"
+ "crypto/subtle"
+ "crypto/x509"
+ "database/sql"
+ "errors"
+ "fmt"
+ "net/url"
+ "strings"
+ "sync"
+ "time"
+)
+
+// oidcServer is the runtime state of the OpenID Connect provider.
+type oidcServer struct {
+ cfg OIDCServerConfig
+
+ mu      sync.Mutex
+ signers map[string]crypto.Signer // parsed private keys by kid
+}
+
+// Clients.
+
+func (a *API) registerOAuthClientInternal(ctx context.Context, c OAuthClient) (OAuthClient, string, error) {
+ if a.oidcServer == nil && a.cfg.DeviceAuth == nil {
+  return OAuthClient{}, "", errOIDCServerDisabled
+ }
+ c.Name = strings.TrimSpace(c.Name)
+ if c.Name == "" {
+  return OAuthClient{}, "", fmt.Errorf("client name required")
+ }
+ // Device flow clients never redirect.
+ if len(c.RedirectURIs) == 0 && a.cfg.DeviceAuth == nil {
+  return OAuthClient{}, "", fmt.Errorf("at least one redirect URI required")
+ }
+ for _, s := range c.Scopes {
+  if s == "" || strings.ContainsAny(s, " \t\r\n") {
+   return OAuthClient{}, "", fmt.Errorf("invalid scope %q", s)
+  }
+ }
+ for _, u := range c.RedirectURIs {
+  p, err := url.Parse(u)
+  if err != nil || !p.IsAbs() || p.Host == "" || p.Fragment != "" || strings.Contains(u, "\n") {
+   return OAuthClient{}, "", fmt.Errorf("invalid redirect URI %q", u)
+  }
+ }
+ id, err := randomBase62(24)
+ if err != nil {
+  return OAuthClient{}, "", err
+ }
+ c.ID = "cl_" + id
+ var secret string
+ var secretHash []byte
+ if !c.Public {
+  if secret, err = newSessionToken(); err != nil {
+   return OAuthClient{}, "", err
+  }
+  sum := sha256.Sum256([]byte(secret))
+  secretHash = sum[:]
+ }
+ now := a.now().Unix()
+ if _, err := a.db.ExecContext(ctx, `
+  INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, skip_consent, scopes, created_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+ `, c.ID, c.Name, secretHash, strings.Join(c.RedirectURIs, "\n"), c.SkipConsent, strings.Join(c.Scopes, " "), now); err != nil {
+  return OAuthClient{}, "", fmt.Errorf("insert client: %w", err)
+ }
+ c.CreatedAt = time.Unix(now, 0)
+ return c, secret, nil
+}
+
+func (a *API) deleteOAuthClientInternal(ctx context.Context, clientID string) error {
+ res, err := a.db.ExecContext(ctx, `DELETE FROM oauth_clients WHERE id = ?`, clientID)
+ if err != nil {
+  return fmt.Errorf("delete client: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return ErrClientNotFound
+ }
+ // Outstanding refresh tokens are not tied to the client row by a foreign key.
+ if _, err := a.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = ? WHERE client_id = ? AND revoked_at = 0`, a.now().Unix(), clientID); err != nil {
+  return fmt.Errorf("revoke client tokens: %w", err)
+ }
+ return nil
+}
+
+// oauthClient loads a client; secretHash is empty for public clients.
+func (a *API) oauthClient(ctx context.Context, clientID string) (OAuthClient, []byte, error) {
+ var (
+  c          OAuthClient
+  secretHash []byte
+  uris       string
+  scopes     string
+  created    int64
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT id, name, secret_hash, redirect_uris, skip_consent, scopes, created_at FROM oauth_clients WHERE id = ?
+ `, clientID).Scan(&c.ID, &c.Name, &secretHash, &uris, &c.SkipConsent, &scopes, &created)
+ if errors.Is(err, sql.ErrNoRows) {
+  return OAuthClient{}, nil, ErrClientNotFound
+ }
+ if err != nil {
+  return OAuthClient{}, nil, fmt.Errorf("query client: %w", err)
+ }
+ if uris != "" {
+  c.RedirectURIs = strings.Split(uris, "\n")
+ }
+ c.Scopes = strings.Fields(scopes)
+ c.Public = len(secretHash) == 0
+ c.CreatedAt = time.Unix(created, 0)
+ return c, secretHash, nil
+}
+
+// checkClientSecret compares a presented secret with the stored hash.
+func checkClientSecret(secretHash []byte, secret string) bool {
+ if len(secretHash) == 0 {
+  return secret == ""
+ }
+ sum := sha256.Sum256([]byte(secret))
+ return subtle.ConstantTimeCompare(sum[:], secretHash) == 1
+}
+
+// Consent.
+
+func (a *API) hasConsent(ctx context.Context, userID int64, clientID string, scopes []string) (bool, error) {
+ var granted string
+ err := a.db.QueryRowContext(ctx, `
+  SELECT scope FROM oauth_consents WHERE user_id = ? AND client_id = ?
+ `, userID, clientID).Scan(&granted)
+ if errors.Is(err, sql.ErrNoRows) {
+  return false, nil
+ }
+ if err != nil {
+  return false, fmt.Errorf("query consent: %w", err)
+ }
+ have := strings.Fields(granted)
+ for _, s := range scopes {
+  if !containsString(have, s) {
+   return false, nil
+  }
+ }
+ return true, nil
+}
+
+func (a *API) saveConsent(ctx context.Context, userID int64, clientID string, scopes []string) error {
+ _, err := a.db.ExecContext(ctx, `
+  INSERT INTO oauth_consents (user_id, client_id, scope, created_at) VALUES (?, ?, ?, ?)
+  ON CONFLICT(user_id, client_id) DO UPDATE SET scope = excluded.scope, created_at = excluded.created_at
+ `, userID, clientID, strings.Join(scopes, " "), a.now().Unix())
+ if err != nil {
+  return fmt.Errorf("save consent: %w", err)
+ }
+ return nil
+}
+
+// Authorization requests and codes.
+
+// authzRequest is a validated authorization request, stored while the user is
+// asked for consent (oauth_consent_requests) and after a code was issued
+// (oauth_codes).
+type authzRequest struct {
+ clientID    string
+ userID      int64
+ redirectURI string
+ scope       string
+ state       string
+ nonce       string
+ challenge   string
+ authTime    int64
+}
+
+// storeAuthzRequest saves req under a fresh random handle in table and returns it.
+func (a *API) storeAuthzRequest(ctx context.Context, table string, req authzRequest, ttl time.Duration) (string, error) {
+ handle, err := newSessionToken()
+ if err != nil {
+  return "", err
+ }
+ sum := sha256.Sum256([]byte(handle))
+ now := a.now()
+ if _, err := a.db.ExecContext(ctx, `
+  INSERT INTO `+table+` (handle_hash, client_id, user_id, redirect_uri, scope, state, nonce, code_challenge, auth_time, expires_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ `, sum[:], req.clientID, req.userID, req.redirectURI, req.scope, req.state, req.nonce, req.challenge, req.authTime, now.Add(ttl).Unix()); err != nil {
+  return "", fmt.Errorf("insert %s: %w", table, err)
+ }
+ return handle, nil
+}
+
+// takeAuthzRequest deletes and returns the request stored under handle (single use).
+// ok is false for unknown or expired handles.
+func (a *API) takeAuthzRequest(ctx context.Context, table, handle string) (authzRequest, bool, error) {
+ sum := sha256.Sum256([]byte(handle))
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return authzRequest{}, false, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var (
+  req       authzRequest
+  expiresAt int64
+ )
+ err = tx.QueryRowContext(ctx, `
+  SELECT client_id, user_id, redirect_uri, scope, state, nonce, code_challenge, auth_time, expires_at
+  FROM `+table+` WHERE handle_hash = ?
+ `, sum[:]).Scan(&req.clientID, &req.userID, &req.redirectURI, &req.scope, &req.state, &req.nonce, &req.challenge, &req.authTime, &expiresAt)
+ if errors.Is(err, sql.ErrNoRows) {
+  return authzRequest{}, false, nil
+ }
+ if err != nil {
+  return authzRequest{}, false, fmt.Errorf("query %s: %w", table, err)
+ }
+ if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE handle_hash = ?`, sum[:]); err != nil {
+  return authzRequest{}, false, fmt.Errorf("delete %s: %w", table, err)
+ }
+ if err := tx.Commit(); err != nil {
+  return authzRequest{}, false, fmt.Errorf("commit: %w", err)
+ }
+ if a.now().Unix() >= expiresAt {
+  return authzRequest{}, false, nil
+ }
+ return req, true, nil
+}
+
+// Signing keys.
+
+// signingKeys returns the provider's keys, newest first: the first one signs, all
+// are published. Retired keys stay published for AccessTTL plus a day so cached
+// tokens and JWKS copies keep verifying. A key is generated on first use.
+func (a *API) signingKeys(ctx context.Context) ([]JWTKey, error) {
+ keys, active, err := a.loadSigningKeys(ctx)
+ if err != nil {
+  return nil, err
+ }
+ if !active {
+  if _, err := a.addSigningKey(ctx, false); err != nil {
+   return nil, err
+  }
+  if keys, _, err = a.loadSigningKeys(ctx); err != nil {
+   return nil, err
+  }
+ }
+ return keys, nil
+}
+
+func (a *API) loadSigningKeys(ctx context.Context) ([]JWTKey, bool, error) {
+ s := a.oidcServer
+ rows, err := a.db.QueryContext(ctx, `
+  SELECT kid, private_key, retired_at FROM oidc_signing_keys
+  WHERE retired_at = 0 OR retired_at > ?
+  ORDER BY retired_at = 0 DESC, created_at DESC, rowid DESC
+ `, a.now().Add(-a.signingKeyRetention()).Unix())
+ if err != nil {
+  return nil, false, fmt.Errorf("query signing keys: %w", err)
+ }
+ defer rows.Close()
+ s.mu.Lock()
+ defer s.mu.Unlock()
+ var (
+  keys   []JWTKey
+  active bool
+ )
+ for rows.Next() {
+  var (
+   kid     string
+   der     []byte
+   retired int64
+  )
+  if err := rows.Scan(&kid, &der, &retired); err != nil {
+   return nil, false, fmt.Errorf("scan signing key: %w", err)
+  }
+  signer, ok := s.signers[kid]
+  if !ok {
+   k, err := x509.ParsePKCS8PrivateKey(der)
+   if err != nil {
+    return nil, false, fmt.Errorf("parse signing key %q: %w", kid, err)
+   }
+   if signer, ok = k.(crypto.Signer); !ok {
+    return nil, false, fmt.Errorf("signing key %q is not a signer", kid)
+   }
+   s.signers[kid] = signer
+  }
+  active = active || retired == 0
+  keys = append(keys, JWTKey{ID: kid, Key: signer})
+ }
+ return keys, active, rows.Err()
+}
+
+func (a *API) signingKeyRetention() time.Duration {
+ return a.oidcServer.cfg.AccessTTL + 24*time.Hour
+}
+
+// rotateSigningKeyInternal generates a new active key and retires the previous one.
+func (a *API) rotateSigningKeyInternal(ctx context.Context) (string, error) {
+ if a.oidcServer == nil {
+  return "", errOIDCServerDisabled
+ }
+ return a.addSigningKey(ctx, true)
+}
+
+// addSigningKey stores a new active key. With retire the active key is retired;
+// without, the key is only stored if there is no active key yet, so concurrent
+// first requests (in any process) settle on one key. It returns the kid of the
+// stored key, or "" if none was stored.
+func (a *API) addSigningKey(ctx context.Context, retire bool) (string, error) {
+ suffix, err := randomBase62(12)
+ if err != nil {
+  return "", err
+ }
+ key, err := generateJWTKey(suffix, a.oidcServer.cfg.SigningAlgorithm)
+ if err != nil {
+  return "", err
+ }
+ der, err := x509.MarshalPKCS8PrivateKey(key.Key)
+ if err != nil {
+  return "", fmt.Errorf("marshal signing key: %w", err)
+ }
+ now := a.now().Unix()
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return "", fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ if retire {
+  if _, err := tx.ExecContext(ctx, `UPDATE oidc_signing_keys SET retired_at = ? WHERE retired_at = 0`, now); err != nil {
+   return "", fmt.Errorf("retire signing keys: %w", err)
+  }
+ } else {
+  var n int
+  if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM oidc_signing_keys WHERE retired_at = 0`).Scan(&n); err != nil {
+   return "", fmt.Errorf("count signing keys: %w", err)
+  }
+  if n > 0 {
+   return "", nil // another request stored one first
+  }
+ }
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO oidc_signing_keys (kid, private_key, created_at) VALUES (?, ?, ?)
+ `, key.ID, der, now); err != nil {
+  return "", fmt.Errorf("insert signing key: %w", err)
+ }
+ if err := tx.Commit(); err != nil {
+  return "", fmt.Errorf("commit: %w", err)
+ }
+ return key.ID, nil
+}
+
+// pruneOIDCServerInternal deletes expired authorization state and signing keys
+// that are no longer published.
+func (a *API) pruneOIDCServerInternal(ctx context.Context) error {
+ if a.oidcServer == nil {
+  return nil
+ }
+ now := a.now()
+ for _, table := range []string{"oauth_codes", "oauth_consent_requests"} {
+  if _, err := a.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at <= ?`, now.Unix()); err != nil {
+   return err
+  }
+ }
+ _, err := a.db.ExecContext(ctx, `
+  DELETE FROM oidc_signing_keys WHERE retired_at != 0 AND retired_at <= ?
+ `, now.Add(-a.signingKeyRetention()).Unix())
+ return err
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+ "context"
+ "crypto/sha256"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "regexp"
+ "strings"
+ "testing"
+)
+
+// newTestProvider starts an API acting as OpenID Connect provider behind an
+// httptest server, so relying parties can fetch discovery and JWKS over HTTP.
+func newTestProvider(t *testing.T, opts ...func(*OIDCServerConfig)) (*API, *httptest.Server) {
+ t.Helper()
+ var op *API
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  op.OIDCServerHandler().ServeHTTP(w, r)
+ }))
+ t.Cleanup(srv.Close)
+ op, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCServer = &OIDCServerConfig{Issuer: srv.URL, LoginURL: "/login", SigningAlgorithm: ES256}
+  for _, o := range opts {
+   o(c.OIDCServer)
+  }
+ })
+ t.Cleanup(cleanup)
+ return op, srv
+}
+
+var consentIDPattern = regexp.MustCompile(`name="consent_id" value="([^"]+)"`)
+
+// approveConsent submits the consent page rendered in rr and returns the redirect.
+func approveConsent(t *testing.T, op *API, rr *httptest.ResponseRecorder, session *http.Cookie) string {
+ t.Helper()
+ m := consentIDPattern.FindStringSubmatch(rr.Body.String())
+ if rr.Code != http.StatusOK || m == nil {
+  t.Fatalf("consent page: %d %s", rr.Code, rr.Body.String())
+ }
+ form := url.Values{"consent_id": {m[1]}, "decision": {"allow"}}.Encode()
+ req := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(form))
+ req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+ req.AddCookie(session)
+ out := httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(out, req)
+ if out.Code != http.StatusFound {
+  t.Fatalf("consent decision: %d %s", out.Code, out.Body.String())
+ }
+ return out.Header().Get("Location")
+}
+
+func postToken(t *testing.T, op *API, clientID, secret string, form url.Values) (int, map[string]any) {
+ t.Helper()
+ req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+ req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+ req.SetBasicAuth(clientID, secret)
+ rr := httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(rr, req)
+ var body map[string]any
+ _ = json.Unmarshal(rr.Body.Bytes(), &body)
+ return rr.Code, body
+}
+
+func TestOIDCServerSignsInRelyingParty(t *testing.T) {
+ op, srv := newTestProvider(t, func(c *OIDCServerConfig) { c.EmailVerified = true })
+ ctx := context.Background()
+ client, secret, err := op.RegisterOAuthClient(ctx, OAuthClient{Name: "Shop", RedirectURIs: []string{"http://rp.example/cb"}})
+ if err != nil || secret == "" {
+  t.Fatalf("RegisterOAuthClient: %+v %v", client, err)
+ }
+ if _, err := op.Register(ctx, "alice@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ session := mustLogin(t, op, "alice@example.com", "password123")
+
+ // The relying party is another API configured with the provider.
+ rp, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{{
+   Name: "op", Issuer: srv.URL, ClientID: client.ID, ClientSecret: secret, RedirectURL: "http://rp.example/cb",
+  }}
+ })
+ defer cleanup()
+ start := httptest.NewRecorder()
+ if err := rp.OIDCLogin(start, httptest.NewRequest(http.MethodGet, "/login/op", nil), "op"); err != nil {
+  t.Fatalf("OIDCLogin: %v", err)
+ }
+ authorize := start.Header().Get("Location")
+
+ // Signed out: sent to the login page with the request to resume.
+ rr := httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, authorize, nil))
+ if loc := rr.Header().Get("Location"); rr.Code != http.StatusFound || !strings.HasPrefix(loc, "/login?next=") {
+  t.Fatalf("signed-out authorize: %d %q", rr.Code, loc)
+ }
+
+ rr = httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(rr, newReqWithCookie(http.MethodGet, authorize, session))
+ callback := approveConsent(t, op, rr, session)
+ if !strings.HasPrefix(callback, "http://rp.example/cb?") || !strings.Contains(callback, "code=") {
+  t.Fatalf("callback: %q", callback)
+ }
+
+ // The first sign-in creates the account at the relying party.
+ cb := httptest.NewRequest(http.MethodGet, callback, nil)
+ for _, c := range start.Result().Cookies() {
+  cb.AddCookie(c)
+ }
+ user, err := rp.OIDCCallback(httptest.NewRecorder(), cb, "op")
+ if err != nil || user.Email != "alice@example.com" {
+  t.Fatalf("OIDCCallback: %+v %v", user, err)
+ }
+
+ // Consent is remembered for the next sign-in.
+ rr = httptest.NewRecorder()
+ start = httptest.NewRecorder()
+ _ = rp.OIDCLogin(start, httptest.NewRequest(http.MethodGet, "/login/op", nil), "op")
+ op.OIDCServerHandler().ServeHTTP(rr, newReqWithCookie(http.MethodGet, start.Header().Get("Location"), session))
+ if rr.Code != http.StatusFound || !strings.Contains(rr.Header().Get("Location"), "code=") {
+  t.Fatalf("second authorize: %d %q", rr.Code, rr.Header().Get("Location"))
+ }
+}
+
+func TestOIDCServerUnverifiedEmail(t *testing.T) {
+ op, srv := newTestProvider(t)
+ ctx := context.Background()
+ client, secret, _ := op.RegisterOAuthClient(ctx, OAuthClient{Name: "Shop", RedirectURIs: []string{"http://rp.example/cb"}, SkipConsent: true})
+ _, _ = op.Register(ctx, "bob@example.com", "password123")
+ session := mustLogin(t, op, "bob@example.com", "password123")
+ rp, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{{
+   Name: "op", Issuer: srv.URL, ClientID: client.ID, ClientSecret: secret, RedirectURL: "http://rp.example/cb",
+  }}
+ })
+ defer cleanup()
+
+ // Without EmailVerified the relying party does not register the email.
+ start := httptest.NewRecorder()
+ if err := rp.OIDCLogin(start, httptest.NewRequest(http.MethodGet, "/login/op", nil), "op"); err != nil {
+  t.Fatalf("OIDCLogin: %v", err)
+ }
+ rr := httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(rr, newReqWithCookie(http.MethodGet, start.Header().Get("Location"), session))
+ cb := httptest.NewRequest(http.MethodGet, rr.Header().Get("Location"), nil)
+ for _, c := range start.Result().Cookies() {
+  cb.AddCookie(c)
+ }
+ if _, err := rp.OIDCCallback(httptest.NewRecorder(), cb, "op"); !errors.Is(err, ErrEmailNotVerified) {
+  t.Fatalf("OIDCCallback: %v", err)
+ }
+}
+
+func TestOIDCServerTokens(t *testing.T) {
+ op, srv := newTestProvider(t)
+ ctx := context.Background()
+ client, secret, _ := op.RegisterOAuthClient(ctx, OAuthClient{Name: "CLI", RedirectURIs: []string{"http://127.0.0.1/cb"}, SkipConsent: true})
+ _, _ = op.Register(ctx, "bob@example.com", "password123")
+ session := mustLogin(t, op, "bob@example.com", "password123")
+
+ verifier := "a-verifier-long-enough-for-pkce-0123456789"
+ sum := sha256.Sum256([]byte(verifier))
+ authorize := func(scope string) string {
+  q := url.Values{
+   "client_id": {client.ID}, "redirect_uri": {"http://127.0.0.1/cb"}, "response_type": {"code"},
+   "scope": {scope}, "code_challenge": {base64.RawURLEncoding.EncodeToString(sum[:])},
+   "code_challenge_method": {"S256"}, "state": {"xyz"},
+  }
+  rr := httptest.NewRecorder()
+  op.OIDCServerHandler().ServeHTTP(rr, newReqWithCookie(http.MethodGet, "/authorize?"+q.Encode(), session))
+  u, err := url.Parse(rr.Header().Get("Location"))
+  if rr.Code != http.StatusFound || err != nil || u.Query().Get("state") != "xyz" || u.Query().Get("iss") != srv.URL {
+   t.Fatalf("authorize: %d %q", rr.Code, rr.Header().Get("Location"))
+  }
+  return u.Query().Get("code")
+ }
+ exchange := func(code, verifier string) (int, map[string]any) {
+  return postToken(t, op, client.ID, secret, url.Values{
+   "grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"http://127.0.0.1/cb"}, "code_verifier": {verifier},
+  })
+ }
+
+ if status, body := exchange(authorize("openid email"), "wrong-verifier"); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+  t.Fatalf("bad PKCE verifier: %d %v", status, body)
+ }
+ // A refresh token needs offline_access.
+ if status, body := exchange(authorize("openid email"), verifier); status != http.StatusOK || body["refresh_token"] != nil {
+  t.Fatalf("exchange without offline_access: %d %v", status, body)
+ }
+ code := authorize("openid email offline_access")
+ status, tokens := exchange(code, verifier)
+ if status != http.StatusOK || tokens["id_token"] == nil || tokens["refresh_token"] == nil {
+  t.Fatalf("code exchange: %d %v", status, tokens)
+ }
+ if status, _ := exchange(code, verifier); status != http.StatusBadRequest {
+  t.Fatalf("code reused: %d", status)
+ }
+ if status, _ := postToken(t, op, client.ID, "not-the-secret", url.Values{"grant_type": {"refresh_token"}}); status != http.StatusUnauthorized {
+  t.Fatalf("wrong client secret: %d", status)
+ }
+
+ // Userinfo accepts the access token but not the ID token.
+ userinfo := func(token string) *httptest.ResponseRecorder {
+  rr := httptest.NewRecorder()
+  op.OIDCServerHandler().ServeHTTP(rr, newReqWithBearer(http.MethodGet, "/userinfo", token))
+  return rr
+ }
+ if rr := userinfo(tokens["access_token"].(string)); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "bob@example.com") {
+  t.Fatalf("userinfo: %d %s", rr.Code, rr.Body.String())
+ }
+ if rr := userinfo(tokens["id_token"].(string)); rr.Code != http.StatusUnauthorized {
+  t.Fatalf("userinfo with ID token: %d", rr.Code)
+ }
+
+ // Refresh tokens rotate; replaying one revokes the family.
+ refresh := func(token string) (int, map[string]any) {
+  return postToken(t, op, client.ID, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}})
+ }
+ first := tokens["refresh_token"].(string)
+ status, rotated := refresh(first)
+ if status != http.StatusOK || rotated["refresh_token"] == first || rotated["id_token"] != nil {
+  t.Fatalf("refresh: %d %v", status, rotated)
+ }
+ if status, _ := refresh(first); status != http.StatusBadRequest {
+  t.Fatalf("replayed refresh token: %d", status)
+ }
+ if status, _ := refresh(rotated["refresh_token"].(string)); status != http.StatusBadRequest {
+  t.Fatalf("family survived reuse: %d", status)
+ }
+
+ // Rotation keeps the previous key published.
+ oldToken := tokens["access_token"].(string)
+ if _, err := op.RotateSigningKey(ctx); err != nil {
+  t.Fatalf("RotateSigningKey: %v", err)
+ }
+ rr := httptest.NewRecorder()
+ op.OIDCServerHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+ var set jwkSet
+ if err := json.Unmarshal(rr.Body.Bytes(), &set); err != nil || len(set.Keys) != 2 {
+  t.Fatalf("jwks after rotation: %s %v", rr.Body.String(), err)
+ }
+ if rr := userinfo(oldToken); rr.Code != http.StatusOK {
+  t.Fatalf("token signed with the retired key: %d", rr.Code)
+ }
+}
+
+func TestOIDCServerFirstSigningKeyOnce(t *testing.T) {
+ op, _ := newTestProvider(t)
+ ctx := context.Background()
+ // Two requests that both found no active key each try to store one.
+ first, err := op.addSigningKey(ctx, false)
+ if err != nil || first == "" {
+  t.Fatalf("first key: %q %v", first, err)
+ }
+ if kid, err := op.addSigningKey(ctx, false); err != nil || kid != "" {
+  t.Fatalf("second first key: %q %v", kid, err)
+ }
+ keys, err := op.signingKeys(ctx)
+ if err != nil || len(keys) != 1 || keys[0].ID != first {
+  t.Fatalf("signing keys: %v %v", keys, err)
+ }
+}
+
+func TestOIDCServerRejectsUnregisteredRedirect(t *testing.T) {
+ op, _ := newTestProvider(t)
+ client, _, _ := op.RegisterOAuthClient(context.Background(), OAuthClient{Name: "App", RedirectURIs: []string{"https://app.example/cb"}})
+ rr := httptest.NewRecorder()
+ q := url.Values{"client_id": {client.ID}, "redirect_uri": {"https://evil.example/cb"}, "response_type": {"code"}}
+ op.OIDCServerHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/authorize?"+q.Encode(), nil))
+ if rr.Code != http.StatusBadRequest || rr.Header().Get("Location") != "" {
+  t.Fatalf("unregistered redirect_uri: %d %q", rr.Code, rr.Header().Get("Location"))
+ }
+}
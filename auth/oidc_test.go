@@ -0,0 +1,273 @@
+package auth
+
+import (
+ "context"
+ "crypto/sha256"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "sync"
+ "testing"
+ "time"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint that
+// redeems codes registered with authorize.
+type mockIdP struct {
+ t      *testing.T
+ srv    *httptest.Server
+ key    JWTKey
+ issued time.Time
+
+ mu         sync.Mutex
+ codes      map[string]mockGrant
+ unverified bool // issue email_verified false
+}
+
+type mockGrant struct {
+ challenge string
+ claims    map[string]any
+}
+
+func newMockIdP(t *testing.T, now time.Time) *mockIdP {
+ t.Helper()
+ key, err := NewJWTKey("idp-1", ES256)
+ if err != nil {
+  t.Fatalf("NewJWTKey: %v", err)
+ }
+ m := &mockIdP{t: t, key: key, issued: now, codes: map[string]mockGrant{}}
+ mux := http.NewServeMux()
+ mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+  _ = json.NewEncoder(w).Encode(map[string]string{
+   "issuer":                 m.srv.URL,
+   "authorization_endpoint": m.srv.URL + "/authorize",
+   "token_endpoint":         m.srv.URL + "/token",
+   "jwks_uri":               m.srv.URL + "/jwks",
+  })
+ })
+ mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+  k, _ := jwkFromPublicKey(key.ID, key.Key.Public())
+  _ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{k}})
+ })
+ mux.HandleFunc("/token", m.token)
+ m.srv = httptest.NewServer(mux)
+ t.Cleanup(m.srv.Close)
+ return m
+}
+
+// authorize plays the user consenting at the provider: it takes the redirect issued
+// by OIDCLogin and returns the callback URL carrying a fresh code.
+func (m *mockIdP) authorize(loginRedirect, sub, email string) string {
+ m.t.Helper()
+ u, err := url.Parse(loginRedirect)
+ if err != nil {
+  m.t.Fatalf("parse redirect: %v", err)
+ }
+ q := u.Query()
+ if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+  m.t.Fatalf("PKCE not requested: %v", q)
+ }
+ code := "code-" + sub + "-" + q.Get("state")[:8]
+ m.mu.Lock()
+ m.codes[code] = mockGrant{challenge: q.Get("code_challenge"), claims: map[string]any{
+  "iss":            m.srv.URL,
+  "aud":            q.Get("client_id"),
+  "sub":            sub,
+  "email":          email,
+  "email_verified": !m.unverified,
+  "nonce":          q.Get("nonce"),
+  "iat":            m.issued.Unix(),
+  "exp":            m.issued.Add(time.Hour).Unix(),
+ }}
+ m.mu.Unlock()
+ return q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+}
+
+func (m *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+ if id, secret, ok := r.BasicAuth(); !ok || id != "client-1" || secret != "s3cret" {
+  http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+  return
+ }
+ m.mu.Lock()
+ g, ok := m.codes[r.PostFormValue("code")]
+ delete(m.codes, r.PostFormValue("code"))
+ m.mu.Unlock()
+ sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+ if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+  http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+  return
+ }
+ idToken, err := signJWT(m.key, g.claims)
+ if err != nil {
+  http.Error(w, err.Error(), http.StatusInternalServerError)
+  return
+ }
+ _ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer", "access_token": "at"})
+}
+
+func (m *mockIdP) provider() OIDCProvider {
+ return OIDCProvider{
+  Name:         "mock",
+  Issuer:       m.srv.URL,
+  ClientID:     "client-1",
+  ClientSecret: "s3cret",
+  RedirectURL:  "http://app.example/auth/callback",
+ }
+}
+
+// oidcSignIn drives a full login through the mock provider and returns the callback
+// recorder and error.
+func oidcSignIn(t *testing.T, api *API, idp *mockIdP, sub, email string) (*httptest.ResponseRecorder, User, error) {
+ t.Helper()
+ rr := httptest.NewRecorder()
+ if err := api.OIDCLogin(rr, httptest.NewRequest(http.MethodGet, "/auth/login", nil), "mock"); err != nil {
+  t.Fatalf("OIDCLogin: %v", err)
+ }
+ if rr.Code != http.StatusFound {
+  t.Fatalf("OIDCLogin status %d", rr.Code)
+ }
+ cb := httptest.NewRequest(http.MethodGet, idp.authorize(rr.Header().Get("Location"), sub, email), nil)
+ for _, c := range rr.Result().Cookies() {
+  cb.AddCookie(c)
+ }
+ out := httptest.NewRecorder()
+ user, err := api.OIDCCallback(out, cb, "mock")
+ return out, user, err
+}
+
+func TestOIDCSignIn(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ idp := newMockIdP(t, base)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+ })
+ defer cleanup()
+
+ rr, user, err := oidcSignIn(t, api, idp, "alice-sub", "Alice@Example.com")
+ if err != nil {
+  t.Fatalf("OIDCCallback: %v", err)
+ }
+ if user.Email != "alice@example.com" {
+  t.Fatalf("unexpected user: %+v", user)
+ }
+ var session *http.Cookie
+ for _, c := range rr.Result().Cookies() {
+  if c.Name == api.cfg.SessionName {
+   session = c
+  }
+ }
+ if session == nil {
+  t.Fatalf("no session cookie after callback")
+ }
+ if got, ok, err := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", session)); err != nil || !ok || got.ID != user.ID {
+  t.Fatalf("CurrentUser: %+v %v %v", got, ok, err)
+ }
+
+ // The same subject signs into the same account; the password login stays closed.
+ _, again, err := oidcSignIn(t, api, idp, "alice-sub", "alice@example.com")
+ if err != nil || again.ID != user.ID {
+  t.Fatalf("second sign-in: %+v %v", again, err)
+ }
+ if _, err := api.Login(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login", nil), "alice@example.com", ""); err == nil {
+  t.Fatalf("password login succeeded for an OIDC-only account")
+ }
+
+ // A new subject claiming a registered email does not take the account over.
+ if _, _, err := oidcSignIn(t, api, idp, "mallory-sub", "alice@example.com"); !errors.Is(err, ErrEmailTaken) {
+  t.Fatalf("email takeover: %v", err)
+ }
+
+ // An unverified email does not register an account, so its owner still can.
+ idp.unverified = true
+ if _, _, err := oidcSignIn(t, api, idp, "eve-sub", "carol@example.com"); !errors.Is(err, ErrEmailNotVerified) {
+  t.Fatalf("unverified email: %v", err)
+ }
+ if _, err := api.Register(context.Background(), "carol@example.com", "password123"); err != nil {
+  t.Fatalf("Register after unverified sign-in: %v", err)
+ }
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ idp := newMockIdP(t, base)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.OIDCProviders = []OIDCProvider{idp.provider()}
+ })
+ defer cleanup()
+
+ rr := httptest.NewRecorder()
+ if err := api.OIDCLogin(rr, httptest.NewRequest(http.MethodGet, "/auth/login", nil), "mock"); err != nil {
+  t.Fatalf("OIDCLogin: %v", err)
+ }
+ callback := idp.authorize(rr.Header().Get("Location"), "bob-sub", "bob@example.com")
+
+ // Without the binding cookie (e.g. a callback URL planted in another browser).
+ if _, err := api.OIDCCallback(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, callback, nil), "mock"); !errors.Is(err, ErrInvalidOIDCState) {
+  t.Fatalf("callback without state cookie: %v", err)
+ }
+
+ // The state is single use.
+ replay := func() error {
+  r := httptest.NewRequest(http.MethodGet, callback, nil)
+  for _, c := range rr.Result().Cookies() {
+   r.AddCookie(c)
+  }
+  _, err := api.OIDCCallback(httptest.NewRecorder(), r, "mock")
+  return err
+ }
+ if err := replay(); err != nil {
+  t.Fatalf("first callback: %v", err)
+ }
+ if err := replay(); !errors.Is(err, ErrInvalidOIDCState) {
+  t.Fatalf("replayed callback: %v", err)
+ }
+
+ if err := api.OIDCLogin(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), "nope"); !errors.Is(err, ErrUnknownProvider) {
+  t.Fatalf("unknown provider: %v", err)
+ }
+}
+
+func TestOIDCDiscoveryFetchesOutsideLock(t *testing.T) {
+ started, release := make(chan struct{}, 1), make(chan struct{})
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  select {
+  case started <- struct{}{}:
+  default:
+  }
+  select {
+  case <-release: // a slow provider
+  case <-r.Context().Done():
+  }
+  http.Error(w, "down", http.StatusServiceUnavailable)
+ }))
+ defer srv.Close()
+ defer close(release)
+ clients, err := newOIDCClients([]OIDCProvider{{Name: "slow", Issuer: srv.URL, ClientID: "c", RedirectURL: "http://app.example/cb"}}, time.Now)
+ if err != nil {
+  t.Fatalf("newOIDCClients: %v", err)
+ }
+ c := clients["slow"]
+ go func() { _, _, _ = c.metadata(context.Background()) }()
+ <-started
+
+ // Another sign-in gives up with its own context instead of queueing behind the
+ // first fetch.
+ ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+ defer cancel()
+ done := make(chan error, 1)
+ go func() {
+  _, _, err := c.metadata(ctx)
+  done <- err
+ }()
+ select {
+ case err := <-done:
+  if err == nil {
+   t.Fatal("metadata succeeded against a failing provider")
+  }
+ case <-time.After(5 * time.Second):
+  t.Fatal("metadata blocked behind a running discovery fetch")
+ }
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+ "context"
+ "database/sql"
+ "errors"
+ "fmt"
+ "net/http"
+ "strings"
+ "time"
+)
+
+func (a *API) createOrganizationInternal(ctx context.Context, ownerID int64, name string) (Organization, error) {
+ name = strings.TrimSpace(name)
+ if name == "" {
+  return Organization{}, fmt.Errorf("organization name required")
+ }
+ now := a.now().Unix()
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return Organization{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+
+ res, err := tx.ExecContext(ctx, `INSERT INTO organizations (name, created_at) VALUES (?, ?)`, name, now)
+ if err != nil {
+  return Organization{}, fmt.Errorf("insert organization: %w", err)
+ }
+ id, err := res.LastInsertId()
+ if err != nil {
+  return Organization{}, fmt.Errorf("last insert id: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO memberships (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+ `, id, ownerID, OrgRoleOwner, now); err != nil {
+  if strings.Contains(strings.ToLower(err.Error()), "foreign key") {
+   return Organization{}, fmt.Errorf("unknown user")
+  }
+  return Organization{}, fmt.Errorf("insert owner: %w", err)
+ }
+ if err := tx.Commit(); err != nil {
+  return Organization{}, fmt.Errorf("commit: %w", err)
+ }
+ return Organization{ID: id, Name: name, CreatedAt: time.Unix(now, 0)}, nil
+}
+
+func (a *API) addMemberInternal(ctx context.Context, orgID, userID int64, role string) error {
+ if err := validateMemberRole(role); err != nil {
+  return err
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ if err := orgExistsTx(ctx, tx, orgID); err != nil {
+  return err
+ }
+ res, err := tx.ExecContext(ctx, `
+  INSERT INTO memberships (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+  ON CONFLICT(org_id, user_id) DO NOTHING
+ `, orgID, userID, role, a.now().Unix())
+ if err != nil {
+  if strings.Contains(strings.ToLower(err.Error()), "foreign key") {
+   return fmt.Errorf("unknown user")
+  }
+  return fmt.Errorf("insert membership: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return ErrAlreadyMember
+ }
+ return tx.Commit()
+}
+
+func (a *API) removeMemberInternal(ctx context.Context, orgID, userID int64) error {
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ role, err := memberRoleTx(ctx, tx, orgID, userID)
+ if err != nil {
+  return err
+ }
+ if role == OrgRoleOwner {
+  return ErrOwnerRole
+ }
+ if _, err := tx.ExecContext(ctx, `DELETE FROM memberships WHERE org_id = ? AND user_id = ?`, orgID, userID); err != nil {
+  return fmt.Errorf("delete membership: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE sessions SET active_org_id = 0 WHERE user_id = ? AND active_org_id = ?
+ `, userID, orgID); err != nil {
+  return fmt.Errorf("reset active organization: %w", err)
+ }
+ return tx.Commit()
+}
+
+func (a *API) setMemberRoleInternal(ctx context.Context, orgID, userID int64, role string) error {
+ if err := validateMemberRole(role); err != nil {
+  return err
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ current, err := memberRoleTx(ctx, tx, orgID, userID)
+ if err != nil {
+  return err
+ }
+ if current == OrgRoleOwner {
+  return ErrOwnerRole
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE memberships SET role = ? WHERE org_id = ? AND user_id = ?
+ `, role, orgID, userID); err != nil {
+  return fmt.Errorf("update membership: %w", err)
+ }
+ return tx.Commit()
+}
+
+// transferOwnershipInternal makes an existing member the owner; the previous owner
+// stays on as an admin.
+func (a *API) transferOwnershipInternal(ctx context.Context, orgID, newOwnerID int64) error {
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ role, err := memberRoleTx(ctx, tx, orgID, newOwnerID)
+ if err != nil {
+  return err
+ }
+ if role == OrgRoleOwner {
+  return nil
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE memberships SET role = ? WHERE org_id = ? AND role = ?
+ `, OrgRoleAdmin, orgID, OrgRoleOwner); err != nil {
+  return fmt.Errorf("demote owner: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `
+  UPDATE memberships SET role = ? WHERE org_id = ? AND user_id = ?
+ `, OrgRoleOwner, orgID, newOwnerID); err != nil {
+  return fmt.Errorf("promote owner: %w", err)
+ }
+ return tx.Commit()
+}
+
+func (a *API) listMembersInternal(ctx context.Context, orgID int64) ([]Membership, error) {
+ return a.queryMemberships(ctx, `WHERE m.org_id = ? ORDER BY m.created_at, m.user_id`, orgID)
+}
+
+func (a *API) listOrganizationsInternal(ctx context.Context, userID int64) ([]Membership, error) {
+ return a.queryMemberships(ctx, `WHERE m.user_id = ? ORDER BY o.name, o.id`, userID)
+}
+
+func (a *API) membershipInternal(ctx context.Context, orgID, userID int64) (Membership, error) {
+ ms, err := a.queryMemberships(ctx, `WHERE m.org_id = ? AND m.user_id = ?`, orgID, userID)
+ if err != nil {
+  return Membership{}, err
+ }
+ if len(ms) == 0 {
+  return Membership{}, ErrNotMember
+ }
+ return ms[0], nil
+}
+
+func (a *API) queryMemberships(ctx context.Context, where string, args ...any) ([]Membership, error) {
+ rows, err := a.db.QueryContext(ctx, `
+  SELECT o.id, o.name, o.created_at, m.user_id, m.role, m.created_at
+  FROM memberships m
+  JOIN organizations o ON o.id = m.org_id
+  `+where, args...)
+ if err != nil {
+  return nil, fmt.Errorf("query memberships: %w", err)
+ }
+ defer rows.Close()
+ var out []Membership
+ for rows.Next() {
+  var (
+   m      Membership
+   oc, mc int64
+  )
+  if err := rows.Scan(&m.Organization.ID, &m.Organization.Name, &oc, &m.UserID, &m.Role, &mc); err != nil {
+   return nil, fmt.Errorf("scan membership: %w", err)
+  }
+  m.Organization.CreatedAt = time.Unix(oc, 0)
+  m.CreatedAt = time.Unix(mc, 0)
+  out = append(out, m)
+ }
+ return out, rows.Err()
+}
+
+// currentSession returns the user and session of the request, from the context when
+// Middleware already ran, else by resolving the session token.
+func (a *API) currentSession(w http.ResponseWriter, r *http.Request) (User, sessionInfo, error) {
+ user, userOK := fromContext(r.Context())
+ info, infoOK := sessionFromContext(r.Context())
+ if userOK && infoOK {
+  return user, info, nil
+ }
+ user, info, ok, err := a.resolveSession(w, r)
+ if err != nil {
+  return User{}, sessionInfo{}, err
+ }
+ if !ok {
+  return User{}, sessionInfo{}, ErrNoSession
+ }
+ return user, info, nil
+}
+
+// setActiveOrganizationInternal records the organization selected for the current
+// session. orgID 0 clears the selection.
+func (a *API) setActiveOrganizationInternal(w http.ResponseWriter, r *http.Request, orgID int64) error {
+ ctx := r.Context()
+ user, info, err := a.currentSession(w, r)
+ if err != nil {
+  return err
+ }
+ if orgID != 0 {
+  if _, err := a.membershipInternal(ctx, orgID, user.ID); err != nil {
+   return err
+  }
+ }
+ if info.stateless == nil {
+  if _, err := a.db.ExecContext(ctx, `UPDATE sessions SET active_org_id = ? WHERE token = ?`, orgID, info.token); err != nil {
+   return fmt.Errorf("update session: %w", err)
+  }
+  return nil
+ }
+ p := *info.stateless
+ p.OrgID = orgID
+ sealed, err := a.sealer.seal(p)
+ if err != nil {
+  return fmt.Errorf("seal session: %w", err)
+ }
+ a.setCookie(w, sealed, time.Unix(p.ExpiresAt, 0))
+ return nil
+}
+
+// organizationMiddlewareInternal resolves the session's active organization. The
+// membership is re-checked on every request, so removed members lose access at once.
+func (a *API) organizationMiddlewareInternal(next http.Handler) http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  user, ok := fromContext(r.Context())
+  info, infoOK := sessionFromContext(r.Context())
+  if !ok || !infoOK || info.activeOrgID == 0 {
+   next.ServeHTTP(w, r)
+   return
+  }
+  m, err := a.membershipInternal(r.Context(), info.activeOrgID, user.ID)
+  if err != nil {
+   if !errors.Is(err, ErrNotMember) {
+    a.logError(r.Context(), "active organization lookup failed", err, userAttr(user.ID))
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   }
+   next.ServeHTTP(w, r)
+   return
+  }
+  next.ServeHTTP(w, r.WithContext(withMembership(r.Context(), m)))
+ })
+}
+
+func orgExistsTx(ctx context.Context, tx txHandle, orgID int64) error {
+ var one int
+ err := tx.QueryRowContext(ctx, `SELECT 1 FROM organizations WHERE id = ?`, orgID).Scan(&one)
+ if errors.Is(err, sql.ErrNoRows) {
+  return ErrOrganizationNotFound
+ }
+ if err != nil {
+  return fmt.Errorf("query organization: %w", err)
+ }
+ return nil
+}
+
+func memberRoleTx(ctx context.Context, tx txHandle, orgID, userID int64) (string, error) {
+ var role string
+ err := tx.QueryRowContext(ctx, `
+  SELECT role FROM memberships WHERE org_id = ? AND user_id = ?
+ `, orgID, userID).Scan(&role)
+ if errors.Is(err, sql.ErrNoRows) {
+  return "", ErrNotMember
+ }
+ if err != nil {
+  return "", fmt.Errorf("query membership: %w", err)
+ }
+ return role, nil
+}
+
+func validateMemberRole(role string) error {
+ if strings.TrimSpace(role) == "" {
+  return fmt.Errorf("member role required")
+ }
+ if role == OrgRoleOwner {
+  return ErrOwnerRole
+ }
+ return nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+)
+
+func TestOrganizationMembership(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ owner, _ := api.Register(ctx, "owner@example.com", "password123")
+ member, _ := api.Register(ctx, "member@example.com", "password123")
+
+ org, err := api.CreateOrganization(ctx, owner.ID, "Acme")
+ if err != nil {
+  t.Fatalf("CreateOrganization: %v", err)
+ }
+ if err := api.AddMember(ctx, org.ID, member.ID, OrgRoleMember); err != nil {
+  t.Fatalf("AddMember: %v", err)
+ }
+ if err := api.AddMember(ctx, org.ID, member.ID, OrgRoleMember); !errors.Is(err, ErrAlreadyMember) {
+  t.Fatalf("duplicate AddMember: %v", err)
+ }
+ if err := api.AddMember(ctx, org.ID+1, member.ID, OrgRoleMember); !errors.Is(err, ErrOrganizationNotFound) {
+  t.Fatalf("AddMember to missing org: %v", err)
+ }
+ if err := api.SetMemberRole(ctx, org.ID, member.ID, OrgRoleOwner); !errors.Is(err, ErrOwnerRole) {
+  t.Fatalf("SetMemberRole to owner: %v", err)
+ }
+ if err := api.RemoveMember(ctx, org.ID, owner.ID); !errors.Is(err, ErrOwnerRole) {
+  t.Fatalf("removing the owner: %v", err)
+ }
+
+ if err := api.TransferOwnership(ctx, org.ID, member.ID); err != nil {
+  t.Fatalf("TransferOwnership: %v", err)
+ }
+ members, err := api.ListMembers(ctx, org.ID)
+ if err != nil || len(members) != 2 {
+  t.Fatalf("ListMembers: %v %v", members, err)
+ }
+ roles := map[int64]string{}
+ for _, m := range members {
+  roles[m.UserID] = m.Role
+ }
+ if roles[member.ID] != OrgRoleOwner || roles[owner.ID] != OrgRoleAdmin {
+  t.Fatalf("ownership not transferred: %v", roles)
+ }
+
+ orgs, err := api.ListOrganizations(ctx, owner.ID)
+ if err != nil || len(orgs) != 1 || orgs[0].Organization.Name != "Acme" {
+  t.Fatalf("ListOrganizations: %v %v", orgs, err)
+ }
+}
+
+func TestActiveOrganizationMiddleware(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ owner, _ := api.Register(ctx, "boss@example.com", "password123")
+ user, _ := api.Register(ctx, "dev@example.com", "password123")
+ org, _ := api.CreateOrganization(ctx, owner.ID, "Initech")
+ if err := api.AddMember(ctx, org.ID, user.ID, OrgRoleAdmin); err != nil {
+  t.Fatalf("AddMember: %v", err)
+ }
+ other, _ := api.CreateOrganization(ctx, owner.ID, "Elsewhere")
+ c := mustLogin(t, api, "dev@example.com", "password123")
+
+ var got Membership
+ var found bool
+ h := api.Middleware(api.OrganizationMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  got, found = OrganizationFromContext(r.Context())
+ })))
+
+ h.ServeHTTP(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", c))
+ if found {
+  t.Fatalf("no organization selected yet")
+ }
+
+ if err := api.SetActiveOrganization(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/org", c), other.ID); !errors.Is(err, ErrNotMember) {
+  t.Fatalf("selecting a foreign org: %v", err)
+ }
+ if err := api.SetActiveOrganization(httptest.NewRecorder(), newReqWithCookie(http.MethodPost, "/org", c), org.ID); err != nil {
+  t.Fatalf("SetActiveOrganization: %v", err)
+ }
+ h.ServeHTTP(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", c))
+ if !found || got.Organization.ID != org.ID || got.Role != OrgRoleAdmin {
+  t.Fatalf("active org not resolved: found=%v m=%+v", found, got)
+ }
+
+ if err := api.RemoveMember(ctx, org.ID, user.ID); err != nil {
+  t.Fatalf("RemoveMember: %v", err)
+ }
+ h.ServeHTTP(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", c))
+ if found {
+  t.Fatalf("removed member still resolved into org")
+ }
+}
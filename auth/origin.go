@@ -0,0 +1,189 @@
+package auth
+
+import (
+ "fmt"
+ "net"
+ "net/http"
+ "net/netip"
+ "net/url"
+ "strings"
+)
+
+// originPattern is a parsed AllowedOrigins entry. wildcard patterns match any
+// subdomain of host, but not host itself.
+type originPattern struct {
+ scheme   string
+ host     string // lower-case, default port stripped
+ wildcard bool
+}
+
+func newOriginPolicy(cfg OriginPolicyConfig) (*OriginPolicy, error) {
+ p := &OriginPolicy{failure: cfg.FailureHandler}
+ for _, o := range cfg.AllowedOrigins {
+  pat, err := parseOriginPattern(o)
+  if err != nil {
+   return nil, err
+  }
+  p.allowed = append(p.allowed, pat)
+ }
+ for _, s := range cfg.TrustedProxies {
+  prefix, err := netip.ParsePrefix(s)
+  if err != nil {
+   addr, aerr := netip.ParseAddr(s)
+   if aerr != nil {
+    return nil, fmt.Errorf("invalid trusted proxy %q", s)
+   }
+   prefix = netip.PrefixFrom(addr, addr.BitLen())
+  }
+  p.proxies = append(p.proxies, prefix.Masked())
+ }
+ return p, nil
+}
+
+func parseOriginPattern(o string) (originPattern, error) {
+ u, err := url.Parse(o)
+ if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+  (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+  return originPattern{}, fmt.Errorf("invalid allowed origin %q: want scheme://host[:port]", o)
+ }
+ pat := originPattern{scheme: u.Scheme, host: normalizeOriginHost(u.Scheme, u.Host)}
+ if rest, ok := strings.CutPrefix(pat.host, "*."); ok {
+  if rest == "" || strings.Contains(rest, "*") {
+   return originPattern{}, fmt.Errorf("invalid allowed origin %q", o)
+  }
+  pat.host, pat.wildcard = rest, true
+ } else if strings.Contains(pat.host, "*") {
+  return originPattern{}, fmt.Errorf("invalid allowed origin %q: wildcards must be a leading \"*.\"", o)
+ }
+ return pat, nil
+}
+
+// normalizeOriginHost lower-cases host and strips the scheme's default port.
+func normalizeOriginHost(scheme, host string) string {
+ host = strings.ToLower(host)
+ switch {
+ case scheme == "https" && strings.HasSuffix(host, ":443"):
+  return strings.TrimSuffix(host, ":443")
+ case scheme == "http" && strings.HasSuffix(host, ":80"):
+  return strings.TrimSuffix(host, ":80")
+ }
+ return host
+}
+
+func (pat originPattern) matches(scheme, host string) bool {
+ if pat.scheme != scheme {
+  return false
+ }
+ if !pat.wildcard {
+  return pat.host == host
+ }
+ return strings.HasSuffix(host, "."+pat.host)
+}
+
+// allowedInternal applies, in order: Fetch Metadata (Sec-Fetch-Site), Origin, and
+// for unsafe methods Referer. Browsers that send none of them are old or the
+// request is not from a browser; unsafe requests are then rejected, safe ones not.
+func (p *OriginPolicy) allowedInternal(r *http.Request) bool {
+ site := r.Header.Get("Sec-Fetch-Site")
+ if site == "same-origin" || site == "none" {
+  return true
+ }
+ if origin := r.Header.Get("Origin"); origin != "" {
+  return p.originAllowed(r, origin)
+ }
+ if site != "" {
+  // same-site or cross-site without an Origin to check against AllowedOrigins.
+  return false
+ }
+ if !isUnsafeMethod(r.Method) {
+  return true
+ }
+ if ref := r.Header.Get("Referer"); ref != "" {
+  return p.originAllowed(r, ref)
+ }
+ return false
+}
+
+// originAllowed reports whether the origin of rawURL (an Origin or Referer value)
+// is the request's own origin or matches AllowedOrigins, scheme included.
+func (p *OriginPolicy) originAllowed(r *http.Request, rawURL string) bool {
+ u, err := url.Parse(rawURL)
+ if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+  return false // includes "Origin: null"
+ }
+ scheme, host := u.Scheme, normalizeOriginHost(u.Scheme, u.Host)
+ selfScheme, selfHost := p.requestOrigin(r)
+ if scheme == selfScheme && host == normalizeOriginHost(selfScheme, selfHost) {
+  return true
+ }
+ for _, pat := range p.allowed {
+  if pat.matches(scheme, host) {
+   return true
+  }
+ }
+ return false
+}
+
+// requestOrigin returns the scheme and host the client used. X-Forwarded-Host and
+// X-Forwarded-Proto are honored only from TrustedProxies; the last value is the
+// one added by the nearest proxy.
+func (p *OriginPolicy) requestOrigin(r *http.Request) (string, string) {
+ scheme, host := "http", r.Host
+ if r.TLS != nil {
+  scheme = "https"
+ }
+ if !p.fromTrustedProxy(r) {
+  return scheme, host
+ }
+ if v := lastHeaderValue(r, "X-Forwarded-Host"); v != "" {
+  host = v
+ }
+ if v := strings.ToLower(lastHeaderValue(r, "X-Forwarded-Proto")); v == "http" || v == "https" {
+  scheme = v
+ }
+ return scheme, host
+}
+
+func (p *OriginPolicy) fromTrustedProxy(r *http.Request) bool {
+ if len(p.proxies) == 0 {
+  return false
+ }
+ host, _, err := net.SplitHostPort(r.RemoteAddr)
+ if err != nil {
+  host = r.RemoteAddr
+ }
+ addr, err := netip.ParseAddr(host)
+ if err != nil {
+  return false
+ }
+ addr = addr.Unmap()
+ for _, prefix := range p.proxies {
+  if prefix.Contains(addr) {
+   return true
+  }
+ }
+ return false
+}
+
+func lastHeaderValue(r *http.Request, name string) string {
+ values := r.Header.Values(name)
+ if len(values) == 0 {
+  return ""
+ }
+ parts := strings.Split(values[len(values)-1], ",")
+ return strings.TrimSpace(parts[len(parts)-1])
+}
+
+func (p *OriginPolicy) middlewareInternal(next http.Handler) http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if isUnsafeMethod(r.Method) && !p.allowedInternal(r) {
+   if p.failure != nil {
+    p.failure.ServeHTTP(w, r)
+    return
+   }
+   http.Error(w, "forbidden", http.StatusForbidden)
+   return
+  }
+  next.ServeHTTP(w, r)
+ })
+}
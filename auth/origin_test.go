@@ -0,0 +1,92 @@
+package auth
+
+import (
+ "crypto/tls"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+)
+
+func originRequest(method, host string, headers map[string]string) *http.Request {
+ r := httptest.NewRequest(method, "http://"+host+"/submit", nil)
+ for k, v := range headers {
+  r.Header.Set(k, v)
+ }
+ return r
+}
+
+func TestOriginPolicyAllowed(t *testing.T) {
+ p, err := NewOriginPolicy(OriginPolicyConfig{
+  AllowedOrigins: []string{"https://*.example.com", "http://localhost:3000"},
+  TrustedProxies: []string{"10.0.0.0/8"},
+ })
+ if err != nil {
+  t.Fatalf("NewOriginPolicy: %v", err)
+ }
+ tlsReq := func(headers map[string]string) *http.Request {
+  r := originRequest(http.MethodPost, "app.test", headers)
+  r.TLS = &tls.ConnectionState{}
+  return r
+ }
+ proxied := func(headers map[string]string) *http.Request {
+  r := originRequest(http.MethodPost, "backend:8080", headers)
+  r.RemoteAddr = "10.1.2.3:5555"
+  r.Header.Set("X-Forwarded-Host", "shop.test")
+  r.Header.Set("X-Forwarded-Proto", "https")
+  return r
+ }
+ cases := []struct {
+  name string
+  r    *http.Request
+  want bool
+ }{
+  {"same origin", tlsReq(map[string]string{"Origin": "https://app.test"}), true},
+  {"scheme mismatch", tlsReq(map[string]string{"Origin": "http://app.test"}), false},
+  {"default port", tlsReq(map[string]string{"Origin": "https://app.test:443"}), true},
+  {"wildcard subdomain", tlsReq(map[string]string{"Origin": "https://api.example.com"}), true},
+  {"nested subdomain", tlsReq(map[string]string{"Origin": "https://a.b.example.com"}), true},
+  {"wildcard excludes apex", tlsReq(map[string]string{"Origin": "https://example.com"}), false},
+  {"suffix lookalike", tlsReq(map[string]string{"Origin": "https://evilexample.com"}), false},
+  {"wildcard wrong scheme", tlsReq(map[string]string{"Origin": "http://api.example.com"}), false},
+  {"exact with port", tlsReq(map[string]string{"Origin": "http://localhost:3000"}), true},
+  {"null origin", tlsReq(map[string]string{"Origin": "null"}), false},
+  {"fetch metadata same-origin", tlsReq(map[string]string{"Sec-Fetch-Site": "same-origin"}), true},
+  {"fetch metadata cross-site", tlsReq(map[string]string{"Sec-Fetch-Site": "cross-site"}), false},
+  {"same-site needs allowed origin", tlsReq(map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "https://evil.app.test"}), false},
+  {"referer fallback", tlsReq(map[string]string{"Referer": "https://app.test/form"}), true},
+  {"no headers on POST", tlsReq(nil), false},
+  {"no headers on GET", originRequest(http.MethodGet, "app.test", nil), true},
+  {"trusted proxy", proxied(map[string]string{"Origin": "https://shop.test"}), true},
+  {"trusted proxy, backend host", proxied(map[string]string{"Origin": "http://backend:8080"}), false},
+ }
+ for _, c := range cases {
+  if got := p.Allowed(c.r); got != c.want {
+   t.Errorf("%s: Allowed = %v, want %v", c.name, got, c.want)
+  }
+ }
+
+ // Forwarded headers from anyone else are ignored.
+ r := originRequest(http.MethodPost, "backend:8080", map[string]string{"Origin": "https://shop.test", "X-Forwarded-Host": "shop.test", "X-Forwarded-Proto": "https"})
+ r.RemoteAddr = "203.0.113.9:5555"
+ if p.Allowed(r) {
+  t.Error("untrusted X-Forwarded-Host honored")
+ }
+}
+
+func TestOriginPolicyMiddleware(t *testing.T) {
+ p, _ := NewOriginPolicy(OriginPolicyConfig{})
+ h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+ rr := httptest.NewRecorder()
+ h.ServeHTTP(rr, originRequest(http.MethodPost, "app.test", map[string]string{"Origin": "http://evil.test"}))
+ if rr.Code != http.StatusForbidden {
+  t.Fatalf("cross-site POST: %d", rr.Code)
+ }
+ rr = httptest.NewRecorder()
+ h.ServeHTTP(rr, originRequest(http.MethodGet, "app.test", map[string]string{"Origin": "http://evil.test"}))
+ if rr.Code != http.StatusOK {
+  t.Fatalf("cross-site GET: %d", rr.Code)
+ }
+ if _, err := NewOriginPolicy(OriginPolicyConfig{AllowedOrigins: []string{"https://api.*.com"}}); err == nil {
+  t.Fatal("inner wildcard accepted")
+ }
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "embed"
+ "errors"
+ "fmt"
+ "html/template"
+ "log/slog"
+ "net/http"
+ "net/url"
+ "strings"
+ "time"
+)
+
+//go:embed templates/*.html
+var pageTemplateFS embed.FS
+
+var defaultPageTemplates = template.Must(template.ParseFS(pageTemplateFS, "templates/*.html"))
+
+// Flash messages survive one redirect in a short-lived cookie holding one of these
+// keys, never the text itself, so a planted cookie cannot put words on the page.
+var pageFlashes = map[string]string{
+ "reset_sent":       "If an account exists for that email, we have sent it a link to reset the password.",
+ "password_reset":   "Your password has been reset. Sign in with your new password.",
+ "password_changed": "Your password has been changed and your other sessions were signed out.",
+ "signed_out":       "You have been signed out.",
+}
+
+const pageFlashMaxAge = time.Minute
+
+func (a *API) pageFlashCookieName() string {
+ return a.cfg.SessionName + "_flash"
+}
+
+func checkPageOptions(p PageOptions) error {
+ if p.SendPasswordReset == nil {
+  return nil
+ }
+ u, err := url.Parse(p.ResetURL)
+ if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+  return fmt.Errorf("Pages.ResetURL must be an absolute URL")
+ }
+ return nil
+}
+
+func (a *API) pageRoutesInternal(mux *http.ServeMux, prefix string) {
+ prefix = strings.TrimSuffix(prefix, "/")
+ mux.Handle(prefix+"/login", a.pageEndpoint(prefix, "login", a.servePageLogin))
+ mux.Handle(prefix+"/register", a.pageEndpoint(prefix, "register", a.servePageRegister))
+ mux.Handle(prefix+"/logout", a.pageEndpoint(prefix, "logout", a.servePageLogout))
+ mux.Handle(prefix+"/account", a.pageEndpoint(prefix, "account", a.servePageAccount))
+ mux.Handle(prefix+"/reauthenticate", a.pageEndpoint(prefix, "reauthenticate", a.servePageReauthenticate))
+ if a.cfg.Pages.SendPasswordReset != nil {
+  mux.Handle(prefix+"/forgot-password", a.pageEndpoint(prefix, "forgot_password", a.servePageForgotPassword))
+  mux.Handle(prefix+"/reset-password", a.pageEndpoint(prefix, "reset_password", a.servePageResetPassword))
+ }
+}
+
+// pageEndpoint resolves the session, enforces CSRF tokens on POST and prepares the
+// Page for a handler.
+func (a *API) pageEndpoint(prefix, name string, h func(w http.ResponseWriter, r *http.Request, p Page)) http.Handler {
+ return a.middlewareInternal(a.csrfMiddlewareInternal(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  switch {
+  case r.Method == http.MethodPost:
+  case name == "logout":
+   w.Header().Set("Allow", "POST")
+   http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+   return
+  case r.Method != http.MethodGet && r.Method != http.MethodHead:
+   w.Header().Set("Allow", "GET, HEAD, POST")
+   http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+   return
+  }
+  p := Page{
+   Name:         name,
+   Prefix:       prefix,
+   CSRFField:    a.csrfTemplateField(r),
+   Next:         safeNextPath(r.FormValue("next")),
+   ResetEnabled: a.cfg.Pages.SendPasswordReset != nil,
+  }
+  p.User, _ = fromContext(r.Context())
+  if c, err := r.Cookie(a.pageFlashCookieName()); err == nil {
+   p.Notice = pageFlashes[c.Value]
+   a.setAuxCookie(w, a.pageFlashCookieName(), "", 0)
+  }
+  h(w, r, p)
+ })))
+}
+
+func (a *API) servePageLogin(w http.ResponseWriter, r *http.Request, p Page) {
+ if r.Method != http.MethodPost {
+  if p.User.ID != 0 {
+   http.Redirect(w, r, a.afterLogin(p.Next), http.StatusSeeOther)
+   return
+  }
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ p.Email = r.PostFormValue("email")
+ if _, err := a.loginInternal(w, r, p.Email, r.PostFormValue("password")); err != nil {
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ http.Redirect(w, r, a.afterLogin(p.Next), http.StatusSeeOther)
+}
+
+func (a *API) servePageRegister(w http.ResponseWriter, r *http.Request, p Page) {
+ if r.Method != http.MethodPost {
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ p.Email = r.PostFormValue("email")
+ password := r.PostFormValue("password")
+ if password != r.PostFormValue("password_confirm") {
+  p.Error = "The passwords do not match."
+  a.renderPage(w, r, http.StatusBadRequest, p)
+  return
+ }
+ user, err := a.registerInternal(r.Context(), p.Email, password)
+ if err == nil {
+  err = a.signInRegistered(w, r.Context(), user)
+ }
+ if err != nil {
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ http.Redirect(w, r, a.afterLogin(p.Next), http.StatusSeeOther)
+}
+
+func (a *API) servePageLogout(w http.ResponseWriter, r *http.Request, p Page) {
+ if err := a.logoutInternal(w, r); err != nil {
+  a.logError(r.Context(), "auth page logout failed", err)
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ a.redirectWithFlash(w, r, p.Prefix+"/login", "signed_out")
+}
+
+// servePageAccount shows the signed-in user's settings and changes the password,
+// signing the browser back in after every other session is revoked.
+func (a *API) servePageAccount(w http.ResponseWriter, r *http.Request, p Page) {
+ if p.User.ID == 0 {
+  http.Redirect(w, r, p.Prefix+"/login?next="+url.QueryEscape(r.URL.Path), http.StatusSeeOther)
+  return
+ }
+ if r.Method != http.MethodPost {
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ ctx := r.Context()
+ password := r.PostFormValue("password")
+ if password != r.PostFormValue("password_confirm") {
+  p.Error = "The new passwords do not match."
+  a.renderPage(w, r, http.StatusBadRequest, p)
+  return
+ }
+ if _, err := a.authenticatePassword(ctx, p.User.Email, r.PostFormValue("current_password")); err != nil {
+  if errors.Is(err, ErrInvalidCredentials) {
+   p.Error = "Your current password is incorrect."
+   a.renderPage(w, r, http.StatusForbidden, p)
+   return
+  }
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ err := a.changePasswordInternal(ctx, p.User.ID, password)
+ if err == nil {
+  err = a.createSessionAndSetCookie(w, ctx, p.User.ID)
+ }
+ if err != nil {
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ a.redirectWithFlash(w, r, p.Prefix+"/account", "password_changed")
+}
+
+// servePageReauthenticate confirms the signed-in user's password for
+// RequireRecentAuth and returns to the "next" path.
+func (a *API) servePageReauthenticate(w http.ResponseWriter, r *http.Request, p Page) {
+ if p.User.ID == 0 {
+  http.Redirect(w, r, p.Prefix+"/login?next="+url.QueryEscape(a.afterLogin(p.Next)), http.StatusSeeOther)
+  return
+ }
+ if r.Method != http.MethodPost {
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ if _, err := a.reauthenticatePasswordInternal(w, r, r.PostFormValue("password")); err != nil {
+  if errors.Is(err, ErrInvalidCredentials) {
+   p.Error = "Your password is incorrect."
+   a.renderPage(w, r, http.StatusForbidden, p)
+   return
+  }
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ http.Redirect(w, r, a.afterLogin(p.Next), http.StatusSeeOther)
+}
+
+// servePageForgotPassword sends a reset link. The response is the same whether or
+// not the email has an account; the lookup, the token and the delivery are queued
+// for resetWorker, so the reply does not wait for them.
+func (a *API) servePageForgotPassword(w http.ResponseWriter, r *http.Request, p Page) {
+ if r.Method != http.MethodPost {
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ req := resetRequest{ctx: context.WithoutCancel(r.Context()), email: r.PostFormValue("email")}
+ select {
+ case a.resetQueue <- req:
+ default:
+  a.log(r.Context(), slog.LevelWarn, "password reset queue full; request dropped")
+ }
+ a.redirectWithFlash(w, r, p.Prefix+"/forgot-password", "reset_sent")
+}
+
+// resetQueueSize bounds the forgot-password requests waiting for the worker; a
+// flood beyond it is dropped instead of piling up goroutines and database work.
+const resetQueueSize = 64
+
+type resetRequest struct {
+ ctx   context.Context
+ email string
+}
+
+// startResetWorker serves the reset queue one request at a time until Close.
+func startResetWorker(a *API) {
+ queue := make(chan resetRequest, resetQueueSize)
+ a.resetQueue = queue
+ // Capture the channel: closeInternal nils a.stopCh after closing it.
+ stop := a.stopCh
+ a.wg.Add(1)
+ go func() {
+  defer a.wg.Done()
+  for {
+   select {
+   case req := <-queue:
+    a.sendPasswordReset(req.ctx, req.email)
+   case <-stop:
+    return
+   }
+  }
+ }()
+}
+
+// sendPasswordReset creates a reset token for email and delivers its link. Errors
+// are only logged; unknown emails and capped accounts are skipped silently.
+func (a *API) sendPasswordReset(ctx context.Context, email string) {
+ token, user, err := a.createPasswordResetInternal(ctx, email)
+ switch {
+ case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrTooManyPasswordResets):
+ case err != nil:
+  a.logError(ctx, "create password reset failed", err)
+ default:
+  if err := a.cfg.Pages.SendPasswordReset(ctx, user, a.passwordResetURL(token)); err != nil {
+   a.logError(ctx, "send password reset failed", err, userAttr(user.ID))
+  }
+ }
+}
+
+func (a *API) servePageResetPassword(w http.ResponseWriter, r *http.Request, p Page) {
+ p.Token = r.FormValue("token")
+ if r.Method != http.MethodPost {
+  if _, err := a.passwordResetUser(r.Context(), p.Token); err != nil {
+   p.Token = ""
+   a.renderPageError(w, r, p, err)
+   return
+  }
+  a.renderPage(w, r, http.StatusOK, p)
+  return
+ }
+ password := r.PostFormValue("password")
+ if password != r.PostFormValue("password_confirm") {
+  p.Error = "The passwords do not match."
+  a.renderPage(w, r, http.StatusBadRequest, p)
+  return
+ }
+ if _, err := a.resetPasswordInternal(r.Context(), p.Token, password); err != nil {
+  if errors.Is(err, ErrInvalidResetToken) {
+   p.Token = ""
+  }
+  a.renderPageError(w, r, p, err)
+  return
+ }
+ a.redirectWithFlash(w, r, p.Prefix+"/login", "password_reset")
+}
+
+func (a *API) passwordResetURL(token string) string {
+ u, _ := url.Parse(a.cfg.Pages.ResetURL) // validated in New
+ q := u.Query()
+ q.Set("token", token)
+ u.RawQuery = q.Encode()
+ return u.String()
+}
+
+func (a *API) afterLogin(next string) string {
+ if next != "" {
+  return next
+ }
+ return a.cfg.Pages.AfterLogin
+}
+
+func (a *API) redirectWithFlash(w http.ResponseWriter, r *http.Request, target, flash string) {
+ a.setAuxCookie(w, a.pageFlashCookieName(), flash, pageFlashMaxAge)
+ http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// renderPageError shows a message for err; unexpected errors are logged and
+// shown generically.
+func (a *API) renderPageError(w http.ResponseWriter, r *http.Request, p Page, err error) {
+ status := http.StatusBadRequest
+ switch {
+ case errors.Is(err, ErrInvalidCredentials):
+  status, p.Error = http.StatusUnauthorized, "Invalid email or password."
+ case errors.Is(err, ErrInvalidEmail):
+  p.Error = "Enter a valid email address."
+ case errors.Is(err, ErrWeakPassword):
+  p.Error = fmt.Sprintf("Use a password of at least %d characters.", a.cfg.MinPasswordLength)
+  if a.cfg.RequireStrongPasswords {
+   p.Error = fmt.Sprintf("Use a password of at least %d characters with letters and digits.", a.cfg.MinPasswordLength)
+  }
+ case errors.Is(err, ErrEmailDomainNotAllowed), errors.Is(err, ErrDisposableEmail),
+  errors.Is(err, ErrRegistrationRejected):
+  p.Error = "That email address cannot be used to sign up."
+ case errors.Is(err, ErrEmailTaken):
+  status, p.Error = http.StatusConflict, "An account with that email already exists."
+ case errors.Is(err, ErrLoginRejected):
+  status, p.Error = http.StatusForbidden, "Sign-in is not allowed for this account."
+ case errors.Is(err, ErrInviteRequired):
+  status, p.Error = http.StatusForbidden, "Sign-up is by invitation only."
+ case errors.Is(err, ErrSessionLimitReached):
+  status, p.Error = http.StatusConflict, "You are signed in on too many devices. Sign out elsewhere and try again."
+ case errors.Is(err, ErrInvalidResetToken):
+  p.Error = "This password reset link is invalid or has expired."
+ default:
+  a.logError(r.Context(), "auth page failed", err, slog.String("page", p.Name))
+  status, p.Error = http.StatusInternalServerError, "Something went wrong. Please try again."
+ }
+ a.renderPage(w, r, status, p)
+}
+
+// renderPage executes the page's template, from PageOptions.Templates when it
+// defines one, else the built-in.
+func (a *API) renderPage(w http.ResponseWriter, r *http.Request, status int, p Page) {
+ tmpl := defaultPageTemplates.Lookup(p.Name)
+ if custom := a.cfg.Pages.Templates; custom != nil && custom.Lookup(p.Name) != nil {
+  tmpl = custom.Lookup(p.Name)
+ }
+ var buf bytes.Buffer
+ if err := tmpl.Execute(&buf, p); err != nil {
+  a.logError(r.Context(), "auth page template failed", err, slog.String("page", p.Name))
+  http.Error(w, "internal error", http.StatusInternalServerError)
+  return
+ }
+ h := w.Header()
+ h.Set("Content-Type", "text/html; charset=utf-8")
+ h.Set("Cache-Control", "no-store")
+ h.Set("X-Frame-Options", "DENY")
+ // Reset links carry their token in the URL; keep it out of Referer headers.
+ h.Set("Referrer-Policy", "no-referrer")
+ w.WriteHeader(status)
+ _, _ = buf.WriteTo(w)
+}
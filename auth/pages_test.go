@@ -0,0 +1,223 @@
+package auth
+
+import (
+ "context"
+ "html/template"
+ "net/http"
+ "net/http/httptest"
+ "net/url"
+ "regexp"
+ "strings"
+ "testing"
+ "time"
+)
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// pageClient keeps cookies between requests and the CSRF token of the last page.
+type pageClient struct {
+ t       *testing.T
+ h       http.Handler
+ cookies map[string]*http.Cookie
+ csrf    string
+}
+
+func newPageClient(t *testing.T, h http.Handler) *pageClient {
+ return &pageClient{t: t, h: h, cookies: map[string]*http.Cookie{}}
+}
+
+func (c *pageClient) do(req *http.Request) *httptest.ResponseRecorder {
+ for _, ck := range c.cookies {
+  req.AddCookie(ck)
+ }
+ rr := serve(c.h, req)
+ for _, ck := range rr.Result().Cookies() {
+  if ck.MaxAge < 0 || ck.Value == "" {
+   delete(c.cookies, ck.Name)
+  } else {
+   c.cookies[ck.Name] = ck
+  }
+ }
+ if m := csrfFieldPattern.FindStringSubmatch(rr.Body.String()); m != nil {
+  c.csrf = m[1]
+ }
+ return rr
+}
+
+func (c *pageClient) get(target string) *httptest.ResponseRecorder {
+ return c.do(httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// post submits form with the CSRF token of the last page.
+func (c *pageClient) post(target string, form url.Values) *httptest.ResponseRecorder {
+ if form.Get("csrf_token") == "" {
+  form.Set("csrf_token", c.csrf)
+ }
+ req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+ req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+ return c.do(req)
+}
+
+func expectRedirect(t *testing.T, rr *httptest.ResponseRecorder, location string) {
+ t.Helper()
+ if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != location {
+  t.Fatalf("want redirect to %q, got %d %q: %s", location, rr.Code, rr.Header().Get("Location"), rr.Body.String())
+ }
+}
+
+func TestPagesLoginRegisterAccount(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+ mux := http.NewServeMux()
+ api.PageRoutes(mux, "/auth")
+ c := newPageClient(t, mux)
+
+ expectRedirect(t, c.get("/auth/account"), "/auth/login?next=%2Fauth%2Faccount")
+ rr := c.get("/auth/register?next=/reports")
+ if rr.Code != http.StatusOK || c.csrf == "" || rr.Header().Get("X-Frame-Options") != "DENY" {
+  t.Fatalf("register page: %d %v", rr.Code, rr.Header())
+ }
+ if rr := c.post("/auth/register", url.Values{"email": {"alice@example.com"}, "csrf_token": {"forged"}}); rr.Code != http.StatusForbidden {
+  t.Fatalf("register with a forged CSRF token: %d", rr.Code)
+ }
+ if rr := c.post("/auth/register", url.Values{"email": {"alice@example.com"}, "password": {"password123"}, "password_confirm": {"password124"}}); rr.Code != http.StatusBadRequest ||
+  !strings.Contains(rr.Body.String(), "do not match") || !strings.Contains(rr.Body.String(), `value="alice@example.com"`) {
+  t.Fatalf("mismatched passwords: %d %s", rr.Code, rr.Body.String())
+ }
+ rr = c.post("/auth/register", url.Values{"email": {"alice@example.com"}, "password": {"password123"}, "password_confirm": {"password123"}, "next": {"/reports"}})
+ expectRedirect(t, rr, "/reports")
+
+ rr = c.get("/auth/account")
+ if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "alice@example.com") {
+  t.Fatalf("account page: %d %s", rr.Code, rr.Body.String())
+ }
+ if rr := c.post("/auth/account", url.Values{"current_password": {"nope"}, "password": {"password456"}, "password_confirm": {"password456"}}); rr.Code != http.StatusForbidden {
+  t.Fatalf("wrong current password: %d", rr.Code)
+ }
+ expectRedirect(t, c.post("/auth/account", url.Values{"current_password": {"password123"}, "password": {"password456"}, "password_confirm": {"password456"}}), "/auth/account")
+ if rr := c.get("/auth/account"); !strings.Contains(rr.Body.String(), "password has been changed") {
+  t.Fatalf("no flash after password change: %s", rr.Body.String())
+ }
+ if rr := c.get("/auth/account"); strings.Contains(rr.Body.String(), "password has been changed") {
+  t.Fatal("flash shown twice")
+ }
+
+ expectRedirect(t, c.post("/auth/logout", url.Values{}), "/auth/login")
+ if rr := c.get("/auth/login"); !strings.Contains(rr.Body.String(), "signed out") {
+  t.Fatalf("logout flash: %s", rr.Body.String())
+ }
+ if rr := c.post("/auth/login", url.Values{"email": {"alice@example.com"}, "password": {"password123"}}); rr.Code != http.StatusUnauthorized ||
+  !strings.Contains(rr.Body.String(), "Invalid email or password") {
+  t.Fatalf("old password: %d", rr.Code)
+ }
+ // Off-site next values fall back to AfterLogin.
+ expectRedirect(t, c.post("/auth/login", url.Values{"email": {"alice@example.com"}, "password": {"password456"}, "next": {"//evil.example/"}}), "/")
+ expectRedirect(t, c.get("/auth/login?next=/reports"), "/reports")
+}
+
+func TestPagesPasswordReset(t *testing.T) {
+ sent := make(chan string, 1)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Pages.ResetURL = "https://app.example/auth/reset-password"
+  c.Pages.SendPasswordReset = func(ctx context.Context, user User, resetURL string) error {
+   sent <- resetURL
+   return nil
+  }
+ })
+ defer cleanup()
+ _, _ = api.Register(context.Background(), "bob@example.com", "password123")
+ mux := http.NewServeMux()
+ api.PageRoutes(mux, "/auth/")
+ c := newPageClient(t, mux)
+
+ if rr := c.get("/auth/login"); !strings.Contains(rr.Body.String(), "/auth/forgot-password") {
+  t.Fatalf("login page lacks reset link: %s", rr.Body.String())
+ }
+ c.get("/auth/forgot-password")
+ unknown := c.post("/auth/forgot-password", url.Values{"email": {"nobody@example.com"}})
+ expectRedirect(t, unknown, "/auth/forgot-password")
+ known := c.post("/auth/forgot-password", url.Values{"email": {"bob@example.com"}})
+ expectRedirect(t, known, "/auth/forgot-password")
+ // The link is sent in the background.
+ var links []string
+ select {
+ case link := <-sent:
+  links = append(links, link)
+ case <-time.After(5 * time.Second):
+  t.Fatal("no reset link sent")
+ }
+ if len(links) != 1 || !strings.HasPrefix(links[0], "https://app.example/auth/reset-password?token=") {
+  t.Fatalf("reset links: %v", links)
+ }
+
+ if rr := c.get("/auth/reset-password?token=bogus"); rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), `name="token"`) {
+  t.Fatalf("bogus token: %d %s", rr.Code, rr.Body.String())
+ }
+ u, _ := url.Parse(links[0])
+ rr := c.get("/auth/reset-password?" + u.RawQuery)
+ if rr.Code != http.StatusOK || rr.Header().Get("Referrer-Policy") != "no-referrer" {
+  t.Fatalf("reset page: %d %v", rr.Code, rr.Header())
+ }
+ token := u.Query().Get("token")
+ expectRedirect(t, c.post("/auth/reset-password", url.Values{"token": {token}, "password": {"password456"}, "password_confirm": {"password456"}}), "/auth/login")
+ if rr := c.get("/auth/login"); !strings.Contains(rr.Body.String(), "password has been reset") {
+  t.Fatalf("reset flash: %s", rr.Body.String())
+ }
+ mustLogin(t, api, "bob@example.com", "password456")
+ if rr := c.post("/auth/reset-password", url.Values{"token": {token}, "password": {"password789"}, "password_confirm": {"password789"}}); rr.Code != http.StatusBadRequest {
+  t.Fatalf("reused link: %d", rr.Code)
+ }
+}
+
+func TestPagesPasswordResetQueueBounded(t *testing.T) {
+ started, release := make(chan struct{}, 1), make(chan struct{})
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Pages.ResetURL = "https://app.example/auth/reset-password"
+  c.Pages.SendPasswordReset = func(ctx context.Context, user User, resetURL string) error {
+   started <- struct{}{}
+   <-release // a slow mailer
+   return nil
+  }
+ })
+ defer cleanup()
+ defer close(release)
+ _, _ = api.Register(context.Background(), "bob@example.com", "password123")
+ mux := http.NewServeMux()
+ api.PageRoutes(mux, "/auth/")
+ c := newPageClient(t, mux)
+ c.get("/auth/forgot-password")
+
+ expectRedirect(t, c.post("/auth/forgot-password", url.Values{"email": {"bob@example.com"}}), "/auth/forgot-password")
+ <-started
+ // While the worker is busy, requests queue up to the bound and the rest are
+ // dropped; every one is answered at once.
+ for i := 0; i < resetQueueSize+5; i++ {
+  expectRedirect(t, c.post("/auth/forgot-password", url.Values{"email": {"nobody@example.com"}}), "/auth/forgot-password")
+ }
+ if n := len(api.resetQueue); n != resetQueueSize {
+  t.Fatalf("%d queued reset requests, want %d", n, resetQueueSize)
+ }
+}
+
+func TestPagesCustomTemplates(t *testing.T) {
+ custom := template.Must(template.New("login").Parse(`<p>Welcome back</p><form>{{.CSRFField}}</form>`))
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Pages.Templates = custom
+ })
+ defer cleanup()
+ h := http.NewServeMux()
+ api.PageRoutes(h, "")
+
+ if rr := serve(h, httptest.NewRequest(http.MethodGet, "/login", nil)); !strings.Contains(rr.Body.String(), "Welcome back") || !csrfFieldPattern.MatchString(rr.Body.String()) {
+  t.Fatalf("custom login: %s", rr.Body.String())
+ }
+ if rr := serve(h, httptest.NewRequest(http.MethodGet, "/register", nil)); !strings.Contains(rr.Body.String(), "Create an account") {
+  t.Fatalf("built-in register: %s", rr.Body.String())
+ }
+ if rr := serve(h, httptest.NewRequest(http.MethodGet, "/forgot-password", nil)); rr.Code != http.StatusNotFound {
+  t.Fatalf("forgot-password without SendPasswordReset: %d", rr.Code)
+ }
+ if _, err := New(Config{DBPath: ":memory:", Pages: PageOptions{SendPasswordReset: func(context.Context, User, string) error { return nil }}}); err == nil {
+  t.Fatal("SendPasswordReset without ResetURL accepted")
+ }
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+ "context"
+ "crypto/sha256"
+ "database/sql"
+ "errors"
+ "fmt"
+ "time"
+)
+
+// Password reset tokens are stored as SHA-256 hashes like invites. They are
+// single-use: redeeming one deletes every reset token of the user.
+
+// maxPasswordResets caps the unexpired reset tokens of one user, which bounds the
+// rows and reset emails a stranger can cause by requesting resets for an email.
+const maxPasswordResets = 3
+
+func (a *API) createPasswordResetInternal(ctx context.Context, email string) (string, User, error) {
+ email = normalizeEmail(email)
+ var (
+  user      User
+  createdAt int64
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT id, email, created_at FROM users WHERE email = ?
+ `, email).Scan(&user.ID, &user.Email, &createdAt)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return "", User{}, ErrUserNotFound
+  }
+  return "", User{}, fmt.Errorf("query user: %w", err)
+ }
+ user.CreatedAt = time.Unix(createdAt, 0)
+
+ token, err := newSessionToken()
+ if err != nil {
+  return "", User{}, err
+ }
+ sum := sha256.Sum256([]byte(token))
+ now := a.now()
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return "", User{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ var active int
+ if err := tx.QueryRowContext(ctx, `
+  SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND expires_at > ?
+ `, user.ID, now.Unix()).Scan(&active); err != nil {
+  return "", User{}, fmt.Errorf("count password resets: %w", err)
+ }
+ if active >= maxPasswordResets {
+  return "", User{}, ErrTooManyPasswordResets
+ }
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)
+ `, user.ID, sum[:], now.Unix(), now.Add(a.cfg.PasswordResetTTL).Unix()); err != nil {
+  return "", User{}, fmt.Errorf("insert password reset: %w", err)
+ }
+ if err := tx.Commit(); err != nil {
+  return "", User{}, fmt.Errorf("commit: %w", err)
+ }
+ return token, user, nil
+}
+
+// passwordResetUser returns the user a valid, unexpired reset token belongs to.
+func (a *API) passwordResetUser(ctx context.Context, token string) (User, error) {
+ sum := sha256.Sum256([]byte(token))
+ var (
+  user                 User
+  createdAt, expiresAt int64
+ )
+ err := a.db.QueryRowContext(ctx, `
+  SELECT u.id, u.email, u.created_at, r.expires_at
+  FROM password_resets r JOIN users u ON u.id = r.user_id
+  WHERE r.token_hash = ?
+ `, sum[:]).Scan(&user.ID, &user.Email, &createdAt, &expiresAt)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return User{}, ErrInvalidResetToken
+  }
+  return User{}, fmt.Errorf("query password reset: %w", err)
+ }
+ if a.now().Unix() >= expiresAt {
+  return User{}, ErrInvalidResetToken
+ }
+ user.CreatedAt = time.Unix(createdAt, 0)
+ return user, nil
+}
+
+// resetPasswordInternal redeems token: the password is replaced, every session is
+// revoked and all of the user's reset tokens are deleted, in one transaction.
+func (a *API) resetPasswordInternal(ctx context.Context, token, newPassword string) (User, error) {
+ user, err := a.passwordResetUser(ctx, token)
+ if err != nil {
+  return User{}, err
+ }
+ if err := validatePasswordPolicy(newPassword, a.cfg.MinPasswordLength, a.cfg.RequireStrongPasswords); err != nil {
+  return User{}, err
+ }
+ hash, err := a.hashPassword(ctx, newPassword)
+ if err != nil {
+  return User{}, fmt.Errorf("hash password: %w", err)
+ }
+
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return User{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ sum := sha256.Sum256([]byte(token))
+ res, err := tx.ExecContext(ctx, `DELETE FROM password_resets WHERE token_hash = ?`, sum[:])
+ if err != nil {
+  return User{}, fmt.Errorf("delete password reset: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return User{}, ErrInvalidResetToken // redeemed concurrently
+ }
+ if _, err := tx.ExecContext(ctx, `DELETE FROM password_resets WHERE user_id = ?`, user.ID); err != nil {
+  return User{}, fmt.Errorf("delete password resets: %w", err)
+ }
+ if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ? WHERE id = ?`, hash, user.ID); err != nil {
+  return User{}, fmt.Errorf("update user: %w", err)
+ }
+ if err := revokeSessionsTx(ctx, tx, user.ID, a.now().Unix()); err != nil {
+  return User{}, err
+ }
+ if err := a.enqueueWebhookTx(ctx, tx, EventPasswordChanged, user.ID); err != nil {
+  return User{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return User{}, fmt.Errorf("commit: %w", err)
+ }
+ a.recordEvent(ctx, Event{Type: EventPasswordChanged, UserID: user.ID, Success: true, Detail: "reset"})
+ a.hookPasswordChanged(ctx, user.ID)
+ a.hookSessionRevoked(ctx, user.ID)
+ return user, nil
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+ "time"
+)
+
+func TestPasswordReset(t *testing.T) {
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Now = func() time.Time { return now }
+ })
+ defer cleanup()
+ ctx := context.Background()
+ user, _ := api.Register(ctx, "alice@example.com", "password123")
+ session := mustLogin(t, api, "alice@example.com", "password123")
+
+ if _, _, err := api.CreatePasswordReset(ctx, "nobody@example.com"); !errors.Is(err, ErrUserNotFound) {
+  t.Fatalf("unknown email: %v", err)
+ }
+ first, _, err := api.CreatePasswordReset(ctx, "alice@example.com")
+ if err != nil {
+  t.Fatalf("CreatePasswordReset: %v", err)
+ }
+ token, got, err := api.CreatePasswordReset(ctx, " Alice@Example.com ")
+ if err != nil || got.ID != user.ID {
+  t.Fatalf("CreatePasswordReset: %+v %v", got, err)
+ }
+
+ if _, err := api.ResetPassword(ctx, token, "short"); !errors.Is(err, ErrWeakPassword) {
+  t.Fatalf("weak password: %v", err)
+ }
+ if got, err := api.ResetPassword(ctx, token, "password456"); err != nil || got.ID != user.ID {
+  t.Fatalf("ResetPassword: %+v %v", got, err)
+ }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", session)); ok {
+  t.Fatal("session survived the reset")
+ }
+ mustLogin(t, api, "alice@example.com", "password456")
+
+ // Used tokens and the user's other tokens are spent.
+ if _, err := api.ResetPassword(ctx, token, "password789"); !errors.Is(err, ErrInvalidResetToken) {
+  t.Fatalf("reused token: %v", err)
+ }
+ if _, err := api.ResetPassword(ctx, first, "password789"); !errors.Is(err, ErrInvalidResetToken) {
+  t.Fatalf("older token: %v", err)
+ }
+
+ token, _, _ = api.CreatePasswordReset(ctx, "alice@example.com")
+ now = now.Add(time.Hour)
+ if _, err := api.ResetPassword(ctx, token, "password789"); !errors.Is(err, ErrInvalidResetToken) {
+  t.Fatalf("expired token: %v", err)
+ }
+ if err := api.PruneExpiredSessions(ctx); err != nil {
+  t.Fatalf("prune: %v", err)
+ }
+ var n int
+ _ = api.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM password_resets`).Scan(&n)
+ if n != 0 {
+  t.Fatalf("%d reset tokens left after prune", n)
+ }
+
+ // Only a few unexpired tokens are kept per user.
+ for i := 0; i < maxPasswordResets; i++ {
+  if _, _, err := api.CreatePasswordReset(ctx, "alice@example.com"); err != nil {
+   t.Fatalf("CreatePasswordReset %d: %v", i, err)
+  }
+ }
+ if _, _, err := api.CreatePasswordReset(ctx, "alice@example.com"); !errors.Is(err, ErrTooManyPasswordResets) {
+  t.Fatalf("reset beyond the cap: %v", err)
+ }
+ now = now.Add(time.Hour)
+ if _, _, err := api.CreatePasswordReset(ctx, "alice@example.com"); err != nil {
+  t.Fatalf("CreatePasswordReset after expiry: %v", err)
+ }
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+ "context"
+ "database/sql"
+ "errors"
+ "fmt"
+ "net/http"
+ "sort"
+ "strings"
+)
+
+func (a *API) defineRoleInternal(ctx context.Context, name string, permissions []string) error {
+ name = strings.TrimSpace(name)
+ if name == "" {
+  return fmt.Errorf("role name required")
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO roles (name, created_at) VALUES (?, ?)
+  ON CONFLICT(name) DO NOTHING
+ `, name, a.now().Unix()); err != nil {
+  return fmt.Errorf("insert role: %w", err)
+ }
+ var roleID int64
+ if err := tx.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = ?`, name).Scan(&roleID); err != nil {
+  return fmt.Errorf("query role: %w", err)
+ }
+ // The given permissions replace whatever the role carried before.
+ if _, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role_id = ?`, roleID); err != nil {
+  return fmt.Errorf("clear permissions: %w", err)
+ }
+ for _, p := range permissions {
+  p = strings.TrimSpace(p)
+  if p == "" {
+   return fmt.Errorf("empty permission for role %q", name)
+  }
+  if _, err := tx.ExecContext(ctx, `
+   INSERT INTO role_permissions (role_id, permission) VALUES (?, ?)
+   ON CONFLICT DO NOTHING
+  `, roleID, p); err != nil {
+   return fmt.Errorf("insert permission: %w", err)
+  }
+ }
+ return tx.Commit()
+}
+
+func (a *API) deleteRoleInternal(ctx context.Context, name string) error {
+ res, err := a.db.ExecContext(ctx, `DELETE FROM roles WHERE name = ?`, name)
+ if err != nil {
+  return fmt.Errorf("delete role: %w", err)
+ }
+ if n, err := res.RowsAffected(); err == nil && n == 0 {
+  return ErrRoleNotFound
+ }
+ return nil
+}
+
+func (a *API) grantRoleInternal(ctx context.Context, userID int64, role string) error {
+ roleID, err := a.roleID(ctx, role)
+ if err != nil {
+  return err
+ }
+ if _, err := a.db.ExecContext(ctx, `
+  INSERT INTO user_roles (user_id, role_id, created_at) VALUES (?, ?, ?)
+  ON CONFLICT DO NOTHING
+ `, userID, roleID, a.now().Unix()); err != nil {
+  if strings.Contains(strings.ToLower(err.Error()), "foreign key") {
+   return fmt.Errorf("unknown user")
+  }
+  return fmt.Errorf("grant role: %w", err)
+ }
+ return nil
+}
+
+func (a *API) revokeRoleInternal(ctx context.Context, userID int64, role string) error {
+ roleID, err := a.roleID(ctx, role)
+ if err != nil {
+  return err
+ }
+ if _, err := a.db.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = ? AND role_id = ?`, userID, roleID); err != nil {
+  return fmt.Errorf("revoke role: %w", err)
+ }
+ return nil
+}
+
+func (a *API) roleID(ctx context.Context, name string) (int64, error) {
+ var id int64
+ err := a.db.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = ?`, name).Scan(&id)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return 0, ErrRoleNotFound
+  }
+  return 0, fmt.Errorf("query role: %w", err)
+ }
+ return id, nil
+}
+
+func (a *API) rolePermissionsInternal(ctx context.Context, role string) ([]string, error) {
+ roleID, err := a.roleID(ctx, role)
+ if err != nil {
+  return nil, err
+ }
+ return a.queryStrings(ctx, `SELECT permission FROM role_permissions WHERE role_id = ? ORDER BY permission`, roleID)
+}
+
+// loadAuthorization resolves the user's roles and the union of their permissions.
+func (a *API) loadAuthorization(ctx context.Context, userID int64) (Authorization, error) {
+ roles, err := a.queryStrings(ctx, `
+  SELECT r.name FROM user_roles ur
+  JOIN roles r ON r.id = ur.role_id
+  WHERE ur.user_id = ?
+  ORDER BY r.name
+ `, userID)
+ if err != nil {
+  return Authorization{}, err
+ }
+ perms, err := a.queryStrings(ctx, `
+  SELECT DISTINCT rp.permission FROM user_roles ur
+  JOIN role_permissions rp ON rp.role_id = ur.role_id
+  WHERE ur.user_id = ?
+  ORDER BY rp.permission
+ `, userID)
+ if err != nil {
+  return Authorization{}, err
+ }
+ return Authorization{Roles: roles, Permissions: perms}, nil
+}
+
+// authorizationFor returns the request's Authorization, loading and caching it in
+// the context on first use.
+func (a *API) authorizationFor(r *http.Request, user User) (Authorization, *http.Request, error) {
+ if az, ok := authorizationFromContext(r.Context()); ok {
+  return az, r, nil
+ }
+ az, err := a.loadAuthorization(r.Context(), user.ID)
+ if err != nil {
+  return Authorization{}, r, err
+ }
+ return az, r.WithContext(withAuthorization(r.Context(), az)), nil
+}
+
+// requireAccessInternal builds RequireRole/RequirePermission: 401 without a user,
+// 403 when allowed reports false.
+func (a *API) requireAccessInternal(allowed func(Authorization) bool) func(http.Handler) http.Handler {
+ return func(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+   user, ok := fromContext(r.Context())
+   if !ok {
+    a.unauthorized(w, r)
+    return
+   }
+   az, r, err := a.authorizationFor(r, user)
+   if err != nil {
+    a.logError(r.Context(), "authorization lookup failed", err, userAttr(user.ID))
+    http.Error(w, "internal error", http.StatusInternalServerError)
+    return
+   }
+   if !allowed(az) {
+    http.Error(w, "forbidden", http.StatusForbidden)
+    return
+   }
+   next.ServeHTTP(w, r)
+  })
+ }
+}
+
+func (a *API) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+ rows, err := a.db.QueryContext(ctx, query, args...)
+ if err != nil {
+  return nil, fmt.Errorf("query: %w", err)
+ }
+ defer rows.Close()
+ var out []string
+ for rows.Next() {
+  var s string
+  if err := rows.Scan(&s); err != nil {
+   return nil, fmt.Errorf("scan: %w", err)
+  }
+  out = append(out, s)
+ }
+ return out, rows.Err()
+}
+
+func sortedContains(sorted []string, s string) bool {
+ i := sort.SearchStrings(sorted, s)
+ return i < len(sorted) && sorted[i] == s
+}
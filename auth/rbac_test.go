@@ -0,0 +1,109 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "net/http"
+ "net/http/httptest"
+ "testing"
+)
+
+func TestRolesAndPermissions(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "admin@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ if err := api.GrantRole(ctx, u.ID, "editor"); !errors.Is(err, ErrRoleNotFound) {
+  t.Fatalf("granting undefined role: %v", err)
+ }
+ if err := api.DefineRole(ctx, "editor", "posts.write", "posts.read"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ if err := api.DefineRole(ctx, "viewer", "posts.read"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ if err := api.GrantRole(ctx, u.ID, "editor"); err != nil {
+  t.Fatalf("GrantRole: %v", err)
+ }
+ if err := api.GrantRole(ctx, u.ID, "viewer"); err != nil {
+  t.Fatalf("GrantRole: %v", err)
+ }
+
+ az, err := api.UserAuthorization(ctx, u.ID)
+ if err != nil {
+  t.Fatalf("UserAuthorization: %v", err)
+ }
+ if !az.HasRole("editor") || !az.HasPermission("posts.write") || len(az.Permissions) != 2 {
+  t.Fatalf("unexpected authorization: %+v", az)
+ }
+
+ // Redefining replaces the permission set.
+ if err := api.DefineRole(ctx, "editor", "posts.read"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ perms, err := api.RolePermissions(ctx, "editor")
+ if err != nil || len(perms) != 1 || perms[0] != "posts.read" {
+  t.Fatalf("RolePermissions: %v %v", perms, err)
+ }
+
+ if err := api.RevokeRole(ctx, u.ID, "viewer"); err != nil {
+  t.Fatalf("RevokeRole: %v", err)
+ }
+ if err := api.DeleteRole(ctx, "editor"); err != nil {
+  t.Fatalf("DeleteRole: %v", err)
+ }
+ az, _ = api.UserAuthorization(ctx, u.ID)
+ if len(az.Roles) != 0 || len(az.Permissions) != 0 {
+  t.Fatalf("expected no roles left, got %+v", az)
+ }
+}
+
+func TestRequireRoleAndPermission(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "staff@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ if err := api.DefineRole(ctx, "staff", "reports.read"); err != nil {
+  t.Fatalf("DefineRole: %v", err)
+ }
+ if err := api.GrantRole(ctx, u.ID, "staff"); err != nil {
+  t.Fatalf("GrantRole: %v", err)
+ }
+
+ ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if _, found := AuthorizationFromContext(r.Context()); !found {
+   t.Errorf("authorization not in context")
+  }
+ })
+ cases := []struct {
+  name    string
+  handler http.Handler
+  user    *User
+  want    int
+ }{
+  {"anonymous", api.RequireRole("staff")(ok), nil, http.StatusUnauthorized},
+  {"has role", api.RequireRole("admin", "staff")(ok), &u, http.StatusOK},
+  {"missing role", api.RequireRole("admin")(ok), &u, http.StatusForbidden},
+  {"has permission", api.RequirePermission("reports.read")(ok), &u, http.StatusOK},
+  {"missing permission", api.RequirePermission("reports.read", "reports.write")(ok), &u, http.StatusForbidden},
+ }
+ for _, tc := range cases {
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(http.MethodGet, "/reports", nil)
+  if tc.user != nil {
+   r = r.WithContext(withUser(r.Context(), *tc.user))
+  }
+  tc.handler.ServeHTTP(w, r)
+  if w.Code != tc.want {
+   t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+  }
+ }
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+ "context"
+ "fmt"
+ "strings"
+)
+
+// disposableEmailDomains is a small built-in list of throwaway-mail providers used by
+// BlockDisposableEmails. Extend it through Config.DisposableEmailDomains.
+var disposableEmailDomains = []string{
+ "10minutemail.com",
+ "20minutemail.com",
+ "dispostable.com",
+ "emailondeck.com",
+ "fakeinbox.com",
+ "getairmail.com",
+ "getnada.com",
+ "guerrillamail.com",
+ "guerrillamail.net",
+ "guerrillamailblock.com",
+ "maildrop.cc",
+ "mailinator.com",
+ "mailnesia.com",
+ "mintemail.com",
+ "mohmal.com",
+ "mytemp.email",
+ "sharklasers.com",
+ "spamgourmet.com",
+ "temp-mail.org",
+ "tempail.com",
+ "tempmail.com",
+ "tempmailo.com",
+ "tempr.email",
+ "throwawaymail.com",
+ "trashmail.com",
+ "yopmail.com",
+}
+
+// checkRegistrationPolicy applies the configured domain rules and the
+// ValidateRegistration hook to a normalized, syntactically valid email.
+func (a *API) checkRegistrationPolicy(ctx context.Context, email string) error {
+ domain := email[strings.LastIndexByte(email, '@')+1:]
+ if len(a.cfg.AllowedEmailDomains) > 0 && !domainMatches(domain, a.cfg.AllowedEmailDomains) {
+  return ErrEmailDomainNotAllowed
+ }
+ if a.cfg.BlockDisposableEmails {
+  if domainMatches(domain, disposableEmailDomains) || domainMatches(domain, a.cfg.DisposableEmailDomains) {
+   return ErrDisposableEmail
+  }
+ }
+ if a.cfg.ValidateRegistration != nil {
+  if err := a.cfg.ValidateRegistration(ctx, email); err != nil {
+   return fmt.Errorf("%w: %w", ErrRegistrationRejected, err)
+  }
+ }
+ return nil
+}
+
+// domainMatches reports whether domain equals, or is a subdomain of, an entry in list.
+func domainMatches(domain string, list []string) bool {
+ for _, d := range list {
+  d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), ".")
+  if d == "" {
+   continue
+  }
+  if domain == d || strings.HasSuffix(domain, "."+d) {
+   return true
+  }
+ }
+ return false
+}
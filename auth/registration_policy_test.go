@@ -0,0 +1,68 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "strings"
+ "testing"
+)
+
+func TestRegistrationDomainPolicy(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.AllowedEmailDomains = []string{"Example.com"}
+  c.BlockDisposableEmails = true
+  c.DisposableEmailDomains = []string{"burner.example.com"}
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "a@example.com", "password123"); err != nil {
+  t.Fatalf("allowed domain: %v", err)
+ }
+ if _, err := api.Register(ctx, "b@eng.example.com", "password123"); err != nil {
+  t.Fatalf("allowed subdomain: %v", err)
+ }
+ if _, err := api.Register(ctx, "c@notexample.com", "password123"); !errors.Is(err, ErrEmailDomainNotAllowed) {
+  t.Fatalf("foreign domain: %v", err)
+ }
+ if _, err := api.Register(ctx, "d@burner.example.com", "password123"); !errors.Is(err, ErrDisposableEmail) {
+  t.Fatalf("disposable domain: %v", err)
+ }
+ if _, err := api.Register(ctx, "A@example.com", "password123"); !errors.Is(err, ErrEmailTaken) {
+  t.Fatalf("duplicate email: %v", err)
+ }
+ if _, err := api.Register(ctx, "nope", "password123"); !errors.Is(err, ErrInvalidEmail) {
+  t.Fatalf("invalid email: %v", err)
+ }
+}
+
+func TestRegistrationValidatorHook(t *testing.T) {
+ errBanned := errors.New("banned")
+ var seen string
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.BlockDisposableEmails = true
+  c.ValidateRegistration = func(ctx context.Context, email string) error {
+   seen = email
+   if strings.HasPrefix(email, "spam") {
+    return errBanned
+   }
+   return nil
+  }
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "x@mailinator.com", "password123"); !errors.Is(err, ErrDisposableEmail) {
+  t.Fatalf("built-in disposable list: %v", err)
+ }
+ _, err := api.Register(ctx, " Spammer@Example.com", "password123")
+ if !errors.Is(err, ErrRegistrationRejected) || !errors.Is(err, errBanned) {
+  t.Fatalf("validator error not wrapped: %v", err)
+ }
+ if seen != "spammer@example.com" {
+  t.Fatalf("validator saw unnormalized email %q", seen)
+ }
+ if _, err := api.Register(ctx, "fine@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+}
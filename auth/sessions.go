@@ -12,30 +12,177 @@ import (
   "fmt"
 )
 
+// sessionInfo is the per-session state resolved alongside the user. Middleware
+// stores it in the request context for helpers that act on the current session.
+type sessionInfo struct {
+ id          int64 // sessions row; 0 for stateless sessions
+ token       string
+ transport   Transport
+ activeOrgID int64
+ csrfToken   string            // server-side sessions; empty until first use
+ stateless   *statelessPayload // decrypted payload in StatelessSessions mode
+}
+
 func (a *API) createSessionAndSetCookie(w http.ResponseWriter, ctx context.Context, userID int64) error {
+  token, expiresAt, err := a.createSession(ctx, userID)
+  if err != nil {
+    return err
+  }
+  a.setCookie(w, token, time.Unix(expiresAt, 0))
+  return nil
+}
+
+// createSession inserts a new session row (or seals a stateless token) and returns
+// the token and its expiry (unix seconds).
+func (a *API) createSession(ctx context.Context, userID int64) (string, int64, error) {
+  if a.sealer != nil {
+    return a.createStatelessSession(ctx, userID)
+  }
+  tx, err := a.db.BeginTx(ctx, nil)
+  if err != nil {
+    return "", 0, fmt.Errorf("begin: %w", err)
+  }
+  defer rollbackIfNeeded(tx)
+  token, expiresAt, err := a.createSessionTx(ctx, tx, userID)
+  if err != nil {
+    return "", 0, err
+  }
+  if err := tx.Commit(); err != nil {
+    return "", 0, fmt.Errorf("commit: %w", err)
+  }
+  return token, expiresAt, nil
+}
+
+// createSessionTx inserts a new session row within tx. The session cap is checked
+// in the same transaction as the insert so concurrent logins cannot exceed it.
+// Server-side sessions only.
+func (a *API) createSessionTx(ctx context.Context, tx txHandle, userID int64) (string, int64, error) {
   now := a.now()
   expiresAt := now.Add(a.cfg.SessionTTL).Unix()
+  if err := a.enforceSessionLimit(ctx, tx, userID, now.Unix()); err != nil {
+    return "", 0, err
+  }
 
   for attempts := 0; attempts < 3; attempts++ {
     token, err := newSessionToken()
     if err != nil {
-      return err
+      return "", 0, err
     }
-    _, err = a.db.ExecContext(ctx, `
-      INSERT INTO sessions (token, user_id, expires_at, created_at)
-      VALUES (?, ?, ?, ?)
-    `, token, userID, expiresAt, now.Unix())
+    _, err = tx.ExecContext(ctx, `
+      INSERT INTO sessions (token, user_id, expires_at, created_at, last_used_at, authenticated_at)
+      VALUES (?, ?, ?, ?, ?, ?)
+    `, token, userID, expiresAt, now.Unix(), now.Unix(), now.Unix())
     if err != nil {
       msg := strings.ToLower(err.Error())
       if strings.Contains(msg, "unique") && strings.Contains(msg, "sessions") && strings.Contains(msg, "token") {
         continue // retry on unlikely collision
       }
-      return err
+      return "", 0, err
     }
-    a.setCookie(w, token, time.Unix(expiresAt, 0))
-    return nil
+    return token, expiresAt, nil
   }
-  return fmt.Errorf("could not create unique session token after retries")
+  return "", 0, fmt.Errorf("could not create unique session token after retries")
+}
+
+// enforceSessionLimit makes room for one more session of userID according to
+// MaxSessionsPerUser and SessionLimitPolicy.
+func (a *API) enforceSessionLimit(ctx context.Context, tx txHandle, userID, now int64) error {
+ limit := a.cfg.MaxSessionsPerUser
+ if limit <= 0 {
+  return nil
+ }
+ // Expired sessions never count towards the cap.
+ if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ? AND expires_at <= ?`, userID, now); err != nil {
+  return fmt.Errorf("prune user sessions: %w", err)
+ }
+ var n int
+ if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, userID).Scan(&n); err != nil {
+  return fmt.Errorf("count sessions: %w", err)
+ }
+ excess := n - limit + 1
+ if excess <= 0 {
+  return nil
+ }
+ order := "created_at"
+ switch a.cfg.SessionLimitPolicy {
+ case RejectNewSession:
+  return ErrSessionLimitReached
+ case EvictLeastRecentlyUsedSession:
+  order = "last_used_at"
+ }
+ if _, err := tx.ExecContext(ctx, `
+  DELETE FROM sessions WHERE id IN (
+   SELECT id FROM sessions WHERE user_id = ? ORDER BY `+order+`, id LIMIT ?
+  )
+ `, userID, excess); err != nil {
+  return fmt.Errorf("evict sessions: %w", err)
+ }
+ return nil
+}
+
+// requireRecentAuth returns the request's user if its session authenticated within
+// maxAge, else ErrNoSession or ErrReauthRequired.
+func (a *API) requireRecentAuth(w http.ResponseWriter, r *http.Request, maxAge time.Duration) (User, error) {
+ user, info, err := a.currentSession(w, r)
+ if err != nil {
+  return User{}, err
+ }
+ at, err := a.sessionAuthenticatedAt(r.Context(), info)
+ if err != nil {
+  return User{}, err
+ }
+ if a.now().Unix()-at > int64(maxAge.Seconds()) {
+  return User{}, ErrReauthRequired
+ }
+ return user, nil
+}
+
+// sessionAuthenticatedAt reports when the session's user last proved their identity
+// (unix seconds): sign-in or ReauthenticatePassword. Sliding refreshes do not count.
+func (a *API) sessionAuthenticatedAt(ctx context.Context, info sessionInfo) (int64, error) {
+ if info.stateless != nil {
+  return info.stateless.AuthAt, nil
+ }
+ var at int64
+ // Sessions from before authenticated_at existed have 0 there; they count from sign-in.
+ err := a.db.QueryRowContext(ctx, `
+  SELECT MAX(authenticated_at, created_at) FROM sessions WHERE token = ?
+ `, info.token).Scan(&at)
+ if errors.Is(err, sql.ErrNoRows) {
+  return 0, ErrNoSession
+ }
+ if err != nil {
+  return 0, fmt.Errorf("query session: %w", err)
+ }
+ return at, nil
+}
+
+// readSessionToken extracts the session token from the transports enabled in
+// SessionTransports. An Authorization: Bearer header takes precedence over the
+// cookie when bearer transport is enabled.
+func (a *API) readSessionToken(r *http.Request) (string, Transport, error) {
+ transports := a.cfg.SessionTransports
+ if transports&TransportBearer != 0 {
+  if token, ok := bearerToken(r); ok && !strings.HasPrefix(token, accessTokenPrefix) {
+   return token, TransportBearer, nil
+  }
+ }
+ if transports&TransportCookie != 0 {
+  token, err := a.readSessionCookie(r)
+  return token, TransportCookie, err
+ }
+ return "", 0, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+ h := r.Header.Get("Authorization")
+ const prefix = "bearer "
+ if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+  return "", false
+ }
+ token := strings.TrimSpace(h[len(prefix):])
+ return token, token != ""
 }
 
 func (a *API) readSessionCookie(r *http.Request) (string, error) {
@@ -98,6 +245,26 @@ func (a *API) clearCookie(w http.ResponseWriter) {
  http.SetCookie(w, c)
 }
 
+// setAuxCookie writes a short-lived, always HttpOnly helper cookie (e.g. the OIDC
+// state binding) sharing the session cookie's domain and security attributes.
+// maxAge <= 0 deletes it.
+func (a *API) setAuxCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+ c := &http.Cookie{
+  Name:     name,
+  Value:    value,
+  Path:     "/",
+  Domain:   a.cfg.CookieDomain,
+  MaxAge:   int(maxAge.Seconds()),
+  HttpOnly: true,
+  Secure:   a.cfg.CookieSecure,
+  SameSite: http.SameSiteLaxMode,
+ }
+ if maxAge <= 0 {
+  c.Value, c.MaxAge, c.Expires = "", -1, time.Unix(0, 0)
+ }
+ http.SetCookie(w, c)
+}
+
 func newSessionToken() (string, error) {
  var b [32]byte
  if _, err := rand.Read(b[:]); err != nil {
@@ -107,6 +274,39 @@ func newSessionToken() (string, error) {
 }
 
 // rollbackIfNeeded rolls back tx if it's still active.
-func rollbackIfNeeded(tx *sql.Tx) {
+func rollbackIfNeeded(tx txHandle) {
  _ = tx.Rollback()
-}
\ No newline at end of file
+}
+
+// reauthenticatePasswordInternal checks password against the signed-in user and
+// marks the session as freshly authenticated.
+func (a *API) reauthenticatePasswordInternal(w http.ResponseWriter, r *http.Request, password string) (User, error) {
+ ctx := r.Context()
+ user, info, err := a.currentSession(w, r)
+ if err != nil {
+  return User{}, err
+ }
+ if _, err := a.authenticatePassword(ctx, user.Email, password); err != nil {
+  return User{}, err
+ }
+ now := a.now().Unix()
+ if info.stateless == nil {
+  res, err := a.db.ExecContext(ctx, `UPDATE sessions SET authenticated_at = ? WHERE token = ?`, now, info.token)
+  if err != nil {
+   return User{}, fmt.Errorf("update session: %w", err)
+  }
+  if n, err := res.RowsAffected(); err == nil && n == 0 {
+   return User{}, ErrNoSession // signed out concurrently
+  }
+  return user, nil
+ }
+ // Stateless sessions only travel in cookies (New refuses TransportBearer).
+ p := *info.stateless
+ p.AuthAt = now
+ sealed, err := a.sealer.seal(p)
+ if err != nil {
+  return User{}, fmt.Errorf("seal session: %w", err)
+ }
+ a.setCookie(w, sealed, time.Unix(p.ExpiresAt, 0))
+ return user, nil
+}
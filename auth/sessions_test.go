@@ -1,6 +1,8 @@
 package auth
 
 import (
+ "context"
+ "errors"
  "net/http"
  "net/http/httptest"
  "testing"
@@ -63,4 +65,142 @@ func TestCookieFlagsOnLoginAndClear(t *testing.T) {
  if !found {
   t.Fatalf("expected clearing cookie")
  }
-}
\ No newline at end of file
+}
+func TestMaxSessionsPerUserEvictsOldest(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.MaxSessionsPerUser = 2
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "cap@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ c1 := mustLogin(t, api, "cap@example.com", "password123")
+ c2 := mustLogin(t, api, "cap@example.com", "password123")
+ c3 := mustLogin(t, api, "cap@example.com", "password123")
+
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c1)); ok {
+  t.Fatalf("oldest session should have been evicted")
+ }
+ for i, c := range []*http.Cookie{c2, c3} {
+  if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c)); !ok {
+   t.Fatalf("session %d should still be valid", i+2)
+  }
+ }
+}
+
+func TestMaxSessionsPerUserEvictsLeastRecentlyUsed(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.MaxSessionsPerUser = 2
+  c.SessionLimitPolicy = EvictLeastRecentlyUsedSession
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "lru@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ c1 := mustLogin(t, api, "lru@example.com", "password123")
+ c2 := mustLogin(t, api, "lru@example.com", "password123")
+
+ // Use c1 later so c2 becomes the least recently used.
+ api.cfg.Now = func() time.Time { return base.Add(2 * time.Minute) }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c1)); !ok {
+  t.Fatalf("c1 should be valid")
+ }
+ mustLogin(t, api, "lru@example.com", "password123")
+
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c2)); ok {
+  t.Fatalf("least recently used session should have been evicted")
+ }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c1)); !ok {
+  t.Fatalf("recently used session should still be valid")
+ }
+}
+
+func TestMaxSessionsPerUserReject(t *testing.T) {
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.MaxSessionsPerUser = 1
+  c.SessionLimitPolicy = RejectNewSession
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ if _, err := api.Register(ctx, "rej@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ c1 := mustLogin(t, api, "rej@example.com", "password123")
+
+ w := httptest.NewRecorder()
+ r := httptest.NewRequest(http.MethodPost, "/login", nil)
+ _, err := api.Login(w, r, "rej@example.com", "password123")
+ if !errors.Is(err, ErrSessionLimitReached) {
+  t.Fatalf("expected ErrSessionLimitReached, got %v", err)
+ }
+ if len(w.Result().Cookies()) != 0 {
+  t.Fatalf("rejected login must not set a cookie")
+ }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c1)); !ok {
+  t.Fatalf("existing session should be untouched")
+ }
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+ for _, mode := range []SessionMode{ServerSessions, StatelessSessions} {
+  now := time.Unix(1_700_000_000, 0)
+  api, cleanup := newTestAPI(t, func(c *Config) {
+   c.SessionMode = mode
+   c.SessionKeys = []SessionKey{testSessionKey("k1", 1)}
+   c.ReauthURL = "/reauthenticate"
+   c.Now = func() time.Time { return now }
+  })
+  _, _ = api.Register(context.Background(), "alice@example.com", "password123")
+  session := mustLogin(t, api, "alice@example.com", "password123")
+  sensitive := api.Middleware(api.RequireRecentAuth(10 * time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+  if rr := serve(sensitive, newReqWithCookie(http.MethodPost, "/settings", session)); rr.Code != http.StatusOK {
+   t.Fatalf("mode %d: fresh session: %d", mode, rr.Code)
+  }
+
+  // Past the window; a sliding refresh does not count as authentication.
+  now = now.Add(50 * time.Minute)
+  rr := serve(sensitive, newReqWithCookie(http.MethodPost, "/settings", session))
+  if rr.Code != http.StatusUnauthorized || decodeJSON(t, rr)["error"] != ErrReauthRequired.Error() {
+   t.Fatalf("mode %d: stale session: %d %s", mode, rr.Code, rr.Body.String())
+  }
+  for _, c := range rr.Result().Cookies() {
+   if c.Name == "session" && c.Value != "" {
+    session = c // stateless tokens are resealed on refresh
+   }
+  }
+  page := newReqWithCookie(http.MethodGet, "/settings", session)
+  page.Header.Set("Accept", "text/html")
+  if rr := serve(sensitive, page); rr.Code != http.StatusFound || rr.Header().Get("Location") != "/reauthenticate?next=%2Fsettings" {
+   t.Fatalf("mode %d: stale page load: %d %q", mode, rr.Code, rr.Header().Get("Location"))
+  }
+
+  w := httptest.NewRecorder()
+  if err := api.ReauthenticatePassword(w, newReqWithCookie(http.MethodPost, "/reauthenticate", session), "wrong-password"); !errors.Is(err, ErrInvalidCredentials) {
+   t.Fatalf("mode %d: wrong password: %v", mode, err)
+  }
+  w = httptest.NewRecorder()
+  if err := api.ReauthenticatePassword(w, newReqWithCookie(http.MethodPost, "/reauthenticate", session), "password123"); err != nil {
+   t.Fatalf("mode %d: ReauthenticatePassword: %v", mode, err)
+  }
+  if cs := w.Result().Cookies(); len(cs) == 1 {
+   session = cs[0]
+  } else if mode == StatelessSessions {
+   t.Fatalf("mode %d: stateless session not resealed", mode)
+  }
+  if rr := serve(sensitive, newReqWithCookie(http.MethodPost, "/settings", session)); rr.Code != http.StatusOK {
+   t.Fatalf("mode %d: after reauthentication: %d", mode, rr.Code)
+  }
+
+  if rr := serve(sensitive, httptest.NewRequest(http.MethodPost, "/settings", nil)); rr.Code != http.StatusUnauthorized {
+   t.Fatalf("mode %d: signed out: %d", mode, rr.Code)
+  }
+  cleanup()
+ }
+}
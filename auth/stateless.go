@@ -0,0 +1,180 @@
+package auth
+
+import (
+ "context"
+ "crypto/aes"
+ "crypto/cipher"
+ "crypto/rand"
+ "database/sql"
+ "encoding/base64"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "net/http"
+ "strings"
+ "time"
+)
+
+// Stateless session tokens have the form "v1.<key id>.<base64url(nonce||ciphertext)>".
+// The key ID and version prefix are bound as additional data, so a token cannot be
+// replayed under a different key or format.
+const statelessTokenVersion = "v1"
+
+// statelessPayload is the encrypted content of a stateless session token.
+type statelessPayload struct {
+ UserID    int64  `json:"uid"`
+ Email     string `json:"em"`
+ UserSince int64  `json:"uc"`
+ IssuedAt  int64  `json:"iat"`
+ ExpiresAt int64  `json:"exp"`
+ Version   int64  `json:"ver"`
+ OrgID     int64  `json:"org,omitempty"`
+ AuthAt    int64  `json:"aat,omitempty"` // last sign-in; unlike IssuedAt it survives refresh
+}
+
+// sessionSealer encrypts and decrypts stateless session payloads with AES-GCM.
+type sessionSealer struct {
+ activeID string
+ aeads    map[string]cipher.AEAD
+}
+
+func newSessionSealer(keys []SessionKey) (*sessionSealer, error) {
+ if len(keys) == 0 {
+  return nil, fmt.Errorf("stateless sessions require at least one SessionKey")
+ }
+ s := &sessionSealer{activeID: keys[0].ID, aeads: make(map[string]cipher.AEAD, len(keys))}
+ for _, k := range keys {
+  if k.ID == "" || strings.Contains(k.ID, ".") {
+   return nil, fmt.Errorf("invalid session key id %q", k.ID)
+  }
+  if _, dup := s.aeads[k.ID]; dup {
+   return nil, fmt.Errorf("duplicate session key id %q", k.ID)
+  }
+  if len(k.Key) != 32 {
+   return nil, fmt.Errorf("session key %q must be 32 bytes; got %d", k.ID, len(k.Key))
+  }
+  block, err := aes.NewCipher(k.Key)
+  if err != nil {
+   return nil, fmt.Errorf("session key %q: %w", k.ID, err)
+  }
+  aead, err := cipher.NewGCM(block)
+  if err != nil {
+   return nil, fmt.Errorf("session key %q: %w", k.ID, err)
+  }
+  s.aeads[k.ID] = aead
+ }
+ return s, nil
+}
+
+func (s *sessionSealer) seal(p statelessPayload) (string, error) {
+ plain, err := json.Marshal(p)
+ if err != nil {
+  return "", err
+ }
+ aead := s.aeads[s.activeID]
+ nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+ if _, err := rand.Read(nonce); err != nil {
+  return "", err
+ }
+ header := statelessTokenVersion + "." + s.activeID
+ sealed := aead.Seal(nonce, nonce, plain, []byte(header))
+ return header + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *sessionSealer) open(token string) (statelessPayload, error) {
+ parts := strings.SplitN(token, ".", 3)
+ if len(parts) != 3 || parts[0] != statelessTokenVersion {
+  return statelessPayload{}, errors.New("malformed session token")
+ }
+ aead, ok := s.aeads[parts[1]]
+ if !ok {
+  return statelessPayload{}, errors.New("unknown session key")
+ }
+ raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+ if err != nil || len(raw) < aead.NonceSize() {
+  return statelessPayload{}, errors.New("malformed session token")
+ }
+ nonce, ct := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+ plain, err := aead.Open(nil, nonce, ct, []byte(parts[0]+"."+parts[1]))
+ if err != nil {
+  return statelessPayload{}, errors.New("invalid session token")
+ }
+ var p statelessPayload
+ if err := json.Unmarshal(plain, &p); err != nil {
+  return statelessPayload{}, errors.New("invalid session payload")
+ }
+ return p, nil
+}
+
+// createStatelessSession loads the user once and seals a fresh payload.
+func (a *API) createStatelessSession(ctx context.Context, userID int64) (string, int64, error) {
+ p, err := a.statelessPayloadFor(ctx, userID)
+ if err != nil {
+  return "", 0, err
+ }
+ p.AuthAt = p.IssuedAt
+ token, err := a.sealer.seal(p)
+ if err != nil {
+  return "", 0, fmt.Errorf("seal session: %w", err)
+ }
+ return token, p.ExpiresAt, nil
+}
+
+// statelessPayloadFor builds a payload from the current users row, including its
+// session_version. It is used at login and whenever a token is refreshed.
+func (a *API) statelessPayloadFor(ctx context.Context, userID int64) (statelessPayload, error) {
+ p := statelessPayload{UserID: userID}
+ err := a.db.QueryRowContext(ctx, `
+  SELECT email, created_at, session_version FROM users WHERE id = ?
+ `, userID).Scan(&p.Email, &p.UserSince, &p.Version)
+ if err != nil {
+  return statelessPayload{}, err
+ }
+ now := a.now()
+ p.IssuedAt = now.Unix()
+ p.ExpiresAt = now.Add(a.cfg.SessionTTL).Unix()
+ return p, nil
+}
+
+// resolveStatelessSession resolves a stateless token without touching the database,
+// except inside the refresh window where the user's session_version is re-checked.
+// Until then a revoked token is still accepted. Stateless tokens are only carried
+// by cookies: New refuses TransportBearer in this mode.
+func (a *API) resolveStatelessSession(w http.ResponseWriter, r *http.Request, token string, transport Transport) (User, sessionInfo, bool, error) {
+ usesCookie := transport == TransportCookie
+ p, err := a.sealer.open(token)
+ now := a.now().Unix()
+ if err != nil || now >= p.ExpiresAt {
+  if usesCookie {
+   a.clearCookie(w)
+  }
+  return User{}, sessionInfo{}, false, nil
+ }
+ ttl := int64(a.cfg.SessionTTL.Seconds())
+ if usesCookie && ttl > 0 && (p.ExpiresAt-now)*5 <= ttl {
+  fresh, err := a.statelessPayloadFor(r.Context(), p.UserID)
+  if err != nil {
+   if errors.Is(err, sql.ErrNoRows) {
+    a.clearCookie(w)
+    return User{}, sessionInfo{}, false, nil
+   }
+   return User{}, sessionInfo{}, false, fmt.Errorf("query user: %w", err)
+  }
+  if fresh.Version != p.Version {
+   // Revoked via RevokeAllSessions or ChangePassword.
+   a.clearCookie(w)
+   return User{}, sessionInfo{}, false, nil
+  }
+  // Per-session selections survive the refresh.
+  fresh.OrgID, fresh.AuthAt = p.OrgID, p.AuthAt
+  if sealed, err := a.sealer.seal(fresh); err == nil {
+   a.setCookie(w, sealed, time.Unix(fresh.ExpiresAt, 0))
+   p, token = fresh, sealed
+   a.addCounter(metricRefreshes, 1, "session")
+  } else {
+   a.logError(r.Context(), "stateless session reseal failed", err, userAttr(p.UserID))
+  }
+ }
+ info := sessionInfo{token: token, transport: transport, activeOrgID: p.OrgID, stateless: &p}
+ return User{ID: p.UserID, Email: p.Email, CreatedAt: time.Unix(p.UserSince, 0)}, info, true, nil
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "net/http"
+ "net/http/httptest"
+ "strings"
+ "testing"
+ "time"
+)
+
+func testSessionKey(id string, fill byte) SessionKey {
+ return SessionKey{ID: id, Key: bytes.Repeat([]byte{fill}, 32)}
+}
+
+func TestStatelessSessionLifecycle(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionMode = StatelessSessions
+  c.SessionKeys = []SessionKey{testSessionKey("k1", 1)}
+  c.SessionTTL = 100 * time.Second
+ })
+ defer cleanup()
+
+ ctx := context.Background()
+ u, err := api.Register(ctx, "edge@example.com", "password123")
+ if err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ c := mustLogin(t, api, "edge@example.com", "password123")
+ if !strings.HasPrefix(c.Value, "v1.k1.") {
+  t.Fatalf("unexpected stateless token %q", c.Value)
+ }
+ var n int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&n); err != nil || n != 0 {
+  t.Fatalf("stateless login must not write session rows: n=%d err=%v", n, err)
+ }
+
+ got, ok, err := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c))
+ if err != nil || !ok || got.ID != u.ID || got.Email != u.Email {
+  t.Fatalf("CurrentUser: user=%v ok=%v err=%v", got, ok, err)
+ }
+
+ // Tampering is rejected.
+ tampered := *c
+ tampered.Value = c.Value[:len(c.Value)-2] + "AA"
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", &tampered)); ok {
+  t.Fatalf("tampered token accepted")
+ }
+
+ // Revocation takes effect at the next refresh, not before.
+ if err := api.RevokeAllSessions(ctx, u.ID); err != nil {
+  t.Fatalf("RevokeAllSessions: %v", err)
+ }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c)); !ok {
+  t.Fatalf("revocation should only be checked on refresh")
+ }
+ api.cfg.Now = func() time.Time { return base.Add(90 * time.Second) }
+ if _, ok, _ := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/me", c)); ok {
+  t.Fatalf("revoked token accepted at refresh")
+ }
+}
+
+func TestStatelessSessionRefreshAndLogout(t *testing.T) {
+ base := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.SessionMode = StatelessSessions
+  c.SessionKeys = []SessionKey{testSessionKey("k1", 1)}
+  c.SessionTTL = 100 * time.Second
+ })
+ defer cleanup()
+
+ if _, err := api.Register(context.Background(), "slide@example.com", "password123"); err != nil {
+  t.Fatalf("register: %v", err)
+ }
+ c := mustLogin(t, api, "slide@example.com", "password123")
+
+ api.cfg.Now = func() time.Time { return base.Add(85 * time.Second) }
+ w := httptest.NewRecorder()
+ if _, ok, _ := api.CurrentUser(w, newReqWithCookie(http.MethodGet, "/me", c)); !ok {
+  t.Fatalf("token should be valid")
+ }
+ var refreshed *http.Cookie
+ for _, sc := range w.Result().Cookies() {
+  if sc.Name == api.cfg.SessionName {
+   refreshed = sc
+  }
+ }
+ if refreshed == nil || refreshed.Value == c.Value || !refreshed.Expires.Equal(base.Add(185*time.Second)) {
+  t.Fatalf("expected resealed cookie expiring at +185s, got %+v", refreshed)
+ }
+
+ w2 := httptest.NewRecorder()
+ if err := api.Logout(w2, newReqWithCookie(http.MethodPost, "/logout", refreshed)); err != nil {
+  t.Fatalf("logout: %v", err)
+ }
+ if len(w2.Result().Cookies()) == 0 || w2.Result().Cookies()[0].MaxAge != 0 {
+  t.Fatalf("expected clearing cookie on logout")
+ }
+}
+
+func TestSessionSealerKeyRotation(t *testing.T) {
+ oldKey, newKey := testSessionKey("old", 1), testSessionKey("new", 2)
+ before, err := newSessionSealer([]SessionKey{oldKey})
+ if err != nil {
+  t.Fatalf("sealer: %v", err)
+ }
+ token, err := before.seal(statelessPayload{UserID: 7, ExpiresAt: 1})
+ if err != nil {
+  t.Fatalf("seal: %v", err)
+ }
+
+ during, _ := newSessionSealer([]SessionKey{newKey, oldKey})
+ if p, err := during.open(token); err != nil || p.UserID != 7 {
+  t.Fatalf("rotated sealer should open old tokens: %v %v", p, err)
+ }
+ fresh, _ := during.seal(statelessPayload{UserID: 8})
+ if !strings.HasPrefix(fresh, "v1.new.") {
+  t.Fatalf("new tokens should use the first key: %q", fresh)
+ }
+
+ after, _ := newSessionSealer([]SessionKey{newKey})
+ if _, err := after.open(token); err == nil {
+  t.Fatalf("retired key must not open tokens")
+ }
+
+ if _, err := newSessionSealer([]SessionKey{{ID: "short", Key: []byte("x")}}); err == nil {
+  t.Fatalf("expected error for short key")
+ }
+}
+
+func TestStatelessSessionsRefuseBearer(t *testing.T) {
+ _, err := New(Config{
+  DBPath:            ":memory:",
+  SessionMode:       StatelessSessions,
+  SessionKeys:       []SessionKey{testSessionKey("k1", 1)},
+  SessionTransports: TransportCookie | TransportBearer,
+ })
+ if err == nil || !strings.Contains(err.Error(), "TransportBearer") {
+  t.Fatalf("New with stateless bearer sessions: %v", err)
+ }
+}
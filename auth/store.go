@@ -2,6 +2,7 @@ package auth
 
 import (
   "context"
+  "crypto/rand"
   "database/sql"
   "fmt"
   "time"
@@ -12,18 +13,34 @@ type dbHandle interface {
  Close() error
  Exec(query string, args ...any) (sql.Result, error)
  ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+ QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
  QueryRow(query string, args ...any) *sql.Row
  QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
- Begin() (*sql.Tx, error)
- BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+ Begin() (txHandle, error)
+ BeginTx(ctx context.Context, opts *sql.TxOptions) (txHandle, error)
+}
+
+// txHandle abstracts *sql.Tx, so transactions can be wrapped like the handle.
+type txHandle interface {
+ Commit() error
+ Rollback() error
+ Exec(query string, args ...any) (sql.Result, error)
+ ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+ Query(query string, args ...any) (*sql.Rows, error)
+ QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+ QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
 // sqliteDB is the concrete DB handle in production (embeds *sql.DB).
 type sqliteDB struct{ *sql.DB }
 
-func (s *sqliteDB) Begin() (*sql.Tx, error) { return s.DB.Begin() }
-func (s *sqliteDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
- return s.DB.BeginTx(ctx, opts)
+func (s *sqliteDB) Begin() (txHandle, error) { return s.BeginTx(context.Background(), nil) }
+func (s *sqliteDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (txHandle, error) {
+ tx, err := s.DB.BeginTx(ctx, opts)
+ if err != nil {
+  return nil, err // not a nil *sql.Tx in a non-nil interface
+ }
+ return tx, nil
 }
 
 // New constructs the API and initializes the database.
@@ -32,8 +49,52 @@ func newAPI(cfg Config) (*API, error) {
  if err := validateBcryptCost(cfg.BcryptCost); err != nil {
   return nil, err
  }
+ var sealer *sessionSealer
+ if cfg.SessionMode == StatelessSessions {
+  if cfg.MaxSessionsPerUser > 0 {
+   return nil, fmt.Errorf("MaxSessionsPerUser is not supported with stateless sessions")
+  }
+  // A bearer token cannot be resealed or cleared, so nothing could end it
+  // before its expiry.
+  if cfg.SessionTransports&TransportBearer != 0 {
+   return nil, fmt.Errorf("TransportBearer is not supported with stateless sessions")
+  }
+  s, err := newSessionSealer(cfg.SessionKeys)
+  if err != nil {
+   return nil, err
+  }
+  sealer = s
+ }
+ if err := checkDeviceAuthConfig(cfg.DeviceAuth, cfg.SessionTransports); err != nil {
+  return nil, err
+ }
+ if err := checkPageOptions(cfg.Pages); err != nil {
+  return nil, err
+ }
+ if err := checkWebhookConfig(cfg.Webhooks); err != nil {
+  return nil, err
+ }
+ csrfKey := cfg.CSRFKey
+ if len(csrfKey) == 0 {
+  csrfKey = make([]byte, 32)
+  if _, err := rand.Read(csrfKey); err != nil {
+   return nil, fmt.Errorf("generate csrf key: %w", err)
+  }
+ } else if len(csrfKey) < 32 {
+  return nil, fmt.Errorf("CSRFKey must be at least 32 bytes")
+ }
+ var jwt *jwtKeys
+ if cfg.JWT != nil {
+  k, err := newJWTKeys(cfg.JWT.SigningKeys)
+  if err != nil {
+   return nil, err
+  }
+  jwt = k
+ }
 
- db, err := sql.Open("sqlite3", cfg.DBPath+"?_foreign_keys=on&_busy_timeout=5000")
+ // _txlock=immediate takes the write lock at BEGIN so read-then-write transactions
+ // (e.g. the session cap check) serialize instead of racing.
+ db, err := sql.Open("sqlite3", cfg.DBPath+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
  if err != nil {
   return nil, fmt.Errorf("open sqlite: %w", err)
  }
@@ -45,7 +106,19 @@ func newAPI(cfg Config) (*API, error) {
  db.SetMaxOpenConns(cfg.MaxOpenConns)
  db.SetMaxIdleConns(cfg.MaxIdleConns)
 
- api := &API{db: &sqliteDB{DB: db}, cfg: cfg, stopCh: make(chan struct{})}
+ var handle dbHandle = &sqliteDB{DB: db}
+ if cfg.Tracer != nil {
+  handle = &tracedDB{dbHandle: handle, tracer: cfg.Tracer}
+ }
+ api := &API{db: handle, cfg: cfg, sealer: sealer, jwt: jwt, csrfKey: csrfKey, stopCh: make(chan struct{}), logger: newLogger(cfg)}
+ if api.oidc, err = newOIDCClients(cfg.OIDCProviders, api.now); err != nil {
+  _ = db.Close()
+  return nil, err
+ }
+ if api.oidcServer, err = newOIDCServer(cfg.OIDCServer); err != nil {
+  _ = db.Close()
+  return nil, err
+ }
  if err := api.migrate(); err != nil {
   _ = db.Close()
   return nil, fmt.Errorf("migrate: %w", err)
@@ -55,6 +128,12 @@ func newAPI(cfg Config) (*API, error) {
  if cfg.PruneInterval > 0 {
   startJanitor(api, cfg.PruneInterval)
  }
+ if cfg.Webhooks != nil {
+  startWebhookDispatcher(api, cfg.Webhooks.PollInterval)
+ }
+ if cfg.Pages.SendPasswordReset != nil {
+  startResetWorker(api)
+ }
 
  return api, nil
 }
@@ -73,6 +152,8 @@ func (a *API) closeInternal() error {
 
 func startJanitor(a *API, interval time.Duration) {
   ticker := time.NewTicker(interval)
+  // Capture the channel: closeInternal nils a.stopCh after closing it.
+  stop := a.stopCh
   a.wg.Add(1)
   go func() {
     defer a.wg.Done()
@@ -81,9 +162,9 @@ func startJanitor(a *API, interval time.Duration) {
       select {
       case <-ticker.C:
         if err := a.pruneExpiredSessionsInternal(context.Background()); err != nil {
-          a.logf("janitor prune error: %v", err)
+          a.logError(context.Background(), "janitor prune failed", err)
         }
-      case <-a.stopCh:
+      case <-stop:
         return
       }
     }
@@ -0,0 +1,294 @@
+package auth
+
+import (
+ "context"
+ "crypto"
+ "crypto/sha256"
+ "database/sql"
+ "encoding/json"
+ "errors"
+ "fmt"
+ "log/slog"
+ "net/http"
+ "strconv"
+ "time"
+)
+
+// jwtKeys holds the parsed JWT configuration: the active signing key and every
+// public key that verifiers should accept.
+type jwtKeys struct {
+ signer JWTKey
+ public map[string]crypto.PublicKey
+ jwks   []byte
+}
+
+func newJWTKeys(keys []JWTKey) (*jwtKeys, error) {
+ if len(keys) == 0 {
+  return nil, fmt.Errorf("JWT requires at least one signing key")
+ }
+ k := &jwtKeys{signer: keys[0], public: make(map[string]crypto.PublicKey, len(keys))}
+ var set jwkSet
+ for _, key := range keys {
+  if key.ID == "" || key.Key == nil {
+   return nil, fmt.Errorf("JWT keys need an ID and a private key")
+  }
+  if _, dup := k.public[key.ID]; dup {
+   return nil, fmt.Errorf("duplicate JWT key id %q", key.ID)
+  }
+  j, err := jwkFromPublicKey(key.ID, key.Key.Public())
+  if err != nil {
+   return nil, err
+  }
+  k.public[key.ID] = key.Key.Public()
+  set.Keys = append(set.Keys, j)
+ }
+ b, err := json.Marshal(set)
+ if err != nil {
+  return nil, err
+ }
+ k.jwks = b
+ return k, nil
+}
+
+func (a *API) issueTokenPairInternal(ctx context.Context, userID int64) (TokenPair, error) {
+ if a.jwt == nil {
+  return TokenPair{}, errJWTDisabled
+ }
+ family, err := newSessionToken()
+ if err != nil {
+  return TokenPair{}, err
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return TokenPair{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+ refresh, err := a.insertRefreshToken(ctx, tx, refreshGrant{userID: userID, family: family}, a.cfg.JWT.RefreshTTL)
+ if err != nil {
+  return TokenPair{}, err
+ }
+ pair, err := a.finishTokenPair(ctx, tx, userID, refresh)
+ if err != nil {
+  return TokenPair{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return TokenPair{}, fmt.Errorf("commit: %w", err)
+ }
+ return pair, nil
+}
+
+func (a *API) loginTokenPairInternal(ctx context.Context, email, password string) (TokenPair, User, error) {
+ if a.jwt == nil {
+  return TokenPair{}, User{}, errJWTDisabled
+ }
+ user, err := a.authenticatePassword(ctx, email, password)
+ if err == nil {
+  err = a.beforeLogin(ctx, user)
+ }
+ if err != nil {
+  a.recordLogin(ctx, email, user, err)
+  return TokenPair{}, User{}, err
+ }
+ pair, err := a.issueTokenPairInternal(ctx, user.ID)
+ a.recordLogin(ctx, email, user, err)
+ if err != nil {
+  return TokenPair{}, User{}, err
+ }
+ return pair, user, nil
+}
+
+// refreshTokenPairInternal rotates a refresh token. Presenting a token that was
+// already rotated means it leaked (or the client raced itself): the whole family
+// is revoked and ErrRefreshTokenReused is returned.
+func (a *API) refreshTokenPairInternal(ctx context.Context, refreshToken string) (TokenPair, error) {
+ if a.jwt == nil {
+  return TokenPair{}, errJWTDisabled
+ }
+ tx, err := a.db.BeginTx(ctx, nil)
+ if err != nil {
+  return TokenPair{}, fmt.Errorf("begin: %w", err)
+ }
+ defer rollbackIfNeeded(tx)
+
+ g, err := a.consumeRefreshToken(ctx, tx, refreshToken, "")
+ if err != nil {
+  return TokenPair{}, err
+ }
+ refresh, err := a.insertRefreshToken(ctx, tx, g, a.cfg.JWT.RefreshTTL)
+ if err != nil {
+  return TokenPair{}, err
+ }
+ pair, err := a.finishTokenPair(ctx, tx, g.userID, refresh)
+ if err != nil {
+  return TokenPair{}, err
+ }
+ if err := tx.Commit(); err != nil {
+  return TokenPair{}, fmt.Errorf("commit: %w", err)
+ }
+ a.addCounter(metricRefreshes, 1, "refresh_token")
+ return pair, nil
+}
+
+// refreshGrant is what a refresh token stands for. clientID is empty for tokens
+// issued by IssueTokenPair and set for OIDC provider clients.
+type refreshGrant struct {
+ userID   int64
+ family   string
+ clientID string
+ scope    string
+}
+
+// consumeRefreshToken marks a refresh token used and returns its grant so the caller
+// can insert the successor in the same transaction. On reuse it revokes the family,
+// commits tx and returns ErrRefreshTokenReused.
+func (a *API) consumeRefreshToken(ctx context.Context, tx txHandle, refreshToken, clientID string) (refreshGrant, error) {
+ sum := sha256.Sum256([]byte(refreshToken))
+ now := a.now().Unix()
+ var (
+  id, expiresAt, usedAt, revokedAt int64
+  g                                refreshGrant
+ )
+ err := tx.QueryRowContext(ctx, `
+  SELECT id, user_id, family, client_id, scope, expires_at, used_at, revoked_at
+  FROM refresh_tokens
+  WHERE token_hash = ?
+ `, sum[:]).Scan(&id, &g.userID, &g.family, &g.clientID, &g.scope, &expiresAt, &usedAt, &revokedAt)
+ if err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return refreshGrant{}, ErrInvalidRefreshToken
+  }
+  return refreshGrant{}, fmt.Errorf("query refresh token: %w", err)
+ }
+ if g.clientID != clientID || revokedAt != 0 || now >= expiresAt {
+  return refreshGrant{}, ErrInvalidRefreshToken
+ }
+ if usedAt != 0 {
+  if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at = 0`, now, g.family); err != nil {
+   return refreshGrant{}, fmt.Errorf("revoke family: %w", err)
+  }
+  if err := tx.Commit(); err != nil {
+   return refreshGrant{}, fmt.Errorf("commit: %w", err)
+  }
+  a.log(ctx, slog.LevelWarn, "refresh token reuse detected; family revoked", userAttr(g.userID))
+  return refreshGrant{}, ErrRefreshTokenReused
+ }
+ if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = ? WHERE id = ?`, now, id); err != nil {
+  return refreshGrant{}, fmt.Errorf("mark refresh token used: %w", err)
+ }
+ return g, nil
+}
+
+func (a *API) revokeRefreshTokenInternal(ctx context.Context, refreshToken string) error {
+ sum := sha256.Sum256([]byte(refreshToken))
+ _, err := a.db.ExecContext(ctx, `
+  UPDATE refresh_tokens SET revoked_at = ?
+  WHERE revoked_at = 0 AND family = (SELECT family FROM refresh_tokens WHERE token_hash = ?)
+ `, a.now().Unix(), sum[:])
+ if err != nil {
+  return fmt.Errorf("revoke refresh token: %w", err)
+ }
+ return nil
+}
+
+func (a *API) insertRefreshToken(ctx context.Context, tx txHandle, g refreshGrant, ttl time.Duration) (string, error) {
+ token, err := newSessionToken()
+ if err != nil {
+  return "", err
+ }
+ sum := sha256.Sum256([]byte(token))
+ now := a.now()
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO refresh_tokens (token_hash, family, user_id, client_id, scope, created_at, expires_at)
+  VALUES (?, ?, ?, ?, ?, ?, ?)
+ `, sum[:], g.family, g.userID, g.clientID, g.scope, now.Unix(), now.Add(ttl).Unix()); err != nil {
+  return "", fmt.Errorf("insert refresh token: %w", err)
+ }
+ return token, nil
+}
+
+// finishTokenPair signs an access token for the user's current row.
+func (a *API) finishTokenPair(ctx context.Context, tx txHandle, userID int64, refresh string) (TokenPair, error) {
+ var (
+  email string
+  uc    int64
+ )
+ if err := tx.QueryRowContext(ctx, `SELECT email, created_at FROM users WHERE id = ?`, userID).Scan(&email, &uc); err != nil {
+  if errors.Is(err, sql.ErrNoRows) {
+   return TokenPair{}, ErrInvalidRefreshToken
+  }
+  return TokenPair{}, fmt.Errorf("query user: %w", err)
+ }
+ access, err := a.signAccessToken(User{ID: userID, Email: email, CreatedAt: time.Unix(uc, 0)})
+ if err != nil {
+  return TokenPair{}, err
+ }
+ return TokenPair{
+  AccessToken:  access,
+  TokenType:    "Bearer",
+  ExpiresIn:    int64(a.cfg.JWT.AccessTTL.Seconds()),
+  RefreshToken: refresh,
+ }, nil
+}
+
+func (a *API) signAccessToken(u User) (string, error) {
+ jti, err := newSessionToken()
+ if err != nil {
+  return "", err
+ }
+ now := a.now()
+ claims := map[string]any{
+  "sub":        strconv.FormatInt(u.ID, 10),
+  "email":      u.Email,
+  "created_at": u.CreatedAt.Unix(),
+  "iat":        now.Unix(),
+  "exp":        now.Add(a.cfg.JWT.AccessTTL).Unix(),
+  "jti":        jti,
+ }
+ if a.cfg.JWT.Issuer != "" {
+  claims["iss"] = a.cfg.JWT.Issuer
+ }
+ if a.cfg.JWT.Audience != "" {
+  claims["aud"] = a.cfg.JWT.Audience
+ }
+ return signJWT(a.jwt.signer, claims)
+}
+
+// localJWTVerifier verifies tokens against the configured keys without HTTP.
+func (a *API) localJWTVerifier() *JWTVerifier {
+ return &JWTVerifier{
+  issuer:   a.cfg.JWT.Issuer,
+  audience: a.cfg.JWT.Audience,
+  leeway:   defaultJWTLeeway,
+  now:      a.now,
+  keyFor:   staticKeySet(a.jwt.public),
+ }
+}
+
+func (a *API) verifyAccessTokenInternal(ctx context.Context, token string) (User, error) {
+ if a.jwt == nil {
+  return User{}, errJWTDisabled
+ }
+ return a.localJWTVerifier().verifyInternal(ctx, token)
+}
+
+// jwtMiddlewareInternal passes requests through untouched when JWT is not configured.
+func (a *API) jwtMiddlewareInternal(next http.Handler) http.Handler {
+ if a.jwt == nil {
+  return next
+ }
+ return a.localJWTVerifier().middlewareInternal(next)
+}
+
+func (a *API) jwksHandlerInternal() http.Handler {
+ return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  if a.jwt == nil {
+   http.NotFound(w, r)
+   return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Cache-Control", "public, max-age=300")
+  _, _ = w.Write(a.jwt.jwks)
+ })
+}
+
+var errJWTDisabled = errors.New("JWT is not configured")
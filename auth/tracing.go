@@ -0,0 +1,147 @@
+package auth
+
+import (
+ "context"
+ "database/sql"
+ "log/slog"
+ "strings"
+)
+
+// Without a Tracer, startSpan returns noopSpan, a zero-size value that needs no
+// allocation, and attributes are only built when a Tracer is set. The database
+// handle is wrapped in tracedDB only when one is configured.
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...slog.Attr) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+func (a *API) startSpan(ctx context.Context, name string) (context.Context, Span) {
+ if a.cfg.Tracer == nil {
+  return ctx, noopSpan{}
+ }
+ return a.cfg.Tracer.Start(ctx, name)
+}
+
+// endSpan records userID (if known) and err on span and ends it.
+func (a *API) endSpan(span Span, userID int64, err error) {
+ if a.cfg.Tracer != nil && userID != 0 {
+  span.SetAttributes(slog.Int64("auth.user_id", userID))
+ }
+ finishSpan(span, err)
+}
+
+func finishSpan(span Span, err error) {
+ if err != nil {
+  span.RecordError(err)
+ }
+ span.End()
+}
+
+// tracedDB starts a span for each call. Statements are recorded without their
+// arguments, which may be tokens or hashes. Transactions are wrapped in tracedTx:
+// the db.begin span covers the wait for SQLite's write lock, and each statement
+// and the commit get spans of their own.
+type tracedDB struct {
+ dbHandle
+ tracer Tracer
+}
+
+func (d *tracedDB) start(ctx context.Context, name, query string) (context.Context, Span) {
+ ctx, span := d.tracer.Start(ctx, name)
+ attrs := []slog.Attr{slog.String("db.system", "sqlite")}
+ if query != "" {
+  attrs = append(attrs, slog.String("db.statement", strings.Join(strings.Fields(query), " ")))
+ }
+ span.SetAttributes(attrs...)
+ return ctx, span
+}
+
+func (d *tracedDB) Exec(query string, args ...any) (sql.Result, error) {
+ return d.ExecContext(context.Background(), query, args...)
+}
+
+func (d *tracedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+ ctx, span := d.start(ctx, "db.exec", query)
+ res, err := d.dbHandle.ExecContext(ctx, query, args...)
+ finishSpan(span, err)
+ return res, err
+}
+
+// QueryContext's span ends when the query returns, before rows are read.
+func (d *tracedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+ ctx, span := d.start(ctx, "db.query", query)
+ rows, err := d.dbHandle.QueryContext(ctx, query, args...)
+ finishSpan(span, err)
+ return rows, err
+}
+
+func (d *tracedDB) QueryRow(query string, args ...any) *sql.Row {
+ return d.QueryRowContext(context.Background(), query, args...)
+}
+
+func (d *tracedDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+ ctx, span := d.start(ctx, "db.query", query)
+ row := d.dbHandle.QueryRowContext(ctx, query, args...)
+ finishSpan(span, row.Err())
+ return row
+}
+
+func (d *tracedDB) Begin() (txHandle, error) {
+ return d.BeginTx(context.Background(), nil)
+}
+
+func (d *tracedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (txHandle, error) {
+ spanCtx, span := d.start(ctx, "db.begin", "")
+ tx, err := d.dbHandle.BeginTx(spanCtx, opts)
+ finishSpan(span, err)
+ if err != nil {
+  return nil, err
+ }
+ return &tracedTx{txHandle: tx, db: d, ctx: ctx}, nil
+}
+
+// tracedTx starts a span for each statement of a transaction, as tracedDB does.
+// Commit and Rollback take no context, so their spans use the one of BeginTx.
+type tracedTx struct {
+ txHandle
+ db  *tracedDB
+ ctx context.Context
+}
+
+func (t *tracedTx) Exec(query string, args ...any) (sql.Result, error) {
+ return t.ExecContext(t.ctx, query, args...)
+}
+
+func (t *tracedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+ ctx, span := t.db.start(ctx, "db.exec", query)
+ res, err := t.txHandle.ExecContext(ctx, query, args...)
+ finishSpan(span, err)
+ return res, err
+}
+
+func (t *tracedTx) Query(query string, args ...any) (*sql.Rows, error) {
+ return t.QueryContext(t.ctx, query, args...)
+}
+
+func (t *tracedTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+ ctx, span := t.db.start(ctx, "db.query", query)
+ rows, err := t.txHandle.QueryContext(ctx, query, args...)
+ finishSpan(span, err)
+ return rows, err
+}
+
+func (t *tracedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+ ctx, span := t.db.start(ctx, "db.query", query)
+ row := t.txHandle.QueryRowContext(ctx, query, args...)
+ finishSpan(span, row.Err())
+ return row
+}
+
+func (t *tracedTx) Commit() error {
+ _, span := t.db.start(t.ctx, "db.commit", "")
+ err := t.txHandle.Commit()
+ finishSpan(span, err)
+ return err
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+ "context"
+ "errors"
+ "log/slog"
+ "net/http"
+ "net/http/httptest"
+ "strconv"
+ "strings"
+ "sync"
+ "testing"
+)
+
+type recordedSpan struct {
+ name   string
+ parent string
+ attrs  map[string]string
+ err    error
+ ended  bool
+}
+
+// recordingTracer keeps every span it starts.
+type recordingTracer struct {
+ mu    sync.Mutex
+ spans []*recordedSpan
+}
+
+type spanCtxKey struct{}
+
+type testSpan struct {
+ t *recordingTracer
+ s *recordedSpan
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+ s := &recordedSpan{name: name, attrs: map[string]string{}}
+ if p, ok := ctx.Value(spanCtxKey{}).(*recordedSpan); ok {
+  s.parent = p.name
+ }
+ rt.mu.Lock()
+ rt.spans = append(rt.spans, s)
+ rt.mu.Unlock()
+ return context.WithValue(ctx, spanCtxKey{}, s), testSpan{rt, s}
+}
+
+func (sp testSpan) SetAttributes(attrs ...slog.Attr) {
+ sp.t.mu.Lock()
+ defer sp.t.mu.Unlock()
+ for _, a := range attrs {
+  sp.s.attrs[a.Key] = a.Value.String()
+ }
+}
+
+func (sp testSpan) RecordError(err error) {
+ sp.t.mu.Lock()
+ defer sp.t.mu.Unlock()
+ sp.s.err = err
+}
+
+func (sp testSpan) End() {
+ sp.t.mu.Lock()
+ defer sp.t.mu.Unlock()
+ sp.s.ended = true
+}
+
+// take returns the recorded spans and starts over.
+func (rt *recordingTracer) take() []*recordedSpan {
+ rt.mu.Lock()
+ defer rt.mu.Unlock()
+ spans := rt.spans
+ rt.spans = nil
+ return spans
+}
+
+func findSpan(spans []*recordedSpan, name, parent string) *recordedSpan {
+ for _, s := range spans {
+  if s.name == name && s.parent == parent {
+   return s
+  }
+ }
+ return nil
+}
+
+// hasStatement reports whether a span named name under parent ran a statement
+// starting with prefix.
+func hasStatement(spans []*recordedSpan, name, parent, prefix string) bool {
+ for _, s := range spans {
+  if s.name == name && s.parent == parent && strings.HasPrefix(s.attrs["db.statement"], prefix) {
+   return true
+  }
+ }
+ return false
+}
+
+func TestTracing(t *testing.T) {
+ tracer := &recordingTracer{}
+ api, cleanup := newTestAPI(t, func(c *Config) { c.Tracer = tracer })
+ defer cleanup()
+ ctx := context.Background()
+ var all []*recordedSpan
+ take := func() []*recordedSpan {
+  spans := tracer.take()
+  all = append(all, spans...)
+  return spans
+ }
+
+ user, err := api.Register(ctx, "alice@example.com", "password123")
+ if err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ uid := strconv.FormatInt(user.ID, 10)
+ spans := take()
+ if s := findSpan(spans, "auth.Register", ""); s == nil || s.attrs["auth.user_id"] != uid || s.err != nil {
+  t.Fatalf("register span: %+v", s)
+ }
+ if s := findSpan(spans, "auth.bcrypt.hash", "auth.Register"); s == nil || s.attrs["bcrypt.cost"] != "4" {
+  t.Fatalf("hash span: %+v", s)
+ }
+ if s := findSpan(spans, "db.begin", "auth.Register"); s == nil || s.attrs["db.system"] != "sqlite" {
+  t.Fatalf("begin span: %+v", s)
+ }
+ // Statements inside the transaction and its commit are traced too.
+ if !hasStatement(spans, "db.exec", "auth.Register", "INSERT INTO users") || findSpan(spans, "db.commit", "auth.Register") == nil {
+  t.Fatalf("register transaction spans: %+v", spans)
+ }
+
+ session := mustLogin(t, api, "alice@example.com", "password123")
+ spans = take()
+ if s := findSpan(spans, "auth.Login", ""); s == nil || s.attrs["auth.user_id"] != uid || s.err != nil {
+  t.Fatalf("login span: %+v", s)
+ }
+ if s := findSpan(spans, "auth.bcrypt.compare", "auth.Login"); s == nil || s.err != nil {
+  t.Fatalf("compare span: %+v", s)
+ }
+ lookup := findSpan(spans, "db.query", "auth.Login")
+ if lookup == nil || !strings.HasPrefix(lookup.attrs["db.statement"], "SELECT id, email, password_hash, created_at FROM users WHERE email = ?") {
+  t.Fatalf("users lookup span: %+v", lookup)
+ }
+ if !hasStatement(spans, "db.exec", "auth.Login", "INSERT INTO sessions") {
+  t.Fatalf("session insert span: %+v", spans)
+ }
+
+ _, err = api.Login(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), "alice@example.com", "wrong-password")
+ spans = take()
+ if s := findSpan(spans, "auth.Login", ""); s == nil || !errors.Is(s.err, ErrInvalidCredentials) || !errors.Is(err, ErrInvalidCredentials) {
+  t.Fatalf("failed login span: %+v (%v)", s, err)
+ }
+ if s := findSpan(spans, "auth.bcrypt.compare", "auth.Login"); s == nil || s.err != nil {
+  t.Fatalf("a mismatch is not a compare error: %+v", s)
+ }
+
+ if _, ok, err := api.CurrentUser(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", session)); !ok || err != nil {
+  t.Fatalf("CurrentUser: %v %v", ok, err)
+ }
+ spans = take()
+ if s := findSpan(spans, "auth.CurrentUser", ""); s == nil || s.attrs["auth.user_id"] != uid || findSpan(spans, "db.query", "auth.CurrentUser") == nil {
+  t.Fatalf("current user spans: %+v", spans)
+ }
+ // Middleware resolves the session under the same span.
+ api.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), newReqWithCookie(http.MethodGet, "/", session))
+ spans = take()
+ if s := findSpan(spans, "auth.CurrentUser", ""); s == nil || s.attrs["auth.user_id"] != uid {
+  t.Fatalf("middleware spans: %+v", spans)
+ }
+
+ // Database errors are recorded; every span ended.
+ if _, err := api.db.ExecContext(ctx, `SELECT * FROM no_such_table`); err == nil {
+  t.Fatal("query on a missing table succeeded")
+ }
+ spans = take()
+ if len(spans) != 1 || spans[0].err == nil {
+  t.Fatalf("failed exec span: %+v", spans)
+ }
+ for _, s := range all {
+  if !s.ended {
+   t.Fatalf("span %s not ended", s.name)
+  }
+  for k, v := range s.attrs {
+   if strings.Contains(v, "password123") || strings.Contains(v, session.Value) {
+    t.Fatalf("span %s attribute %s leaks a secret: %q", s.name, k, v)
+   }
+  }
+ }
+}
+
+func TestTracingDisabled(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+ if _, ok := api.db.(*sqliteDB); !ok {
+  t.Fatalf("db handle wrapped without a tracer: %T", api.db)
+ }
+ ctx := context.Background()
+ errBoom := errors.New("boom")
+ allocs := testing.AllocsPerRun(100, func() {
+  _, span := api.startSpan(ctx, "auth.Login")
+  api.endSpan(span, 1, errBoom)
+ })
+ if allocs != 0 {
+  t.Fatalf("no-op span allocates %v times", allocs)
+ }
+}
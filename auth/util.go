@@ -37,10 +37,10 @@ func validEmailBasic(e string) bool {
 // validatePasswordPolicy enforces minimal length and optional strength requirements.
 func validatePasswordPolicy(pw string, minLen int, requireStrong bool) error {
  if len(pw) < minLen {
-  return fmt.Errorf("password too short (min %d)", minLen)
+  return fmt.Errorf("%w: password too short (min %d)", ErrWeakPassword, minLen)
  }
  if requireStrong && !hasLetterAndDigit(pw) {
-  return fmt.Errorf("password must contain at least one letter and one digit")
+  return fmt.Errorf("%w: password must contain at least one letter and one digit", ErrWeakPassword)
  }
  return nil
 }
@@ -64,6 +64,8 @@ func hasLetterAndDigit(s string) bool {
 // SameOrigin performs a basic same-origin check using the Origin header.
 // If Origin is absent (e.g., non-CORS same-site requests), it returns true.
 // It compares the Host in Origin with r.Host (scheme is ignored).
+// For scheme-aware checks, trusted origins, Fetch Metadata and proxies, use
+// OriginPolicy.
 func SameOrigin(r *http.Request) bool {
   origin := r.Header.Get("Origin")
   if origin != "" {
@@ -97,9 +99,3 @@ func isUnsafeMethod(m string) bool {
     return false
   }
 }
-
-func (a *API) logf(format string, args ...any) {
-  if a != nil && a.cfg.Logf != nil {
-    a.cfg.Logf(format, args...)
-  }
-}
\ No newline at end of file
@@ -0,0 +1,254 @@
+package auth
+
+import (
+ "bytes"
+ "context"
+ "crypto/hmac"
+ "crypto/sha256"
+ "encoding/hex"
+ "encoding/json"
+ "fmt"
+ "io"
+ "log/slog"
+ "net/http"
+ "net/url"
+ "strconv"
+ "strings"
+ "time"
+)
+
+// Webhook events are written to webhook_outbox by enqueueWebhookTx inside the
+// transaction of the change they describe, so a committed change always has its
+// event and a rolled-back one never does. The dispatcher delivers them afterwards,
+// at least once: receivers should deduplicate by WebhookEvent.ID.
+
+// Webhook request headers.
+const (
+ WebhookSignatureHeader = "X-Webhook-Signature"
+ WebhookIDHeader        = "X-Webhook-ID"
+)
+
+// webhookBatch bounds the events one dispatcher pass delivers.
+const webhookBatch = 50
+
+// maxWebhookError bounds the stored last_error of a failed delivery.
+const maxWebhookError = 512
+
+func checkWebhookConfig(cfg *WebhookConfig) error {
+ if cfg == nil {
+  return nil
+ }
+ u, err := url.Parse(cfg.URL)
+ if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+  return fmt.Errorf("Webhooks.URL must be an absolute http(s) URL")
+ }
+ if len(cfg.Secret) < 32 {
+  return fmt.Errorf("Webhooks.Secret must be at least 32 bytes")
+ }
+ return nil
+}
+
+// enqueueWebhookTx adds an event for userID to the outbox in tx. It is a no-op
+// unless Webhooks is configured.
+func (a *API) enqueueWebhookTx(ctx context.Context, tx txHandle, typ EventType, userID int64) error {
+ if a.cfg.Webhooks == nil {
+  return nil
+ }
+ now := a.now().Unix()
+ if _, err := tx.ExecContext(ctx, `
+  INSERT INTO webhook_outbox (type, user_id, email, created_at, next_attempt_at)
+  SELECT ?, id, email, ?, ? FROM users WHERE id = ?`, string(typ), now, now, userID); err != nil {
+  return fmt.Errorf("enqueue webhook: %w", err)
+ }
+ return nil
+}
+
+func startWebhookDispatcher(a *API, interval time.Duration) {
+ ticker := time.NewTicker(interval)
+ // Capture the channel: closeInternal nils a.stopCh after closing it.
+ stop := a.stopCh
+ ctx, cancel := context.WithCancel(context.Background())
+ a.wg.Add(1)
+ go func() {
+  defer a.wg.Done()
+  defer ticker.Stop()
+  defer cancel()
+  go func() {
+   // Abort an in-flight delivery on Close.
+   select {
+   case <-stop:
+    cancel()
+   case <-ctx.Done():
+   }
+  }()
+  for {
+   select {
+   case <-ticker.C:
+    if err := a.dispatchWebhooksInternal(ctx); err != nil && ctx.Err() == nil {
+     a.logError(ctx, "webhook dispatch failed", err)
+    }
+   case <-stop:
+    return
+   }
+  }
+ }()
+}
+
+// pendingWebhook is an outbox row due for delivery.
+type pendingWebhook struct {
+ event    WebhookEvent
+ attempts int
+}
+
+// dispatchWebhooksInternal delivers due outbox events. A failed delivery is
+// retried with exponential backoff until MaxAttempts, then given up on.
+func (a *API) dispatchWebhooksInternal(ctx context.Context) error {
+ cfg := a.cfg.Webhooks
+ rows, err := a.db.QueryContext(ctx, `
+  SELECT id, type, user_id, email, created_at, attempts FROM webhook_outbox
+  WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?
+  ORDER BY id LIMIT ?`, a.now().Unix(), webhookBatch)
+ if err != nil {
+  return fmt.Errorf("select webhooks: %w", err)
+ }
+ var due []pendingWebhook
+ for rows.Next() {
+  var p pendingWebhook
+  var typ string
+  var created int64
+  if err := rows.Scan(&p.event.ID, &typ, &p.event.UserID, &p.event.Email, &created, &p.attempts); err != nil {
+   rows.Close()
+   return fmt.Errorf("scan webhook: %w", err)
+  }
+  p.event.Type = EventType(typ)
+  p.event.CreatedAt = time.Unix(created, 0).UTC()
+  due = append(due, p)
+ }
+ rows.Close()
+ if err := rows.Err(); err != nil {
+  return fmt.Errorf("select webhooks: %w", err)
+ }
+
+ for _, p := range due {
+  derr := a.deliverWebhook(ctx, cfg, p.event)
+  if ctx.Err() != nil {
+   return ctx.Err()
+  }
+  now := a.now()
+  if derr == nil {
+   if _, err := a.db.ExecContext(ctx, `UPDATE webhook_outbox SET delivered_at = ?, attempts = attempts + 1, last_error = '' WHERE id = ?`,
+    now.Unix(), p.event.ID); err != nil {
+    return fmt.Errorf("mark webhook delivered: %w", err)
+   }
+   continue
+  }
+  msg := derr.Error()
+  if len(msg) > maxWebhookError {
+   msg = msg[:maxWebhookError]
+  }
+  attempts := p.attempts + 1
+  if attempts >= cfg.MaxAttempts {
+   a.logError(ctx, "webhook abandoned", derr, slog.Int64("webhook_id", p.event.ID),
+    slog.String(logKeyEvent, string(p.event.Type)), userAttr(p.event.UserID), slog.Int("attempts", attempts))
+   _, err = a.db.ExecContext(ctx, `UPDATE webhook_outbox SET attempts = ?, last_error = ?, failed_at = ? WHERE id = ?`,
+    attempts, msg, now.Unix(), p.event.ID)
+  } else {
+   next := now.Add(webhookBackoff(cfg, attempts))
+   _, err = a.db.ExecContext(ctx, `UPDATE webhook_outbox SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+    attempts, msg, next.Unix(), p.event.ID)
+  }
+  if err != nil {
+   return fmt.Errorf("record webhook failure: %w", err)
+  }
+ }
+ return nil
+}
+
+// webhookBackoff is the delay after the given number of failed attempts:
+// InitialBackoff doubling per attempt, capped at MaxBackoff.
+func webhookBackoff(cfg *WebhookConfig, attempts int) time.Duration {
+ d := cfg.InitialBackoff
+ for i := 1; i < attempts && d < cfg.MaxBackoff; i++ {
+  d *= 2
+ }
+ return min(d, cfg.MaxBackoff)
+}
+
+func (a *API) deliverWebhook(ctx context.Context, cfg *WebhookConfig, ev WebhookEvent) error {
+ body, err := json.Marshal(ev)
+ if err != nil {
+  return fmt.Errorf("encode: %w", err)
+ }
+ req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+ if err != nil {
+  return err
+ }
+ req.Header.Set("Content-Type", "application/json")
+ req.Header.Set(WebhookIDHeader, strconv.FormatInt(ev.ID, 10))
+ req.Header.Set(WebhookSignatureHeader, signWebhook(cfg.Secret, a.now().Unix(), body))
+ res, err := cfg.Client.Do(req)
+ if err != nil {
+  return err
+ }
+ defer res.Body.Close()
+ _, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+ if res.StatusCode < 200 || res.StatusCode > 299 {
+  return fmt.Errorf("webhook receiver answered %s", res.Status)
+ }
+ return nil
+}
+
+// signWebhook returns the signature header value "t=<unix>,v1=<hex>", where v1
+// is the HMAC-SHA256 of "<unix>.<body>" under secret.
+func signWebhook(secret []byte, ts int64, body []byte) string {
+ t := strconv.FormatInt(ts, 10)
+ return "t=" + t + ",v1=" + hex.EncodeToString(webhookMAC(secret, t, body))
+}
+
+func webhookMAC(secret []byte, ts string, body []byte) []byte {
+ mac := hmac.New(sha256.New, secret)
+ mac.Write([]byte(ts))
+ mac.Write([]byte("."))
+ mac.Write(body)
+ return mac.Sum(nil)
+}
+
+func verifyWebhookSignatureInternal(secret []byte, header string, body []byte, maxAge time.Duration, now time.Time) error {
+ var ts, sig string
+ for _, part := range strings.Split(header, ",") {
+  k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+  switch k {
+  case "t":
+   ts = v
+  case "v1":
+   sig = v
+  }
+ }
+ unix, err := strconv.ParseInt(ts, 10, 64)
+ if err != nil {
+  return ErrInvalidWebhookSignature
+ }
+ got, err := hex.DecodeString(sig)
+ if err != nil || !hmac.Equal(got, webhookMAC(secret, ts, body)) {
+  return ErrInvalidWebhookSignature
+ }
+ if maxAge > 0 {
+  if age := now.Sub(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+   return fmt.Errorf("%w: timestamp outside %v", ErrInvalidWebhookSignature, maxAge)
+  }
+ }
+ return nil
+}
+
+// pruneWebhooksInternal deletes delivered and abandoned events older than
+// AuditRetention.
+func (a *API) pruneWebhooksInternal(ctx context.Context) error {
+ cutoff := a.now().Add(-a.cfg.AuditRetention).Unix()
+ if _, err := a.db.ExecContext(ctx, `
+  DELETE FROM webhook_outbox
+  WHERE (delivered_at IS NOT NULL AND delivered_at <= ?) OR (failed_at IS NOT NULL AND failed_at <= ?)`,
+  cutoff, cutoff); err != nil {
+  return fmt.Errorf("prune webhooks: %w", err)
+ }
+ return nil
+}
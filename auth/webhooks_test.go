@@ -0,0 +1,236 @@
+package auth
+
+import (
+ "context"
+ "encoding/json"
+ "errors"
+ "io"
+ "net/http"
+ "net/http/httptest"
+ "strings"
+ "sync"
+ "testing"
+ "time"
+)
+
+var testWebhookSecret = []byte(strings.Repeat("s", 32))
+
+// webhookReceiver records the requests it gets and answers with status.
+type webhookReceiver struct {
+ mu       sync.Mutex
+ status   int
+ requests []receivedWebhook
+ got      chan struct{}
+}
+
+type receivedWebhook struct {
+ header http.Header
+ body   []byte
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+ rec := &webhookReceiver{status: http.StatusOK, got: make(chan struct{}, 100)}
+ srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  body, _ := io.ReadAll(r.Body)
+  rec.mu.Lock()
+  rec.requests = append(rec.requests, receivedWebhook{header: r.Header.Clone(), body: body})
+  status := rec.status
+  rec.mu.Unlock()
+  w.WriteHeader(status)
+  rec.got <- struct{}{}
+ }))
+ t.Cleanup(srv.Close)
+ return rec, srv
+}
+
+func (rec *webhookReceiver) count() int {
+ rec.mu.Lock()
+ defer rec.mu.Unlock()
+ return len(rec.requests)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+ rec, srv := newWebhookReceiver(t)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Webhooks = &WebhookConfig{URL: srv.URL, Secret: testWebhookSecret, PollInterval: 10 * time.Millisecond}
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ user, err := api.Register(ctx, "alice@example.com", "password123")
+ if err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ if _, err := api.Register(ctx, "alice@example.com", "password123"); !errors.Is(err, ErrEmailTaken) {
+  t.Fatalf("duplicate Register: %v", err)
+ }
+ if err := api.ChangePassword(ctx, user.ID, "password456"); err != nil {
+  t.Fatalf("ChangePassword: %v", err)
+ }
+ for i := 0; i < 2; i++ {
+  select {
+  case <-rec.got:
+  case <-time.After(5 * time.Second):
+   t.Fatalf("received %d webhooks, want 2", rec.count())
+  }
+ }
+
+ wantTypes := []EventType{EventRegister, EventPasswordChanged}
+ for i, req := range rec.requests {
+  if err := VerifyWebhookSignature(testWebhookSecret, req.header.Get(WebhookSignatureHeader), req.body, 0); err != nil {
+   t.Fatalf("webhook %d signature: %v", i, err)
+  }
+  var ev WebhookEvent
+  if err := json.Unmarshal(req.body, &ev); err != nil {
+   t.Fatalf("webhook %d body %s: %v", i, req.body, err)
+  }
+  if ev.Type != wantTypes[i] || ev.UserID != user.ID || ev.Email != "alice@example.com" || !ev.CreatedAt.Equal(time.Unix(1_700_000_000, 0)) {
+   t.Fatalf("webhook %d: %+v", i, ev)
+  }
+  if id := req.header.Get(WebhookIDHeader); id == "" || !strings.Contains(string(req.body), `"id":`+id+`,`) {
+   t.Fatalf("webhook %d id header %q for %s", i, id, req.body)
+  }
+ }
+
+ // Delivered events are not sent again.
+ for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+  var pending int
+  if err := api.db.QueryRow(`SELECT COUNT(*) FROM webhook_outbox WHERE delivered_at IS NULL`).Scan(&pending); err != nil {
+   t.Fatalf("outbox: %v", err)
+  }
+  if pending == 0 {
+   break
+  }
+  if time.Now().After(deadline) {
+   t.Fatalf("%d events not marked delivered", pending)
+  }
+ }
+ if err := api.dispatchWebhooksInternal(ctx); err != nil {
+  t.Fatalf("dispatch: %v", err)
+ }
+ if n := rec.count(); n != 2 {
+  t.Fatalf("redelivered: %d requests", n)
+ }
+}
+
+func TestWebhookRetries(t *testing.T) {
+ rec, srv := newWebhookReceiver(t)
+ rec.status = http.StatusServiceUnavailable
+ now := time.Unix(1_700_000_000, 0)
+ api, cleanup := newTestAPI(t, func(c *Config) {
+  c.Now = func() time.Time { return now }
+  c.Webhooks = &WebhookConfig{
+   URL:            srv.URL,
+   Secret:         testWebhookSecret,
+   PollInterval:   time.Hour, // dispatch by hand
+   MaxAttempts:    3,
+   InitialBackoff: time.Minute,
+  }
+ })
+ defer cleanup()
+ ctx := context.Background()
+
+ if _, err := api.Register(ctx, "bob@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ var attempts int
+ var lastError string
+ var next int64
+ state := func() {
+  t.Helper()
+  if err := api.db.QueryRow(`SELECT attempts, last_error, next_attempt_at FROM webhook_outbox`).Scan(&attempts, &lastError, &next); err != nil {
+   t.Fatalf("outbox: %v", err)
+  }
+ }
+ dispatch := func(wantRequests int) {
+  t.Helper()
+  if err := api.dispatchWebhooksInternal(ctx); err != nil {
+   t.Fatalf("dispatch: %v", err)
+  }
+  if n := rec.count(); n != wantRequests {
+   t.Fatalf("requests: %d, want %d", n, wantRequests)
+  }
+ }
+
+ dispatch(1)
+ state()
+ if attempts != 1 || !strings.Contains(lastError, "503") || next != now.Add(time.Minute).Unix() {
+  t.Fatalf("after failure: attempts %d, error %q, next %d", attempts, lastError, next)
+ }
+ dispatch(1) // not due yet
+
+ now = now.Add(time.Minute)
+ dispatch(2)
+ state()
+ if next != now.Add(2*time.Minute).Unix() {
+  t.Fatalf("backoff did not double: next in %ds", next-now.Unix())
+ }
+
+ // The third failure abandons the event.
+ now = now.Add(2 * time.Minute)
+ dispatch(3)
+ now = now.Add(24 * time.Hour)
+ dispatch(3)
+ var failed int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM webhook_outbox WHERE failed_at IS NOT NULL`).Scan(&failed); err != nil || failed != 1 {
+  t.Fatalf("abandoned events: %d (%v)", failed, err)
+ }
+
+ // A recovered receiver gets new events; old ones are pruned after AuditRetention.
+ rec.mu.Lock()
+ rec.status = http.StatusNoContent
+ rec.mu.Unlock()
+ if _, err := api.Register(ctx, "carol@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ dispatch(4)
+ now = now.Add(api.cfg.AuditRetention)
+ if err := api.PruneExpiredSessions(ctx); err != nil {
+  t.Fatalf("prune: %v", err)
+ }
+ var left int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM webhook_outbox`).Scan(&left); err != nil || left != 0 {
+  t.Fatalf("outbox after prune: %d (%v)", left, err)
+ }
+}
+
+func TestWebhooksDisabled(t *testing.T) {
+ api, cleanup := newTestAPI(t)
+ defer cleanup()
+ if _, err := api.Register(context.Background(), "dave@example.com", "password123"); err != nil {
+  t.Fatalf("Register: %v", err)
+ }
+ var n int
+ if err := api.db.QueryRow(`SELECT COUNT(*) FROM webhook_outbox`).Scan(&n); err != nil || n != 0 {
+  t.Fatalf("outbox without Webhooks: %d (%v)", n, err)
+ }
+
+ for _, wh := range []*WebhookConfig{
+  {URL: "/relative", Secret: testWebhookSecret},
+  {URL: "https://example.com/hook", Secret: []byte("short")},
+ } {
+  if _, err := New(Config{DBPath: ":memory:", Webhooks: wh}); err == nil {
+   t.Fatalf("New accepted %+v", wh)
+  }
+ }
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+ body := []byte(`{"id":1}`)
+ now := time.Now()
+ sig := signWebhook(testWebhookSecret, now.Unix(), body)
+
+ if err := VerifyWebhookSignature(testWebhookSecret, sig, body, time.Minute); err != nil {
+  t.Fatalf("valid signature: %v", err)
+ }
+ for name, check := range map[string]error{
+  "tampered body": VerifyWebhookSignature(testWebhookSecret, sig, []byte(`{"id":2}`), 0),
+  "wrong secret":  VerifyWebhookSignature([]byte(strings.Repeat("x", 32)), sig, body, 0),
+  "malformed":     VerifyWebhookSignature(testWebhookSecret, "v1=abc", body, 0),
+  "stale":         VerifyWebhookSignature(testWebhookSecret, signWebhook(testWebhookSecret, now.Add(-time.Hour).Unix(), body), body, time.Minute),
+ } {
+  if !errors.Is(check, ErrInvalidWebhookSignature) {
+   t.Errorf("%s: %v", name, check)
+  }
+ }
+}